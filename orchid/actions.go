@@ -5,349 +5,2669 @@ Implementation of the Api for executing commands locally
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
-	"github.com/hpcloud/tail"
+	"io"
+	"io/ioutil"
 	"os"
 	"os/exec"
+	"os/signal"
+	"path/filepath"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// How long to wait for a stopped job to cancel itself before killing it
+	stopTimeout = 10 * time.Second
 )
 
 type Actions struct {
-	path string
+	path          string
+	setup         *Setup
+	setupMutex    sync.Mutex
+	transfers     *transferLimiter
+	transferMutex sync.Mutex
+
+	// Whether orchid runs without a terminal, failing interactive features
+	// rather than waiting for input
+	noTTY bool
+
+	// Whether logs are followed by polling them rather than using tail
+	pollLogs bool
+
+	// Context of the invocation, cancelling jobs once it is done, e.g. by
+	// running out of time
+	ctx context.Context
+}
+
+/*
+Get the context of the invocation
+*/
+func (a *Actions) context() context.Context {
+	if a.ctx == nil {
+		return context.Background()
+	}
+	return a.ctx
+}
+
+/*
+Load the setup, reusing the setup already loaded if any, e.g. by the
+interactive shell
+*/
+func (a *Actions) loadSetup() (Setup, error) {
+	a.setupMutex.Lock()
+	setup := a.setup
+	a.setupMutex.Unlock()
+
+	if setup != nil {
+		return a.withNoTTY(*setup), nil
+	}
+	loaded, err := loadSetup(a.path)
+	return a.withNoTTY(loaded), err
+}
+
+/*
+Get the setup with its machines marked as used without a terminal if orchid
+runs without one, so ssh never waits for input, e.g. the PIN of a token
+*/
+func (a *Actions) withNoTTY(setup Setup) Setup {
+	setup.Machines = append([]Machine{}, setup.Machines...)
+	for i := range setup.Machines {
+		setup.Machines[i].NoTTY = a.noTTY
+	}
+	return setup
+}
+
+/*
+Check whether the id is the id of a job
+*/
+func (a *Actions) isJob(id string) bool {
+	setup, err := a.loadSetup()
+	if err != nil {
+		return false
+	}
+	_, found := setup.findJob(id)
+	return found
+}
+
+/*
+Check whether the id is the id of an action targeting a group
+*/
+func (a *Actions) isGroupAction(id string) bool {
+	setup, err := a.loadSetup()
+	if err != nil {
+		return false
+	}
+	action, found := setup.findAction(id)
+	return found && action.Group != ""
 }
 
 /*
-List all jobs
+Load the setup anew and keep it for use by subsequent actions. If the setup is
+invalid, the previously loaded setup is kept
 */
-func (a *Actions) ListJobs() {
+func (a *Actions) reloadSetup() error {
 	setup, err := loadSetup(a.path)
+	if err != nil {
+		return err
+	}
+
+	a.setupMutex.Lock()
+	a.setup = &setup
+	a.setupMutex.Unlock()
+	return nil
+}
+
+/*
+Type defining the result of executing a command on a single machine
+*/
+type execResult struct {
+	Machine  string
+	Stdout   bytes.Buffer
+	Stderr   bytes.Buffer
+	ExitCode int
+	Err      error
+}
+
+/*
+List all jobs, printing each job using the format if given
+*/
+func (a *Actions) ListJobs(format string) error {
+	tmpl, err := listFormat(format)
+	if err != nil {
+		return err
+	}
+
+	setup, err := a.loadSetup()
+	if err != nil {
+		fmt.Println("ERROR: " + err.Error())
+	}
+
+	for _, job := range setup.Jobs {
+		if tmpl != nil {
+			err = printFormatted(tmpl, job)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		fmt.Println(withDescription(job.Id, job.Description))
+		for _, ex := range job.Pipeline {
+			fmt.Printf("\t%s -> %s %v\n", stepMachine(ex), stepCommand(ex), ex.Args)
+		}
+	}
+	return nil
+}
+
+/*
+Describe the job with the given id: its description, its steps, and its latest
+run
+*/
+func (a *Actions) DescribeJob(jobId string) error {
+	setup, err := a.loadSetup()
+	if err != nil {
+		return err
+	}
+
+	job, found := setup.findJob(jobId)
+	if !found {
+		return ErrJobNotFound
+	}
+
+	fmt.Println("Job: " + job.Id)
+	if job.DefaultMachine != "" {
+		fmt.Println("Default machine: " + job.DefaultMachine)
+	}
+	if job.Description != "" {
+		fmt.Println()
+		fmt.Println(job.Description)
+	}
+
+	fmt.Println()
+	fmt.Println("Steps:")
+	for i, executable := range job.Pipeline {
+		fmt.Printf("%d. %s\t%s -> %s %v\n", i+1, stepName(executable, i), stepMachine(executable), stepCommand(executable), executable.Args)
+		if executable.Check {
+			fmt.Println("\tCheck")
+		}
+		if len(executable.Tags) > 0 {
+			fmt.Printf("\tTags: %s\n", strings.Join(executable.Tags, ", "))
+		}
+		if executable.Retries > 0 {
+			fmt.Printf("\tRetries: %d\n", executable.Retries)
+		}
+		if len(executable.IgnoreExitCodes) > 0 {
+			fmt.Printf("\tIgnored exit codes: %v\n", executable.IgnoreExitCodes)
+		}
+		if len(executable.ExitStatuses) > 0 {
+			fmt.Printf("\tExit statuses: %v\n", executable.ExitStatuses)
+		}
+	}
+
+	logs, err := recentJobLogs(a.path, job.Id)
+	if err != nil {
+		return err
+	}
+	fmt.Println()
+	if len(logs) == 0 {
+		fmt.Println("Never run")
+	}
+	for _, log := range logs {
+		fmt.Printf("Latest run: %s at %s (log %s)\n", log.Status, log.StartTime.Format(time.RFC1123), log.Id)
+	}
+	return nil
+}
+
+/*
+Describe the machine with the given id: how it is connected to, the groups it
+belongs to, the actions targeting it, its gathered facts, and whether it is
+reachable right now along with the time connecting took. Only the names of keys
+and of the environment variables holding passwords are shown
+*/
+func (a *Actions) DescribeMachine(machineId string) error {
+	setup, err := a.loadSetup()
+	if err != nil {
+		return err
+	}
+
+	machine, found := setup.findMachine(machineId)
+	if !found {
+		return ErrMachineNotFound
+	}
+
+	fmt.Println("Machine: " + machine.Id)
+	if machine.Description != "" {
+		fmt.Println()
+		fmt.Println(machine.Description)
+	}
+
+	fmt.Println()
+	if machine.Host != "" {
+		fmt.Println("Host: " + machine.Host)
+		if machine.SSHConfig != "" {
+			fmt.Println("SSH config: " + machine.SSHConfig)
+		}
+	} else {
+		fmt.Printf("Address: %s@%s:%s\n", machine.User, machine.Address, machine.Port)
+	}
+	if machine.PrivateKey != "" {
+		fmt.Println("Key: " + machine.PrivateKey)
+	}
+	if machine.KeyProvider != "" {
+		fmt.Println("Key provider: " + machine.KeyProvider)
+	}
+	if machine.PasswordEnv != "" {
+		fmt.Println("Password from: $" + machine.PasswordEnv)
+	}
+	if machine.Shell != "" {
+		fmt.Println("Shell: " + machine.Shell)
+	}
+	if machine.PreCommand != "" {
+		fmt.Println("Pre command: " + machine.PreCommand)
+	}
+	if machine.PostCommand != "" {
+		fmt.Println("Post command: " + machine.PostCommand)
+	}
+
+	groups := []string{}
+	for _, group := range setup.Groups {
+		for _, member := range setup.groupMachines(group) {
+			if member.Id == machine.Id {
+				groups = append(groups, group.Id)
+				break
+			}
+		}
+	}
+	if len(groups) > 0 {
+		fmt.Println("Groups: " + strings.Join(groups, ", "))
+	}
+
+	fmt.Println()
+	fmt.Println("Actions:")
+	targeting := 0
+	for _, action := range setup.Actions {
+		if !containsString(actionMachines(setup, action), machine.Id) {
+			continue
+		}
+		via := ""
+		if action.Group != "" {
+			via = " (group " + action.Group + ")"
+		}
+		fmt.Printf("\t%s%s -> %s\n", action.Id, via, action.Command)
+		targeting++
+	}
+	if targeting == 0 {
+		fmt.Println("\tNone")
+	}
+
+	fmt.Println()
+	facts, found, err := loadFacts(a.path, machine.Id)
+	if err != nil {
+		return err
+	}
+	if found {
+		fmt.Printf("Facts (gathered %s):\n", facts.GatheredAt.Format(time.RFC1123))
+		fmt.Printf("\tOS: %s %s (%s)\n", facts.OS, facts.Kernel, facts.Arch)
+		if facts.Distribution != "" {
+			fmt.Println("\tDistribution: " + facts.Distribution)
+		}
+		fmt.Println("\tHostname: " + facts.Hostname)
+		fmt.Printf("\tFree disk: %d KB\n", facts.FreeDiskKB)
+	} else {
+		fmt.Println("No facts gathered. Gather them using orchid facts " + machine.Id)
+	}
+
+	fmt.Println()
+	start := time.Now()
+	reachability := probeMachine(a.path, machine)
+	if reachability.Reachable {
+		fmt.Printf("Reachable (connected in %s)\n", time.Since(start).Round(time.Millisecond))
+	} else {
+		fmt.Println("Unreachable: " + strings.TrimSpace(reachability.Error))
+	}
+	return nil
+}
+
+/*
+Append the description to the id if it has one, for listings
+*/
+func withDescription(id, description string) string {
+	if description == "" {
+		return id
+	}
+	return id + " - " + description
+}
+
+/*
+List all actions, or only those targeting the machine with the given id, either
+directly or through a group. If byMachine is given, the actions are grouped by
+the machines they target. Otherwise each action is printed using the format if
+given
+*/
+func (a *Actions) ListActions(machineId string, byMachine bool, format string) error {
+	tmpl, err := listFormat(format)
+	if err != nil {
+		return err
+	}
+	if tmpl != nil && byMachine {
+		return errors.New("Actions grouped by machine can not be formatted")
+	}
+
+	setup, err := a.loadSetup()
+	if err != nil {
+		return err
+	}
+	if machineId != "" && !machineExists(machineId, setup.Machines) {
+		return ErrMachineNotFound
+	}
+
+	if !byMachine {
+		for _, action := range setup.Actions {
+			if machineId != "" && !containsString(actionMachines(setup, action), machineId) {
+				continue
+			}
+			if tmpl != nil {
+				err = printFormatted(tmpl, action)
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			fmt.Println(withDescription(action.Id, action.Description))
+			fmt.Printf("\t%s -> %s\n",
+				actionTarget(setup, action),
+				action.Command,
+			)
+		}
+		return nil
+	}
+
+	machineIds := []string{"local"}
+	for _, machine := range setup.Machines {
+		machineIds = append(machineIds, machine.Id)
+	}
+	for _, id := range machineIds {
+		if machineId != "" && id != machineId {
+			continue
+		}
+
+		targeting := []Action{}
+		for _, action := range setup.Actions {
+			if containsString(actionMachines(setup, action), id) {
+				targeting = append(targeting, action)
+			}
+		}
+		if len(targeting) == 0 {
+			continue
+		}
+
+		fmt.Println(id + ":")
+		for _, action := range targeting {
+			via := ""
+			if action.Group != "" {
+				via = " (group " + action.Group + ")"
+			}
+			fmt.Printf("\t%s%s -> %s\n", action.Id, via, action.Command)
+		}
+	}
+	return nil
+}
+
+/*
+Get the ids of the machines the action targets, i.e. its machine or the machines
+of its group
+*/
+func actionMachines(setup Setup, action Action) []string {
+	if action.Group == "" {
+		return []string{action.Machine}
+	}
+
+	ids := []string{}
+	if group, found := setup.findGroup(action.Group); found {
+		for _, machine := range setup.groupMachines(group) {
+			ids = append(ids, machine.Id)
+		}
+	}
+	return ids
+}
+
+/*
+Describe the target of the action, including the number of machines of a group
+*/
+func actionTarget(setup Setup, action Action) string {
+	if action.Group == "" {
+		return action.Machine
+	}
+	return fmt.Sprintf("group %s (%d machines)", action.Group, len(actionMachines(setup, action)))
+}
+
+/*
+List all machines, printing each machine using the format if given
+*/
+func (a *Actions) ListMachines(format string) error {
+	tmpl, err := listFormat(format)
+	if err != nil {
+		return err
+	}
+
+	setup, err := a.loadSetup()
+	if err != nil {
+		fmt.Println("ERROR: " + err.Error())
+	}
+
+	for _, machine := range setup.Machines {
+		if tmpl != nil {
+			err = printFormatted(tmpl, machine)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		fmt.Println(withDescription(machine.Id, machine.Description))
+		if machine.Host != "" {
+			fmt.Printf("\t%s (ssh config: %s)\n", machine.Host, machine.SSHConfig)
+		} else {
+			key := machine.PrivateKey
+			if machine.KeyProvider != "" {
+				key = machine.KeyProvider
+			}
+			fmt.Printf("\t%s@%s:%s (%s)\n", machine.User, machine.Address, machine.Port, key)
+		}
+	}
+	return nil
+}
+
+/*
+List all scripts
+*/
+func (a *Actions) ListScripts() {
+	setup, err := a.loadSetup()
+	if err != nil {
+		fmt.Println("ERROR: " + err.Error())
+	}
+
+	pathLength := len(a.path + "/scripts")
+	for _, script := range setup.Scripts {
+		fmt.Printf("%-40s\tfile\n", script[pathLength+1:])
+	}
+	for _, script := range setup.InlineScripts {
+		fmt.Printf("%-40s\tinline\n", script.Id)
+	}
+}
+
+/*
+List all keys along with the machines using them, flagging keys not used by
+any machine as orphaned
+*/
+func (a *Actions) ListKeys() {
+	machines, keyDirectory, err := a.keyMachines()
+	if err != nil {
+		fmt.Println("ERROR: " + err.Error())
+		return
+	}
+	keys, err := loadDir(keyDirectory)
+	if err != nil {
+		fmt.Println("ERROR: " + err.Error())
+		return
+	}
+
+	used := usedKeys(machines)
+	pathLength := len(keyDirectory)
+	for _, key := range keys {
+		name := key[pathLength+1:]
+		fmt.Println(name)
+		if len(used[name]) == 0 {
+			fmt.Println("\t(orphaned)")
+		} else {
+			fmt.Println("\t" + strings.Join(used[name], ", "))
+		}
+	}
+}
+
+/*
+Load the machines of the setup and the inventory along with the directory of
+their keys, for telling which keys are used. The machines are loaded without
+validating the setup, so an invalid setup, e.g. one referring to a missing key,
+does not hide references to keys. Environment variables referenced by the keys
+are expanded like when loading the setup, except that a variable that is not
+set is an error, as the key it names can not be told
+*/
+func (a *Actions) keyMachines() ([]Machine, string, error) {
+	machines, err := loadMachines(a.path)
+	if err != nil {
+		return nil, "", err
+	}
+	settings, err := loadSettings(a.path)
+	if err != nil {
+		return nil, "", err
+	}
+	if settings.Inventory != nil {
+		inventory, err := loadInventory(a.path, *settings.Inventory)
+		if err != nil {
+			return nil, "", err
+		}
+		machines = append(machines, inventory...)
+	}
+
+	for _, machine := range machines {
+		if envReference.MatchString(machine.PrivateKey) && !settings.ExpandEnv {
+			return nil, "", errors.New("Machine " + machine.Id + " refers to the key " + machine.PrivateKey + ", but ExpandEnv is not set, so the key it uses can not be told")
+		}
+	}
+	if settings.ExpandEnv {
+		err = expandSetupEnv(machines, nil, nil, true)
+		if err != nil {
+			return nil, "", errors.New("The keys of machines can not be told: " + err.Error())
+		}
+	}
+
+	keyDirectory := settings.keyDir(a.path)
+	setKeyFiles(machines, keyDirectory)
+	return machines, keyDirectory, nil
+}
+
+/*
+Get the machines using each key by its name in the keys directory. The public
+key of a used key is used by the same machines, as it is kept along with it
+*/
+func usedKeys(machines []Machine) map[string][]string {
+	used := map[string][]string{}
+	for _, machine := range machines {
+		if machine.PrivateKey == "" {
+			continue
+		}
+		used[machine.PrivateKey] = append(used[machine.PrivateKey], machine.Id)
+		used[machine.PrivateKey+".pub"] = append(used[machine.PrivateKey+".pub"], machine.Id)
+	}
+	return used
+}
+
+/*
+Delete the keys not used by any machine, see keyMachines, after listing them
+and asking for confirmation unless yes is given. Machines referring to missing
+keys are warned about
+*/
+func (a *Actions) PruneKeys(yes bool) (err error) {
+	defer func() {
+		a.audit("prune-keys", "", auditResult(err))
+	}()
+
+	machines, keyDirectory, err := a.keyMachines()
+	if err != nil {
+		return errors.New("Not pruning keys: " + err.Error())
+	}
+	keys, err := loadDir(keyDirectory)
+	if err != nil {
+		return err
+	}
+
+	for _, machine := range machines {
+		if machine.PrivateKey == "" {
+			continue
+		}
+		if _, err := os.Stat(keyFile(machine)); err != nil {
+			fmt.Println("WARNING: Machine " + machine.Id + " refers to the missing key " + machine.PrivateKey)
+		}
+	}
+
+	used := usedKeys(machines)
+	pathLength := len(keyDirectory)
+	orphaned := []string{}
+	for _, key := range keys {
+		if len(used[key[pathLength+1:]]) == 0 {
+			orphaned = append(orphaned, key[pathLength+1:])
+		}
+	}
+	if len(orphaned) == 0 {
+		fmt.Println("No orphaned keys")
+		return nil
+	}
+
+	fmt.Println("Orphaned keys:")
+	for _, key := range orphaned {
+		fmt.Println("\t" + key)
+	}
+	if !yes {
+		err = a.requireTerminal("Confirming the deletion of the keys", "Pass --yes to delete them without confirming")
+		if err != nil {
+			return err
+		}
+	}
+	if !yes && !askYesNo(fmt.Sprintf("Delete %d orphaned keys?", len(orphaned))) {
+		return ErrNotConfirmed
+	}
+
+	for _, key := range orphaned {
+		err = os.Remove(keyDirectory + "/" + key)
+		if err != nil {
+			return err
+		}
+		fmt.Println("Deleted " + key)
+	}
+	return nil
+}
+
+/*
+Print the public key of the private key of the machine, e.g. for adding it to
+the authorized_keys of a new server. For machines with a KeyProvider, the public
+keys offered by the provider are printed
+*/
+func (a *Actions) ShowKey(machineId string) error {
+	setup, err := a.loadSetup()
+	if err != nil {
+		return err
+	}
+
+	machine, found := setup.findMachine(machineId)
+	if !found {
+		return ErrMachineNotFound
+	}
+	if machine.KeyProvider != "" {
+		keys, err := providerPublicKeys(machine)
+		if err != nil {
+			return err
+		}
+		fmt.Println(keys)
+		return nil
+	}
+	if machine.PrivateKey == "" {
+		return errors.New("The machine '" + machineId + "' has no PrivateKey")
+	}
+
+	key, err := publicKey(keyFile(machine))
+	if err != nil {
+		return err
+	}
+	fmt.Println(key)
+	return nil
+}
+
+/*
+Print where the machine, job, action, group, script, or key with the given id
+is defined
+*/
+func (a *Actions) Which(id string) error {
+	setup, err := a.loadSetup()
+	if err != nil {
+		return err
+	}
+
+	locations, err := locateEntity(a.path, setup, id)
+	if err != nil {
+		return err
+	}
+	if len(locations) == 0 {
+		return errors.New("Nothing with the id '" + id + "' was found")
+	}
+
+	for _, location := range locations {
+		if location.Line > 0 {
+			fmt.Printf("%s %s: %s:%d\n", location.Kind, id, location.File, location.Line)
+		} else {
+			fmt.Printf("%s %s: %s\n", location.Kind, id, location.File)
+		}
+	}
+	return nil
+}
+
+/*
+List all existing logs stored locally, printing each log using the format if
+given
+*/
+func (a *Actions) ListLogs(format string) error {
+	tmpl, err := listFormat(format)
+	if err != nil {
+		return err
+	}
+
+	logs, err := loadLogs(a.path)
+	if err != nil {
+		fmt.Println("ERROR: " + err.Error())
+	}
+
+	if tmpl != nil {
+		for _, log := range logs {
+			err = printFormatted(tmpl, log)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	fmt.Printf("%-20s\t%-20s\t%-20s\t%-32s\t%-32s\n", "Id", "Job", "Status", "Start", "End")
+	for _, log := range logs {
+		job := log.JobId
+		if log.ActionId != "" {
+			job = log.ActionId + "@" + log.Machine
+		}
+		fmt.Printf("%-20s\t%-20s\t%-20s\t%-32s\t%-32s\n", log.Id, job, log.Status, log.StartTime, log.EndTime)
+	}
+	return nil
+}
+
+/*
+Print a summary of the runs of each job: the number of runs, the share of them
+that succeeded, their average duration, and when the job last ran. Only runs
+started within the since window are included, e.g. "7d", or all if empty
+*/
+func (a *Actions) Stats(since string) error {
+	start, err := parseSince(since)
+	if err != nil {
+		return err
+	}
+
+	logs, err := loadLogs(a.path)
+	if err != nil {
+		return err
+	}
+
+	stats := computeStats(logs, start)
+	if len(stats) == 0 {
+		fmt.Println("No runs found")
+		return nil
+	}
+
+	fmt.Printf("%-20s\t%-6s\t%-8s\t%-12s\t%-32s\n", "Job", "Runs", "Success", "Avg duration", "Last run")
+	for _, jobStats := range stats {
+		runs := fmt.Sprintf("%d", jobStats.Runs)
+		if jobStats.Running > 0 {
+			runs += fmt.Sprintf(" (%d running)", jobStats.Running)
+		}
+		success, duration := "-", "-"
+		if jobStats.Runs > jobStats.Running {
+			success = fmt.Sprintf("%.0f%%", jobStats.successRate())
+			duration = jobStats.AverageDuration.Round(time.Second).String()
+		}
+		fmt.Printf("%-20s\t%-6s\t%-8s\t%-12s\t%-32s\n", jobStats.JobId, runs, success, duration, jobStats.LastRun.Format(time.RFC1123))
+	}
+	return nil
+}
+
+/*
+Clear the cache of steps, making cached steps run the next time
+*/
+func (a *Actions) ClearCache() (err error) {
+	defer func() {
+		a.audit("clear-cache", "", auditResult(err))
+	}()
+
+	entries, err := ioutil.ReadDir(cacheDir(a.path))
+	if os.IsNotExist(err) {
+		fmt.Println("The cache is empty")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	err = os.RemoveAll(cacheDir(a.path))
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Cleared %d cached steps\n", len(entries))
+	return nil
+}
+
+/*
+Print the audit log
+*/
+func (a *Actions) ShowAudit() {
+	entries, err := loadAudit(a.path)
+	if err != nil {
+		fmt.Println("ERROR: " + err.Error())
+	}
+
+	fmt.Printf("%-32s\t%-12s\t%-12s\t%-24s\t%s\n", "Time", "User", "Command", "Target", "Result")
+	for _, entry := range entries {
+		fmt.Printf("%-32s\t%-12s\t%-12s\t%-24s\t%s\n", entry.Time.Format(time.RFC1123), entry.User, entry.Command, entry.Target, entry.Result)
+	}
+}
+
+/*
+Rename the machine, job, action, group, script, or key with the given id, and
+update all references to it across the setup
+*/
+func (a *Actions) Rename(kind, oldId, newId string) (err error) {
+	defer func() {
+		a.audit("rename", kind+" "+oldId+" to "+newId, auditResult(err))
+	}()
+
+	references, err := renameEntity(a.path, kind, oldId, newId)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Renamed %s %s to %s, updating %d references\n", kind, oldId, newId, references)
+	return nil
+}
+
+/*
+Copy the job with the given id to a new job with the new id, e.g. as the start
+of a variant of the job. The copy is added after the job in jobs.json, keeping
+the fields of the job as they are. Fails if a job with the new id exists
+*/
+func (a *Actions) DuplicateJob(srcId, newId string) (err error) {
+	defer func() {
+		a.audit("duplicate", srcId+" to "+newId, auditResult(err))
+	}()
+
+	if newId == "" {
+		return errors.New("The new id must be non-empty")
+	}
+
+	jobs, err := loadSetupFile(a.path, "jobs.json")
+	if err != nil {
+		return err
+	}
+
+	source := -1
+	for i, job := range jobs {
+		if job.getString("Id") == newId {
+			return errors.New("A job with the id '" + newId + "' already exists")
+		}
+		if job.getString("Id") == srcId {
+			source = i
+		}
+	}
+	if source == -1 {
+		return fmt.Errorf("%w in jobs.json: '%s'", ErrJobNotFound, srcId)
+	}
+
+	// Copy the job through JSON, so the copy shares nothing with the job
+	data, err := encodeSetup(jobs[source], "")
+	if err != nil {
+		return err
+	}
+	duplicate := setupElement{}
+	err = json.Unmarshal(data, &duplicate)
+	if err != nil {
+		return err
+	}
+	duplicate.replaceString("Id", srcId, newId)
+
+	jobs = append(jobs[:source+1], append([]setupElement{duplicate}, jobs[source+1:]...)...)
+	err = writeSetupFile(a.path, "jobs.json", jobs)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Duplicated job " + srcId + " as " + newId)
+	return nil
+}
+
+/*
+Run the job with the given id. The options select which of the job's steps to
+run, the remaining steps are skipped. The output of the job is followed until
+it is done, after which the result of the job and its steps is returned. An
+error is returned only if the job could not be started; a failing job is
+reported by the status of the result
+*/
+func (a *Actions) RunJob(jobId string, options RunOptions) (JobResult, error) {
+	return a.runJob(a.context(), jobId, options)
+}
+
+/*
+Run the job with the given id like RunJob, cancelling it if the given context
+is cancelled
+*/
+func (a *Actions) runJob(parent context.Context, jobId string, options RunOptions) (jobResult JobResult, err error) {
+	defer func() {
+		result := auditResult(err)
+		if err == nil {
+			result = jobResult.Status + " (log " + jobResult.LogId + ")"
+		}
+		a.audit("run", jobId, result)
+	}()
+
+	err = checkLock(a.path, options.Force)
+	if err != nil {
+		return JobResult{}, err
+	}
+
+	setup, err := a.loadSetup()
+	if err != nil {
+		return JobResult{}, err
+	}
+
+	if job, found := setup.findJob(jobId); found && job.Confirm && !options.Yes {
+		err = a.confirmId("job", jobId)
+		if err != nil {
+			return JobResult{}, err
+		}
+	}
+
+	log := newLog(jobId)
+	log.Options = options
+
+	output, err := createOutputFile(options.Output)
+	if err != nil {
+		return JobResult{}, err
+	}
+	if output != nil {
+		defer output.Close()
+	}
+
+	pipeline, err := buildPipeline(a.path, setup, jobId, log, options)
+	if err != nil {
+		return JobResult{}, err
+	}
+
+	// Cancel the job if orchid is told to stop, e.g. by StopJob
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	defer signal.Stop(signals)
+	go func() {
+		select {
+		case <-signals:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	results := make(chan JobResult, 1)
+	go func() {
+		results <- pipeline.Run(ctx, a.path)
+	}()
+
+	fmt.Println(log.Id)
+
+	// Show progress until the first line of output, as connecting may take
+	// a while
+	var progress *spinner
+	if !options.Quiet && isTerminal(os.Stdout) {
+		progress = startSpinner(startMessage(pipeline))
+	}
+
+	// Tail the log, ensuring the program does not terminate
+	err = followLog(a.path, log.Id, a.pollLogs, func(text string) {
+		progress.Stop()
+		fmt.Println(text)
+		if output != nil {
+			fmt.Fprintln(output, text)
+		}
+	})
+	progress.Stop()
+	if err != nil {
+		fmt.Println("ERROR: " + err.Error())
+	}
+
+	return <-results, nil
+}
+
+/*
+Run the job of the log with the given id again, with the same options as the
+run of the log. The new log is linked to the old one. Force, quiet, and yes
+apply to this run only
+*/
+func (a *Actions) ReRun(logId string, force, quiet, yes bool) (JobResult, error) {
+	logId, err := resolveLogId(a.path, logId)
+	if err != nil {
+		return JobResult{}, err
+	}
+
+	log, found, err := findLog(a.path, logId)
+	if err != nil {
+		return JobResult{}, err
+	}
+	if !found {
+		return JobResult{}, ErrLogNotFound
+	}
+	if log.ActionId != "" {
+		return JobResult{}, errors.New("The log is of the action " + log.ActionId + ", which is executed using exec")
+	}
+
+	options := log.Options
+	options.Force = force
+	options.Quiet = quiet
+	options.Yes = yes
+	options.RerunOf = log.Id
+	options.Output = ""
+
+	fmt.Println("Re-running job " + log.JobId + " of log " + log.Id)
+	return a.RunJob(log.JobId, options)
+}
+
+/*
+Run the steps that failed in the run of the log with the given id again, along
+with the steps never reached as the run stopped at the failure, with the same
+options as that run, leaving the steps that succeeded alone. The steps are
+selected by their position, so they must not have changed since the run. The
+new log is linked to the old one. Force, quiet, and yes apply to this run only
+*/
+func (a *Actions) Retry(logId string, force, quiet, yes bool) (JobResult, error) {
+	logId, err := resolveLogId(a.path, logId)
+	if err != nil {
+		return JobResult{}, err
+	}
+
+	log, found, err := findLog(a.path, logId)
+	if err != nil {
+		return JobResult{}, err
+	}
+	if !found {
+		return JobResult{}, ErrLogNotFound
+	}
+	if log.ActionId != "" {
+		return JobResult{}, errors.New("The log is of the action " + log.ActionId + ", which is executed using exec")
+	}
+	if log.running() {
+		return JobResult{}, errors.New("The job of log " + log.Id + " is still running")
+	}
+
+	// Steps after a failure were selected for the run, but never reached
+	steps := []int{}
+	names := []string{}
+	failed := false
+	for i, step := range log.Steps {
+		failed = failed || step.Status == "Error"
+		if step.Status == "Error" || (failed && step.Status == "Pending") {
+			steps = append(steps, i)
+			names = append(names, step.Name)
+		}
+	}
+	if !failed {
+		return JobResult{}, errors.New("No steps failed in the run of log " + log.Id)
+	}
+
+	setup, err := a.loadSetup()
+	if err != nil {
+		return JobResult{}, err
+	}
+	job, found := setup.findJob(log.JobId)
+	if !found {
+		return JobResult{}, ErrJobNotFound
+	}
+	for _, i := range steps {
+		if i >= len(job.Pipeline) || stepName(job.Pipeline[i], i) != log.Steps[i].Name {
+			return JobResult{}, errors.New("The steps of job " + log.JobId + " changed since the run of log " + log.Id + ", so they can not be retried. Use run --from instead")
+		}
+	}
+
+	options := log.Options
+	options.Only = nil
+	options.Steps = steps
+	options.From = ""
+	options.To = ""
+	options.Force = force
+	options.Quiet = quiet
+	options.Yes = yes
+	options.RerunOf = ""
+	options.RetryOf = log.Id
+	options.Output = ""
+
+	fmt.Println("Retrying " + strings.Join(names, ", ") + " of job " + log.JobId + " of log " + log.Id)
+	return a.RunJob(log.JobId, options)
+}
+
+/*
+Roll the job with the given id back to the marker deployed before the current
+one, running the job again with the options of the last successful run with
+that marker. The current marker is that of the last successful run with a
+marker. Rollbacks are not deployments of their own, and the markers rolled back
+from were undone, so both are passed over, making repeated rollbacks step back
+further rather than return to the marker just rolled back from. Force, quiet,
+and yes apply to this run only
+*/
+func (a *Actions) Rollback(jobId string, force, quiet, yes bool) (JobResult, error) {
+	logs, err := loadLogs(a.path)
+	if err != nil {
+		return JobResult{}, err
+	}
+
+	markers := map[string]string{}
+	for _, log := range logs {
+		markers[log.Id] = log.Options.Marker
+	}
+
+	var current *Log
+	var previous *Log
+	rolledBack := map[string]bool{}
+	for i := len(logs) - 1; i >= 0 && previous == nil; i-- {
+		log := logs[i]
+		if log.JobId != jobId || log.Status != "Finished" || log.Options.Marker == "" {
+			continue
+		}
+		if log.Options.RollbackOf != "" {
+			rolledBack[markers[log.Options.RollbackOf]] = true
+			continue
+		}
+		if rolledBack[log.Options.Marker] {
+			continue
+		}
+		if current == nil {
+			current = &logs[i]
+		} else if log.Options.Marker != current.Options.Marker {
+			previous = &logs[i]
+		}
+	}
+	if current == nil {
+		return JobResult{}, errors.New("No successful run of job '" + jobId + "' with a marker was found")
+	}
+	if previous == nil {
+		return JobResult{}, errors.New("No successful run of job '" + jobId + "' with a marker before " + current.Options.Marker + " was found")
+	}
+
+	options := previous.Options
+	options.Force = force
+	options.Quiet = quiet
+	options.Yes = yes
+	options.RerunOf = ""
+	options.RollbackOf = current.Id
+	options.Output = ""
+
+	fmt.Println("Rolling back job " + jobId + " from " + current.Options.Marker + " to " + previous.Options.Marker + " of log " + previous.Id)
+	return a.RunJob(jobId, options)
+}
+
+/*
+Execute the action with the given id. Force executes the action even if orchid
+is locked. An action targeting a group is executed on each of its machines,
+carrying on past unreachable machines unless abortOnUnreachable is given, in
+which case nothing is executed if any machine is unreachable. An action marked
+Confirm asks for its id to be typed before it is executed, unless yes is given.
+The variables are substituted into the command of the action, and that of the
+health check of a batch. If batch is given, a group action is executed in waves
+of machines
+*/
+func (a *Actions) ExecuteAction(actionId string, force bool, abortOnUnreachable bool, yes bool, vars map[string]string, batch *Batch) (err error) {
+	defer func() {
+		a.audit("exec", actionId, auditResult(err))
+	}()
+
+	err = checkLock(a.path, force)
+	if err != nil {
+		return err
+	}
+
+	setup, err := a.loadSetup()
+	if err != nil {
+		fmt.Println("ERROR: " + err.Error())
+	}
+
+	action, found := setup.findAction(actionId)
+	if !found {
+		return ErrActionNotFound
+	}
+
+	action.Command, err = expandVars(action.Command, vars)
+	if err != nil {
+		return err
+	}
+
+	if action.Confirm && !yes {
+		err = a.confirmId("action", actionId)
+		if err != nil {
+			return err
+		}
+	}
+
+	if batch != nil && action.Group == "" {
+		return errors.New("Only actions targeting a group can be executed in batches")
+	}
+	if action.Group != "" {
+		return a.runGroupAction(setup, action, abortOnUnreachable, batch, vars)
+	}
+
+	return a.runAction(setup, action)
+}
+
+/*
+Execute the action with the given id on the given machine instead of the one it
+is configured to run on, e.g. for testing it on a sandbox machine. The run is
+recorded in the audit log as a test. Force executes the action even if orchid
+is locked. An action marked Confirm asks for its id to be typed before it is
+executed, unless yes is given. The variables are substituted into the command
+of the action, as when executing it
+*/
+func (a *Actions) TestAction(actionId, machineId string, force, yes bool, vars map[string]string) (err error) {
+	defer func() {
+		a.audit("test", actionId+" on "+machineId, auditResult(err))
+	}()
+
+	err = checkLock(a.path, force)
+	if err != nil {
+		return err
+	}
+
+	setup, err := a.loadSetup()
+	if err != nil {
+		return err
+	}
+
+	action, found := setup.findAction(actionId)
+	if !found {
+		return ErrActionNotFound
+	}
+
+	if _, found = setup.findMachine(machineId); !found && machineId != "local" {
+		return ErrMachineNotFound
+	}
+
+	action.Command, err = expandVars(action.Command, vars)
+	if err != nil {
+		return err
+	}
+
+	if action.Confirm && !yes {
+		err = a.confirmId("action", actionId)
+		if err != nil {
+			return err
+		}
+	}
+
+	target := action.Machine
+	if action.Group != "" {
+		target = "group " + action.Group
+	}
+	fmt.Printf("Testing action %s on %s (configured for %s)\n", action.Id, machineId, target)
+	action.Machine = machineId
+
+	return a.runAction(setup, action)
+}
+
+/*
+Execute the action on the machine it targets. A multi-line command is piped to
+bash rather than passed as an argument, avoiding quoting it
+*/
+func (a *Actions) runAction(setup Setup, action Action) error {
+	return a.runActionTo(setup, action, os.Stdout, os.Stderr)
+}
+
+/*
+Execute the action on the machine it targets like runAction, writing its output
+to the given writers
+*/
+func (a *Actions) runActionTo(setup Setup, action Action, stdout, stderr io.Writer) error {
+	var cmd *exec.Cmd
+	multiLine := strings.Contains(strings.TrimSpace(action.Command), "\n")
+
+	// Commands spanning several lines are piped to bash, in strict mode
+	// if enabled
+	settings, err := loadSettings(a.path)
+	if err != nil {
+		return err
+	}
+	bashArgs := append(shellFlags("bash", strictMode(settings, action.Strict, action.Lenient)), "-s")
+
+	if action.Machine == "local" {
+		// Only execute binaries allowed by the settings. The binaries run
+		// by a script can not be told, so scripts are refused entirely
+		if multiLine {
+			if settings.AllowedBinaries != nil {
+				return errors.New("Actions spanning several lines can not be executed locally while AllowedBinaries is set, as the binaries they run can not be checked")
+			}
+			cmd = exec.Command("/bin/bash", bashArgs...)
+		} else {
+			err = settings.checkBinaryAllowed(action.Command)
+			if err != nil {
+				return err
+			}
+			cmd = exec.Command(action.Command)
+		}
+	} else if multiLine {
+		machine, found := setup.findMachine(action.Machine)
+		if !found {
+			return ErrMachineNotFound
+		}
+
+		// No terminal is allocated, as the command is read from stdin
+		sshCommand := fmt.Sprintf(
+			"ssh -T %s %s '%s'",
+			sshOptions(a.path, machine, "-p"),
+			sshDestination(machine),
+			withMachineHooks(machine, "bash "+strings.Join(bashArgs, " ")),
+		)
+		cmd, err = machineCommand(machine, sshCommand)
+		if err != nil {
+			return err
+		}
+	} else {
+		// If not to be executed locally, find the machine
+		machine, found := setup.findMachine(action.Machine)
+		if !found {
+			return ErrMachineNotFound
+		}
+
+		// A terminal is allocated for commands interacting with the user,
+		// unless there is none, where they read nothing instead
+		tty := "-tt"
+		if a.noTTY {
+			tty = "-T"
+		}
+		sshCommand := fmt.Sprintf(
+			"ssh %s %s %s '%s'",
+			tty,
+			sshOptions(a.path, machine, "-p"),
+			sshDestination(machine),
+			withMachineHooks(machine, action.Command),
+		)
+		cmd, err = machineCommand(machine, sshCommand)
+		if err != nil {
+			return err
+		}
+	}
+
+	if !a.noTTY {
+		cmd.Stdin = os.Stdin
+	}
+	if multiLine {
+		cmd.Stdin = strings.NewReader(action.Command)
+	}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	err = cmd.Run()
+	if _, ignored := ignoredExitCode(err, action.IgnoreExitCodes); ignored {
+		return nil
+	}
+	if action.Machine != "local" {
+		return remoteError(action.Machine, err)
+	}
+	return err
+}
+
+/*
+Execute the action on each machine of the group it targets, one machine at a
+time, followed by a summary of how many succeeded and failed. The output on
+each machine is logged, so the execution can be followed using FollowGroup
+*/
+func (a *Actions) runGroupAction(setup Setup, action Action, abortOnUnreachable bool, batch *Batch, vars map[string]string) error {
+	group, found := setup.findGroup(action.Group)
+	if !found {
+		return ErrGroupNotFound
+	}
+	machines := setup.groupMachines(group)
+
+	if abortOnUnreachable {
+		err := a.checkAllReachable(machines)
+		if err != nil {
+			return err
+		}
+	}
+
+	logs, err := startGroupLogs(a.path, action, machines)
+	if err != nil {
+		return err
+	}
+	defer logs.close()
+
+	if batch != nil {
+		return a.runGroupActionInWaves(setup, action, machines, *batch, logs, vars)
+	}
+
+	failed := []string{}
+	for _, machine := range machines {
+		fmt.Printf("----- %s -----\n", machine.Id)
+		action.Machine = machine.Id
+		err := logs.run(a, setup, action)
+		if err != nil {
+			fmt.Println("ERROR: " + err.Error())
+			failed = append(failed, machine.Id)
+		}
+	}
+
+	fmt.Printf("%d ok, %d failed\n", len(machines)-len(failed), len(failed))
+	if len(failed) > 0 {
+		return errors.New("The action failed on " + strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+/*
+Check that all the machines are reachable, probing them rather than trusting
+cached results, as the check guards against partially applying an action
+*/
+func (a *Actions) checkAllReachable(machines []Machine) error {
+	settings, err := loadSettings(a.path)
+	if err != nil {
+		return err
+	}
+
+	results, err := checkReachability(a.path, machines, settings.reachabilityTTL(), true)
+	if err != nil {
+		return err
+	}
+
+	unreachable := []string{}
+	for _, machine := range machines {
+		if !results[machine.Id].Reachable {
+			unreachable = append(unreachable, machine.Id)
+		}
+	}
+	if len(unreachable) > 0 {
+		return errors.New("Nothing was executed, as some machines are unreachable: " + strings.Join(unreachable, ", "))
+	}
+	return nil
+}
+
+/*
+Execute a command on all machines in parallel using the given number of
+workers. The output of each machine is printed once all machines are done,
+followed by a summary of how many succeeded and failed. An error naming the
+machines that failed is returned if any did. Force executes the command even if
+orchid is locked
+*/
+func (a *Actions) Exec(command string, workers int, force bool) (err error) {
+	defer func() {
+		a.audit("exec --all", command, auditResult(err))
+	}()
+
+	err = checkLock(a.path, force)
+	if err != nil {
+		return err
+	}
+
+	setup, err := a.loadSetup()
+	if err != nil {
+		return err
+	}
+
+	if workers < 1 {
+		return errors.New("The number of workers must be at least 1")
+	}
+
+	// Hand out the machines to the workers
+	results := make([]*execResult, len(setup.Machines))
+	indices := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indices {
+				results[i] = a.execOnMachine(setup.Machines[i], command)
+			}
+		}()
+	}
+	for i := range setup.Machines {
+		indices <- i
+	}
+	close(indices)
+	wg.Wait()
+
+	// Print a block for each machine followed by the summary
+	ok := 0
+	failed := []string{}
+	for _, result := range results {
+		if result.Err != nil {
+			failed = append(failed, result.Machine)
+			fmt.Printf("----- %s (error: %s) -----\n", result.Machine, result.Err.Error())
+		} else {
+			ok++
+			fmt.Printf("----- %s (exit code %d) -----\n", result.Machine, result.ExitCode)
+		}
+		fmt.Print(result.Stdout.String())
+		if result.Stderr.Len() > 0 {
+			fmt.Println("stderr:")
+			fmt.Print(result.Stderr.String())
+		}
+	}
+	fmt.Printf("%d ok, %d failed\n", ok, len(failed))
+
+	if len(failed) > 0 {
+		return errors.New("The command failed on " + strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+/*
+Execute a command on a single machine, capturing its output and exit code
+*/
+func (a *Actions) execOnMachine(machine Machine, command string) *execResult {
+	result := &execResult{Machine: machine.Id}
+
+	sshCommand := fmt.Sprintf(
+		"ssh %s %s '%s'",
+		sshOptions(a.path, machine, "-p"),
+		sshDestination(machine),
+		withMachineHooks(machine, command),
+	)
+	cmd, err := machineCommand(machine, sshCommand)
+	if err != nil {
+		result.ExitCode = -1
+		result.Err = err
+		return result
+	}
+	cmd.Stdout = &result.Stdout
+	cmd.Stderr = &result.Stderr
+
+	err = cmd.Run()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		// The command ran but failed
+		result.ExitCode = exitErr.ExitCode()
+		result.Err = fmt.Errorf("exit code %d", result.ExitCode)
+	} else if err != nil {
+		result.ExitCode = -1
+		result.Err = err
+	}
+
+	return result
+}
+
+/*
+Check whether each machine is reachable. Recent results are reused from the
+cache unless noCache is given
+*/
+func (a *Actions) PingAll(noCache bool) error {
+	setup, err := a.loadSetup()
+	if err != nil {
+		return err
+	}
+
+	settings, err := loadSettings(a.path)
+	if err != nil {
+		return err
+	}
+
+	results, err := checkReachability(a.path, setup.Machines, settings.reachabilityTTL(), noCache)
+	if err != nil {
+		return err
+	}
+
+	for _, machine := range setup.Machines {
+		result := results[machine.Id]
+		status := "reachable"
+		if !result.Reachable {
+			status = "unreachable: " + strings.TrimSpace(result.Error)
+		}
+		if result.Cached {
+			status += " (cached " + result.Checked.Format(time.Kitchen) + ")"
+		}
+		fmt.Printf("%-20s\t%s\n", machine.Id, status)
+	}
+
+	return nil
+}
+
+/*
+Get the output stored locally in the log with the given id, also writing it to
+the output file if given. With jsonLines, each line is written as a JSON object
+attributed to its step, followed by the status of the log once its job is done
+*/
+func (a *Actions) GetLogOutput(logId, output string, jsonLines bool) {
+	logId, err := resolveLogId(a.path, logId)
+	if err != nil {
+		fmt.Println("ERROR: " + err.Error())
+		return
+	}
+
+	file, err := createOutputFile(output)
+	if err != nil {
+		fmt.Println("ERROR: " + err.Error())
+		return
+	}
+	if file != nil {
+		defer file.Close()
+	}
+
+	if jsonLines {
+		writers := []io.Writer{os.Stdout}
+		if file != nil {
+			writers = append(writers, file)
+		}
+		err = followJSONLines(a.path, logId, a.pollLogs, writers...)
+		if err != nil {
+			fmt.Println("ERROR: " + err.Error())
+		}
+		return
+	}
+
+	err = followLog(a.path, logId, a.pollLogs, func(text string) {
+		fmt.Println(text)
+		if file != nil {
+			fmt.Fprintln(file, text)
+		}
+	})
+	if err != nil {
+		fmt.Println("ERROR: " + err.Error())
+	}
+}
+
+/*
+Follow the output of the most recent run of the job with the given id. With
+latest, following switches to each new run of the job as it starts, waiting for
+the next run once the followed one is done, until orchid is stopped
+*/
+func (a *Actions) FollowJob(jobId string, latest bool) error {
+	setup, err := a.loadSetup()
+	if err != nil {
+		return err
+	}
+	if _, found := setup.findJob(jobId); !found {
+		return ErrJobNotFound
+	}
+
+	log, found, err := latestJobLog(a.path, jobId)
+	if err != nil {
+		return err
+	}
+	if !found && !latest {
+		return errors.New("No logs found for job '" + jobId + "'")
+	}
+	if !latest {
+		return followLog(a.path, log.Id, a.pollLogs, func(text string) {
+			fmt.Println(text)
+		})
+	}
+
+	followed := ""
+	for {
+		if found && log.Id != followed {
+			followed = log.Id
+			fmt.Println("Following log " + log.Id + " of job " + jobId)
+
+			// Stop following once a newer run starts
+			stop := make(chan struct{})
+			go func(logId string) {
+				for {
+					time.Sleep(logCheckInterval)
+					next, found, err := latestJobLog(a.path, jobId)
+					if err == nil && found && next.Id != logId {
+						close(stop)
+						return
+					}
+				}
+			}(log.Id)
+			err = followLogUntil(a.path, log.Id, a.pollLogs, 0, stop, func(text string) {
+				fmt.Println(text)
+			})
+			if err != nil {
+				return err
+			}
+
+			select {
+			case <-stop:
+			default:
+				fmt.Println("Waiting for the next run of job " + jobId)
+			}
+		}
+
+		time.Sleep(logCheckInterval)
+		log, found, err = latestJobLog(a.path, jobId)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+/*
+Open the output of the log with the given id in the pager. The output of a
+failed run is opened at its first line mentioning an error
+*/
+func (a *Actions) ViewLog(logId string) error {
+	logId, err := resolveLogId(a.path, logId)
+	if err != nil {
+		return err
+	}
+
+	log, found, err := findLog(a.path, logId)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return ErrLogNotFound
+	}
+
+	err = a.requireTerminal("Viewing a log in the pager", "Use logs <log id> to print it instead")
+	if err != nil {
+		return err
+	}
+
+	line := 0
+	if log.Status == "Error" {
+		line, err = firstErrorLine(a.path, logId)
+		if err != nil {
+			return err
+		}
+	}
+	return runPager(a.path+"/logs/"+logId, line)
+}
+
+/*
+Show when each step of the log with the given id ran, as a timeline, or as a
+trace in the Chrome trace event format if chrome is given
+*/
+func (a *Actions) Trace(logId string, chrome bool) error {
+	logId, err := resolveLogId(a.path, logId)
+	if err != nil {
+		return err
+	}
+
+	log, found, err := findLog(a.path, logId)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return ErrLogNotFound
+	}
+
+	if !chrome {
+		fmt.Print(formatTimeline(log))
+		return nil
+	}
+	trace, err := chromeTrace(log)
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(trace))
+	return nil
+}
+
+/*
+Print the pipeline of the job with the given id as a diagram in the format,
+either dot for Graphviz or mermaid
+*/
+func (a *Actions) Graph(jobId, format string) error {
+	setup, err := a.loadSetup()
+	if err != nil {
+		return err
+	}
+
+	job, found := setup.findJob(jobId)
+	if !found {
+		return ErrJobNotFound
+	}
+
+	graph, err := renderGraph(job, format)
+	if err != nil {
+		return err
+	}
+	fmt.Print(graph)
+	return nil
+}
+
+/*
+Print the last n lines of the output stored locally in the log with the given
+id. If follow is given and the job of the log is still running, its output is
+followed from there
+*/
+func (a *Actions) TailLog(logId string, n int, follow bool) error {
+	logId, err := resolveLogId(a.path, logId)
+	if err != nil {
+		return err
+	}
+
+	lines, offset, err := tailLog(a.path, logId, n)
+	if err != nil {
+		return err
+	}
+	for _, line := range lines {
+		fmt.Println(line)
+	}
+
+	if !follow {
+		return nil
+	}
+	log, found, err := findLog(a.path, logId)
+	if err != nil || !found || !log.running() {
+		return err
+	}
+	return followLogFrom(a.path, logId, a.pollLogs, offset, func(text string) {
+		fmt.Println(text)
+	})
+}
+
+/*
+Follow the output of several logs at once, prefixing each line with the id of
+its log. A job id is expanded to the logs of its running jobs, or its latest
+log if none are running
+*/
+func (a *Actions) FollowLogs(ids []string) error {
+	setup, err := a.loadSetup()
+	if err != nil {
+		return err
+	}
+
+	logIds := []string{}
+	for _, id := range ids {
+		if _, found := setup.findJob(id); found {
+			jobLogs, err := recentJobLogs(a.path, id)
+			if err != nil {
+				return err
+			}
+			if len(jobLogs) == 0 {
+				return errors.New("No logs found for job '" + id + "'")
+			}
+			for _, log := range jobLogs {
+				logIds = append(logIds, log.Id)
+			}
+			continue
+		}
+
+		logId, err := resolveLogId(a.path, id)
+		if err != nil {
+			return err
+		}
+		logIds = append(logIds, logId)
+	}
+
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	for _, logId := range logIds {
+		wg.Add(1)
+		go func(logId string) {
+			defer wg.Done()
+			prefix := "[" + logId[:8] + "] "
+			err := followLog(a.path, logId, a.pollLogs, func(text string) {
+				mutex.Lock()
+				fmt.Println(prefix + text)
+				mutex.Unlock()
+			})
+			if err != nil {
+				mutex.Lock()
+				fmt.Println(prefix + "ERROR: " + err.Error())
+				mutex.Unlock()
+			}
+		}(logId)
+	}
+	wg.Wait()
+
+	return nil
+}
+
+/*
+Stop the running job with the given log id
+*/
+func (a *Actions) StopJob(logId string) (err error) {
+	defer func() {
+		a.audit("stop", logId, auditResult(err))
+	}()
+
+	logId, err = resolveLogId(a.path, logId)
+	if err != nil {
+		return err
+	}
+
+	log, _, err := findLog(a.path, logId)
+	if err != nil {
+		return err
+	}
+	if !log.running() {
+		return errors.New("The job of log '" + logId + "' is not running")
+	}
+
+	err = stopLog(a.path, log)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Stopped " + log.Id)
+	return nil
+}
+
+/*
+Cancel all running instances of the job with the given id, printing the ids of
+the logs cancelled
+*/
+func (a *Actions) Cancel(jobId string) (err error) {
+	defer func() {
+		a.audit("cancel", jobId, auditResult(err))
+	}()
+
+	logs, err := runningLogs(a.path)
+	if err != nil {
+		return err
+	}
+
+	jobLogs := []Log{}
+	for _, log := range logs {
+		if log.JobId == jobId {
+			jobLogs = append(jobLogs, log)
+		}
+	}
+	if len(jobLogs) == 0 {
+		return errors.New("Job '" + jobId + "' is not running")
+	}
+
+	cancelled := 0
+	for _, log := range jobLogs {
+		err = stopLog(a.path, log)
+		if err != nil {
+			fmt.Println("ERROR: Failed to cancel " + log.Id + ": " + err.Error())
+			continue
+		}
+		fmt.Println("Cancelled " + log.Id)
+		cancelled++
+	}
+	if cancelled < len(jobLogs) {
+		return fmt.Errorf("Cancelled %d of %d running instances of job '%s'", cancelled, len(jobLogs), jobId)
+	}
+
+	return nil
+}
+
+/*
+Stop all running jobs
+*/
+func (a *Actions) KillAll() (err error) {
+	defer func() {
+		a.audit("killall", "", auditResult(err))
+	}()
+
+	logs, err := runningLogs(a.path)
+	if err != nil {
+		return err
+	}
+
+	stopped := 0
+	for _, log := range logs {
+		err = stopLog(a.path, log)
+		if err != nil {
+			fmt.Println("ERROR: Failed to stop " + log.Id + ": " + err.Error())
+			continue
+		}
+		fmt.Println("Stopped " + log.Id)
+		stopped++
+	}
+	fmt.Printf("Stopped %d of %d running jobs\n", stopped, len(logs))
+
+	return nil
+}
+
+/*
+Reconcile the logs left marked running, e.g. after a crash. Logs whose process
+no longer exists are marked failed, with the terminating line written to their
+output so anyone following them is released. If stale is given, jobs still
+running whose output has not been written to for that long are stopped
+*/
+func (a *Actions) KillHung(stale time.Duration) (err error) {
+	defer func() {
+		a.audit("kill-hung", "", auditResult(err))
+	}()
+
+	logs, err := loadLogs(a.path)
+	if err != nil {
+		return err
+	}
+
+	reconciled := 0
+	for _, log := range logs {
+		if log.Status != "New" && log.Status != "Started" {
+			continue
+		}
+
+		if log.Pid != 0 && !processAlive(log.Pid) {
+			err = failHungLog(a.path, log)
+			if err != nil {
+				fmt.Println("ERROR: Failed to mark " + log.Id + " failed: " + err.Error())
+				continue
+			}
+			fmt.Println("Marked " + log.Id + " of job " + log.JobId + " failed, as its process is gone")
+			reconciled++
+			continue
+		}
+
+		if stale <= 0 {
+			continue
+		}
+		info, err := os.Stat(a.path + "/logs/" + log.Id)
+		if err != nil || time.Since(info.ModTime()) < stale {
+			continue
+		}
+		if log.Pid == 0 {
+			err = failHungLog(a.path, log)
+		} else {
+			err = stopLog(a.path, log)
+		}
+		if err != nil {
+			fmt.Println("ERROR: Failed to stop " + log.Id + ": " + err.Error())
+			continue
+		}
+		fmt.Println("Stopped " + log.Id + " of job " + log.JobId + ", as it wrote no output since " + info.ModTime().Format(time.RFC3339))
+		reconciled++
+	}
+	fmt.Printf("Reconciled %d hung logs\n", reconciled)
+
+	return nil
+}
+
+/*
+Mark the log of a job whose process is gone failed
+*/
+func failHungLog(path string, log Log) error {
+	file, err := os.OpenFile(path+"/logs/"+log.Id, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = file.WriteString("ERROR: The job was interrupted, as the process running it is gone\n")
+	if err != nil {
+		return err
+	}
+	_, err = log.error(path, file)
+	return err
+}
+
+/*
+Stop the job of the given log by telling the process running it to cancel it.
+If the process does not cancel the job in time, it is killed and the log is
+marked cancelled on its behalf
+*/
+func stopLog(path string, log Log) error {
+	if log.Pid == 0 {
+		return errors.New("The process running log '" + log.Id + "' is unknown")
+	}
+
+	err := syscall.Kill(log.Pid, syscall.SIGTERM)
+	if err != nil && err != syscall.ESRCH {
+		return err
+	}
+
+	// Wait for the job to be cancelled
+	waited := time.Duration(0)
+	for waited < stopTimeout {
+		current, found, err := findLog(path, log.Id)
+		if err == nil && found && !current.running() {
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
+		waited += 100 * time.Millisecond
+	}
+
+	syscall.Kill(log.Pid, syscall.SIGKILL)
+
+	file, err := os.OpenFile(path+"/logs/"+log.Id, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = log.cancel(path, file)
+	return err
+}
+
+/*
+Lock orchid, preventing jobs and actions from being run until unlocked
+*/
+func (a *Actions) Lock(reason string) (err error) {
+	defer func() {
+		a.audit("lock", reason, auditResult(err))
+	}()
+
+	lock, locked, err := loadLock(a.path)
+	if err != nil {
+		return err
+	}
+	if locked {
+		return errors.New("Orchid is already locked by " + lock.User + ": " + lock.Reason)
+	}
+
+	return newLock(reason).save(a.path)
+}
+
+/*
+Unlock orchid, allowing jobs and actions to be run again
+*/
+func (a *Actions) Unlock() (err error) {
+	defer func() {
+		a.audit("unlock", "", auditResult(err))
+	}()
+
+	_, locked, err := loadLock(a.path)
+	if err != nil {
+		return err
+	}
+	if !locked {
+		return errors.New("Orchid is not locked")
+	}
+
+	return os.Remove(a.path + "/lock.json")
+}
+
+/*
+Interactive ssh
+*/
+func (a *Actions) SSH(machineId string) (err error) {
+	defer func() {
+		a.audit("ssh", machineId, auditResult(err))
+	}()
+
+	err = a.requireTerminal("An interactive ssh session", "Use exec to execute commands unattended")
+	if err != nil {
+		return err
+	}
+
+	setup, err := a.loadSetup()
 	if err != nil {
 		fmt.Println("ERROR: " + err.Error())
 	}
 
-	for _, job := range setup.Jobs {
-		fmt.Println(job.Id)
-		for _, ex := range job.Pipeline {
-			fmt.Printf("\t%s -> %s %v\n", ex.Machine, ex.Script, ex.Args)
+	var machine Machine
+	found := false
+	for _, m := range setup.Machines {
+		if m.Id == machineId {
+			machine = m
+			found = true
+			break
 		}
 	}
-}
 
-/*
-List all actions
-*/
-func (a *Actions) ListActions() {
-	setup, err := loadSetup(a.path)
-	if err != nil {
-		fmt.Println("ERROR: " + err.Error())
+	// Check if no machine matched
+	if !found {
+		return ErrMachineNotFound
 	}
 
-	for _, action := range setup.Actions {
-		fmt.Println(action.Id)
-		fmt.Printf("\t%s -> %s\n",
-			action.Machine,
-			action.Command,
-		)
+	sshCommand := fmt.Sprintf(
+		"ssh -tt %s %s",
+		sshOptions(a.path, machine, "-p"),
+		sshDestination(machine),
+	)
+	cmd, err := machineCommand(machine, sshCommand)
+	if err != nil {
+		return err
 	}
+
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	return cmd.Run()
 }
 
+
 /*
-List all machines
+Copy files/directories between this machine and another, or between two other
+machines. Remote paths are given as <machine id>:<path>. Copies between two
+machines go through this machine, as the machines may not reach each other. If
+verify is given, the SHA256 checksums of the source and the copy are compared
+once copied, failing if they differ. Copying to a machine is refused while
+orchid is locked, unless force is given
 */
-func (a *Actions) ListMachines() {
-	setup, err := loadSetup(a.path)
+func (a *Actions) SCP(from, to string, verify, force bool) (err error) {
+	defer func() {
+		a.audit("scp", from+" "+to, auditResult(err))
+	}()
+
+	setup, err := a.loadSetup()
 	if err != nil {
 		fmt.Println("ERROR: " + err.Error())
 	}
 
-	for _, machine := range setup.Machines {
-		fmt.Println(machine.Id)
-		fmt.Printf("\t%s@%s:%s (%s)\n", machine.User, machine.Address, machine.Port, machine.PrivateKey)
+	// Figure out which is local and which is remote
+	fromMachineId, fromPath := splitTransferPath(from)
+	toMachineId, toPath := splitTransferPath(to)
+
+	if fromMachineId == "" && toMachineId == "" {
+		return errors.New("Both '" + from + "' and '" + to + "' are local paths. " + transferSyntax)
+	}
+	if toMachineId != "" {
+		err = checkLock(a.path, force)
+		if err != nil {
+			return err
+		}
+	}
+	if fromMachineId != "" && toMachineId != "" {
+		fromMachine, found := setup.findMachine(fromMachineId)
+		if !found {
+			return fmt.Errorf("%w: '%s' (from '%s'). %s", ErrMachineNotFound, fromMachineId, from, transferSyntax)
+		}
+		toMachine, found := setup.findMachine(toMachineId)
+		if !found {
+			return fmt.Errorf("%w: '%s' (from '%s'). %s", ErrMachineNotFound, toMachineId, to, transferSyntax)
+		}
+		err = a.scpBetween(fromMachine, fromPath, toMachine, toPath)
+		if err != nil || !verify {
+			return err
+		}
+		source, err := remoteChecksum(a.path, fromMachine, fromPath, "")
+		if err != nil {
+			return err
+		}
+		copy, err := remoteChecksum(a.path, toMachine, toPath, filepath.Base(fromPath))
+		if err != nil {
+			return err
+		}
+		return compareChecksums(source, copy)
 	}
-}
 
-/*
-List all scripts
-*/
-func (a *Actions) ListScripts() {
-	setup, err := loadSetup(a.path)
-	if err != nil {
-		fmt.Println("ERROR: " + err.Error())
+	machineId, remotePath, remoteArg := toMachineId, toPath, to
+	if fromMachineId != "" {
+		machineId, remotePath, remoteArg = fromMachineId, fromPath, from
 	}
 
-	for _, script := range setup.Scripts {
-		fmt.Println(script)
+	machine, found := setup.findMachine(machineId)
+	if !found {
+		return fmt.Errorf("%w: '%s' (from '%s'). %s", ErrMachineNotFound, machineId, remoteArg, transferSyntax)
+	}
+
+	remoteString := remoteDestination(machine) + ":" + remotePath
+	if fromMachineId != "" {
+		err = a.scp(machine, remoteString, to, os.Stdout, os.Stderr)
+	} else {
+		err = a.scp(machine, from, remoteString, os.Stdout, os.Stderr)
+	}
+	if err != nil || !verify {
+		return err
+	}
+
+	var source, copy string
+	if fromMachineId != "" {
+		source, err = remoteChecksum(a.path, machine, remotePath, "")
+		if err == nil {
+			copy, err = localChecksum(to, filepath.Base(remotePath))
+		}
+	} else {
+		source, err = localChecksum(from, "")
+		if err == nil {
+			copy, err = remoteChecksum(a.path, machine, remotePath, filepath.Base(from))
+		}
 	}
+	if err != nil {
+		return err
+	}
+	return compareChecksums(source, copy)
 }
 
 /*
-List all existing logs stored locally
+Copy files/directories from one machine to another in two hops, through a
+temporary directory on this machine, which is removed afterwards
 */
-func (a *Actions) ListLogs() {
-	logs, err := loadLogs(a.path)
+func (a *Actions) scpBetween(fromMachine Machine, fromPath string, toMachine Machine, toPath string) error {
+	dir, err := ioutil.TempDir("", "orchid-scp-")
 	if err != nil {
-		fmt.Println("ERROR: " + err.Error())
+		return err
 	}
+	defer os.RemoveAll(dir)
 
-	fmt.Printf("%-20s\t%-20s\t%-20s\t%-32s\t%-32s\n", "Id", "Job", "Status", "Start", "End")
-	for _, log := range logs {
-		fmt.Printf("%-20s\t%-20s\t%-20s\t%-32s\t%-32s\n", log.Id, log.JobId, log.Status, log.StartTime, log.EndTime)
+	fmt.Printf("Copying from %s to %s through this machine\n", fromMachine.Id, toMachine.Id)
+	err = a.scp(fromMachine, remoteDestination(fromMachine)+":"+fromPath, dir, os.Stdout, os.Stderr)
+	if err != nil {
+		return errors.New("Could not copy from " + fromMachine.Id + ": " + err.Error())
 	}
-}
 
-/*
-Run the job with the given id
-*/
-func (a *Actions) RunJob(jobId string) {
-	log := newLog(jobId)
+	// The source may match several files, e.g. using a wildcard
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	sources := []string{}
+	for _, entry := range entries {
+		sources = append(sources, "'"+strings.Replace(dir+"/"+entry.Name(), "'", `'\''`, -1)+"'")
+	}
+	if len(sources) == 0 {
+		return errors.New("Nothing was copied from " + fromMachine.Id)
+	}
 
-	pipeline, err := buildPipeline(a.path, jobId, log)
+	err = a.scp(toMachine, strings.Join(sources, " "), remoteDestination(toMachine)+":"+toPath, os.Stdout, os.Stderr)
 	if err != nil {
-		fmt.Println("ERROR: " + err.Error())
+		return errors.New("Could not copy to " + toMachine.Id + ": " + err.Error())
 	}
+	return nil
+}
 
-	go func() {
-		pipeline.Run(a.path)
-	}()
+/*
+Copy files/directories between this machine and another, like SCP
+*/
+func (a *Actions) Cp(from, to string, verify, force bool) error {
+	return a.SCP(from, to, verify, force)
+}
 
-	fmt.Println(log.Id)
+/*
+Description of the syntax of the arguments of SCP, for errors
+*/
+const transferSyntax = "Give remote paths as <machine id>:<path>, e.g. 'machine1:/etc/hosts ./hosts', './hosts machine1:/tmp/hosts', or 'machine1:/etc/hosts machine2:/tmp/hosts'"
 
-	// Tail the log, ensuring the program does not terminate
-	a.GetLogOutput(log.Id)
+/*
+Split an argument of SCP into the machine id and the path. Arguments without a
+colon, or starting with "/" or ".", are local paths and have no machine id. Only
+the first colon separates the machine id, as paths may contain colons
+*/
+func splitTransferPath(arg string) (string, string) {
+	if !strings.Contains(arg, ":") || strings.HasPrefix(arg, "/") || strings.HasPrefix(arg, ".") {
+		return "", arg
+	}
+	parts := strings.SplitN(arg, ":", 2)
+	return parts[0], parts[1]
 }
 
 /*
-Execute the action with the given id
+Copy the local file/directory to the remote path on every machine of the group.
+The copies run concurrently within the limits of concurrent transfers, and the
+outcome for each machine is printed once all are done. Force copies even if
+orchid is locked
 */
-func (a *Actions) ExecuteAction(actionId string) error {
-	setup, err := loadSetup(a.path)
+func (a *Actions) CopyToGroup(localPath, groupId, remotePath string, force bool) (err error) {
+	defer func() {
+		a.audit("copy", localPath+" "+groupId+":"+remotePath, auditResult(err))
+	}()
+
+	err = checkLock(a.path, force)
 	if err != nil {
-		fmt.Println("ERROR: " + err.Error())
+		return err
 	}
 
-	// Find the action
-	var action Action
-	found := false
-	for _, a := range setup.Actions {
-		if a.Id == actionId {
-			action = a
-			found = true
-			break
-		}
+	setup, err := a.loadSetup()
+	if err != nil {
+		return err
 	}
 
-	// Check if no action matched
+	group, found := setup.findGroup(groupId)
 	if !found {
-		return errors.New("No action with the given id was found")
+		return ErrGroupNotFound
 	}
+	machines := setup.groupMachines(group)
 
-	var cmd *exec.Cmd
+	if _, err = os.Stat(localPath); err != nil {
+		return err
+	}
 
-	if action.Machine == "local" {
-		// If the script is to be executed locally, do so
-		cmd = exec.Command(action.Command)
-	} else {
-		// If not to be executed locally, find the machine
-		var machine Machine
-		found = false
-		for _, m := range setup.Machines {
-			if m.Id == action.Machine {
-				machine = m
-				found = true
-				break
-			}
-		}
+	results := make([]*execResult, len(machines))
+	var wg sync.WaitGroup
+	for i, machine := range machines {
+		wg.Add(1)
+		go func(i int, machine Machine) {
+			defer wg.Done()
+			result := &execResult{Machine: machine.Id}
+			to := remoteDestination(machine) + ":" + remotePath
+			result.Err = a.scp(machine, localPath, to, &result.Stdout, &result.Stderr)
+			results[i] = result
+		}(i, machine)
+	}
+	wg.Wait()
 
-		// Check if no machine matched
-		if !found {
-			return errors.New("No machine with the given id was found")
+	failed := 0
+	for _, result := range results {
+		if result.Err != nil {
+			failed++
+			fmt.Printf("%-20s\tfailed: %s\n", result.Machine, strings.TrimSpace(result.Stderr.String()+" "+result.Err.Error()))
+		} else {
+			fmt.Printf("%-20s\tok\n", result.Machine)
 		}
-
-		// Do the execution
-		sshCommand := fmt.Sprintf(
-			"ssh -tt -o 'StrictHostKeyChecking no' -o 'BatchMode yes' %s@%s -p %s -i %s '%s'",
-			machine.User,
-			machine.Address,
-			machine.Port,
-			a.path+"/keys/"+machine.PrivateKey,
-			action.Command,
-		)
-		cmd = exec.Command("/bin/bash", "-c", sshCommand)
 	}
+	fmt.Printf("%d ok, %d failed\n", len(results)-failed, failed)
 
-	cmd.Stdin = os.Stdin
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-
-	return cmd.Run()
+	if failed > 0 {
+		return fmt.Errorf("Copying failed on %d of %d machines", failed, len(results))
+	}
+	return nil
 }
 
 /*
-Get the output stored locally in the log with the given id
+Export the job with the given id as a bundle holding everything needed to run
+it elsewhere, except keys
 */
-func (a *Actions) GetLogOutput(logId string) {
-	// If the log id given is not full, search for the first log that
-	// matches the id prefix
-	if len(logId) < 16 {
-		match := ""
-		logs, err := loadLogs(a.path)
-		if err != nil {
-			fmt.Println("ERROR: " + err.Error())
-		}
+func (a *Actions) Export(jobId, outPath string) (err error) {
+	defer func() {
+		a.audit("export", jobId+" to "+outPath, auditResult(err))
+	}()
 
-		for _, log := range logs {
-			if strings.HasPrefix(log.Id, logId) {
-				match = log.Id
-				break
-			}
-		}
+	setup, err := a.loadSetup()
+	if err != nil {
+		return err
+	}
 
-		// If no match, inform the user
-		if match == "" {
-			fmt.Println("ERROR: Log not found")
-			return
-		}
+	out, err := os.Create(outPath)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	err = exportJob(a.path, setup, jobId, out)
+	if err != nil {
+		os.Remove(outPath)
+		return err
+	}
+
+	fmt.Println("Exported job " + jobId + " to " + outPath)
+	return nil
+}
+
+/*
+Import the bundle into the setup, as exported by Export
+*/
+func (a *Actions) Import(bundlePath string) (err error) {
+	defer func() {
+		a.audit("import", bundlePath, auditResult(err))
+	}()
 
-		logId = match
+	in, err := os.Open(bundlePath)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
 
+	imported, err := importBundle(a.path, in)
+	for _, entity := range imported {
+		fmt.Println("Imported " + entity)
 	}
-	t, err := tail.TailFile(a.path+"/logs/"+logId, tail.Config{Follow: true})
 	if err != nil {
-		fmt.Println("ERROR: " + err.Error())
-		return
+		return err
+	}
+	if len(imported) == 0 {
+		fmt.Println("Everything in the bundle already exists")
 	}
 
-	for line := range t.Lines {
-		if line.Text == "-----Finished-----" || line.Text == "-----Error-----" {
-			break
-		}
-		fmt.Println(line.Text)
+	// Keys are not part of bundles, so the setup may need keys added
+	if _, setupErr := loadSetup(a.path); setupErr != nil {
+		fmt.Println("WARNING: The setup is invalid after importing: " + setupErr.Error())
 	}
+	return nil
 }
 
 /*
-Interactive ssh
+Import the hosts of the ssh config at the given path, ~/.ssh/config by default,
+as machines. Wildcard hosts are skipped, and so are hosts whose id is already in
+use, reporting the conflict. The identity files of the hosts are copied to the
+keys
 */
-func (a *Actions) SSH(machineId string) error {
-	setup, err := loadSetup(a.path)
+func (a *Actions) ImportFromSSHConfig(configPath string) (err error) {
+	defer func() {
+		a.audit("import-ssh-config", configPath, auditResult(err))
+	}()
+
+	if configPath == "" {
+		configPath = "~/.ssh/config"
+	}
+	configPath, err = filepath.Abs(expandHome(configPath))
 	if err != nil {
-		fmt.Println("ERROR: " + err.Error())
+		return err
 	}
 
-	var machine Machine
-	found := false
-	for _, m := range setup.Machines {
-		if m.Id == machineId {
-			machine = m
-			found = true
-			break
-		}
+	file, err := os.Open(configPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	blocks, err := parseSSHConfig(file)
+	if err != nil {
+		return err
 	}
 
-	// Check if no machine matched
-	if !found {
-		return errors.New("No machine with the given id was found")
+	machines, err := loadSetupFile(a.path, "machines.json")
+	if err != nil {
+		return err
+	}
+	ids := map[string]bool{}
+	for _, machine := range machines {
+		ids[machine.getString("Id")] = true
 	}
 
-	sshCommand := fmt.Sprintf(
-		"ssh -tt -o 'StrictHostKeyChecking no' -o 'BatchMode yes' %s@%s -p %s -i %s",
-		machine.User,
-		machine.Address,
-		machine.Port,
-		a.path+"/keys/"+machine.PrivateKey,
-	)
-	cmd := exec.Command("/bin/bash", "-c", sshCommand)
+	imported := 0
+	for _, host := range resolveSSHConfigHosts(blocks) {
+		if ids[host.Alias] {
+			fmt.Println("Skipped " + host.Alias + ": A machine with the id already exists")
+			continue
+		}
+		machine, err := sshConfigMachine(a.path, configPath, host)
+		if err != nil {
+			fmt.Println("Skipped " + host.Alias + ": " + err.Error())
+			continue
+		}
 
-	cmd.Stdin = os.Stdin
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+		machines = append(machines, machine)
+		ids[host.Alias] = true
+		imported++
+		fmt.Println("Imported machine " + host.Alias)
+	}
 
-	return cmd.Run()
-}
+	if imported == 0 {
+		fmt.Println("No machines were imported")
+		return nil
+	}
+	err = writeSetupFile(a.path, "machines.json", machines)
+	if err != nil {
+		return err
+	}
 
+	if _, setupErr := loadSetup(a.path); setupErr != nil {
+		fmt.Println("WARNING: The setup is invalid after importing: " + setupErr.Error())
+	}
+	return nil
+}
 
 /*
-Copy files/directories from one machine to another
+Diagnose the environment orchid runs in: the external binaries it relies on,
+the structure and permissions of the orchid directory, the permissions of the
+keys, and the validity of the setup. Prints a checklist with hints on fixing
+what failed
 */
-func (a *Actions) SCP(from, to string) error {
-	setup, err := loadSetup(a.path)
-	if err != nil {
-		fmt.Println("ERROR: " + err.Error())
+func (a *Actions) Doctor() error {
+	// The setup is loaded anew, as a setup loaded earlier may be outdated
+	setup, setupErr := loadSetup(a.path)
+	setup = a.withNoTTY(setup)
+	setupCheck := doctorCheck{Name: "Setup is valid", Passed: setupErr == nil}
+	if setupErr != nil {
+		setupCheck.Hint = setupErr.Error()
 	}
 
-	// Figure out which is local and which is remote
-	fromParts := strings.Split(from, ":")
-	toParts := strings.Split(to, ":")
+	checks := checkBinaries(setup)
+	checks = append(checks, checkDirectory(a.path)...)
+	checks = append(checks, checkKeyPermissions(a.path)...)
+	checks = append(checks, setupCheck)
+
+	failed := printChecks(checks)
+	fmt.Println()
+	if failed > 0 {
+		return fmt.Errorf("%d of %d checks failed", failed, len(checks))
+	}
+	fmt.Println("All checks passed")
+	return nil
+}
 
-	var machineId string
-	var localToRemote bool
+/*
+Gather the facts of the machine with the given id, e.g. its OS and architecture,
+storing them for the steps run on the machine. Without a machine id, the facts
+of all machines are gathered
+*/
+func (a *Actions) GatherFacts(machineId string) (err error) {
+	defer func() {
+		a.audit("facts", machineId, auditResult(err))
+	}()
 
-	if len(fromParts) == 1 && len(toParts) == 2 { // Local to remote
-		localToRemote = true
-		machineId = toParts[0]
-	} else if len(fromParts) == 2 && len(toParts) == 1 { // Remote to local
-		localToRemote = false
-		machineId = fromParts[0]
-	} else { // Invalid
-		return errors.New("Invalid arguments to scp")
+	setup, err := a.loadSetup()
+	if err != nil {
+		return err
 	}
 
-	var machine Machine
-	found := false
-	for _, m := range setup.Machines {
-		if m.Id == machineId {
-			machine = m
-			found = true
-			break
+	machines := setup.Machines
+	if machineId != "" {
+		machine, found := setup.findMachine(machineId)
+		if !found {
+			return ErrMachineNotFound
 		}
+		machines = []Machine{machine}
 	}
 
-	// Check if no machine matched
-	if !found {
-		return errors.New("No machine with the given id was found")
+	failed := 0
+	for _, machine := range machines {
+		facts, err := gatherFacts(a.path, machine)
+		if err == nil {
+			err = saveFacts(a.path, facts)
+		}
+		if err != nil {
+			fmt.Println("ERROR: " + machine.Id + ": " + err.Error())
+			failed++
+			continue
+		}
+
+		fmt.Printf("%s: %s %s (kernel %s", machine.Id, facts.OS, facts.Arch, facts.Kernel)
+		if facts.Distribution != "" {
+			fmt.Printf(", %s", facts.Distribution)
+		}
+		fmt.Printf(", %d MB free)\n", facts.FreeDiskKB/1024)
 	}
 
-	// Build the from / to strings
-	var fromString string
-	var toString string
+	if failed > 0 {
+		return fmt.Errorf("Could not gather the facts of %d of %d machines", failed, len(machines))
+	}
+	return nil
+}
 
-	remoteString := fmt.Sprintf(
-		"%s@%s:",
-		machine.User,
-		machine.Address,
-	)
+/*
+Verify the host key of the machine with the given id by showing its
+fingerprints, to be compared with ones obtained out-of-band. If confirmed, the
+host key is pinned, after which connecting to the machine fails if its host key
+changes
+*/
+func (a *Actions) Verify(machineId string) (err error) {
+	defer func() {
+		a.audit("verify", machineId, auditResult(err))
+	}()
 
-	if localToRemote {
-		fromString = from
-		toString = remoteString + toParts[1]
-	} else {
-		fromString = remoteString + fromParts[1]
-		toString = to
+	setup, err := a.loadSetup()
+	if err != nil {
+		return err
 	}
 
-	// Build and execute the command
-	scpCommand := fmt.Sprintf(
-		"scp -o 'StrictHostKeyChecking no' -o 'BatchMode yes' -i %s -P %s -r %s %s",
-		a.path+"/keys/"+machine.PrivateKey,
-		machine.Port,
-		fromString,
-		toString,
-	)
-	cmd := exec.Command("/bin/bash", "-c", scpCommand)
+	machine, found := setup.findMachine(machineId)
+	if !found {
+		return ErrMachineNotFound
+	}
 
-	cmd.Stdin = os.Stdin
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	keys, err := scanHostKeys(a.path, machine)
+	if err != nil {
+		return err
+	}
 
-	return cmd.Run()
+	fmt.Println("Host key fingerprints of machine " + machine.Id + ":")
+	for _, key := range keys {
+		fingerprint, err := hostKeyFingerprint(key)
+		if err != nil {
+			return err
+		}
+		fmt.Println("  " + fingerprint)
+	}
+
+	if hostKeyPinned(a.path, machine.Id) {
+		fmt.Println("A host key is already pinned for the machine, and will be replaced")
+	}
+	err = a.requireTerminal("Confirming the fingerprints of the host key", "")
+	if err != nil {
+		return err
+	}
+	if !askYesNo("Do the fingerprints match, and should the host key be pinned?") {
+		fmt.Println("The host key was not pinned")
+		return nil
+	}
+
+	err = pinHostKeys(a.path, machine.Id, keys)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Pinned the host key of machine " + machine.Id + " to " + knownHostsFile(a.path))
+	return nil
 }
 
 /*
-Mount SSHfs
+Mount SSHfs. The options are passed on to sshfs, e.g. "ro" for a read-only
+mount or "reconnect" for flaky connections
 */
-func (a *Actions) Mount(machineId string,remoteMountPoint string,localMountPoint string) error {
-	setup, err := loadSetup(a.path)
+func (a *Actions) Mount(machineId string,remoteMountPoint string,localMountPoint string, options []string) (err error) {
+	defer func() {
+		a.audit("mount", machineId+":"+remoteMountPoint+" "+localMountPoint, auditResult(err))
+	}()
+
+	setup, err := a.loadSetup()
 	if err != nil {
 		fmt.Println("ERROR: " + err.Error())
 	}
@@ -364,19 +2684,29 @@ func (a *Actions) Mount(machineId string,remoteMountPoint string,localMountPoint
 
 	// Check if no machine matched
 	if !found {
-		return errors.New("No machine with the given id was found")
+		return ErrMachineNotFound
 	}
 
-        commandString := fmt.Sprintf(
-                "sshfs %s@%s:%s %s -p %s -o IdentityFile=%s -o sshfs_sync",
-		machine.User,
-		machine.Address,
-                remoteMountPoint,
-                localMountPoint,
-		machine.Port,
-		a.path+"/keys/"+machine.PrivateKey,
+	extraOptions := ""
+	for _, option := range options {
+		if option == "" {
+			return errors.New("Invalid empty sshfs option")
+		}
+		extraOptions += " -o " + shellQuote(option)
+	}
+
+	commandString := fmt.Sprintf(
+		"sshfs %s:%s %s %s -o sshfs_sync%s",
+		remoteDestination(machine),
+		remoteMountPoint,
+		localMountPoint,
+		sshfsOptions(a.path, machine),
+		extraOptions,
 	)
-	cmd := exec.Command("/bin/bash", "-c", commandString)
+	cmd, err := machineCommand(machine, commandString)
+	if err != nil {
+		return err
+	}
 
 	cmd.Stdin = os.Stdin
 	cmd.Stdout = os.Stdout
@@ -385,7 +2715,11 @@ func (a *Actions) Mount(machineId string,remoteMountPoint string,localMountPoint
 	return cmd.Run()
 }
 
-func (a *Actions) Unmount(localpath string) error{
+func (a *Actions) Unmount(localpath string) (err error) {
+	defer func() {
+		a.audit("unmount", localpath, auditResult(err))
+	}()
+
         commandString := fmt.Sprintf("fusermount -u %s", localpath)
 
 	cmd := exec.Command("/bin/bash", "-c", commandString)
@@ -0,0 +1,107 @@
+/*
+Collecting the artifacts of steps, i.e. files fetched back from the machine a
+step ran on once it succeeds
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+/*
+Get the directory holding the artifacts collected by the job of the log
+*/
+func artifactsDir(path, logId string) string {
+	return path + "/artifacts/" + logId
+}
+
+/*
+Fetch the artifacts of the step from the machine it ran on into the artifacts
+directory of the log. The artifacts are paths, which may contain glob patterns,
+expanded on the machine. Returns the paths of the collected files, relative to
+the artifacts directory
+*/
+func collectArtifacts(ctx context.Context, path string, artifacts []string, machineId string, machines []Machine, logId string) ([]string, error) {
+	dir := artifactsDir(path, logId)
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	before, err := listArtifacts(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	// Quoting the paths leaves the glob patterns to be expanded where the
+	// files are
+	var cmd *exec.Cmd
+	if machineId == "local" {
+		cmd = exec.Command("/bin/bash", "-c", "cp -r -- "+strings.Join(artifacts, " ")+" '"+dir+"'")
+	} else {
+		machine, _ := Setup{Machines: machines}.findMachine(machineId)
+		sources := []string{}
+		for _, artifact := range artifacts {
+			sources = append(sources, remoteDestination(machine)+":'"+artifact+"'")
+		}
+		scpCommand := fmt.Sprintf(
+			"scp %s -r %s '%s'",
+			sshOptions(path, machine, "-P"),
+			strings.Join(sources, " "),
+			dir,
+		)
+		cmd, err = machineCommand(machine, scpCommand)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	output := &strings.Builder{}
+	cmd.Stdout = output
+	cmd.Stderr = output
+	err = runCmd(ctx, cmd)
+	if err != nil {
+		return nil, fmt.Errorf("Could not collect the artifacts: %s %s", err.Error(), strings.TrimSpace(output.String()))
+	}
+
+	after, err := listArtifacts(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	// Files collected by earlier steps are not part of this step's artifacts,
+	// unless overwritten
+	collected := []string{}
+	for file, modTime := range after {
+		if previous, found := before[file]; !found || modTime != previous {
+			collected = append(collected, file)
+		}
+	}
+	sort.Strings(collected)
+	return collected, nil
+}
+
+/*
+List the files in the artifacts directory along with their modification times
+*/
+func listArtifacts(dir string) (map[string]int64, error) {
+	files := map[string]int64{}
+	err := filepath.Walk(dir, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			relative, _ := filepath.Rel(dir, file)
+			files[relative] = info.ModTime().UnixNano()
+		}
+		return nil
+	})
+	return files, err
+}
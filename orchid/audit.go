@@ -0,0 +1,116 @@
+/*
+Definition of and methods for the audit log, recording every invocation of
+orchid that causes an effect
+*/
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/user"
+	"time"
+)
+
+/*
+Type defining a single entry of the audit log
+*/
+type AuditEntry struct {
+	Time    time.Time
+	User    string
+	Command string
+	Target  string
+	Result  string
+}
+
+/*
+Append an entry to the audit log. Failing to do so is reported, but does not
+affect the command being audited
+*/
+func (a *Actions) audit(command, target, result string) {
+	entry := AuditEntry{
+		Time:    time.Now(),
+		User:    currentUser(),
+		Command: command,
+		Target:  target,
+		Result:  result,
+	}
+
+	err := appendAuditEntry(a.path, entry)
+	if err != nil {
+		fmt.Println("ERROR: Failed to write to the audit log: " + err.Error())
+	}
+}
+
+/*
+Append an entry to the audit log file, one JSON object per line
+*/
+func appendAuditEntry(path string, entry AuditEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path+"/audit.log", os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.Write(append(data, '\n'))
+	return err
+}
+
+/*
+Load all entries of the audit log
+*/
+func loadAudit(path string) ([]AuditEntry, error) {
+	entries := []AuditEntry{}
+
+	f, err := os.Open(path + "/audit.log")
+	if os.IsNotExist(err) {
+		return entries, nil
+	}
+	if err != nil {
+		return entries, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		entry := AuditEntry{}
+		err = json.Unmarshal(scanner.Bytes(), &entry)
+		if err != nil {
+			return entries, err
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, scanner.Err()
+}
+
+/*
+Get the result to record in the audit log for the given error
+*/
+func auditResult(err error) string {
+	if err != nil {
+		return "Error: " + err.Error()
+	}
+	return "OK"
+}
+
+/*
+Get the identity of the user running orchid. The identity can be configured
+using the ORCHID_USER environment variable, and defaults to the OS user
+*/
+func currentUser() string {
+	if identity := os.Getenv("ORCHID_USER"); identity != "" {
+		return identity
+	}
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return "unknown"
+}
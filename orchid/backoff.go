@@ -0,0 +1,57 @@
+/*
+Exponential backoff with jitter, used for spacing out retries
+*/
+
+package main
+
+import (
+	"context"
+	"math/rand"
+	"time"
+)
+
+/*
+Type defining a backoff policy. The delay before each retry doubles, starting
+from Base and capped at Max, and is reduced by a random fraction of up to
+Jitter to spread out retries. Attempts is the number of retries allowed
+*/
+type Backoff struct {
+	Base     time.Duration
+	Max      time.Duration
+	Jitter   float64
+	Attempts int
+}
+
+/*
+Get the delay before the given retry, counting from 0
+*/
+func (b Backoff) Delay(retry int) time.Duration {
+	delay := b.Base
+	for i := 0; i < retry && (b.Max <= 0 || delay < b.Max); i++ {
+		delay *= 2
+	}
+	if b.Max > 0 && delay > b.Max {
+		delay = b.Max
+	}
+
+	if b.Jitter > 0 {
+		delay -= time.Duration(rand.Float64() * b.Jitter * float64(delay))
+	}
+	return delay
+}
+
+/*
+Wait for the delay before the given retry, returning false if the context is
+cancelled while waiting
+*/
+func (b Backoff) Wait(ctx context.Context, retry int) bool {
+	timer := time.NewTimer(b.Delay(retry))
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
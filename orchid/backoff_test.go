@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+/*
+Test that the delay doubles with each retry until capped at Max
+*/
+func TestBackoffDelay(t *testing.T) {
+	backoff := Backoff{Base: time.Second, Max: 10 * time.Second}
+	expected := []time.Duration{
+		time.Second,
+		2 * time.Second,
+		4 * time.Second,
+		8 * time.Second,
+		10 * time.Second,
+		10 * time.Second,
+	}
+	for retry, delay := range expected {
+		if got := backoff.Delay(retry); got != delay {
+			t.Errorf("retry %d: got delay %s, expected %s", retry, got, delay)
+		}
+	}
+
+	// Without a Max, the delay keeps doubling
+	backoff.Max = 0
+	if got := backoff.Delay(10); got != 1024*time.Second {
+		t.Errorf("got delay %s without Max, expected %s", got, 1024*time.Second)
+	}
+}
+
+/*
+Test that jitter only reduces the delay, by up to the Jitter fraction of it,
+also once capped at Max
+*/
+func TestBackoffJitter(t *testing.T) {
+	backoff := Backoff{Base: time.Second, Max: 10 * time.Second, Jitter: 0.25}
+	for retry := 0; retry < 8; retry++ {
+		full := Backoff{Base: backoff.Base, Max: backoff.Max}.Delay(retry)
+		min := full - time.Duration(backoff.Jitter*float64(full))
+		for i := 0; i < 100; i++ {
+			delay := backoff.Delay(retry)
+			if delay < min || delay > full {
+				t.Fatalf("retry %d: got delay %s, expected it between %s and %s", retry, delay, min, full)
+			}
+		}
+	}
+}
+
+/*
+Test that waiting stops once the context is cancelled
+*/
+func TestBackoffWaitCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if (Backoff{Base: time.Hour}).Wait(ctx, 0) {
+		t.Error("expected waiting to stop as the context is cancelled")
+	}
+}
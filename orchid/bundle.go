@@ -0,0 +1,298 @@
+/*
+Exporting a job along with the machines and scripts it depends on as a bundle,
+and importing such bundles into a setup
+*/
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+/*
+Write a bundle of the job with the given id to out, as a gzipped tar archive
+holding the job, the machines it runs on, and the scripts it runs, whether
+files or inline. Keys are not included, but machines keep the names of their
+keys
+*/
+func exportJob(path string, setup Setup, jobId string, out io.Writer) error {
+	job, found := setup.findJob(jobId)
+	if !found {
+		return ErrJobNotFound
+	}
+
+	// Find the machines and scripts the job depends on
+	machineIds := map[string]bool{}
+	scripts := []string{}
+	for _, executable := range job.Pipeline {
+		if executable.Machine != "" && executable.Machine != "local" {
+			machineIds[executable.Machine] = true
+		}
+		if executable.MachineSelector != nil {
+			for _, candidate := range executable.MachineSelector.Candidates {
+				machineIds[candidate] = true
+			}
+		}
+		if executable.Script != "" {
+			scripts = append(scripts, executable.Script)
+		}
+	}
+
+	jobs, err := loadSetupFile(path, "jobs.json")
+	if err != nil {
+		return err
+	}
+	jobs = filterElements(jobs, map[string]bool{jobId: true})
+
+	machines, err := loadSetupFile(path, "machines.json")
+	if err != nil {
+		return err
+	}
+	machines = filterElements(machines, machineIds)
+
+	// Machines of a dynamic inventory are not in machines.json
+	for _, machine := range setup.Machines {
+		if machineIds[machine.Id] && len(filterElements(machines, map[string]bool{machine.Id: true})) == 0 {
+			data, err := json.Marshal(machine)
+			if err != nil {
+				return err
+			}
+			element := setupElement{}
+			if err = json.Unmarshal(data, &element); err != nil {
+				return err
+			}
+			machines = append(machines, element)
+		}
+	}
+
+	// Inline scripts are bundled in scripts.json, and script files as is
+	inlineIds := map[string]bool{}
+	scriptFiles := []string{}
+	for _, script := range scripts {
+		if _, found := setup.findInlineScript(script); found {
+			inlineIds[script] = true
+		} else {
+			scriptFiles = append(scriptFiles, script)
+		}
+	}
+	inlineScripts, err := loadSetupFile(path, "scripts.json")
+	if err != nil {
+		return err
+	}
+	inlineScripts = filterElements(inlineScripts, inlineIds)
+
+	gz := gzip.NewWriter(out)
+	archive := tar.NewWriter(gz)
+
+	files := map[string][]setupElement{"jobs.json": jobs, "machines.json": machines}
+	if len(inlineScripts) > 0 {
+		files["scripts.json"] = inlineScripts
+	}
+	for name, elements := range files {
+		data, err := encodeSetup(elements, "  ")
+		if err != nil {
+			return err
+		}
+		err = addToBundle(archive, name, append(data, '\n'), 0644)
+		if err != nil {
+			return err
+		}
+	}
+
+	added := map[string]bool{}
+	for _, script := range scriptFiles {
+		if added[script] {
+			continue
+		}
+		added[script] = true
+
+		file := path + "/scripts/" + script
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		info, err := os.Stat(file)
+		if err != nil {
+			return err
+		}
+		err = addToBundle(archive, "scripts/"+script, data, int64(info.Mode().Perm()))
+		if err != nil {
+			return err
+		}
+	}
+
+	if err = archive.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+/*
+Add a file to the bundle
+*/
+func addToBundle(archive *tar.Writer, name string, data []byte, mode int64) error {
+	header := &tar.Header{
+		Name:    name,
+		Mode:    mode,
+		Size:    int64(len(data)),
+		ModTime: time.Now(),
+	}
+	err := archive.WriteHeader(header)
+	if err != nil {
+		return err
+	}
+	_, err = archive.Write(data)
+	return err
+}
+
+/*
+Keep the elements with the given ids
+*/
+func filterElements(elements []setupElement, ids map[string]bool) []setupElement {
+	filtered := []setupElement{}
+	for _, element := range elements {
+		if ids[element.getString("Id")] {
+			filtered = append(filtered, element)
+		}
+	}
+	return filtered
+}
+
+/*
+Merge the bundle read from in into the setup. Jobs and machines which already
+exist with the same definition, and scripts with the same content, are kept. If
+any differ, nothing is imported. Returns what was imported
+*/
+func importBundle(path string, in io.Reader) ([]string, error) {
+	gz, err := gzip.NewReader(in)
+	if err != nil {
+		return nil, errors.New("Not a bundle: " + err.Error())
+	}
+	archive := tar.NewReader(gz)
+
+	files := map[string][]byte{}
+	modes := map[string]os.FileMode{}
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.New("Not a bundle: " + err.Error())
+		}
+
+		// Refuse files which would end up outside the setup
+		name := filepath.Clean(header.Name)
+		if filepath.IsAbs(name) || strings.HasPrefix(name, "..") {
+			return nil, errors.New("The bundle contains the invalid path '" + header.Name + "'")
+		}
+		if name != "jobs.json" && name != "machines.json" && name != "scripts.json" && !strings.HasPrefix(name, "scripts/") {
+			return nil, errors.New("The bundle contains the unexpected file '" + header.Name + "'")
+		}
+
+		data, err := ioutil.ReadAll(archive)
+		if err != nil {
+			return nil, err
+		}
+		files[name] = data
+		modes[name] = os.FileMode(header.Mode).Perm()
+	}
+
+	imported := []string{}
+	merged := map[string][]setupElement{}
+	changed := map[string]bool{}
+	for _, name := range []string{"jobs.json", "machines.json", "scripts.json"} {
+		elements := []setupElement{}
+		if data, found := files[name]; found {
+			if err = json.Unmarshal(data, &elements); err != nil {
+				return nil, errors.New("The bundle contains an invalid " + name + ": " + err.Error())
+			}
+		}
+
+		existing, err := loadSetupFile(path, name)
+		if err != nil {
+			return nil, err
+		}
+		kind := strings.TrimSuffix(name, "s.json")
+
+		for _, element := range elements {
+			id := element.getString("Id")
+			current := filterElements(existing, map[string]bool{id: true})
+			if len(current) == 0 {
+				existing = append(existing, element)
+				imported = append(imported, kind+" "+id)
+				changed[name] = true
+				continue
+			}
+
+			same, err := sameElements(current[0], element)
+			if err != nil {
+				return nil, err
+			}
+			if !same {
+				return nil, errors.New("A different " + kind + " with the id '" + id + "' already exists. Nothing was imported")
+			}
+		}
+		merged[name] = existing
+	}
+
+	scripts := []string{}
+	for name, data := range files {
+		if !strings.HasPrefix(name, "scripts/") {
+			continue
+		}
+		current, err := ioutil.ReadFile(path + "/" + name)
+		if err == nil && !bytes.Equal(current, data) {
+			return nil, errors.New("A different script named '" + strings.TrimPrefix(name, "scripts/") + "' already exists. Nothing was imported")
+		}
+		if os.IsNotExist(err) {
+			scripts = append(scripts, name)
+		}
+	}
+
+	// Write everything once nothing conflicts
+	for _, name := range scripts {
+		err = os.MkdirAll(filepath.Dir(path+"/"+name), 0755)
+		if err != nil {
+			return imported, err
+		}
+		err = ioutil.WriteFile(path+"/"+name, files[name], modes[name])
+		if err != nil {
+			return imported, err
+		}
+		imported = append(imported, "script "+strings.TrimPrefix(name, "scripts/"))
+	}
+	for name := range changed {
+		err = writeSetupFile(path, name, merged[name])
+		if err != nil {
+			return imported, err
+		}
+	}
+
+	return imported, nil
+}
+
+/*
+Check whether the two elements define the same, regardless of formatting
+*/
+func sameElements(a, b setupElement) (bool, error) {
+	encodedA, err := encodeSetup(a, "")
+	if err != nil {
+		return false, err
+	}
+	encodedB, err := encodeSetup(b, "")
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(encodedA, encodedB), nil
+}
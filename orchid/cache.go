@@ -0,0 +1,93 @@
+/*
+Caching the success of steps, skipping cached steps whose inputs are unchanged
+since they last succeeded
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+/*
+Get the directory holding the cached successes of steps
+*/
+func cacheDir(path string) string {
+	return path + "/cache"
+}
+
+/*
+Type defining a cached success of a step
+*/
+type cacheEntry struct {
+	JobId string
+	Step  string
+	LogId string
+	Time  time.Time
+}
+
+/*
+Get the key of the step in the cache, a hash of everything deciding what the
+step does: the job and step, where it runs, what it runs, and its arguments and
+input
+*/
+func stepCacheKey(path, jobId string, step Step) (string, error) {
+	executable := step.Executable
+
+	script := executable.Command
+	if script == "" {
+		data, err := ioutil.ReadFile(path + "/scripts/" + executable.Script)
+		if err != nil {
+			return "", err
+		}
+		script = string(data)
+	}
+
+	input, _, err := stepInput(path, executable)
+	if err != nil {
+		return "", err
+	}
+
+	inputs, err := json.Marshal(struct {
+		JobId      string
+		Step       string
+		Executable Executable
+		Script     string
+		Input      string
+	}{jobId, step.Name, executable, script, input})
+	if err != nil {
+		return "", err
+	}
+
+	hash := sha256.Sum256(inputs)
+	return hex.EncodeToString(hash[:]), nil
+}
+
+/*
+Check whether the key is in the cache
+*/
+func cached(path, key string) bool {
+	_, err := os.Stat(cacheDir(path) + "/" + key)
+	return err == nil
+}
+
+/*
+Store the key in the cache, recording the success of the step
+*/
+func storeInCache(path, key string, entry cacheEntry) error {
+	err := os.MkdirAll(cacheDir(path), 0755)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(cacheDir(path)+"/"+key, data, 0644)
+}
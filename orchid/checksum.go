@@ -0,0 +1,105 @@
+/*
+Verifying copies by comparing the SHA256 checksums of the files on both ends,
+catching files truncated or corrupted on the way
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+/*
+Quote the string for a POSIX shell
+*/
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+/*
+Get the SHA256 checksum of the local file. If the path is a directory, the
+checksum is of the file with the given name in it, i.e. the file copied into
+the directory
+*/
+func localChecksum(path, name string) (string, error) {
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		path = filepath.Join(path, name)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	if info, err := file.Stat(); err == nil && info.IsDir() {
+		return "", errors.New("Only copies of files can be verified, but " + path + " is a directory")
+	}
+
+	hash := sha256.New()
+	_, err = io.Copy(hash, file)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+/*
+Get the SHA256 checksum of the file on the machine. If the path is a directory,
+the checksum is of the file with the given name in it. The script is piped to
+sh, using sha256sum, or shasum on machines without it, e.g. macOS
+*/
+func remoteChecksum(path string, machine Machine, remotePath, name string) (string, error) {
+	// Relative paths and ~ are relative to the home directory for both scp
+	// and ssh
+	remotePath = strings.TrimPrefix(remotePath, "~/")
+	script := "p=" + shellQuote(remotePath) + "\n" +
+		`if [ -d "$p" ]; then p="$p/"` + shellQuote(name) + "; fi\n" +
+		`if [ -d "$p" ]; then echo "Only copies of files can be verified, but $p is a directory" >&2; exit 1; fi` + "\n" +
+		`if command -v sha256sum >/dev/null 2>&1; then sha256sum -- "$p"; else shasum -a 256 -- "$p"; fi` + "\n"
+
+	sshCommand := fmt.Sprintf(
+		"ssh -T %s %s 'sh -s'",
+		sshOptions(path, machine, "-p"),
+		sshDestination(machine),
+	)
+	cmd, err := machineCommand(machine, sshCommand)
+	if err != nil {
+		return "", err
+	}
+
+	output := bytes.Buffer{}
+	errOutput := bytes.Buffer{}
+	cmd.Stdin = strings.NewReader(script)
+	cmd.Stdout = &output
+	cmd.Stderr = &errOutput
+	err = cmd.Run()
+	if err != nil {
+		return "", errors.New("Could not get the checksum on " + machine.Id + ": " + strings.TrimSpace(errOutput.String()))
+	}
+
+	fields := strings.Fields(output.String())
+	if len(fields) == 0 {
+		return "", errors.New("Could not get the checksum on " + machine.Id + ": No checksum was printed")
+	}
+	return fields[0], nil
+}
+
+/*
+Compare the checksums of the source and the copy, printing the checksum if they
+match
+*/
+func compareChecksums(source, copy string) error {
+	if source != copy {
+		return errors.New("The copy is corrupt. The SHA256 checksum of the source is " + source + ", but that of the copy is " + copy)
+	}
+	fmt.Println("Verified, SHA256 " + source)
+	return nil
+}
@@ -0,0 +1,361 @@
+/*
+Shell completion scripts and the machine-readable id listings they call back
+into
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*
+Type defining a command of the command line and the kinds of ids completed for
+its arguments, by the position of the argument counting from 1. Position 0
+completes the kinds for every argument, e.g. for commands taking flags before
+their id, and is not combined with other positions
+*/
+type completedCommand struct {
+	Name string
+	Args map[int]string
+}
+
+/*
+The commands of the command line, completed as the first word. The completion
+scripts and the commands of the interactive shell are generated from these
+*/
+var commands = []completedCommand{
+	{"run", map[int]string{0: "jobs"}},
+	{"exec", map[int]string{0: "actions"}},
+	{"test", map[int]string{1: "actions", 2: "machines"}},
+	{"list", map[int]string{1: "lists"}},
+	{"logs", map[int]string{0: "jobs logs"}},
+	{"view", map[int]string{1: "logs"}},
+	{"follow", map[int]string{0: "jobs"}},
+	{"stop", map[int]string{0: "jobs logs"}},
+	{"killall", nil},
+	{"kill-hung", nil},
+	{"connections", nil},
+	{"lock", nil},
+	{"unlock", nil},
+	{"audit", nil},
+	{"ping", nil},
+	{"ssh", map[int]string{1: "machines"}},
+	{"scp", nil},
+	{"cp", nil},
+	{"mount", map[int]string{1: "machines"}},
+	{"unmount", nil},
+	{"forward", map[int]string{1: "machines"}},
+	{"which", map[int]string{1: "machines jobs actions groups scripts keys"}},
+	{"rename", nil},
+	{"duplicate", map[int]string{1: "jobs"}},
+	{"describe", map[int]string{1: "jobs"}},
+	{"describe-machine", map[int]string{1: "machines"}},
+	{"copy", map[int]string{2: "groups"}},
+	{"edit", map[int]string{1: "files"}},
+	{"export", map[int]string{1: "jobs"}},
+	{"import", nil},
+	{"import-ssh-config", nil},
+	{"init", nil},
+	{"verify", map[int]string{1: "machines"}},
+	{"stats", nil},
+	{"trace", map[int]string{0: "logs"}},
+	{"graph", map[int]string{0: "jobs"}},
+	{"rerun", map[int]string{0: "logs"}},
+	{"retry", map[int]string{0: "logs"}},
+	{"rollback", map[int]string{0: "jobs"}},
+	{"cancel", map[int]string{1: "jobs"}},
+	{"doctor", nil},
+	{"clear-cache", nil},
+	{"watch", map[int]string{1: "jobs"}},
+	{"facts", map[int]string{1: "machines"}},
+	{"show-key", map[int]string{1: "machines"}},
+	{"swap-key", map[int]string{1: "machines"}},
+	{"prune-keys", nil},
+	{"shell", nil},
+	{"completion", map[int]string{1: "shells"}},
+}
+
+/*
+Get the names of the commands of the command line
+*/
+func commandNames() []string {
+	names := []string{}
+	for _, command := range commands {
+		names = append(names, command.Name)
+	}
+	return names
+}
+
+/*
+Type defining a case of the completion scripts: the patterns of
+"<command>:<word number>" completing the given kinds of ids
+*/
+type completionCase struct {
+	Patterns []string
+	Kinds    string
+}
+
+/*
+Get the cases of the completion scripts, with the patterns of the same kinds
+in a single case, in the order the kinds first appear in the commands. The word
+number counts the command as 1, as COMP_CWORD of bash does
+*/
+func completionCases() []completionCase {
+	cases := []completionCase{}
+	index := map[string]int{}
+	for _, command := range commands {
+		positions := []int{}
+		for position := range command.Args {
+			positions = append(positions, position)
+		}
+		sort.Ints(positions)
+
+		for _, position := range positions {
+			kinds := command.Args[position]
+			pattern := command.Name + ":*"
+			if position > 0 {
+				pattern = command.Name + ":" + strconv.Itoa(position+1)
+			}
+			i, found := index[kinds]
+			if !found {
+				i = len(cases)
+				index[kinds] = i
+				cases = append(cases, completionCase{Kinds: kinds})
+			}
+			cases[i].Patterns = append(cases[i].Patterns, pattern)
+		}
+	}
+	return cases
+}
+
+/*
+Get the cases of the case statement of the bash and zsh completion scripts,
+indented by the given tabs
+*/
+func shellCases(indent string) string {
+	lines := ""
+	for _, c := range completionCases() {
+		lines += indent + strings.Join(c.Patterns, "|") + ") kind=\"" + c.Kinds + "\" ;;\n"
+	}
+	return lines
+}
+
+/*
+Get the cases of the switch statement of the fish completion script
+*/
+func fishCases() string {
+	lines := ""
+	for _, c := range completionCases() {
+		lines += "\t\t\tcase '" + strings.Join(c.Patterns, "' '") + "'\n"
+		lines += "\t\t\t\tset kind " + c.Kinds + "\n"
+	}
+	return lines
+}
+
+/*
+Print the completion script of the given shell
+*/
+func (a *Actions) Completion(shell string) error {
+	switch shell {
+	case "bash":
+		fmt.Print(bashCompletion())
+	case "zsh":
+		fmt.Print(zshCompletion())
+	case "fish":
+		fmt.Print(fishCompletion())
+	default:
+		return errors.New("Unknown shell '" + shell + "'. Must be bash, zsh, or fish")
+	}
+	return nil
+}
+
+/*
+Print the ids of the given kinds, one per line. Used by the completion scripts
+*/
+func (a *Actions) Complete(kinds []string) error {
+	for _, kind := range kinds {
+		ids, err := completionIds(a.path, kind)
+		if err != nil {
+			return err
+		}
+		for _, id := range ids {
+			fmt.Println(id)
+		}
+	}
+	return nil
+}
+
+/*
+Get the ids of the given kind. Only the file holding the ids is read, and only
+the ids are decoded, to keep completion fast. The dynamic inventory is not
+queried; its machines are completed from the cache only
+*/
+func completionIds(path, kind string) ([]string, error) {
+	switch kind {
+	case "commands":
+		return commandNames(), nil
+	case "lists":
+		return []string{"jobs", "actions", "machines", "scripts", "keys", "logs"}, nil
+	case "shells":
+		return []string{"bash", "zsh", "fish"}, nil
+	case "files":
+		return []string{"machines", "jobs", "actions", "groups", "scripts", "settings"}, nil
+	case "jobs":
+		return readIds(path + "/jobs.json")
+	case "actions":
+		return readIds(path + "/actions.json")
+	case "groups":
+		return readIds(path + "/groups.json")
+	case "logs":
+		return readIds(path + "/logs.json")
+	case "scripts", "keys":
+		dir := path + "/" + kind
+		if kind == "keys" {
+			var err error
+			dir, err = keyDir(path)
+			if err != nil {
+				return []string{}, err
+			}
+		}
+		files, err := loadDir(dir)
+		if err != nil {
+			return files, err
+		}
+		names := []string{}
+		for _, file := range files {
+			names = append(names, file[len(dir)+1:])
+		}
+		if kind == "scripts" {
+			inline, err := readIds(path + "/scripts.json")
+			if err != nil {
+				return names, err
+			}
+			names = append(names, inline...)
+		}
+		return names, nil
+	case "machines":
+		ids, err := readIds(path + "/machines.json")
+		if err != nil {
+			return ids, err
+		}
+		cache := struct{ Machines []struct{ Id string } }{}
+		data, err := ioutil.ReadFile(path + "/inventory-cache.json")
+		if err == nil && json.Unmarshal(data, &cache) == nil {
+			for _, machine := range cache.Machines {
+				ids = append(ids, machine.Id)
+			}
+		}
+		return ids, nil
+	}
+	return []string{}, errors.New("Unknown kind '" + kind + "'")
+}
+
+/*
+Read the ids of the elements of the JSON list in the file. A missing file has
+no ids
+*/
+func readIds(file string) ([]string, error) {
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return []string{}, nil
+	}
+	if err != nil {
+		return []string{}, err
+	}
+
+	elements := []struct{ Id string }{}
+	err = json.Unmarshal(data, &elements)
+	if err != nil {
+		return []string{}, err
+	}
+
+	ids := []string{}
+	for _, element := range elements {
+		ids = append(ids, element.Id)
+	}
+	return ids, nil
+}
+
+/*
+Get the completion script for bash. The kind of id to complete is decided from
+the command and the position of the word
+*/
+func bashCompletion() string {
+	return `_orchid() {
+	local cur="${COMP_WORDS[COMP_CWORD]}" kind=""
+	if [ "$COMP_CWORD" -eq 1 ]; then
+		kind="commands"
+	else
+		case "${COMP_WORDS[1]}:$COMP_CWORD" in
+` + shellCases("\t\t\t") + `		esac
+	fi
+	if [ -n "$kind" ]; then
+		COMPREPLY=($(compgen -W "$(orchid __complete $kind 2>/dev/null)" -- "$cur"))
+	fi
+}
+complete -F _orchid orchid
+`
+}
+
+/*
+Get the body of the completion function for zsh, as installed from the
+zsh-completion directory
+*/
+func zshCompletionBody(indent string) string {
+	return indent + `local kind=""
+` + indent + `if (( CURRENT == 2 )); then
+` + indent + `	kind="commands"
+` + indent + `else
+` + indent + `	case "$words[2]:$((CURRENT - 1))" in
+` + shellCases(indent+"\t\t") + indent + `	esac
+` + indent + `fi
+` + indent + `if [[ -n $kind ]]; then
+` + indent + `	compadd -- ${(f)"$(orchid __complete ${=kind} 2>/dev/null)"}
+` + indent + `fi
+`
+}
+
+/*
+Get the completion script for zsh
+*/
+func zshCompletion() string {
+	return "_orchid() {\n" + zshCompletionBody("\t") + "}\n\ncompdef _orchid orchid\n"
+}
+
+/*
+Get the completion file for zsh, kept in the zsh-completion directory for
+installing into the fpath
+*/
+func zshCompletionFile() string {
+	return "#compdef orchid\n\n" + zshCompletionBody("")
+}
+
+/*
+Get the completion script for fish
+*/
+func fishCompletion() string {
+	return `function __orchid_complete
+	set -l words (commandline -opc)
+	set -l kind
+	if test (count $words) -eq 1
+		set kind commands
+	else
+		switch "$words[2]:"(count $words)
+` + fishCases() + `		end
+	end
+	if test -n "$kind"
+		orchid __complete $kind 2>/dev/null
+	end
+end
+
+complete -c orchid -f -a '(__orchid_complete)'
+`
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+/*
+Test that the zsh completion file is the one generated from the commands, so
+it is updated along with them
+*/
+func TestZshCompletionFile(t *testing.T) {
+	data, err := ioutil.ReadFile("../zsh-completion/_orchid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != zshCompletionFile() {
+		t.Errorf("zsh-completion/_orchid is outdated, expected:\n%s", zshCompletionFile())
+	}
+}
+
+/*
+Test that each command of the command line is completed, and only commands
+taking ids complete them
+*/
+func TestCompletionCases(t *testing.T) {
+	patterns := map[string]string{}
+	for _, c := range completionCases() {
+		for _, pattern := range c.Patterns {
+			if _, found := patterns[pattern]; found {
+				t.Errorf("the pattern %s is in more than one case", pattern)
+			}
+			patterns[pattern] = c.Kinds
+		}
+	}
+
+	expected := map[string]string{
+		"run:*":  "jobs",
+		"test:2": "actions",
+		"test:3": "machines",
+		"copy:3": "groups",
+		"logs:*": "jobs logs",
+	}
+	for pattern, kinds := range expected {
+		if patterns[pattern] != kinds {
+			t.Errorf("got kinds %q for %s, expected %q", patterns[pattern], pattern, kinds)
+		}
+	}
+	for pattern := range patterns {
+		if strings.HasPrefix(pattern, "ping:") {
+			t.Errorf("ping takes no arguments, but %s is completed", pattern)
+		}
+	}
+
+	for _, script := range []string{bashCompletion(), zshCompletion(), fishCompletion()} {
+		if !strings.Contains(script, "test:3") {
+			t.Errorf("the cases are missing from the script:\n%s", script)
+		}
+	}
+}
+
+/*
+Test that the shell completes the commands of the command line that can be run
+in it, and its own commands
+*/
+func TestShellCommands(t *testing.T) {
+	names := map[string]bool{}
+	for _, name := range shellCommands() {
+		names[name] = true
+	}
+	for _, name := range []string{"run", "prune-keys", "reload", "exit"} {
+		if !names[name] {
+			t.Errorf("the shell does not complete %s", name)
+		}
+	}
+	if names["shell"] || names["completion"] {
+		t.Error("the shell completes starting a shell or completion")
+	}
+}
@@ -0,0 +1,124 @@
+/*
+Sharing ssh connections to machines between commands using ssh's ControlMaster,
+e.g. for the interactive shell or executing commands on many machines, where
+connecting anew for each command adds up
+*/
+
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+Get the directory holding the control sockets of the shared connections. The
+paths of unix sockets are limited to about 100 bytes, so the sockets are kept
+in a short directory of the user in the temporary directory, rather than in
+the orchid directory
+*/
+func socketDir() string {
+	return filepath.Join(os.TempDir(), "orchid-"+strconv.Itoa(os.Getuid()))
+}
+
+/*
+Get the path of the control socket of the shared connection to the machine.
+Sockets are named by a hash of the orchid directory and the machine, so a
+connection is only shared by commands accessing the same machine of the same
+setup, and the path stays short however long the id of the machine is
+*/
+func controlPath(path, machineId string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	sum := sha1.Sum([]byte(path + "\x00" + machineId))
+	return socketDir() + "/" + hex.EncodeToString(sum[:])[:20]
+}
+
+/*
+Get the ssh options sharing the connection to the machine, if the
+ConnectionPersist setting is given. The first command accessing the machine
+opens the connection, which is closed once idle for ConnectionPersist
+*/
+func connectionOptions(path string, machine Machine) string {
+	settings, err := loadSettings(path)
+	if err != nil || settings.ConnectionPersist == "" {
+		return ""
+	}
+	persist, err := parseDuration(settings.ConnectionPersist)
+	if err != nil || persist <= 0 {
+		return ""
+	}
+	if os.MkdirAll(socketDir(), 0700) != nil {
+		return ""
+	}
+
+	return fmt.Sprintf(
+		" -o ControlMaster=auto -o ControlPath=%s -o ControlPersist=%d",
+		controlPath(path, machine.Id),
+		int(persist/time.Second),
+	)
+}
+
+/*
+Print the machines with an open shared connection, along with how long each
+has been open, followed by the number of open connections, the number of
+sockets of dead connections removed, and how long idle connections are kept.
+If closeAll is given, the connections are closed instead
+*/
+func (a *Actions) Connections(closeAll bool) error {
+	setup, err := a.loadSetup()
+	if err != nil {
+		return err
+	}
+	settings, err := loadSettings(a.path)
+	if err != nil {
+		return err
+	}
+
+	open, stale := 0, 0
+	for _, machine := range setup.Machines {
+		socket := controlPath(a.path, machine.Id)
+		info, err := os.Stat(socket)
+		if err != nil {
+			continue
+		}
+
+		// The socket is left behind if the connection died
+		check := exec.Command("ssh", "-O", "check", "-o", "ControlPath="+socket, sshDestination(machine))
+		if check.Run() != nil {
+			os.Remove(socket)
+			stale++
+			continue
+		}
+		open++
+
+		if !closeAll {
+			fmt.Println(machine.Id + "\tconnected for " + time.Since(info.ModTime()).Round(time.Second).String())
+			continue
+		}
+		exit := exec.Command("ssh", "-O", "exit", "-o", "ControlPath="+socket, sshDestination(machine))
+		if output, err := exit.CombinedOutput(); err != nil {
+			fmt.Println("ERROR: Failed to close the connection to " + machine.Id + ": " + string(output))
+			continue
+		}
+		fmt.Println("Closed the connection to " + machine.Id)
+	}
+	stats := []string{fmt.Sprintf("%d open connections", open)}
+	if stale > 0 {
+		stats = append(stats, fmt.Sprintf("%d sockets of dead connections removed", stale))
+	}
+	if settings.ConnectionPersist != "" {
+		stats = append(stats, "idle connections are closed after "+settings.ConnectionPersist)
+	}
+	fmt.Println(strings.Join(stats, ", "))
+
+	return nil
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+/*
+Test that control sockets have short paths, whatever the orchid directory and
+the id of the machine, and differ between machines and orchid directories
+*/
+func TestControlPath(t *testing.T) {
+	long := "/srv/" + strings.Repeat("orchid/", 20)
+	machine := strings.Repeat("database-replica-", 10)
+
+	paths := map[string]bool{}
+	for _, socket := range []string{
+		controlPath(long, machine),
+		controlPath(long, "web1"),
+		controlPath("/srv/orchid", machine),
+	} {
+		if !strings.HasPrefix(socket, socketDir()+"/") {
+			t.Errorf("got socket %s, expected it in %s", socket, socketDir())
+		}
+		if len(socket) > len(socketDir())+21 {
+			t.Errorf("got socket %s, expected a short name", socket)
+		}
+		paths[socket] = true
+	}
+	if len(paths) != 3 {
+		t.Errorf("expected the sockets of different machines and orchid directories to differ, got %v", paths)
+	}
+	if controlPath(long, "web1") != controlPath(long, "web1") {
+		t.Error("expected the same socket for the same machine")
+	}
+}
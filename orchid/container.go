@@ -0,0 +1,81 @@
+/*
+Running steps inside a container on their machine using docker, e.g. for
+tooling not installed on every machine
+*/
+
+package main
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+)
+
+/*
+Valid names of environment variables of the machine passed into containers
+*/
+var containerEnvName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+/*
+Quote the argument for the shell on the machine, and again for the local shell,
+as the command is itself quoted in the ssh command line
+*/
+func remoteArg(s string) string {
+	return strings.Replace(shellQuote(s), "'", `'\''`, -1)
+}
+
+/*
+Wrap the interpreter running the step in a container of the image of the step,
+removed once the step is done. The script is piped to the interpreter in the
+container through the stdin of docker. The environment of the step is given to
+the container, along with the variables of the machine named by ContainerEnv,
+and the volumes of ContainerVolumes are mounted. Fails with exit code 127 if
+docker is not available on the machine
+*/
+func containerCommand(executable Executable, env []string, interpreter []string) []string {
+	command := []string{
+		`command -v docker >/dev/null 2>&1 || { echo "docker is not available on the machine" >&2 ; exit 127 ; } &&`,
+		"docker", "run", "--rm", "-i",
+	}
+	for _, pair := range env {
+		command = append(command, "-e", pair)
+	}
+	for _, name := range executable.ContainerEnv {
+		command = append(command, "-e", name)
+	}
+	for _, volume := range executable.ContainerVolumes {
+		command = append(command, "-v", remoteArg(volume))
+	}
+	command = append(command, remoteArg(executable.Container))
+	return append(command, interpreter...)
+}
+
+/*
+Validate the container settings of the step
+*/
+func validateContainer(executable Executable) error {
+	if executable.Container == "" {
+		if len(executable.ContainerEnv) > 0 || len(executable.ContainerVolumes) > 0 {
+			return errors.New("ContainerEnv and ContainerVolumes require a Container")
+		}
+		return nil
+	}
+
+	if executable.Machine == "local" {
+		return errors.New("Containers are only supported for steps on remote machines")
+	}
+	if executable.Shell == "login" {
+		return errors.New("Steps in containers can not use the login shell of the machine")
+	}
+	for _, name := range executable.ContainerEnv {
+		if !containerEnvName.MatchString(name) {
+			return errors.New("Invalid name '" + name + "' in ContainerEnv")
+		}
+	}
+	for _, volume := range executable.ContainerVolumes {
+		if !strings.Contains(volume, ":") {
+			return errors.New("Invalid volume '" + volume + "', expected <machine path>:<container path>")
+		}
+	}
+	return nil
+}
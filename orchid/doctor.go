@@ -0,0 +1,167 @@
+/*
+Diagnosing the environment orchid runs in, pointing out what is missing or
+misconfigured along with how to fix it
+*/
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+)
+
+/*
+Type defining the outcome of a single check of the environment. The hint tells
+how to fix a failed check. Failing optional checks only warns
+*/
+type doctorCheck struct {
+	Name     string
+	Passed   bool
+	Optional bool
+	Hint     string
+}
+
+/*
+Check the external binaries orchid relies on. Binaries only needed by some
+features are only required if the setup uses them
+*/
+func checkBinaries(setup Setup) []doctorCheck {
+	passwords := false
+	for _, machine := range setup.Machines {
+		passwords = passwords || machine.PasswordEnv != ""
+	}
+
+	binaries := []struct {
+		name     string
+		required bool
+		hint     string
+	}{
+		{"bash", true, "Install bash"},
+		{"ssh", true, "Install the OpenSSH client, e.g. the openssh-client package"},
+		{"scp", true, "Install the OpenSSH client, e.g. the openssh-client package"},
+		{"ssh-keyscan", false, "Install the OpenSSH client, needed by orchid verify"},
+		{"ssh-keygen", false, "Install the OpenSSH client, needed by orchid verify"},
+		{"sshfs", false, "Install sshfs, needed by orchid mount"},
+		{"fusermount", false, "Install fuse, needed for unmounting directories mounted by orchid mount"},
+		{"sshpass", passwords, "Install sshpass, needed by machines using PasswordEnv"},
+	}
+
+	checks := []doctorCheck{}
+	for _, binary := range binaries {
+		_, err := exec.LookPath(binary.name)
+		checks = append(checks, doctorCheck{
+			Name:     "Binary " + binary.name + " is installed",
+			Passed:   err == nil,
+			Optional: !binary.required,
+			Hint:     binary.hint,
+		})
+	}
+	return checks
+}
+
+/*
+Check the structure of the orchid directory and that orchid can write to it
+*/
+func checkDirectory(path string) []doctorCheck {
+	checks := []doctorCheck{}
+
+	info, err := os.Stat(path)
+	checks = append(checks, doctorCheck{
+		Name:   "Orchid directory " + path + " exists",
+		Passed: err == nil && info.IsDir(),
+		Hint:   "Create the directory, or pass its path using -p",
+	})
+	if err != nil {
+		return checks
+	}
+
+	for _, file := range []string{"machines.json", "jobs.json"} {
+		_, err := os.Stat(path + "/" + file)
+		checks = append(checks, doctorCheck{
+			Name:   "Configuration file " + file + " exists",
+			Passed: err == nil,
+			Hint:   "Create " + path + "/" + file + ", e.g. holding an empty list []",
+		})
+	}
+
+	dirs := []string{path + "/scripts", path + "/logs"}
+	// Invalid settings fail the check of the setup instead
+	if keyDirectory, err := keyDir(path); err == nil {
+		dirs = []string{path + "/scripts", keyDirectory, path + "/logs"}
+	}
+	for _, dir := range dirs {
+		info, err := os.Stat(dir)
+		checks = append(checks, doctorCheck{
+			Name:   "Directory " + dir + " exists",
+			Passed: err == nil && info.IsDir(),
+			Hint:   "Create it using mkdir -p " + dir,
+		})
+	}
+
+	// Logs and state files are written to the directory
+	file, err := ioutil.TempFile(path, ".doctor-*")
+	if err == nil {
+		file.Close()
+		os.Remove(file.Name())
+	}
+	checks = append(checks, doctorCheck{
+		Name:   "Orchid directory is writable",
+		Passed: err == nil,
+		Hint:   "Give the user running orchid write access to " + path,
+	})
+
+	return checks
+}
+
+/*
+Check that the keys can only be read by their owner, as ssh refuses to use keys
+readable by others
+*/
+func checkKeyPermissions(path string) []doctorCheck {
+	checks := []doctorCheck{}
+
+	keyDirectory, err := keyDir(path)
+	if err != nil {
+		return checks
+	}
+	keys, err := loadDir(keyDirectory)
+	if err != nil {
+		return checks
+	}
+	for _, key := range keys {
+		info, err := os.Stat(key)
+		if err != nil {
+			continue
+		}
+		checks = append(checks, doctorCheck{
+			Name:   "Key " + key + " is only readable by its owner",
+			Passed: info.Mode().Perm()&0077 == 0,
+			Hint:   "Restrict its permissions using chmod 600 " + key,
+		})
+	}
+	return checks
+}
+
+/*
+Print the checks as a checklist. Returns the number of failed checks, not
+counting optional ones
+*/
+func printChecks(checks []doctorCheck) int {
+	failed := 0
+	for _, check := range checks {
+		switch {
+		case check.Passed:
+			fmt.Println("[ OK ] " + check.Name)
+			continue
+		case check.Optional:
+			fmt.Println("[WARN] " + check.Name)
+		default:
+			fmt.Println("[FAIL] " + check.Name)
+			failed++
+		}
+		fmt.Println("       " + check.Hint)
+	}
+	return failed
+}
@@ -0,0 +1,214 @@
+/*
+Editing the configuration files of the setup, validating them before saving
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+/*
+Open the configuration file with the given name, e.g. "jobs", in the editor of
+the user. Once the editor exits, the changes are validated along with the rest
+of the setup, and only saved if valid. The previous version is kept as a backup
+*/
+func (a *Actions) Edit(name string) (err error) {
+	defer func() {
+		a.audit("edit", name, auditResult(err))
+	}()
+
+	empty, found := editableFiles[name]
+	if !found {
+		return errors.New("Unknown file '" + name + "'. Must be machines, jobs, actions, groups, scripts, or settings")
+	}
+	err = a.requireTerminal("Editing in the editor", "")
+	if err != nil {
+		return err
+	}
+
+	file := a.path + "/" + name + ".json"
+	original, err := ioutil.ReadFile(file)
+	exists := err == nil
+	if os.IsNotExist(err) {
+		original = []byte(empty)
+	} else if err != nil {
+		return err
+	}
+
+	// Edit a copy, leaving the file untouched until the changes are valid
+	temp, err := ioutil.TempFile("", "orchid-"+name+"-*.json")
+	if err != nil {
+		return err
+	}
+	_, err = temp.Write(original)
+	temp.Close()
+	if err != nil {
+		os.Remove(temp.Name())
+		return err
+	}
+
+	for {
+		err = runEditor(temp.Name())
+		if err != nil {
+			os.Remove(temp.Name())
+			return err
+		}
+
+		var edited []byte
+		edited, err = ioutil.ReadFile(temp.Name())
+		if err != nil {
+			os.Remove(temp.Name())
+			return err
+		}
+		if bytes.Equal(edited, original) {
+			os.Remove(temp.Name())
+			fmt.Println("No changes made")
+			return nil
+		}
+
+		err = a.saveEdit(name, edited, original, exists)
+		if err == nil {
+			os.Remove(temp.Name())
+			if exists {
+				fmt.Printf("Saved %s.json. The previous version is kept in %s.json.bak\n", name, name)
+			} else {
+				fmt.Printf("Saved %s.json\n", name)
+			}
+			return nil
+		}
+
+		fmt.Println("ERROR: " + err.Error())
+		if !askYesNo("Edit again?") {
+			fmt.Println("The changes were not saved. They are kept in " + temp.Name())
+			return errors.New("The changes to " + name + ".json are invalid")
+		}
+	}
+}
+
+/*
+The configuration files that can be edited, along with their content if they do
+not exist yet
+*/
+var editableFiles = map[string]string{
+	"machines": "[]\n",
+	"jobs":     "[]\n",
+	"actions":  "[]\n",
+	"groups":   "[]\n",
+	"scripts":  "[]\n",
+	"settings": "{}\n",
+}
+
+/*
+Save the edited configuration file if valid. The file is decoded strictly,
+catching misspelled fields, after which the setup is loaded with the file in
+place. If invalid, the original file is restored
+*/
+func (a *Actions) saveEdit(name string, edited, original []byte, exists bool) error {
+	err := decodeStrict(name, edited)
+	if err != nil {
+		return errors.New("Invalid " + name + ".json: " + err.Error())
+	}
+
+	file := a.path + "/" + name + ".json"
+	if exists {
+		err = ioutil.WriteFile(file+".bak", original, 0644)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = ioutil.WriteFile(file, edited, 0644)
+	if err != nil {
+		return err
+	}
+
+	_, err = loadSetup(a.path)
+	if err != nil {
+		if exists {
+			ioutil.WriteFile(file, original, 0644)
+		} else {
+			os.Remove(file)
+		}
+		return err
+	}
+	return nil
+}
+
+/*
+Decode the content of the configuration file with the given name, failing on
+fields unknown to orchid
+*/
+func decodeStrict(name string, data []byte) error {
+	var target interface{}
+	switch name {
+	case "machines":
+		target = &[]Machine{}
+	case "jobs":
+		target = &[]Job{}
+	case "actions":
+		target = &[]Action{}
+	case "groups":
+		target = &[]Group{}
+	case "scripts":
+		target = &[]Script{}
+	case "settings":
+		target = &Settings{}
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(target)
+}
+
+/*
+Open the file in the editor of the user, given by $VISUAL or $EDITOR, falling
+back to vi
+*/
+func runEditor(file string) error {
+	editor := os.Getenv("VISUAL")
+	if editor == "" {
+		editor = os.Getenv("EDITOR")
+	}
+	if editor == "" {
+		editor = "vi"
+	}
+
+	// The editor may include arguments, e.g. "code --wait"
+	cmd := exec.Command("/bin/bash", "-c", editor+` "$0"`, file)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+/*
+Ask the user a yes/no question, defaulting to no
+*/
+func askYesNo(question string) bool {
+	fmt.Print(question + " [y/N] ")
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+/*
+Ask the user to confirm running the action or job marked Confirm by typing its
+id, e.g. to avoid running a dangerous action against production by mistake
+*/
+func confirmId(kind, id string) error {
+	fmt.Print("The " + kind + " " + id + " requires confirmation. Type the " + kind + " id to confirm: ")
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	if strings.TrimSpace(answer) != id {
+		return ErrNotConfirmed
+	}
+	return nil
+}
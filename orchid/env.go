@@ -0,0 +1,141 @@
+/*
+Environment variables given to the steps of jobs, merged from the settings, the
+job, and the step, and environment variables referenced in the setup
+*/
+
+package main
+
+import (
+	"errors"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+/*
+Valid names of environment variables
+*/
+var envName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+/*
+Validate the names of the environment variables
+*/
+func validateEnv(env map[string]string) error {
+	for name := range env {
+		if !envName.MatchString(name) {
+			return errors.New("Invalid environment variable name '" + name + "'")
+		}
+	}
+	return nil
+}
+
+/*
+Merge the environment variables of the levels, later levels overriding earlier
+ones, e.g. the settings, then the job, then the step
+*/
+func mergeEnv(levels ...map[string]string) map[string]string {
+	merged := map[string]string{}
+	for _, env := range levels {
+		for name, value := range env {
+			merged[name] = value
+		}
+	}
+	return merged
+}
+
+/*
+Get the environment variables as NAME=value pairs, sorted by name
+*/
+func envList(env map[string]string) []string {
+	list := []string{}
+	for name, value := range env {
+		list = append(list, name+"="+value)
+	}
+	sort.Strings(list)
+	return list
+}
+
+/*
+Get the environment variables as arguments of env in the command run on a
+remote machine. The values are quoted for the shell on the machine, and again
+for the local shell, as the command is itself quoted in the ssh command line
+*/
+func remoteEnvArgs(env map[string]string) []string {
+	quote := func(s string) string {
+		return strings.Replace(s, "'", `'\''`, -1)
+	}
+
+	args := []string{}
+	for _, pair := range envList(env) {
+		parts := strings.SplitN(pair, "=", 2)
+		args = append(args, quote(parts[0]+"='"+quote(parts[1])+"'"))
+	}
+	return args
+}
+
+/*
+References to environment variables in the setup, e.g. ${DEPLOY_HOST}. Only the
+braced form is expanded, so commands keep using $NAME for variables of the
+machine they run on
+*/
+var envReference = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+/*
+Expand the environment variables referenced in the string. If strict is given,
+referencing a variable that is not set is an error, otherwise it expands to
+nothing
+*/
+func expandEnvReferences(s string, strict bool) (string, error) {
+	var missing error
+	expanded := envReference.ReplaceAllStringFunc(s, func(reference string) string {
+		name := envReference.FindStringSubmatch(reference)[1]
+		value, found := os.LookupEnv(name)
+		if !found && strict && missing == nil {
+			missing = errors.New("The environment variable " + name + " is not set")
+		}
+		return value
+	})
+	return expanded, missing
+}
+
+/*
+Expand the environment variables referenced in the setup, in the connection
+details of machines, the commands and arguments of steps, and the commands of
+actions. The setup is changed in place
+*/
+func expandSetupEnv(machines []Machine, jobs []Job, actions []Action, strict bool) error {
+	var err error
+	expand := func(s *string, entity string) {
+		if err != nil {
+			return
+		}
+		var expandErr error
+		*s, expandErr = expandEnvReferences(*s, strict)
+		if expandErr != nil {
+			err = errors.New("Setup invalid: " + entity + ": " + expandErr.Error())
+		}
+	}
+
+	for i := range machines {
+		machine := &machines[i]
+		entity := "Machine '" + machine.Id + "'"
+		for _, field := range []*string{&machine.Address, &machine.Port, &machine.User, &machine.PrivateKey, &machine.KeyProvider, &machine.Host, &machine.SSHConfig} {
+			expand(field, entity)
+		}
+	}
+	for i := range jobs {
+		entity := "Job '" + jobs[i].Id + "'"
+		for j := range jobs[i].Pipeline {
+			step := &jobs[i].Pipeline[j]
+			expand(&step.Command, entity)
+			for k := range step.Args {
+				expand(&step.Args[k], entity)
+			}
+		}
+	}
+	for i := range actions {
+		expand(&actions[i].Command, "Action '"+actions[i].Id+"'")
+	}
+	return err
+}
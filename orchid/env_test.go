@@ -0,0 +1,38 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+/*
+Test that the step overrides the job, which overrides the settings, and that
+levels without environment variables are skipped
+*/
+func TestMergeEnv(t *testing.T) {
+	settings := map[string]string{"STAGE": "settings", "REGION": "eu"}
+	job := map[string]string{"STAGE": "job", "APP": "web"}
+	step := map[string]string{"STAGE": "step"}
+
+	tests := []struct {
+		name     string
+		levels   []map[string]string
+		expected map[string]string
+	}{
+		{"all levels", []map[string]string{settings, job, step}, map[string]string{"STAGE": "step", "REGION": "eu", "APP": "web"}},
+		{"without step", []map[string]string{settings, job, nil}, map[string]string{"STAGE": "job", "REGION": "eu", "APP": "web"}},
+		{"without job", []map[string]string{settings, nil, step}, map[string]string{"STAGE": "step", "REGION": "eu"}},
+		{"without settings", []map[string]string{nil, job, step}, map[string]string{"STAGE": "step", "APP": "web"}},
+		{"none", []map[string]string{nil, nil, nil}, map[string]string{}},
+	}
+
+	for _, test := range tests {
+		if merged := mergeEnv(test.levels...); !reflect.DeepEqual(merged, test.expected) {
+			t.Errorf("%s: got %v, expected %v", test.name, merged, test.expected)
+		}
+	}
+
+	if settings["STAGE"] != "settings" || job["STAGE"] != "job" {
+		t.Error("merging changed the environment variables of the levels")
+	}
+}
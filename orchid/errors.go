@@ -0,0 +1,67 @@
+/*
+Errors returned by the actions, allowing callers to tell the kinds of failures
+apart using errors.Is and errors.As rather than by their messages
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+)
+
+var (
+	ErrMachineNotFound = errors.New("No machine with the given id was found")
+	ErrJobNotFound     = errors.New("No job with the given id was found")
+	ErrActionNotFound  = errors.New("No action with the given id was found")
+	ErrGroupNotFound   = errors.New("No group with the given id was found")
+	ErrLogNotFound     = errors.New("Log not found")
+
+	// The user did not confirm running an action or job marked Confirm
+	ErrNotConfirmed = errors.New("Not confirmed")
+
+	// ssh could not connect to the machine, e.g. as the connection was
+	// refused or timed out
+	ErrConnection = errors.New("Could not connect to the machine")
+)
+
+/*
+Type defining the error of a command exiting with a non-zero exit code on a
+remote machine. It wraps the error of the command
+*/
+type ErrRemoteExit struct {
+	Machine string
+	Code    int
+	Err     error
+}
+
+/*
+Get the message of the error
+*/
+func (e *ErrRemoteExit) Error() string {
+	return fmt.Sprintf("exit status %d on machine %s", e.Code, e.Machine)
+}
+
+/*
+Get the error of the command, e.g. an *exec.ExitError
+*/
+func (e *ErrRemoteExit) Unwrap() error {
+	return e.Err
+}
+
+/*
+Classify the error of running a command on the machine through ssh. ssh exits
+with 255 when it fails to connect, while other exit codes are those of the
+command
+*/
+func remoteError(machineId string, err error) error {
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok {
+		return err
+	}
+	if exitErr.ExitCode() == 255 {
+		return fmt.Errorf("%w %s: %s", ErrConnection, machineId, err.Error())
+	}
+	return &ErrRemoteExit{Machine: machineId, Code: exitErr.ExitCode(), Err: err}
+}
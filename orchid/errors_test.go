@@ -0,0 +1,44 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+/*
+Test that copying from or to unknown machines fails with ErrMachineNotFound,
+naming the machine
+*/
+func TestSCPMachineNotFound(t *testing.T) {
+	a := &Actions{path: t.TempDir(), setup: &Setup{}}
+	tests := [][2]string{
+		{"web9:/etc/hosts", "hosts"},
+		{"hosts", "web9:/tmp/hosts"},
+		{"web9:/etc/hosts", "web8:/tmp/hosts"},
+	}
+	for _, test := range tests {
+		err := a.SCP(test[0], test[1], false, true)
+		if !errors.Is(err, ErrMachineNotFound) {
+			t.Errorf("%s to %s: got %v, expected ErrMachineNotFound", test[0], test[1], err)
+		}
+	}
+}
+
+/*
+Test that running on unknown machines fails with ErrMachineNotFound
+*/
+func TestRemapMachineNotFound(t *testing.T) {
+	job := Job{Id: "deploy", Pipeline: []Executable{{Machine: "web1"}}}
+	setup := Setup{Machines: []Machine{{Id: "web1"}}}
+
+	options := []RunOptions{
+		{MachineMap: map[string]string{"web9": "web1"}},
+		{MachineMap: map[string]string{"web1": "web9"}},
+		{OnlyMachines: []string{"web9"}},
+	}
+	for _, option := range options {
+		if _, err := remapMachines(job, setup, option); !errors.Is(err, ErrMachineNotFound) {
+			t.Errorf("%+v: got %v, expected ErrMachineNotFound", option, err)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+/*
+Gathering facts about machines, e.g. their OS and architecture, allowing jobs to
+branch on them
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+Script printing the facts of a machine as key=value lines. Only POSIX tools are
+used, as nothing is known about the machine yet
+*/
+const factScript = `echo "os=$(uname -s)"
+echo "arch=$(uname -m)"
+echo "kernel=$(uname -r)"
+echo "hostname=$(hostname)"
+if [ -r /etc/os-release ]; then echo "distribution=$(. /etc/os-release && echo "$ID")"; fi
+echo "free_disk_kb=$(df -Pk / | awk 'NR == 2 { print $4 }')"
+`
+
+/*
+Type defining the facts gathered about a machine
+*/
+type Facts struct {
+	MachineId    string
+	OS           string
+	Arch         string
+	Kernel       string
+	Hostname     string
+	Distribution string
+	FreeDiskKB   int64
+	GatheredAt   time.Time
+}
+
+/*
+Get the file holding the facts of the machine
+*/
+func factsFile(path, machineId string) string {
+	return path + "/facts/" + machineId + ".json"
+}
+
+/*
+Parse the output of the fact script
+*/
+func parseFacts(machineId, output string) (Facts, error) {
+	facts := Facts{MachineId: machineId, GatheredAt: time.Now()}
+	for _, line := range strings.Split(output, "\n") {
+		parts := strings.SplitN(strings.TrimSpace(line), "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		switch parts[0] {
+		case "os":
+			facts.OS = parts[1]
+		case "arch":
+			facts.Arch = parts[1]
+		case "kernel":
+			facts.Kernel = parts[1]
+		case "hostname":
+			facts.Hostname = parts[1]
+		case "distribution":
+			facts.Distribution = parts[1]
+		case "free_disk_kb":
+			facts.FreeDiskKB, _ = strconv.ParseInt(parts[1], 10, 64)
+		}
+	}
+
+	if facts.OS == "" {
+		return facts, errors.New("The machine did not report its facts")
+	}
+	return facts, nil
+}
+
+/*
+Gather the facts of the machine by running the fact script on it over SSH
+*/
+func gatherFacts(path string, machine Machine) (Facts, error) {
+	sshCommand := fmt.Sprintf(
+		"ssh -T %s %s 'sh -s'",
+		sshOptions(path, machine, "-p"),
+		sshDestination(machine),
+	)
+	cmd, err := machineCommand(machine, sshCommand)
+	if err != nil {
+		return Facts{}, err
+	}
+
+	output := bytes.Buffer{}
+	errOutput := bytes.Buffer{}
+	cmd.Stdin = strings.NewReader(factScript)
+	cmd.Stdout = &output
+	cmd.Stderr = &errOutput
+	err = cmd.Run()
+	if err != nil {
+		return Facts{}, errors.New("Could not gather the facts: " + err.Error() + " " + strings.TrimSpace(errOutput.String()))
+	}
+
+	return parseFacts(machine.Id, output.String())
+}
+
+/*
+Store the facts of the machine
+*/
+func saveFacts(path string, facts Facts) error {
+	err := os.MkdirAll(path+"/facts", 0755)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(facts, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(factsFile(path, facts.MachineId), data, 0644)
+}
+
+/*
+Load the stored facts of the machine. Returns false if none were gathered
+*/
+func loadFacts(path, machineId string) (Facts, bool, error) {
+	data, err := ioutil.ReadFile(factsFile(path, machineId))
+	if os.IsNotExist(err) {
+		return Facts{}, false, nil
+	}
+	if err != nil {
+		return Facts{}, false, err
+	}
+
+	facts := Facts{}
+	err = json.Unmarshal(data, &facts)
+	if err != nil {
+		return Facts{}, false, err
+	}
+	return facts, true, nil
+}
+
+/*
+Characters allowed in the values of facts passed to steps, keeping them safe to
+put on a command line unquoted
+*/
+var factValue = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
+/*
+Get the environment variables passing the stored facts of the machine to the
+steps run on it, e.g. ORCHID_FACT_OS=Linux
+*/
+func factsEnv(path, machineId string) []string {
+	facts, found, err := loadFacts(path, machineId)
+	if err != nil || !found {
+		return []string{}
+	}
+
+	values := []struct {
+		name  string
+		value string
+	}{
+		{"OS", facts.OS},
+		{"ARCH", facts.Arch},
+		{"KERNEL", facts.Kernel},
+		{"HOSTNAME", facts.Hostname},
+		{"DISTRIBUTION", facts.Distribution},
+		{"FREE_DISK_KB", strconv.FormatInt(facts.FreeDiskKB, 10)},
+	}
+
+	env := []string{}
+	for _, v := range values {
+		env = append(env, "ORCHID_FACT_"+v.name+"="+factValue.ReplaceAllString(v.value, "_"))
+	}
+	return env
+}
@@ -0,0 +1,374 @@
+/*
+Following the output of logs while their jobs run
+*/
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"github.com/hpcloud/tail"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// How long to wait for a log file to appear before giving up
+	logWaitTimeout = 5 * time.Second
+
+	// How often to check whether the job of a followed log is still running
+	logCheckInterval = time.Second
+
+	// How often a log followed by polling is checked for new output
+	logPollInterval = 250 * time.Millisecond
+)
+
+/*
+Follow the output of the log with the given id, passing each line to the given
+function until the log is terminated or its job is no longer running. Poll
+follows the log by polling it rather than using tail, see followLogSteps
+*/
+func followLog(path, logId string, poll bool, handle func(text string)) error {
+	return followLogFrom(path, logId, poll, 0, handle)
+}
+
+/*
+Follow the output of the log with the given id from the given offset in bytes,
+passing each line to the given function until the log is terminated or its job
+is no longer running
+*/
+func followLogFrom(path, logId string, poll bool, offset int64, handle func(text string)) error {
+	return followLogUntil(path, logId, poll, offset, nil, handle)
+}
+
+/*
+Follow the log like followLogFrom, stopping early if the stop channel is
+closed
+*/
+func followLogUntil(path, logId string, poll bool, offset int64, stop <-chan struct{}, handle func(text string)) error {
+	return followLogSteps(path, logId, poll, offset, stop, func(step, text string) {
+		handle(text)
+	})
+}
+
+/*
+Follow the log like followLogUntil, passing each line to the given function
+along with the name of the step writing it. The markers of steps starting are
+not passed on, while output of steps merely looking like a marker is, as it is
+not where the log recorded a step starting. The log is followed using tail,
+notified of changes through inotify, unless poll is given, the PollLogs setting
+is, or the logs are on a filesystem not reliably notifying changes. The log is
+then followed by polling it instead, see pollLines
+*/
+func followLogSteps(path, logId string, poll bool, offset int64, stop <-chan struct{}, handle func(step, text string)) error {
+	// The log file may not exist yet if the job is just starting. Wait
+	// briefly for it to appear before giving up
+	logFile := path + "/logs/" + logId
+	waited := time.Duration(0)
+	for {
+		_, err := os.Stat(logFile)
+		if err == nil {
+			break
+		}
+		if !os.IsNotExist(err) || waited >= logWaitTimeout {
+			return err
+		}
+		time.Sleep(100 * time.Millisecond)
+		waited += 100 * time.Millisecond
+	}
+
+	// Following from an offset continues the step started before it
+	step := ""
+	if log, found, err := findLog(path, logId); err == nil && found {
+		step = log.stepOf(offset)
+	}
+
+	var t logLines
+	var err error
+	if poll || pollLogs(path) {
+		t, err = pollLines(logFile, offset)
+	} else {
+		t, err = tailLines(logFile, offset)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Periodically check whether the job is still running, as the log will
+	// never be terminated if the process running the job died
+	ticker := time.NewTicker(logCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case line, ok := <-t.Lines:
+			if !ok {
+				return nil
+			}
+			if isTerminator(line.Text) {
+				t.Stop()
+				return nil
+			}
+			lineOffset := offset
+			offset += int64(len(line.Text)) + 1
+			if _, isMarker := parseStepMarker(line.Text); isMarker {
+				// The step is only recorded once it started, so the log is
+				// read anew
+				log, found, err := findLog(path, logId)
+				if err == nil && found {
+					if name, started := log.stepAt(line.Text, lineOffset); started {
+						step = name
+						continue
+					}
+				}
+			}
+			handle(step, line.Text)
+		case <-stop:
+			t.Stop()
+			return nil
+		case <-ticker.C:
+			log, found, err := findLog(path, logId)
+			if err == nil && found && !log.running() {
+				// Pass on what remains of the log and stop following it
+				t.StopAtEOF()
+			}
+		}
+	}
+}
+
+/*
+Check whether logs are followed by polling them for changes rather than using
+tail. Polling is used if the PollLogs setting is given, or if the logs are on a
+filesystem not reliably notifying changes, e.g. mounted using sshfs
+*/
+func pollLogs(path string) bool {
+	settings, err := loadSettings(path)
+	if err == nil && settings.PollLogs {
+		return true
+	}
+	return unnotifiedFilesystem(path + "/logs")
+}
+
+/*
+Type defining the lines of a followed log file, whether read using tail or by
+polling the file. StopAtEOF stops once the lines written so far are read
+*/
+type logLines struct {
+	Lines     <-chan *tail.Line
+	Stop      func()
+	StopAtEOF func()
+}
+
+/*
+Follow the log file from the given offset using tail
+*/
+func tailLines(logFile string, offset int64) (logLines, error) {
+	config := tail.Config{Follow: true, MustExist: true}
+	if offset > 0 {
+		config.Location = &tail.SeekInfo{Offset: offset, Whence: io.SeekStart}
+	}
+	t, err := tail.TailFile(logFile, config)
+	if err != nil {
+		return logLines{}, err
+	}
+	return logLines{
+		Lines:     t.Lines,
+		Stop:      func() { t.Stop() },
+		StopAtEOF: func() { t.StopAtEOF() },
+	}, nil
+}
+
+/*
+Follow the log file from the given offset by repeatedly checking its size and
+reading what was appended, for filesystems on which tail misses changes. A file
+truncated or replaced, e.g. rotated, is read again from its start
+*/
+func pollLines(logFile string, offset int64) (logLines, error) {
+	file, err := os.Open(logFile)
+	if err != nil {
+		return logLines{}, err
+	}
+
+	lines := make(chan *tail.Line)
+	stop := make(chan struct{})
+	atEOF := make(chan struct{})
+	var stopOnce, atEOFOnce sync.Once
+
+	go func() {
+		defer close(lines)
+		// The file is replaced when reopened
+		defer func() { file.Close() }()
+
+		send := func(text string) bool {
+			select {
+			case lines <- &tail.Line{Text: text, Time: time.Now()}:
+				return true
+			case <-stop:
+				return false
+			}
+		}
+
+		pending := []byte{}
+		stopping := false
+		for {
+			// Start over on a new or truncated file
+			info, statErr := os.Stat(logFile)
+			if current, err := file.Stat(); statErr == nil && err == nil && (!os.SameFile(info, current) || info.Size() < offset) {
+				if reopened, err := os.Open(logFile); err == nil {
+					file.Close()
+					file, offset, pending = reopened, 0, []byte{}
+					info, _ = reopened.Stat()
+				}
+			}
+
+			read := false
+			if statErr == nil && info.Size() > offset {
+				data := make([]byte, info.Size()-offset)
+				n, _ := file.ReadAt(data, offset)
+				offset += int64(n)
+				pending = append(pending, data[:n]...)
+				read = n > 0
+			}
+			for {
+				newline := bytes.IndexByte(pending, '\n')
+				if newline < 0 {
+					break
+				}
+				if !send(string(pending[:newline])) {
+					return
+				}
+				pending = pending[newline+1:]
+			}
+
+			if stopping && !read {
+				if len(pending) > 0 {
+					send(string(pending))
+				}
+				return
+			}
+			select {
+			case <-stop:
+				return
+			case <-atEOF:
+				stopping = true
+			case <-time.After(logPollInterval):
+			}
+		}
+	}()
+
+	return logLines{
+		Lines:     lines,
+		Stop:      func() { stopOnce.Do(func() { close(stop) }) },
+		StopAtEOF: func() { atEOFOnce.Do(func() { close(atEOF) }) },
+	}, nil
+}
+
+/*
+Create the file the followed output is also written to, e.g. for collecting it
+as a CI artifact. Returns nil if no file is given, or if it is "-" meaning
+stdout, which the output is written to anyway
+*/
+func createOutputFile(output string) (*os.File, error) {
+	if output == "" || output == "-" {
+		return nil, nil
+	}
+	file, err := os.Create(output)
+	if err != nil {
+		return nil, errors.New("Could not create the output file: " + err.Error())
+	}
+	return file, nil
+}
+
+/*
+Get the last n lines of the output of the log with the given id, along with the
+offset in bytes following them, from which the log can be followed. The markers
+of steps starting are left out
+*/
+func tailLog(path, logId string, n int) ([]string, int64, error) {
+	log, _, err := findLog(path, logId)
+	if err != nil {
+		return nil, 0, err
+	}
+	data, err := ioutil.ReadFile(path + "/logs/" + logId)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// A line still being written is left to be followed
+	complete := data[:bytes.LastIndexByte(data, '\n')+1]
+
+	lines := []string{}
+	if len(complete) > 0 {
+		lineOffset := int64(0)
+		for _, line := range strings.Split(strings.TrimSuffix(string(complete), "\n"), "\n") {
+			if _, isMarker := log.stepAt(line, lineOffset); !isMarker && !isTerminator(line) {
+				lines = append(lines, line)
+			}
+			lineOffset += int64(len(line)) + 1
+		}
+	}
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return lines, int64(len(complete)), nil
+}
+
+/*
+Get the most recently started log of the job with the given id. Returns false
+if the job has no logs
+*/
+func latestJobLog(path, jobId string) (Log, bool, error) {
+	logs, err := loadLogs(path)
+	if err != nil {
+		return Log{}, false, err
+	}
+
+	latest, found := Log{}, false
+	for _, log := range logs {
+		if log.JobId == jobId && (!found || log.StartTime.After(latest.StartTime)) {
+			latest, found = log, true
+		}
+	}
+	return latest, found, nil
+}
+
+/*
+Get the logs of the running jobs of the job with the given id, or its latest
+log if none are running
+*/
+func recentJobLogs(path, jobId string) ([]Log, error) {
+	logs, err := loadLogs(path)
+	if err != nil {
+		return []Log{}, err
+	}
+
+	jobLogs := []Log{}
+	for _, log := range logs {
+		if log.JobId == jobId {
+			jobLogs = append(jobLogs, log)
+		}
+	}
+	if len(jobLogs) == 0 {
+		return jobLogs, nil
+	}
+
+	running := []Log{}
+	for _, log := range jobLogs {
+		if log.Status == "Started" && log.running() {
+			running = append(running, log)
+		}
+	}
+	if len(running) > 0 {
+		return running, nil
+	}
+
+	sort.Slice(jobLogs, func(i, j int) bool {
+		return jobLogs[i].StartTime.After(jobLogs[j].StartTime)
+	})
+	return jobLogs[:1], nil
+}
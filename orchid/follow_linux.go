@@ -0,0 +1,38 @@
+/*
+Detecting filesystems on which followed logs are polled for changes on Linux
+*/
+
+package main
+
+import (
+	"syscall"
+)
+
+/*
+Magic numbers of the filesystems on which changes to files are not reliably
+notified through inotify, e.g. as they are made by another host
+*/
+var unnotifiedFilesystems = map[uint32]string{
+	0x6969:     "nfs",
+	0x65735546: "fuse",
+	0x517b:     "smb",
+	0xff534d42: "cifs",
+	0xfe534d42: "smb2",
+	0x01021997: "9p",
+	0x00c36400: "ceph",
+}
+
+/*
+Check whether the directory is on a filesystem not reliably notifying changes
+to its files. The type of the filesystem is a signed or unsigned integer of 32
+or 64 bits depending on the architecture, but always holds a 32 bit magic
+number
+*/
+func unnotifiedFilesystem(dir string) bool {
+	stat := syscall.Statfs_t{}
+	if syscall.Statfs(dir, &stat) != nil {
+		return false
+	}
+	_, unnotified := unnotifiedFilesystems[uint32(stat.Type)]
+	return unnotified
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+// +build !linux
+
+/*
+Detecting filesystems on which followed logs are polled for changes, elsewhere
+than on Linux
+*/
+
+package main
+
+/*
+Check whether the directory is on a filesystem not reliably notifying changes
+to its files. Only detected on Linux, elsewhere logs are polled only if given
+the PollLogs setting or --poll-logs
+*/
+func unnotifiedFilesystem(dir string) bool {
+	return false
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+/*
+Read the given number of lines from the followed log, failing if they do not
+arrive in time
+*/
+func readLines(t *testing.T, lines logLines, n int) []string {
+	t.Helper()
+	texts := []string{}
+	for len(texts) < n {
+		select {
+		case line, ok := <-lines.Lines:
+			if !ok {
+				t.Fatalf("the lines ended after %q", texts)
+			}
+			texts = append(texts, line.Text)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("got %q, expected %d lines", texts, n)
+		}
+	}
+	return texts
+}
+
+/*
+Test following a log by polling it, from an offset, across appends, and across
+the log being replaced
+*/
+func TestPollLines(t *testing.T) {
+	logFile := t.TempDir() + "/log"
+	if err := ioutil.WriteFile(logFile, []byte("skipped\none\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	lines, err := pollLines(logFile, int64(len("skipped\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lines.Stop()
+	if got := readLines(t, lines, 1); !reflect.DeepEqual(got, []string{"one"}) {
+		t.Errorf("got %q, expected the line after the offset", got)
+	}
+
+	file, err := os.OpenFile(logFile, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString("tw")
+	time.Sleep(2 * logPollInterval)
+	file.WriteString("o\nthree\n")
+	file.Close()
+	if got := readLines(t, lines, 2); !reflect.DeepEqual(got, []string{"two", "three"}) {
+		t.Errorf("got %q, expected the appended lines, joined when written in parts", got)
+	}
+
+	replacement := logFile + ".new"
+	if err := ioutil.WriteFile(replacement, []byte("rotated\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(replacement, logFile); err != nil {
+		t.Fatal(err)
+	}
+	if got := readLines(t, lines, 1); !reflect.DeepEqual(got, []string{"rotated"}) {
+		t.Errorf("got %q, expected the replaced log read from its start", got)
+	}
+}
+
+/*
+Test that following a log by polling it stops at its end once asked to,
+passing on a last line without a newline
+*/
+func TestPollLinesStopAtEOF(t *testing.T) {
+	logFile := t.TempDir() + "/log"
+	if err := ioutil.WriteFile(logFile, []byte("one\ntwo"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	lines, err := pollLines(logFile, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines.StopAtEOF()
+	lines.StopAtEOF()
+	if got := readLines(t, lines, 2); !reflect.DeepEqual(got, []string{"one", "two"}) {
+		t.Errorf("got %q, expected both lines", got)
+	}
+	select {
+	case _, ok := <-lines.Lines:
+		if ok {
+			t.Error("got a line past the end of the log")
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("following the log did not stop at its end")
+	}
+}
+
+/*
+Test following the output of a finished log by polling it, leaving out the
+markers of its steps
+*/
+func TestFollowLogPolling(t *testing.T) {
+	path := t.TempDir()
+	job := Job{Id: "polled", Pipeline: []Executable{
+		{Id: "first", Machine: "local", Command: "echo one"},
+		{Id: "second", Machine: "local", Command: "echo two"},
+	}}
+	result, output := runTestJob(t, path, job)
+	if result.Status != "Finished" {
+		t.Fatalf("got status %s, expected Finished:\n%s", result.Status, output)
+	}
+
+	steps, texts := []string{}, []string{}
+	err := followLogSteps(path, result.LogId, true, 0, nil, func(step, text string) {
+		steps = append(steps, step)
+		texts = append(texts, text)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(texts, []string{"one", "two"}) || !reflect.DeepEqual(steps, []string{"first", "second"}) {
+		t.Errorf("got lines %q of steps %q, expected one of first and two of second", texts, steps)
+	}
+}
@@ -0,0 +1,51 @@
+/*
+Formatting the items of listings using a template given by the user, e.g. for
+scripts consuming the listings
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"text/template"
+)
+
+/*
+Parse the template printed for each item of a listing, or nil if none is given.
+The json function encodes a value as JSON, and join joins a list using a
+separator
+*/
+func listFormat(format string) (*template.Template, error) {
+	if format == "" {
+		return nil, nil
+	}
+
+	tmpl, err := template.New("format").Funcs(template.FuncMap{
+		"json": func(value interface{}) (string, error) {
+			data, err := encodeSetup(value, "")
+			return string(data), err
+		},
+		"join": func(list []string, separator string) string {
+			return strings.Join(list, separator)
+		},
+	}).Parse(format)
+	if err != nil {
+		return nil, errors.New("Invalid format: " + err.Error())
+	}
+	return tmpl, nil
+}
+
+/*
+Print the item of a listing using the template, followed by a newline
+*/
+func printFormatted(tmpl *template.Template, item interface{}) error {
+	err := tmpl.Execute(os.Stdout, item)
+	if err != nil {
+		return errors.New("Formatting failed: " + err.Error())
+	}
+	fmt.Println()
+	return nil
+}
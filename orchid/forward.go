@@ -0,0 +1,166 @@
+/*
+Forwarding ports through machines, e.g. for reaching services on a machine that
+are not exposed publicly, or a whole private network through a bastion
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"regexp"
+	"strconv"
+	"syscall"
+)
+
+/*
+Valid specs of local and remote forwards, i.e. [bind address:]port:host:host
+port, with IPv6 addresses bracketed
+*/
+var forwardSpec = regexp.MustCompile(`^(?:([^:\[\]]+|\[[^\]]+\]):)?(\d+):([^:\[\]]+|\[[^\]]+\]):(\d+)$`)
+
+/*
+Valid specs of SOCKS proxies, i.e. [bind address:]port
+*/
+var dynamicForwardSpec = regexp.MustCompile(`^(?:([^:\[\]]+|\[[^\]]+\]):)?(\d+)$`)
+
+/*
+The ssh flags of the forward modes
+*/
+var forwardModeFlags = map[string]string{
+	"local":   "-L",
+	"remote":  "-R",
+	"dynamic": "-D",
+}
+
+/*
+Validate the spec of a forward of the mode
+*/
+func validateForwardSpec(mode, spec string) error {
+	var ports []string
+	if mode == "dynamic" {
+		match := dynamicForwardSpec.FindStringSubmatch(spec)
+		if match == nil {
+			return errors.New("Invalid SOCKS proxy '" + spec + "', expected [bind address:]port")
+		}
+		ports = []string{match[2]}
+	} else {
+		match := forwardSpec.FindStringSubmatch(spec)
+		if match == nil {
+			return errors.New("Invalid forward '" + spec + "', expected [bind address:]port:host:host port")
+		}
+		ports = []string{match[2], match[4]}
+	}
+
+	for _, port := range ports {
+		n, err := strconv.Atoi(port)
+		if err != nil || n < 1 || n > 65535 {
+			return errors.New("Invalid port " + port + " in forward '" + spec + "'")
+		}
+	}
+	return nil
+}
+
+/*
+Get the description of a forward of the mode, as printed once forwarding
+*/
+func describeForward(mode, spec, machineId string) string {
+	switch mode {
+	case "remote":
+		return "Forwarding " + spec + " from " + machineId + " to this machine"
+	case "dynamic":
+		return "SOCKS proxy on " + spec + " through " + machineId
+	}
+	return "Forwarding " + spec + " through " + machineId
+}
+
+/*
+Forward ports through the machine, given as specs of ssh. The mode "local"
+forwards local ports to hosts and ports as seen from the machine like ssh -L,
+e.g. 8080:localhost:80 for a service listening on localhost on the machine.
+The mode "remote" forwards ports of the machine to hosts and ports as seen from
+this machine like ssh -R, and "dynamic" runs a local SOCKS proxy connecting
+through the machine like ssh -D, given as [bind address:]port. The forwards
+are kept open until interrupted, with keepalives detecting a dropped
+connection, which fails the forward. Shared connections are not used, as the
+forwards would otherwise be handed to the shared connection and closed only
+along with it
+*/
+func (a *Actions) Forward(machineId, mode string, specs []string) (err error) {
+	defer func() {
+		a.audit("forward", machineId, auditResult(err))
+	}()
+
+	sshFlag, found := forwardModeFlags[mode]
+	if !found {
+		return errors.New("Unknown forward mode '" + mode + "', expected local, remote, or dynamic")
+	}
+	if len(specs) == 0 {
+		return errors.New("No ports to forward given")
+	}
+	forwards := ""
+	for _, spec := range specs {
+		if err := validateForwardSpec(mode, spec); err != nil {
+			return err
+		}
+		forwards += " " + sshFlag + " " + shellQuote(spec)
+	}
+
+	setup, err := a.loadSetup()
+	if err != nil {
+		return err
+	}
+	machine, found := setup.findMachine(machineId)
+	if !found {
+		return ErrMachineNotFound
+	}
+
+	sshCommand := fmt.Sprintf(
+		"ssh -N -o ExitOnForwardFailure=yes -o ControlPath=none -o ServerAliveInterval=15 -o ServerAliveCountMax=3%s %s %s",
+		forwards,
+		sshOptions(a.path, machine, "-p"),
+		sshDestination(machine),
+	)
+	cmd, err := machineCommand(machine, sshCommand)
+	if err != nil {
+		return err
+	}
+
+	for _, spec := range specs {
+		fmt.Println(describeForward(mode, spec, machineId))
+	}
+	fmt.Println("Press Ctrl-C to stop")
+
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	// Stop forwarding when interrupted, rather than exit along with ssh
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	defer signal.Stop(signals)
+	err = cmd.Start()
+	if err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	select {
+	case err = <-done:
+		// ssh only exits on its own if it could not forward, or once the
+		// connection dropped
+		if err != nil {
+			return errors.New("Forwarding through " + machineId + " stopped, as the connection failed or dropped: " + err.Error())
+		}
+		return errors.New("Forwarding through " + machineId + " stopped, as the connection was closed")
+	case <-signals:
+		cmd.Process.Signal(syscall.SIGTERM)
+		<-done
+		fmt.Println("Stopped forwarding through " + machineId)
+		return nil
+	}
+}
@@ -0,0 +1,75 @@
+/*
+Rendering the pipeline of a job as a diagram, e.g. for documentation or for
+reviewing changes to a job
+*/
+
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+/*
+Render the pipeline of the job as a Graphviz DOT graph. The steps run in order,
+so each step has an edge from the step before it
+*/
+func dotGraph(job Job) string {
+	escape := func(s string) string {
+		return strings.Replace(strings.Replace(s, `\`, `\\`, -1), `"`, `\"`, -1)
+	}
+	quote := func(s string) string {
+		return `"` + escape(s) + `"`
+	}
+
+	graph := strings.Builder{}
+	graph.WriteString("digraph " + quote(job.Id) + " {\n")
+	graph.WriteString("\trankdir=LR;\n")
+	graph.WriteString("\tnode [shape=box];\n")
+	for i, executable := range job.Pipeline {
+		// Nodes are labelled with the name of the step and its machine
+		name := stepName(executable, i)
+		graph.WriteString("\t" + quote(name) + " [label=\"" + escape(name) + `\n` + escape(stepMachine(executable)) + "\"];\n")
+		if i > 0 {
+			graph.WriteString("\t" + quote(stepName(job.Pipeline[i-1], i-1)) + " -> " + quote(name) + ";\n")
+		}
+	}
+	graph.WriteString("}\n")
+	return graph.String()
+}
+
+/*
+Render the pipeline of the job as a Mermaid flowchart. Nodes are named after
+the position of their step, as step names may contain characters Mermaid does
+not allow in node ids
+*/
+func mermaidGraph(job Job) string {
+	quote := func(s string) string {
+		return `"` + strings.Replace(s, `"`, "#quot;", -1) + `"`
+	}
+
+	graph := strings.Builder{}
+	graph.WriteString("flowchart LR\n")
+	for i, executable := range job.Pipeline {
+		node := "step" + strconv.Itoa(i+1)
+		graph.WriteString("\t" + node + "[" + quote(stepName(executable, i)+"<br/>"+stepMachine(executable)) + "]\n")
+		if i > 0 {
+			graph.WriteString("\tstep" + strconv.Itoa(i) + " --> " + node + "\n")
+		}
+	}
+	return graph.String()
+}
+
+/*
+Render the pipeline of the job in the format, either dot or mermaid
+*/
+func renderGraph(job Job, format string) (string, error) {
+	switch format {
+	case "dot":
+		return dotGraph(job), nil
+	case "mermaid":
+		return mermaidGraph(job), nil
+	}
+	return "", errors.New("Unknown graph format '" + format + "', expected dot or mermaid")
+}
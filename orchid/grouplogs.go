@@ -0,0 +1,178 @@
+/*
+Logging the output of group actions per machine, so the execution of an action
+on many machines can be followed live, one prefixed line at a time
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/dchest/uniuri"
+	"io"
+	"os"
+	"sync"
+)
+
+/*
+Colors the lines of each machine are prefixed with when following the logs of
+a group action on a terminal
+*/
+var machineColors = []string{"\033[36m", "\033[33m", "\033[35m", "\033[32m", "\033[34m", "\033[31m"}
+
+/*
+Type defining the logs of an execution of a group action, one per machine of
+the group
+*/
+type groupLogs struct {
+	path  string
+	logs  map[string]Log
+	files map[string]*os.File
+}
+
+/*
+Create a log for each machine the group action is executed on. All logs are
+created up front, so the execution can be followed on every machine from the
+start. The logs share the id of the execution in GroupRun
+*/
+func startGroupLogs(path string, action Action, machines []Machine) (*groupLogs, error) {
+	g := &groupLogs{path: path, logs: map[string]Log{}, files: map[string]*os.File{}}
+	run := uniuri.New()
+	for _, machine := range machines {
+		log := Log{
+			Id:       uniuri.New(),
+			ActionId: action.Id,
+			Machine:  machine.Id,
+			GroupRun: run,
+			Status:   "New",
+			Pid:      os.Getpid(),
+		}
+		file, err := os.Create(path + "/logs/" + log.Id)
+		if err != nil {
+			g.close()
+			return nil, err
+		}
+		g.files[machine.Id] = file
+		err = log.save(path)
+		if err != nil {
+			g.close()
+			return nil, err
+		}
+		g.logs[machine.Id] = log
+	}
+	return g, nil
+}
+
+/*
+Execute the action on the machine it targets, writing its output to the log of
+the machine as well as to stdout
+*/
+func (g *groupLogs) run(a *Actions, setup Setup, action Action) error {
+	log := g.logs[action.Machine]
+	file := g.files[action.Machine]
+	log, err := log.start(g.path)
+	if err != nil {
+		return err
+	}
+
+	err = a.runActionTo(setup, action, io.MultiWriter(os.Stdout, file), io.MultiWriter(os.Stderr, file))
+	if err != nil {
+		fmt.Fprintln(file, "ERROR: "+err.Error())
+		log, _ = log.error(g.path, file)
+	} else {
+		log, _ = log.finish(g.path, file, "Finished")
+	}
+	g.logs[action.Machine] = log
+	return err
+}
+
+/*
+Close the log files, cancelling the logs of machines the action was not
+executed on, e.g. those of waves after a failed one, so following them stops
+*/
+func (g *groupLogs) close() {
+	for machineId, file := range g.files {
+		if log := g.logs[machineId]; log.Status == "New" {
+			log.cancel(g.path, file)
+		}
+		file.Close()
+	}
+}
+
+/*
+Follow the logs of the most recent execution of the group action with the
+given id, printing the lines of all machines as they are written, prefixed with
+the id of their machine. The prefixes are colored per machine on a terminal.
+Following stops once the action completed on every machine
+*/
+func (a *Actions) FollowGroup(actionId string) error {
+	logs, err := loadLogs(a.path)
+	if err != nil {
+		return err
+	}
+
+	// Logs are stored in the order they are created, so the last log of
+	// the action belongs to its most recent execution
+	run := ""
+	for _, log := range logs {
+		if log.ActionId == actionId && log.GroupRun != "" {
+			run = log.GroupRun
+		}
+	}
+	if run == "" {
+		return errors.New("No logs found for action '" + actionId + "'")
+	}
+
+	runLogs := []Log{}
+	width := 0
+	for _, log := range logs {
+		if log.GroupRun == run {
+			runLogs = append(runLogs, log)
+			if len(log.Machine) > width {
+				width = len(log.Machine)
+			}
+		}
+	}
+
+	colored := isTerminal(os.Stdout)
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	for i, log := range runLogs {
+		prefix := fmt.Sprintf("[%-*s] ", width, log.Machine)
+		if colored {
+			prefix = machineColors[i%len(machineColors)] + prefix + "\033[0m"
+		}
+
+		wg.Add(1)
+		go func(logId, prefix string) {
+			defer wg.Done()
+			err := followLog(a.path, logId, a.pollLogs, func(text string) {
+				mutex.Lock()
+				fmt.Println(prefix + text)
+				mutex.Unlock()
+			})
+			if err != nil {
+				mutex.Lock()
+				fmt.Println(prefix + "ERROR: " + err.Error())
+				mutex.Unlock()
+			}
+		}(log.Id, prefix)
+	}
+	wg.Wait()
+
+	// Summarize how the action went on each machine
+	ok, failed := 0, 0
+	for _, log := range runLogs {
+		if current, found, err := findLog(a.path, log.Id); err == nil && found {
+			log = current
+		}
+		if log.Status == "Finished" {
+			ok++
+		} else if log.Status == "Error" {
+			failed++
+		}
+	}
+	fmt.Printf("%d ok, %d failed\n", ok, failed)
+
+	return nil
+}
@@ -0,0 +1,189 @@
+/*
+Verifying the host keys of machines and pinning them, after which connecting to
+a machine fails if its host key changes
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+/*
+Get the file holding the pinned host keys
+*/
+func knownHostsFile(path string) string {
+	return path + "/known_hosts"
+}
+
+/*
+Get the options checking the host key of the machine. Once pinned, the host key
+must match the pinned one. Host keys are pinned by machine id, so they are kept
+when the address of a machine changes
+*/
+func hostKeyOptions(path string, machine Machine) string {
+	if !hostKeyPinned(path, machine.Id) {
+		return "-o 'StrictHostKeyChecking no'"
+	}
+	return fmt.Sprintf(
+		"-o 'StrictHostKeyChecking yes' -o 'UserKnownHostsFile %s' -o 'HostKeyAlias %s'",
+		knownHostsFile(path),
+		machine.Id,
+	)
+}
+
+/*
+Check whether a host key is pinned for the machine with the given id
+*/
+func hostKeyPinned(path, machineId string) bool {
+	entries, err := readKnownHosts(path)
+	if err != nil {
+		return false
+	}
+	for _, entry := range entries {
+		if knownHostsName(entry) == machineId {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Read the entries of the file holding the pinned host keys
+*/
+func readKnownHosts(path string) ([]string, error) {
+	data, err := ioutil.ReadFile(knownHostsFile(path))
+	if os.IsNotExist(err) {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []string{}
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.TrimSpace(line) != "" {
+			entries = append(entries, line)
+		}
+	}
+	return entries, nil
+}
+
+/*
+Get the name of the host of a known_hosts entry
+*/
+func knownHostsName(entry string) string {
+	return strings.SplitN(entry, " ", 2)[0]
+}
+
+/*
+Pin the host keys for the machine with the given id, replacing any pinned
+before. The keys are given as output by ssh-keyscan
+*/
+func pinHostKeys(path, machineId string, keys []string) error {
+	entries, err := readKnownHosts(path)
+	if err != nil {
+		return err
+	}
+
+	kept := []string{}
+	for _, entry := range entries {
+		if knownHostsName(entry) != machineId {
+			kept = append(kept, entry)
+		}
+	}
+	for _, key := range keys {
+		fields := strings.SplitN(key, " ", 2)
+		kept = append(kept, machineId+" "+fields[1])
+	}
+
+	return ioutil.WriteFile(knownHostsFile(path), []byte(strings.Join(kept, "\n")+"\n"), 0644)
+}
+
+/*
+Rename the pinned host keys of the machine, if any
+*/
+func renamePinnedHostKeys(path, oldId, newId string) error {
+	entries, err := readKnownHosts(path)
+	if err != nil || len(entries) == 0 {
+		return err
+	}
+
+	for i, entry := range entries {
+		if knownHostsName(entry) == oldId {
+			entries[i] = newId + strings.TrimPrefix(entry, oldId)
+		}
+	}
+	return ioutil.WriteFile(knownHostsFile(path), []byte(strings.Join(entries, "\n")+"\n"), 0644)
+}
+
+/*
+Get the host keys of the machine using ssh-keyscan, one per line in the format
+of known_hosts
+*/
+func scanHostKeys(path string, machine Machine) ([]string, error) {
+	address := strings.Trim(machine.Address, "[]")
+	port := machine.Port
+
+	// Machines using a ssh config have their address given by it
+	if machine.Host != "" {
+		args := []string{"-G", machine.Host}
+		if machine.SSHConfig != "" {
+			args = []string{"-F", sshConfigFile(path, machine), "-G", machine.Host}
+		}
+		output, err := exec.Command("ssh", args...).Output()
+		if err != nil {
+			return nil, errors.New("Could not read the ssh config of the machine: " + err.Error())
+		}
+		scanner := bufio.NewScanner(bytes.NewReader(output))
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) == 2 && fields[0] == "hostname" {
+				address = fields[1]
+			}
+			if len(fields) == 2 && fields[0] == "port" {
+				port = fields[1]
+			}
+		}
+	}
+
+	args := []string{address}
+	if port != "" {
+		args = []string{"-p", port, address}
+	}
+	output, err := exec.Command("ssh-keyscan", args...).Output()
+	if err != nil {
+		return nil, errors.New("Could not get the host keys of the machine: " + err.Error())
+	}
+
+	keys := []string{}
+	for _, line := range strings.Split(string(output), "\n") {
+		if line != "" && !strings.HasPrefix(line, "#") && strings.Contains(line, " ") {
+			keys = append(keys, line)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("The machine did not present any host keys")
+	}
+	return keys, nil
+}
+
+/*
+Get the SHA256 fingerprint of the host key, as output by ssh-keygen
+*/
+func hostKeyFingerprint(key string) (string, error) {
+	cmd := exec.Command("ssh-keygen", "-l", "-E", "sha256", "-f", "-")
+	cmd.Stdin = strings.NewReader(key + "\n")
+	output, err := cmd.Output()
+	if err != nil {
+		return "", errors.New("Could not get the fingerprint of the host key: " + err.Error())
+	}
+	return strings.TrimSpace(string(output)), nil
+}
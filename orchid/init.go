@@ -0,0 +1,56 @@
+/*
+Creating the configuration of a new orchid directory
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+/*
+The files of a new configuration. New configurations run steps and actions in
+strict mode, while existing ones without the Strict setting keep running
+leniently
+*/
+var initialFiles = []struct {
+	name    string
+	content string
+}{
+	{"machines.json", "[]\n"},
+	{"jobs.json", "[]\n"},
+	{"actions.json", "[]\n"},
+	{"settings.json", "{\n  \"Strict\": true\n}\n"},
+}
+
+/*
+Create a new configuration in the orchid directory, with no machines, jobs, or
+actions yet. An existing configuration is left untouched
+*/
+func (a *Actions) Init() error {
+	for _, file := range initialFiles {
+		if _, err := os.Stat(a.path + "/" + file.name); err == nil {
+			return errors.New("The orchid directory already holds a configuration: " + file.name + " exists")
+		}
+	}
+
+	for _, dir := range []string{a.path, a.path + "/scripts", a.path + "/logs"} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+	if err := os.MkdirAll(a.path+"/keys", 0700); err != nil {
+		return err
+	}
+	for _, file := range initialFiles {
+		if err := ioutil.WriteFile(a.path+"/"+file.name, []byte(file.content), 0644); err != nil {
+			return err
+		}
+	}
+
+	fmt.Println("Created a new configuration in " + a.path)
+	return nil
+}
@@ -0,0 +1,57 @@
+/*
+Feeding predefined input to the commands of steps, e.g. answers to the prompts
+of interactive tools
+*/
+
+package main
+
+import (
+	"errors"
+	"github.com/dchest/uniuri"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+/*
+Get the file holding the input of the step, relative to the orchid directory
+unless absolute
+*/
+func inputFile(path string, executable Executable) string {
+	if filepath.IsAbs(executable.InputFile) {
+		return executable.InputFile
+	}
+	return path + "/" + executable.InputFile
+}
+
+/*
+Get the input of the step, given either inline or as a file. Returns false if
+the step has no input
+*/
+func stepInput(path string, executable Executable) (string, bool, error) {
+	if executable.Input != "" {
+		return executable.Input, true, nil
+	}
+	if executable.InputFile == "" {
+		return "", false, nil
+	}
+
+	data, err := ioutil.ReadFile(inputFile(path, executable))
+	if err != nil {
+		return "", false, errors.New("Could not read the InputFile of the step: " + err.Error())
+	}
+	return string(data), true, nil
+}
+
+/*
+Wrap the script read by the shell from stdin so its commands read the input
+from stdin instead of the rest of the script. The shell reads the whole group,
+including the here-document holding the input, before running it
+*/
+func withInput(script, input string) string {
+	delimiter := "ORCHID_INPUT_" + uniuri.New()
+	if !strings.HasSuffix(input, "\n") {
+		input += "\n"
+	}
+	return "{\n" + script + "\n} <<'" + delimiter + "'\n" + input + delimiter + "\n"
+}
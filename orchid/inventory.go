@@ -0,0 +1,141 @@
+/*
+Definition of and methods for loading machines from a dynamic inventory, i.e.
+an external command or HTTP endpoint returning the machines as JSON
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+/*
+Type defining the dynamic inventory configuration. Either Command or Url must
+be given
+*/
+type Inventory struct {
+	Command  string
+	Url      string
+	CacheTTL string
+}
+
+/*
+Type defining the cached machines of the dynamic inventory. Source is the
+command or URL the machines were loaded from
+*/
+type inventoryCache struct {
+	Loaded   time.Time
+	Source   string
+	Machines []Machine
+}
+
+/*
+Get the source of the machines of the inventory, telling apart the machines
+cached for different inventories
+*/
+func (i Inventory) source() string {
+	if i.Command != "" {
+		return "command:" + i.Command
+	}
+	return "url:" + i.Url
+}
+
+/*
+Load the machines of the dynamic inventory, reusing the cached machines if
+loaded recently from the same inventory
+*/
+func loadInventory(path string, inventory Inventory) ([]Machine, error) {
+	ttl, err := parseDuration(inventory.CacheTTL)
+	if err != nil {
+		return []Machine{}, errors.New("Inventory config invalid: Invalid CacheTTL: " + err.Error())
+	}
+	if inventory.CacheTTL == "" {
+		ttl = time.Minute
+	}
+
+	// Use the cache if recent enough
+	cache := inventoryCache{}
+	data, err := ioutil.ReadFile(path + "/inventory-cache.json")
+	if err == nil && json.Unmarshal(data, &cache) == nil && cache.Source == inventory.source() && time.Since(cache.Loaded) < ttl {
+		return cache.Machines, nil
+	}
+
+	if inventory.Command != "" {
+		data, err = runInventoryCommand(path, inventory.Command)
+	} else if inventory.Url != "" {
+		data, err = fetchInventory(inventory.Url)
+	} else {
+		return []Machine{}, errors.New("Inventory config invalid: Inventory must have a non-empty Command or Url")
+	}
+	if err != nil {
+		return []Machine{}, err
+	}
+
+	machines := []Machine{}
+	err = json.Unmarshal(data, &machines)
+	if err != nil {
+		return []Machine{}, errors.New("Inventory returned invalid machines: " + err.Error())
+	}
+
+	// Failing to cache the machines only makes the next load slower
+	cache = inventoryCache{Loaded: time.Now(), Source: inventory.source(), Machines: machines}
+	if data, err = json.Marshal(cache); err == nil {
+		ioutil.WriteFile(path+"/inventory-cache.json", data, 0644)
+	}
+
+	return machines, nil
+}
+
+/*
+Run the inventory command in the orchid directory, returning its output
+*/
+func runInventoryCommand(path, command string) ([]byte, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command("/bin/bash", "-c", command)
+	cmd.Dir = path
+	cmd.Stderr = &stderr
+
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, errors.New("Inventory command failed: " + err.Error() + ": " + strings.TrimSpace(stderr.String()))
+	}
+	return output, nil
+}
+
+/*
+Fetch the machines from the inventory endpoint
+*/
+func fetchInventory(url string) ([]byte, error) {
+	client := http.Client{Timeout: 30 * time.Second}
+	response, err := client.Get(url)
+	if err != nil {
+		return nil, errors.New("Inventory request failed: " + err.Error())
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, errors.New("Inventory request failed: " + response.Status)
+	}
+	return ioutil.ReadAll(response.Body)
+}
+
+/*
+Merge the machines of the dynamic inventory into the static machines, failing
+if any machine id is defined by both
+*/
+func mergeInventory(machines, inventory []Machine) ([]Machine, error) {
+	for _, machine := range inventory {
+		if _, found := (Setup{Machines: machines}).findMachine(machine.Id); found {
+			return []Machine{}, errors.New("Inventory invalid: Machine '" + machine.Id + "' is also defined in machines.json")
+		}
+		machines = append(machines, machine)
+	}
+	return machines, nil
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+)
+
+/*
+Test that cached machines are reused for the same inventory only, not once the
+inventory changed
+*/
+func TestInventoryCache(t *testing.T) {
+	path := t.TempDir()
+	tests := []struct {
+		inventory Inventory
+		expected  string
+	}{
+		{Inventory{Command: `echo '[{"Id": "web1"}]'`, CacheTTL: "1h"}, "web1"},
+		{Inventory{Command: `echo '[{"Id": "web2"}]'`, CacheTTL: "1h"}, "web2"},
+		// Only the TTL changed, so the cached machines are used
+		{Inventory{Command: `echo '[{"Id": "web2"}]'`, CacheTTL: "2h"}, "web2"},
+	}
+	for _, test := range tests {
+		machines, err := loadInventory(path, test.inventory)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(machines) != 1 || machines[0].Id != test.expected {
+			t.Errorf("got machines %v for the inventory %s, expected %s", machines, test.inventory.Command, test.expected)
+		}
+	}
+
+	if _, err := loadInventory(path, Inventory{Command: "exit 1", CacheTTL: "1h"}); err == nil {
+		t.Error("expected the machines cached for another inventory not to be used")
+	}
+}
@@ -0,0 +1,81 @@
+/*
+Streaming the output of logs as JSON lines, one JSON object per line, e.g. for
+dashboards rendering the output of running jobs live
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+/*
+Type defining a line of output of a log. Ts is when the line was read from the
+log, and Step the name of the step writing it, empty for lines written before
+the first step. The output and errors of steps are written to the same log, so
+Stream is always "output"
+*/
+type jsonLine struct {
+	Ts     time.Time `json:"ts"`
+	Step   string    `json:"step"`
+	Stream string    `json:"stream"`
+	Text   string    `json:"text"`
+}
+
+/*
+Type defining the object terminating the JSON lines of a log, once its job is
+done
+*/
+type jsonStatus struct {
+	Ts     time.Time    `json:"ts"`
+	LogId  string       `json:"logId"`
+	JobId  string       `json:"jobId"`
+	Status string       `json:"status"`
+	Steps  []StepResult `json:"steps"`
+}
+
+/*
+Write the value as a single JSON line to each of the writers
+*/
+func writeJSONLine(value interface{}, writers ...io.Writer) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	for _, w := range writers {
+		fmt.Fprintln(w, string(data))
+	}
+	return nil
+}
+
+/*
+Follow the log with the given id, writing each line as a JSON line attributed
+to its step, followed by the status of the log once its job is done. Poll
+follows the log by polling it, see followLogSteps
+*/
+func followJSONLines(path, logId string, poll bool, writers ...io.Writer) error {
+	err := followLogSteps(path, logId, poll, 0, nil, func(step, text string) {
+		writeJSONLine(jsonLine{Ts: time.Now(), Step: step, Stream: "output", Text: text}, writers...)
+	})
+	if err != nil {
+		return err
+	}
+
+	log, found, err := findLog(path, logId)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return ErrLogNotFound
+	}
+	return writeJSONLine(jsonStatus{
+		Ts:     time.Now(),
+		LogId:  log.Id,
+		JobId:  log.JobId,
+		Status: log.Status,
+		Steps:  log.Steps,
+	}, writers...)
+}
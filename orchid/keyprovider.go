@@ -0,0 +1,84 @@
+/*
+Accessing machines using keys that are not files in the keys directory, e.g.
+keys held by an ssh-agent or by a hardware token through a PKCS#11 provider
+*/
+
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+/*
+Validate the KeyProvider of the machine, either "agent" or "pkcs11:" followed
+by the path of the PKCS#11 library
+*/
+func validateKeyProvider(provider string) error {
+	if provider == "agent" {
+		return nil
+	}
+	if strings.HasPrefix(provider, "pkcs11:") {
+		if strings.TrimPrefix(provider, "pkcs11:") == "" {
+			return errors.New("The KeyProvider pkcs11: must be followed by the path of the PKCS#11 library")
+		}
+		return nil
+	}
+	return errors.New("Unknown KeyProvider '" + provider + "', expected agent or pkcs11:<library path>")
+}
+
+/*
+Get the options making ssh authenticate using the key provider of the machine
+instead of a key file. The agent is found by ssh through SSH_AUTH_SOCK, so it
+needs no options
+*/
+func keyProviderOptions(machine Machine) string {
+	if library := strings.TrimPrefix(machine.KeyProvider, "pkcs11:"); library != machine.KeyProvider {
+		return "-o PKCS11Provider=" + shellQuote(library)
+	}
+	return ""
+}
+
+/*
+Check whether ssh may ask for the PIN of the token of the machine, i.e. whether
+it uses a PKCS#11 provider while run from a terminal, and not given --no-tty.
+Run unattended, the PIN can not be entered, so the keys must be added to an
+ssh-agent using ssh-add -s instead
+*/
+func promptsForPin(machine Machine) bool {
+	return strings.HasPrefix(machine.KeyProvider, "pkcs11:") && !machine.NoTTY && isTerminal(os.Stdin)
+}
+
+/*
+Check that the key provider of the machine is available, i.e. that an
+ssh-agent is running for machines using the agent
+*/
+func checkKeyProvider(machine Machine) error {
+	if machine.KeyProvider == "agent" && os.Getenv("SSH_AUTH_SOCK") == "" {
+		return errors.New("Machine '" + machine.Id + "' uses the ssh-agent as its KeyProvider, but SSH_AUTH_SOCK is not set")
+	}
+	return nil
+}
+
+/*
+Get the public keys offered by the key provider of the machine, as lines of an
+authorized_keys file
+*/
+func providerPublicKeys(machine Machine) (string, error) {
+	err := checkKeyProvider(machine)
+	if err != nil {
+		return "", err
+	}
+
+	cmd := exec.Command("ssh-add", "-L")
+	if library := strings.TrimPrefix(machine.KeyProvider, "pkcs11:"); library != machine.KeyProvider {
+		cmd = exec.Command("ssh-keygen", "-D", library)
+	}
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", errors.New("Could not get the public keys of the KeyProvider of machine '" + machine.Id + "': " + strings.TrimSpace(string(output)))
+	}
+	return strings.TrimSpace(string(output)), nil
+}
@@ -0,0 +1,209 @@
+/*
+Rotating the keys of machines, authorizing a new key on the machine and
+switching to it only once it is verified to work
+*/
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+/*
+Derive the public key of the private key file. An empty passphrase makes
+ssh-keygen fail rather than prompt for the passphrase of encrypted keys
+*/
+func publicKey(file string) (string, error) {
+	output, err := exec.Command("ssh-keygen", "-y", "-P", "", "-f", file).CombinedOutput()
+	if err != nil {
+		return "", errors.New("Could not derive the public key of " + filepath.Base(file) + ": " + strings.TrimSpace(string(output)))
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+/*
+Run the shell script on the machine, piping it to sh. Shared connections are
+not used, and only the key of the machine is offered, so the script runs only
+if the key of the machine itself is accepted
+*/
+func runKeyScript(path string, machine Machine, script string) error {
+	sshCommand := fmt.Sprintf(
+		"ssh -T -o ControlPath=none -o IdentitiesOnly=yes %s %s 'sh -s'",
+		sshOptions(path, machine, "-p"),
+		sshDestination(machine),
+	)
+	cmd, err := machineCommand(machine, sshCommand)
+	if err != nil {
+		return err
+	}
+
+	output := bytes.Buffer{}
+	cmd.Stdin = strings.NewReader(script)
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	err = cmd.Run()
+	if err != nil {
+		message := strings.TrimSpace(output.String())
+		if message == "" {
+			message = err.Error()
+		}
+		return errors.New("Failed on " + machine.Id + ": " + message)
+	}
+	return nil
+}
+
+/*
+Get the script adding the public key to the authorized keys of the user on the
+machine, unless already there
+*/
+func authorizeKeyScript(key string) string {
+	return "key=" + shellQuote(key) + "\n" +
+		"mkdir -p ~/.ssh && chmod 700 ~/.ssh && touch ~/.ssh/authorized_keys && chmod 600 ~/.ssh/authorized_keys || exit 1\n" +
+		`grep -qxF -- "$key" ~/.ssh/authorized_keys || printf '%s\n' "$key" >> ~/.ssh/authorized_keys` + "\n"
+}
+
+/*
+Get the script removing the public key from the authorized keys of the user on
+the machine
+*/
+func revokeKeyScript(key string) string {
+	return "key=" + shellQuote(key) + "\n" +
+		`grep -vxF -- "$key" ~/.ssh/authorized_keys > ~/.ssh/authorized_keys.orchid` + "\n" +
+		"chmod 600 ~/.ssh/authorized_keys.orchid && mv ~/.ssh/authorized_keys.orchid ~/.ssh/authorized_keys\n"
+}
+
+/*
+Rotate the key of the machine to the private key file at newKeyPath. The public
+key is added to the authorized keys on the machine using the current key, and
+the new key is copied to the keys. Only once connecting using the new key is
+verified, the machine is changed to use it in machines.json. If removeOld is
+given, the old key is then removed from the authorized keys on the machine. If
+verifying the new key fails, the machine keeps using the old key
+*/
+func (a *Actions) SwapKey(machineId, newKeyPath string, removeOld bool) (err error) {
+	defer func() {
+		a.audit("swap-key", machineId, auditResult(err))
+	}()
+
+	setup, err := a.loadSetup()
+	if err != nil {
+		return err
+	}
+	machine, found := setup.findMachine(machineId)
+	if !found {
+		return ErrMachineNotFound
+	}
+	if machine.Host != "" || machine.PrivateKey == "" {
+		return errors.New("The key of machine '" + machineId + "' can not be swapped, as it has no PrivateKey or its key is given by its ssh config")
+	}
+
+	machines, err := loadSetupFile(a.path, "machines.json")
+	if err != nil {
+		return err
+	}
+	inMachines := false
+	for _, element := range machines {
+		if element.getString("Id") != machineId {
+			continue
+		}
+		inMachines = true
+
+		// The key is rewritten as given in machines.json, so it must be the
+		// key the machine uses, not e.g. a reference to an environment
+		// variable
+		if element.getString("PrivateKey") != machine.PrivateKey {
+			return errors.New("The key of machine '" + machineId + "' can not be swapped, as its PrivateKey in machines.json is not the key file itself")
+		}
+	}
+	if !inMachines {
+		return errors.New("The machine '" + machineId + "' is not defined in machines.json, e.g. as it is part of a dynamic inventory")
+	}
+
+	oldKey, err := publicKey(keyFile(machine))
+	if err != nil {
+		return err
+	}
+	newKey, err := publicKey(newKeyPath)
+	if err != nil {
+		return err
+	}
+	if oldKey == newKey {
+		return errors.New("The machine '" + machineId + "' already uses the key")
+	}
+
+	// Copy the new key to the keys, unless it is already there
+	data, err := ioutil.ReadFile(newKeyPath)
+	if err != nil {
+		return err
+	}
+	newMachine := machine
+	newMachine.PrivateKey = filepath.Base(newKeyPath)
+	newMachine.KeyFile = setup.KeyDir + "/" + newMachine.PrivateKey
+	copied := false
+	if existing, err := ioutil.ReadFile(keyFile(newMachine)); err == nil {
+		if !bytes.Equal(existing, data) {
+			return errors.New("A different key named '" + newMachine.PrivateKey + "' already exists")
+		}
+	} else {
+		err = ioutil.WriteFile(keyFile(newMachine), data, 0600)
+		if err != nil {
+			return err
+		}
+		copied = true
+	}
+
+	fmt.Println("Authorizing the new key on " + machineId)
+	err = runKeyScript(a.path, machine, authorizeKeyScript(newKey))
+	if err != nil {
+		if copied {
+			os.Remove(keyFile(newMachine))
+		}
+		return err
+	}
+
+	// Connect using nothing but the new key, as a password or the old key
+	// could connect regardless
+	fmt.Println("Verifying the new key")
+	verifyMachine := newMachine
+	verifyMachine.PasswordEnv = ""
+	err = runKeyScript(a.path, verifyMachine, "true\n")
+	if err != nil {
+		runKeyScript(a.path, machine, revokeKeyScript(newKey))
+		if copied {
+			os.Remove(keyFile(newMachine))
+		}
+		return errors.New("Connecting using the new key failed, keeping the old key: " + err.Error())
+	}
+
+	// The old key is only revoked once machines.json no longer uses it
+	replaced := false
+	for _, element := range machines {
+		if element.getString("Id") == machineId {
+			replaced = element.replaceString("PrivateKey", machine.PrivateKey, newMachine.PrivateKey) || replaced
+		}
+	}
+	if !replaced {
+		return errors.New("Could not change the PrivateKey of machine '" + machineId + "' in machines.json, keeping the old key. The new key stays authorized on the machine")
+	}
+	err = writeSetupFile(a.path, "machines.json", machines)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Machine " + machineId + " now uses the key " + newMachine.PrivateKey)
+
+	if removeOld {
+		err = runKeyScript(a.path, verifyMachine, revokeKeyScript(oldKey))
+		if err != nil {
+			return errors.New("Could not remove the old key from the authorized keys: " + err.Error())
+		}
+		fmt.Println("Removed the old key " + machine.PrivateKey + " from the authorized keys on " + machineId)
+	}
+	return nil
+}
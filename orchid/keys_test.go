@@ -0,0 +1,44 @@
+package main
+
+import (
+	"io/ioutil"
+	"reflect"
+	"testing"
+)
+
+/*
+Test that keys and their public keys are used by the machines referring to
+them, as listed and pruned
+*/
+func TestUsedKeys(t *testing.T) {
+	machines := []Machine{
+		{Id: "web1", PrivateKey: "web"},
+		{Id: "web2", PrivateKey: "web"},
+		{Id: "db1", PrivateKey: "db"},
+		{Id: "hsm1", KeyProvider: "agent"},
+	}
+	used := usedKeys(machines)
+	expected := map[string][]string{
+		"web":     {"web1", "web2"},
+		"web.pub": {"web1", "web2"},
+		"db":      {"db1"},
+		"db.pub":  {"db1"},
+	}
+	if !reflect.DeepEqual(used, expected) {
+		t.Errorf("got %v, expected %v", used, expected)
+	}
+}
+
+/*
+Test that keys are not told apart as used or orphaned if the machines can not
+be loaded, rather than taking every key for orphaned
+*/
+func TestKeyMachinesInvalidSetup(t *testing.T) {
+	path := t.TempDir()
+	if err := ioutil.WriteFile(path+"/machines.json", []byte(`[{"Id": `), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := (&Actions{path: path}).keyMachines(); err == nil {
+		t.Error("expected an error for invalid machines")
+	}
+}
@@ -0,0 +1,84 @@
+/*
+Definition of and methods for the lock preventing jobs and actions from being
+run, e.g. during a change freeze
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+/*
+Type defining the lock
+*/
+type Lock struct {
+	Reason string
+	User   string
+	Time   time.Time
+}
+
+/*
+Load the lock, returning false if orchid is not locked
+*/
+func loadLock(path string) (Lock, bool, error) {
+	data, err := ioutil.ReadFile(path + "/lock.json")
+	if os.IsNotExist(err) {
+		return Lock{}, false, nil
+	}
+	if err != nil {
+		return Lock{}, false, err
+	}
+
+	lock := Lock{}
+	err = json.Unmarshal(data, &lock)
+	if err != nil {
+		return Lock{}, false, err
+	}
+
+	return lock, true, nil
+}
+
+/*
+Save the lock, locking orchid
+*/
+func (l Lock) save(path string) error {
+	data, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path+"/lock.json", data, 0644)
+}
+
+/*
+Create a new lock with the given reason, held by the current user
+*/
+func newLock(reason string) Lock {
+	return Lock{
+		Reason: reason,
+		User:   currentUser(),
+		Time:   time.Now(),
+	}
+}
+
+/*
+Check that orchid is not locked, unless the lock is to be ignored
+*/
+func checkLock(path string, force bool) error {
+	lock, locked, err := loadLock(path)
+	if err != nil {
+		return err
+	}
+
+	if locked && !force {
+		return errors.New("Orchid is locked by " + lock.User + " since " + lock.Time.Format(time.RFC1123) +
+			": " + lock.Reason + " (use --force to run anyway)")
+	}
+
+	return nil
+}
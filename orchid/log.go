@@ -9,6 +9,8 @@ import (
 	"github.com/dchest/uniuri"
 	"io/ioutil"
 	"os"
+	"strings"
+	"syscall"
 	"time"
 )
 
@@ -18,39 +20,95 @@ Definition of the log type
 type Log struct {
 	Id        string
 	JobId     string
+	ActionId  string `json:",omitempty"`
+	Machine   string `json:",omitempty"`
+	GroupRun  string `json:",omitempty"`
 	Status    string
 	StartTime time.Time
 	EndTime   time.Time
+	Pid       int
+	Steps     []StepResult
+	Options   RunOptions
 }
 
 /*
-Save the log to the logs configuration file
+Save the log to the logs configuration file. The file is locked while the logs
+are loaded, changed, and written, so jobs saving their logs concurrently, also
+in other processes, do not lose each other's changes
 */
 func (l Log) save(path string) error {
-	logs, err := loadLogs(path)
+	return withLogsLock(path, func() error {
+		logs, err := loadLogs(path)
+		if err != nil {
+			return err
+		}
+
+		found := false
+		for i, log := range logs {
+			if l.Id == log.Id {
+				found = true
+				logs[i] = l
+				break
+			}
+		}
+
+		if !found {
+			logs = append(logs, l)
+		}
+
+		return writeLogs(path, logs)
+	})
+}
+
+/*
+Run the function holding the lock of the logs configuration file, waiting for
+other processes holding it
+*/
+func withLogsLock(path string, f func() error) error {
+	err := os.MkdirAll(path+"/locks", 0755)
 	if err != nil {
 		return err
 	}
-
-	found := false
-	for i, log := range logs {
-		if l.Id == log.Id {
-			found = true
-			logs[i] = l
-			break
-		}
+	file, err := os.OpenFile(path+"/locks/logs.lock", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return err
 	}
+	defer file.Close()
 
-	if !found {
-		logs = append(logs, l)
+	err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX)
+	if err != nil {
+		return err
 	}
+	defer syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+	return f()
+}
 
+/*
+Write the logs configuration file. The logs are written to a temporary file
+renamed over the file, so logs are never loaded while only partly written
+*/
+func writeLogs(path string, logs []Log) error {
 	data, err := json.Marshal(logs)
 	if err != nil {
 		return err
 	}
 
-	return ioutil.WriteFile(path+"/logs.json", data, 0644)
+	temp, err := ioutil.TempFile(path, ".logs.json-*")
+	if err != nil {
+		return err
+	}
+	_, err = temp.Write(data)
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(temp.Name(), 0644)
+	}
+	if err != nil {
+		os.Remove(temp.Name())
+		return err
+	}
+	return os.Rename(temp.Name(), path+"/logs.json")
 }
 
 /*
@@ -60,16 +118,56 @@ persistent log configuration
 func (l Log) start(path string) (Log, error) {
 	l.StartTime = time.Now()
 	l.Status = "Started"
+	l.Pid = os.Getpid()
 	return l, l.save(path)
 }
 
 /*
-Indicate that the log has finished, setting the end time and updating the
-persistent log configuration
+Get the result of the job of the log
+*/
+func (l Log) result() JobResult {
+	return JobResult{
+		LogId:     l.Id,
+		JobId:     l.JobId,
+		Status:    l.Status,
+		StartTime: l.StartTime,
+		EndTime:   l.EndTime,
+		Steps:     append([]StepResult{}, l.Steps...),
+	}
+}
+
+/*
+Check whether the job of the log is still running, i.e. the log has not
+reached a final status and the process running the job is still alive. Logs
+without a pid, e.g. created before the pid was recorded, are not running, as
+there is no process to tell
+*/
+func (l Log) running() bool {
+	if l.Status != "New" && l.Status != "Started" {
+		return false
+	}
+	if l.Pid == 0 {
+		return false
+	}
+	return processAlive(l.Pid)
+}
+
+/*
+Check whether a process with the given pid exists
 */
-func (l Log) finish(path string, file *os.File) (Log, error) {
+func processAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
+
+/*
+Indicate that the log has finished with the given status, "Finished" or a
+custom status of an exit code, setting the end time and updating the persistent
+log configuration
+*/
+func (l Log) finish(path string, file *os.File, status string) (Log, error) {
 	l.EndTime = time.Now()
-	l.Status = "Finished"
+	l.Status = status
 	return l, l.saveAndWriteToLog(path, file, "Finished")
 }
 
@@ -83,6 +181,16 @@ func (l Log) error(path string, file *os.File) (Log, error) {
 	return l, l.saveAndWriteToLog(path, file, "Error")
 }
 
+/*
+Indicate that the log has been cancelled, setting the end time and updating the
+persistent log configuration
+*/
+func (l Log) cancel(path string, file *os.File) (Log, error) {
+	l.EndTime = time.Now()
+	l.Status = "Cancelled"
+	return l, l.saveAndWriteToLog(path, file, "Cancelled")
+}
+
 /*
 Helper method for saving the log and writing a terminating line to the log
 output file
@@ -93,10 +201,146 @@ func (l Log) saveAndWriteToLog(path string, file *os.File, text string) error {
 		return err
 	}
 
-	_, err = file.WriteString("-----" + text + "-----")
+	_, err = file.WriteString("-----" + text + "-----\n")
 	return err
 }
 
+/*
+Get the file holding the result of the job of the log once it is done
+*/
+func resultFile(path, logId string) string {
+	return path + "/logs/" + logId + ".result"
+}
+
+/*
+Write the result of the job to the result file of its log, for automation
+parsing the result rather than the output. The file is written to a temporary
+file first and then renamed, so it is either complete or missing
+*/
+func writeResultFile(path string, result JobResult) error {
+	result.Steps = withStepOutputs(path, result.LogId, result.Steps)
+	data, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	temp, err := ioutil.TempFile(path+"/logs", "."+result.LogId+".result-*")
+	if err != nil {
+		return err
+	}
+	_, err = temp.Write(append(data, '\n'))
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(temp.Name(), 0644)
+	}
+	if err != nil {
+		os.Remove(temp.Name())
+		return err
+	}
+	return os.Rename(temp.Name(), resultFile(path, result.LogId))
+}
+
+/*
+Get the steps with the output each wrote to the log output file, found using
+the offset and length recorded for the step, without its marker. The output is
+only given in the result file, not stored in the log. Without the output file,
+the steps are returned without output
+*/
+func withStepOutputs(path, logId string, steps []StepResult) []StepResult {
+	data, err := ioutil.ReadFile(path + "/logs/" + logId)
+	if err != nil {
+		return steps
+	}
+
+	withOutputs := []StepResult{}
+	for _, step := range steps {
+		end := step.Offset + step.Length
+		if !step.StartTime.IsZero() && step.Offset >= 0 && end <= int64(len(data)) {
+			output := string(data[step.Offset:end])
+			if newline := strings.Index(output, "\n"); newline >= 0 {
+				output = output[newline+1:]
+			} else {
+				output = ""
+			}
+			step.Output = output
+		}
+		withOutputs = append(withOutputs, step)
+	}
+	return withOutputs
+}
+
+/*
+Check whether the status is one of the statuses used by orchid itself, which
+can not be used as custom statuses of exit codes
+*/
+func reservedStatus(status string) bool {
+	switch status {
+	case "", "New", "Started", "Finished", "Error", "Cancelled", "Pending", "Skipped", "Cached":
+		return true
+	}
+	return false
+}
+
+/*
+Check whether the line is one of the lines terminating a log output file
+*/
+func isTerminator(line string) bool {
+	return line == "-----Finished-----" || line == "-----Error-----" || line == "-----Cancelled-----"
+}
+
+/*
+Get the line written to a log output file when the step with the given name
+starts, attributing the lines following it to the step
+*/
+func stepMarker(name string) string {
+	return "----- Step " + name + " -----"
+}
+
+/*
+Get the name of the step started by the line, if it is a step marker
+*/
+func parseStepMarker(line string) (string, bool) {
+	if !strings.HasPrefix(line, "----- Step ") || !strings.HasSuffix(line, " -----") || len(line) < len("----- Step  -----") {
+		return "", false
+	}
+	return line[len("----- Step ") : len(line)-len(" -----")], true
+}
+
+/*
+Get the name of the step started by the line at the given offset in the log
+output file, if it is the marker of a step. Only lines at the offset recorded
+for a step when it started are markers, so output of steps looking like one
+is not mistaken for a step starting
+*/
+func (l Log) stepAt(line string, offset int64) (string, bool) {
+	name, isMarker := parseStepMarker(line)
+	if !isMarker {
+		return "", false
+	}
+	for _, step := range l.Steps {
+		if step.Name == name && !step.StartTime.IsZero() && step.Offset == offset {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+/*
+Get the name of the step writing the output at the given offset in the log
+output file, or "" if before the first step
+*/
+func (l Log) stepOf(offset int64) string {
+	name, start := "", int64(-1)
+	for _, step := range l.Steps {
+		if !step.StartTime.IsZero() && step.Offset < offset && step.Offset > start {
+			name, start = step.Name, step.Offset
+		}
+	}
+	return name
+}
+
 /*
 Create a new log, assigning it a new identifier
 */
@@ -138,3 +382,61 @@ func loadLogs(path string) ([]Log, error) {
 
 	return *logs, nil
 }
+
+/*
+Find the log with the given id among the logs stored locally
+*/
+func findLog(path, logId string) (Log, bool, error) {
+	logs, err := loadLogs(path)
+	if err != nil {
+		return Log{}, false, err
+	}
+
+	for _, log := range logs {
+		if log.Id == logId {
+			return log, true, nil
+		}
+	}
+	return Log{}, false, nil
+}
+
+/*
+Load the logs of all jobs currently running
+*/
+func runningLogs(path string) ([]Log, error) {
+	logs, err := loadLogs(path)
+	if err != nil {
+		return []Log{}, err
+	}
+
+	running := []Log{}
+	for _, log := range logs {
+		if log.Status == "Started" && log.running() {
+			running = append(running, log)
+		}
+	}
+	return running, nil
+}
+
+/*
+Resolve a possibly abbreviated log id to the full id of the first log whose id
+starts with it
+*/
+func resolveLogId(path, logId string) (string, error) {
+	if len(logId) >= 16 {
+		return logId, nil
+	}
+
+	logs, err := loadLogs(path)
+	if err != nil {
+		return "", err
+	}
+
+	for _, log := range logs {
+		if strings.HasPrefix(log.Id, logId) {
+			return log.Id, nil
+		}
+	}
+
+	return "", ErrLogNotFound
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+/*
+Test that the result file holds the output of each step, found in the log
+using the offset and length of the step
+*/
+func TestResultFileOutputs(t *testing.T) {
+	path := t.TempDir()
+	job := Job{Id: "outputs", Pipeline: []Executable{
+		{Id: "first", Machine: "local", Command: "echo one\necho two"},
+		{Id: "second", Machine: "local", Command: "echo three"},
+	}}
+	result, output := runTestJob(t, path, job)
+	if result.Status != "Finished" {
+		t.Fatalf("got status %s, expected Finished:\n%s", result.Status, output)
+	}
+
+	data, err := ioutil.ReadFile(resultFile(path, result.LogId))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var written JobResult
+	if err := json.Unmarshal(data, &written); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"one\ntwo\n", "three\n"}
+	for i, step := range written.Steps {
+		if step.Output != expected[i] {
+			t.Errorf("step %s: got output %q, expected %q", step.Name, step.Output, expected[i])
+		}
+		if marker := output[step.Offset : step.Offset+step.Length]; !strings.HasPrefix(marker, stepMarker(step.Name)+"\n") {
+			t.Errorf("step %s: got %q at its offset, expected its marker and output", step.Name, marker)
+		}
+	}
+	if result.Steps[0].Output != "" {
+		t.Error("the output of steps was stored in the log")
+	}
+}
+
+/*
+Test that only the markers written when steps start are taken for them, not
+output of steps merely looking like a marker
+*/
+func TestStepMarkers(t *testing.T) {
+	path := t.TempDir()
+	job := Job{Id: "markers", Pipeline: []Executable{
+		{Id: "first", Machine: "local", Command: "echo one\necho '----- Step second -----'\necho two"},
+		{Id: "second", Machine: "local", Command: "echo three"},
+	}}
+	result, output := runTestJob(t, path, job)
+	if result.Status != "Finished" {
+		t.Fatalf("got status %s, expected Finished:\n%s", result.Status, output)
+	}
+
+	log, found, err := findLog(path, "test-markers")
+	if err != nil || !found {
+		t.Fatalf("the log was not saved: %v", err)
+	}
+
+	steps := map[string]string{}
+	step, offset := "", int64(0)
+	for _, line := range strings.SplitAfter(output, "\n") {
+		if name, isMarker := log.stepAt(strings.TrimSuffix(line, "\n"), offset); isMarker {
+			step = name
+		} else {
+			steps[strings.TrimSuffix(line, "\n")] = step
+			if of := log.stepOf(offset); of != step {
+				t.Errorf("got step %q of the line %q, expected %q", of, line, step)
+			}
+		}
+		offset += int64(len(line))
+	}
+
+	expected := map[string]string{
+		"one":                     "first",
+		"----- Step second -----": "first",
+		"two":                     "first",
+		"three":                   "second",
+	}
+	for text, step := range expected {
+		if steps[text] != step {
+			t.Errorf("got line %q attributed to step %q, expected %q", text, steps[text], step)
+		}
+	}
+
+	lines, _, err := tailLog(path, "test-markers", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(lines, "\n") != "one\n----- Step second -----\ntwo\nthree" {
+		t.Errorf("expected the tail without the markers of the steps, got:\n%s", strings.Join(lines, "\n"))
+	}
+}
+
+/*
+Test that only logs of live processes that have not reached a final status are
+running
+*/
+func TestLogRunning(t *testing.T) {
+	tests := []struct {
+		log     Log
+		running bool
+	}{
+		{Log{Status: "Started", Pid: os.Getpid()}, true},
+		{Log{Status: "New", Pid: os.Getpid()}, true},
+		{Log{Status: "Started"}, false},
+		{Log{Status: "Finished", Pid: os.Getpid()}, false},
+	}
+	for _, test := range tests {
+		if running := test.log.running(); running != test.running {
+			t.Errorf("%s with pid %d: got running %v, expected %v", test.log.Status, test.log.Pid, running, test.running)
+		}
+	}
+}
+
+/*
+Test that logs saved concurrently are all kept
+*/
+func TestSaveLogsConcurrently(t *testing.T) {
+	path := t.TempDir()
+	done := make(chan error)
+	for i := 0; i < 20; i++ {
+		go func(i int) {
+			done <- Log{Id: fmt.Sprintf("log%d", i), JobId: "deploy", Status: "Started"}.save(path)
+		}(i)
+	}
+	for i := 0; i < 20; i++ {
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	logs, err := loadLogs(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(logs) != 20 {
+		t.Errorf("got %d logs, expected all 20 saved", len(logs))
+	}
+}
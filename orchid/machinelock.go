@@ -0,0 +1,212 @@
+/*
+Locking machines while steps run on them, preventing jobs from running steps on
+the same machine at the same time, e.g. a scheduled and a manual deploy
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"syscall"
+	"time"
+)
+
+/*
+How often a lock held by another job is tried again while waiting for it
+*/
+const machineLockInterval = 500 * time.Millisecond
+
+/*
+Get the file locked while steps run on the machine
+*/
+func machineLockFile(path, machineId string) string {
+	return path + "/locks/" + machineId + ".lock"
+}
+
+/*
+Type defining a held lock of a machine
+*/
+type machineLock struct {
+	file *os.File
+}
+
+/*
+Try to lock the machine without waiting. Returns false if the machine is locked
+by another job. The lock is released by the OS if orchid dies holding it
+*/
+func tryLockMachine(path, machineId string) (*machineLock, bool, error) {
+	err := os.MkdirAll(path+"/locks", 0755)
+	if err != nil {
+		return nil, false, err
+	}
+
+	file, err := os.OpenFile(machineLockFile(path, machineId), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, false, err
+	}
+
+	err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		file.Close()
+		return nil, false, nil
+	}
+	if err != nil {
+		file.Close()
+		return nil, false, err
+	}
+	return &machineLock{file: file}, true, nil
+}
+
+/*
+Type defining a job waiting for the lock of a machine. Waiters with a higher
+Priority get the lock first, and waiters of the same priority in the order they
+started waiting
+*/
+type lockWaiter struct {
+	Id       string
+	Priority int
+	Since    time.Time
+	Pid      int
+}
+
+/*
+Get the directory holding the jobs waiting for the lock of the machine
+*/
+func machineQueueDir(path, machineId string) string {
+	return path + "/locks/" + machineId + ".queue"
+}
+
+/*
+Check whether the waiter gets the lock before the other waiter
+*/
+func (w lockWaiter) before(other lockWaiter) bool {
+	if w.Priority != other.Priority {
+		return w.Priority > other.Priority
+	}
+	return w.Since.Before(other.Since)
+}
+
+/*
+Add the waiter to the queue of the machine. The returned function removes it
+again
+*/
+func enqueueWaiter(path, machineId string, waiter lockWaiter) (func(), error) {
+	dir := machineQueueDir(path, machineId)
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(waiter)
+	if err != nil {
+		return nil, err
+	}
+	file := dir + "/" + waiter.Id
+	err = ioutil.WriteFile(file, data, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return func() { os.Remove(file) }, nil
+}
+
+/*
+Get the position of the waiter in the queue of the machine, 1 being next in
+line. Waiters whose process is gone, e.g. as orchid was killed while waiting,
+are removed from the queue
+*/
+func queuePosition(path, machineId string, waiter lockWaiter) int {
+	dir := machineQueueDir(path, machineId)
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return 1
+	}
+
+	position := 1
+	for _, file := range files {
+		if file.Name() == waiter.Id {
+			continue
+		}
+		data, err := ioutil.ReadFile(dir + "/" + file.Name())
+		if err != nil {
+			continue
+		}
+		other := lockWaiter{}
+		if json.Unmarshal(data, &other) != nil || !processAlive(other.Pid) {
+			os.Remove(dir + "/" + file.Name())
+			continue
+		}
+		if other.before(waiter) {
+			position++
+		}
+	}
+	return position
+}
+
+/*
+Lock the machine, waiting up to the timeout for another job to release it
+unless told not to wait. Jobs waiting for the machine queue for it, getting the
+lock by their priority, and in the order they started waiting within the same
+priority. The waiting callback is called with the position of the job in the
+queue once the machine turns out to be locked, and again whenever the position
+changes
+*/
+func lockMachine(ctx context.Context, path, machineId string, timeout time.Duration, wait bool,
+	waiter lockWaiter, waiting func(position int)) (*machineLock, error) {
+	if wait {
+		waiter.Since = time.Now()
+		waiter.Pid = os.Getpid()
+		dequeue, err := enqueueWaiter(path, machineId, waiter)
+		if err != nil {
+			return nil, errors.New("Could not queue for machine " + machineId + ": " + err.Error())
+		}
+		defer dequeue()
+	}
+
+	deadline := time.Now().Add(timeout)
+	lastPosition := 0
+	for {
+		// Only the first in the queue tries to get the lock, so a waiter
+		// of a higher priority gets it once released
+		position := 1
+		if wait {
+			position = queuePosition(path, machineId, waiter)
+		}
+		if position == 1 {
+			lock, locked, err := tryLockMachine(path, machineId)
+			if err != nil {
+				return nil, errors.New("Could not lock machine " + machineId + ": " + err.Error())
+			}
+			if locked {
+				return lock, nil
+			}
+		}
+
+		if !wait {
+			return nil, errors.New("Machine " + machineId + " is locked by another job")
+		}
+		if time.Now().After(deadline) {
+			return nil, errors.New("Timed out after " + timeout.String() + " waiting for the lock of machine " + machineId)
+		}
+		if position != lastPosition {
+			waiting(position)
+			lastPosition = position
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(machineLockInterval):
+		}
+	}
+}
+
+/*
+Release the lock of the machine
+*/
+func (l *machineLock) release() {
+	syscall.Flock(int(l.file.Fd()), syscall.LOCK_UN)
+	l.file.Close()
+}
@@ -0,0 +1,183 @@
+/*
+Notifying about the outcome of jobs by posting to a webhook, with a payload
+rendered from a template which may include an excerpt of the log
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+)
+
+/*
+The payload posted if a notification has no template
+*/
+const defaultNotificationTemplate = `{"text": {{ printf "Job %s: %s (log %s)" .JobId .Status .LogId | json }}}`
+
+/*
+How long to wait for the webhook to respond
+*/
+const notificationTimeout = 10 * time.Second
+
+/*
+Type defining the notification of a job. The URL is posted to when the job
+fails, or whenever it ends if On is "always". The template renders the payload
+*/
+type Notification struct {
+	URL      string
+	On       string
+	Template string
+}
+
+/*
+Type defining the data available to the template of a notification
+*/
+type notificationData struct {
+	JobId  string
+	LogId  string
+	Status string
+	Step   string
+	Error  string
+	Log    logExcerpt
+}
+
+/*
+Type giving templates access to the output of a log, as .Log.Tail <n>. Go
+templates only call exported methods with arguments, so the excerpt can not be
+given as .log.tail <n> like the lowercase data of other templates, e.g. .vars
+*/
+type logExcerpt struct {
+	file string
+}
+
+/*
+Get the last n lines of the output of the log
+*/
+func (l logExcerpt) Tail(n int) string {
+	data, err := ioutil.ReadFile(l.file)
+	if err != nil {
+		return ""
+	}
+
+	lines := strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+	if n >= 0 && len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return strings.Join(lines, "\n")
+}
+
+/*
+Parse the template of the notification
+*/
+func notificationTemplate(notification Notification) (*template.Template, error) {
+	text := notification.Template
+	if text == "" {
+		text = defaultNotificationTemplate
+	}
+
+	// Encoding values as JSON strings keeps the payload valid whatever the
+	// output of the job
+	return template.New("notification").Funcs(template.FuncMap{
+		"json": func(value interface{}) (string, error) {
+			data, err := encodeSetup(value, "")
+			return string(data), err
+		},
+	}).Parse(text)
+}
+
+/*
+Validate the notification
+*/
+func validateNotification(notification Notification) error {
+	if notification.URL == "" {
+		return errors.New("Notify must have a URL")
+	}
+	if notification.On != "" && notification.On != "failure" && notification.On != "always" {
+		return errors.New("Unknown On '" + notification.On + "'. Must be failure or always")
+	}
+	if strings.Contains(notification.Template, ".log.tail") {
+		return errors.New("The template must reference the end of the log as .Log.Tail <n>, as Go templates can not call .log.tail")
+	}
+	return checkNotificationPayload(notification)
+}
+
+/*
+Send the notification of the job if its status calls for it. Step and failure
+are the step that failed and its error, if any
+*/
+func (p Pipeline) notify(path, status, step, failure string) {
+	if p.Notify == nil || (status == "Finished" && p.Notify.On != "always") {
+		return
+	}
+
+	data := notificationData{
+		JobId:  p.Log.JobId,
+		LogId:  p.Log.Id,
+		Status: status,
+		Step:   step,
+		Error:  failure,
+		Log:    logExcerpt{file: path + "/logs/" + p.Log.Id},
+	}
+
+	err := sendNotification(*p.Notify, data)
+	if err != nil {
+		fmt.Fprintf(p.File, "WARNING: Could not send the notification: %s\n", err.Error())
+	}
+}
+
+/*
+Render the payload of the notification and post it to its URL
+*/
+func sendNotification(notification Notification, data notificationData) error {
+	tmpl, err := notificationTemplate(notification)
+	if err != nil {
+		return err
+	}
+
+	payload := bytes.Buffer{}
+	err = tmpl.Execute(&payload, data)
+	if err != nil {
+		return err
+	}
+
+	client := http.Client{Timeout: notificationTimeout}
+	response, err := client.Post(notification.URL, "application/json", &payload)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode >= 300 {
+		return errors.New("The webhook responded with " + response.Status)
+	}
+	return nil
+}
+
+/*
+Check that the payload of the notification is valid JSON for some data, catching
+templates producing invalid payloads before they are needed
+*/
+func checkNotificationPayload(notification Notification) error {
+	tmpl, err := notificationTemplate(notification)
+	if err != nil {
+		return err
+	}
+
+	payload := bytes.Buffer{}
+	err = tmpl.Execute(&payload, notificationData{Status: "Error"})
+	if err != nil {
+		return err
+	}
+	if !json.Valid(payload.Bytes()) {
+		return errors.New("The template does not render valid JSON")
+	}
+	return nil
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+/*
+Test that templates referencing the end of the log as .Log.Tail are valid,
+while .log.tail is rejected naming the field to use
+*/
+func TestNotificationLogTail(t *testing.T) {
+	notification := Notification{URL: "https://hooks.example.com/", Template: `{"text": {{ .Log.Tail 20 | json }}}`}
+	if err := validateNotification(notification); err != nil {
+		t.Errorf("got %v for .Log.Tail", err)
+	}
+
+	notification.Template = `{"text": {{ .log.tail 20 | json }}}`
+	if err := validateNotification(notification); err == nil || !strings.Contains(err.Error(), ".Log.Tail") {
+		t.Errorf("got %v for .log.tail, expected an error naming .Log.Tail", err)
+	}
+}
@@ -12,6 +12,8 @@ import (
 	"os"
         "path/filepath"
         "log"
+	"strings"
+	"time"
 )
 
 /*
@@ -25,80 +27,960 @@ func main() {
 	}
 
 	// Handle flags and arguments
-	var path string
+	var path, timeout string
+	var noTTY, pollLogs bool
 	flag.StringVar(&path, "-p", "orchid", "Specify the path to the config directory")
+	flag.StringVar(&timeout, "timeout", "", "Give up and exit non-zero if the command runs longer than the duration, e.g. 10m")
+	flag.BoolVar(&noTTY, "no-tty", false, "Fail interactive features instead of waiting for input, implied if stdin is not a terminal")
+	flag.BoolVar(&pollLogs, "poll-logs", false, "Follow logs by polling them for changes, e.g. on network filesystems")
 	flag.Parse()
 	var args = flag.Args()
 
+	// Flags may be given without a command
+	if len(args) == 0 {
+		printUsage()
+		return
+	}
+
         currentdir, err := filepath.Abs(filepath.Dir(os.Args[0]))
         if err != nil {
                 log.Fatal("Can't determine full path!")
         }
         path = currentdir + "/" + path
 
-	actions := Actions{path}
+	actions := Actions{path: path, noTTY: noTTY || !isTerminal(os.Stdin), pollLogs: pollLogs}
+
+	// Cap how long the command runs, killing whatever it started
+	if timeout != "" {
+		duration, err := parseDuration(timeout)
+		if err != nil || duration <= 0 {
+			fmt.Println("ERROR: Invalid timeout '" + timeout + "'")
+			os.Exit(1)
+		}
+		actions.ctx = withTimeout(duration)
+	}
 
 	// Create logs dir if it does not exist
 	os.Mkdir("orchid/logs", 0744)
 
+	runCommand(&actions, args)
+
+	// Commands stopped by running out of time, e.g. cancelled jobs, exit
+	// non-zero too
+	if actions.context().Err() != nil {
+		killDescendants()
+		os.Exit(timeoutExitCode)
+	}
+}
+
+/*
+Run the command given by the arguments. Used both for the command line and the
+interactive shell
+*/
+func runCommand(actions *Actions, args []string) {
 	// Run job
 	if args[0] == "run" {
-		if len(args) != 2 {
+		var only, from, to, machineMap, onlyMachines, output string
+		var force, quiet, checkOnly, noCache, noWait, watchLog, yes bool
+		var marker, varFile, stepTimeout, jobTimeout string
+		var vars varFlags
+		runFlags := flag.NewFlagSet("run", flag.ContinueOnError)
+		runFlags.StringVar(&only, "only", "", "Comma separated names or tags of the steps to run")
+		runFlags.StringVar(&from, "from", "", "Name of the first step to run")
+		runFlags.StringVar(&to, "to", "", "Name of the last step to run")
+		runFlags.BoolVar(&force, "force", false, "Run the job even if orchid is locked")
+		runFlags.BoolVar(&quiet, "quiet", false, "Do not show progress while waiting for the job to produce output")
+		runFlags.BoolVar(&checkOnly, "check-only", false, "Only run the check steps of the job")
+		runFlags.BoolVar(&noCache, "no-cache", false, "Run cached steps even if their inputs are unchanged")
+		runFlags.StringVar(&machineMap, "machine", "", "Comma separated machines to run on instead of others, e.g. web1=web1-canary")
+		runFlags.StringVar(&onlyMachines, "only-machine", "", "Comma separated machines to run only the steps of")
+		runFlags.StringVar(&output, "output", "", "File to also write the output of the job to")
+		runFlags.BoolVar(&watchLog, "watch-log", false, "Open the log in the pager once the job is done")
+		runFlags.BoolVar(&noWait, "no-wait", false, "Fail instead of waiting if a machine is locked by another job")
+		runFlags.BoolVar(&yes, "yes", false, "Run the job without asking for confirmation")
+		runFlags.Var(&vars, "var", "Variable substituted into the steps, as <name>=<value>. May be given several times")
+		runFlags.StringVar(&varFile, "var-file", "", "YAML, JSON, or .env file of variables, overridden by --var")
+		runFlags.StringVar(&marker, "marker", "", "What the run deploys, e.g. a version, for rolling back to it")
+		runFlags.StringVar(&stepTimeout, "step-timeout", "", "Fail attempts of steps without a Timeout of their own running longer than the duration, e.g. 60s")
+		runFlags.StringVar(&jobTimeout, "job-timeout", "", "Fail the job if it runs longer than the duration, e.g. 10m")
+		if runFlags.Parse(args[1:]) != nil {
+			return
+		}
+
+		if runFlags.NArg() != 1 {
 			printUsage()
 			return
 		}
 
-		jobId := args[1]
-		actions.RunJob(jobId)
+		options := RunOptions{From: from, To: to, Force: force, Quiet: quiet, CheckOnly: checkOnly, NoCache: noCache, NoWait: noWait, Output: output, Yes: yes, Marker: marker, StepTimeout: stepTimeout, JobTimeout: jobTimeout}
+		for _, timeout := range []string{stepTimeout, jobTimeout} {
+			if _, err := parseDuration(timeout); err != nil {
+				fmt.Println("ERROR: Invalid timeout '" + timeout + "'")
+				return
+			}
+		}
+		if only != "" {
+			options.Only = strings.Split(only, ",")
+		}
+		if onlyMachines != "" {
+			options.OnlyMachines = strings.Split(onlyMachines, ",")
+		}
+		if machineMap != "" {
+			options.MachineMap = map[string]string{}
+			for _, mapping := range strings.Split(machineMap, ",") {
+				parts := strings.SplitN(mapping, "=", 2)
+				if len(parts) != 2 {
+					fmt.Println("ERROR: Invalid machine mapping '" + mapping + "', expected <machine id>=<machine id>")
+					return
+				}
+				options.MachineMap[parts[0]] = parts[1]
+			}
+		}
+
+		var err error
+		options.Vars, err = resolveVars(varFile, vars)
+		if err != nil {
+			fmt.Println("ERROR: " + err.Error())
+			return
+		}
+
+		jobId := runFlags.Arg(0)
+		result, err := actions.RunJob(jobId, options)
+		if err != nil {
+			fmt.Println("ERROR: " + err.Error())
+			return
+		}
+
+		if watchLog {
+			err = actions.ViewLog(result.LogId)
+			if err != nil {
+				fmt.Println("ERROR: " + err.Error())
+			}
+		}
+	}
+
+	// Run a job whenever files change
+	if args[0] == "watch" {
+		var debounce time.Duration
+		watchFlags := flag.NewFlagSet("watch", flag.ContinueOnError)
+		watchFlags.DurationVar(&debounce, "debounce", 500*time.Millisecond, "How long files must be unchanged before the job runs")
+		if watchFlags.Parse(args[1:]) != nil {
+			return
+		}
+
+		if watchFlags.NArg() != 2 {
+			printUsage()
+			return
+		}
+
+		err := actions.Watch(watchFlags.Arg(0), watchFlags.Arg(1), debounce)
+		if err != nil {
+			fmt.Println("ERROR: " + err.Error())
+		}
 	}
 
-	// Execute action
+	// Run the job of a log again
+	if args[0] == "rerun" {
+		var force, quiet, yes bool
+		rerunFlags := flag.NewFlagSet("rerun", flag.ContinueOnError)
+		rerunFlags.BoolVar(&force, "force", false, "Run the job even if orchid is locked")
+		rerunFlags.BoolVar(&quiet, "quiet", false, "Do not show progress while waiting for the job to produce output")
+		rerunFlags.BoolVar(&yes, "yes", false, "Run the job without asking for confirmation")
+		if rerunFlags.Parse(args[1:]) != nil {
+			return
+		}
+
+		if rerunFlags.NArg() != 1 {
+			printUsage()
+			return
+		}
+
+		_, err := actions.ReRun(rerunFlags.Arg(0), force, quiet, yes)
+		if err != nil {
+			fmt.Println("ERROR: " + err.Error())
+		}
+	}
+
+	// Run the failed steps of a run again
+	if args[0] == "retry" {
+		var force, quiet, yes bool
+		retryFlags := flag.NewFlagSet("retry", flag.ContinueOnError)
+		retryFlags.BoolVar(&force, "force", false, "Run the job even if orchid is locked")
+		retryFlags.BoolVar(&quiet, "quiet", false, "Do not show progress while waiting for the job to produce output")
+		retryFlags.BoolVar(&yes, "yes", false, "Run the job without asking for confirmation")
+		if retryFlags.Parse(args[1:]) != nil {
+			return
+		}
+
+		if retryFlags.NArg() != 1 {
+			printUsage()
+			return
+		}
+
+		_, err := actions.Retry(retryFlags.Arg(0), force, quiet, yes)
+		if err != nil {
+			fmt.Println("ERROR: " + err.Error())
+		}
+	}
+
+	// Roll a job back to the previously deployed marker
+	if args[0] == "rollback" {
+		var force, quiet, yes bool
+		rollbackFlags := flag.NewFlagSet("rollback", flag.ContinueOnError)
+		rollbackFlags.BoolVar(&force, "force", false, "Run the job even if orchid is locked")
+		rollbackFlags.BoolVar(&quiet, "quiet", false, "Do not show progress while waiting for the job to produce output")
+		rollbackFlags.BoolVar(&yes, "yes", false, "Run the job without asking for confirmation")
+		if rollbackFlags.Parse(args[1:]) != nil {
+			return
+		}
+
+		if rollbackFlags.NArg() != 1 {
+			printUsage()
+			return
+		}
+
+		_, err := actions.Rollback(rollbackFlags.Arg(0), force, quiet, yes)
+		if err != nil {
+			fmt.Println("ERROR: " + err.Error())
+		}
+	}
+
+	// Execute action, or a command on all machines
 	if args[0] == "exec" {
-		if len(args) != 2 {
+		var all, force, abortOnUnreachable, yes bool
+		var workers int
+		var varFile, batch, healthCheck string
+		var vars varFlags
+		execFlags := flag.NewFlagSet("exec", flag.ContinueOnError)
+		execFlags.BoolVar(&all, "all", false, "Execute the given command on all machines")
+		execFlags.BoolVar(&force, "force", false, "Execute the action or command even if orchid is locked")
+		execFlags.BoolVar(&abortOnUnreachable, "abort-on-unreachable", false, "Execute a group action only if all machines of the group are reachable")
+		execFlags.BoolVar(&yes, "yes", false, "Execute the action without asking for confirmation")
+		execFlags.Var(&vars, "var", "Variable substituted into the command, as <name>=<value>. May be given several times")
+		execFlags.StringVar(&varFile, "var-file", "", "YAML, JSON, or .env file of variables, overridden by --var")
+		execFlags.StringVar(&batch, "batch", "", "Execute a group action in waves of the number or percentage of machines, e.g. 2 or 25%")
+		execFlags.StringVar(&healthCheck, "health-check", "", "Action executed on each machine of a wave before the next wave starts")
+		execFlags.IntVar(&workers, "workers", 10, "Number of machines to execute the command on concurrently")
+		if execFlags.Parse(args[1:]) != nil {
+			return
+		}
+
+		if execFlags.NArg() != 1 {
+			printUsage()
+			return
+		}
+
+		if all {
+			err := actions.Exec(execFlags.Arg(0), workers, force)
+			if err != nil {
+				fmt.Println("ERROR: " + err.Error())
+			}
+			return
+		}
+
+		actionVars, err := resolveVars(varFile, vars)
+		if err != nil {
+			fmt.Println("ERROR: " + err.Error())
+			return
+		}
+
+		var waves *Batch
+		if batch != "" {
+			waves, err = parseBatch(batch)
+			if err != nil {
+				fmt.Println("ERROR: " + err.Error())
+				return
+			}
+			waves.HealthCheck = healthCheck
+		} else if healthCheck != "" {
+			fmt.Println("ERROR: --health-check is only used with --batch")
+			return
+		}
+
+		actionId := execFlags.Arg(0)
+		err = actions.ExecuteAction(actionId, force, abortOnUnreachable, yes, actionVars, waves)
+		if err != nil {
+			fmt.Println("ERROR: " + err.Error())
+		}
+	}
+
+	// Execute action on a given machine for testing
+	if args[0] == "test" {
+		var force, yes bool
+		var varFile string
+		var vars varFlags
+		testFlags := flag.NewFlagSet("test", flag.ContinueOnError)
+		testFlags.BoolVar(&force, "force", false, "Execute the action even if orchid is locked")
+		testFlags.BoolVar(&yes, "yes", false, "Execute the action without asking for confirmation")
+		testFlags.Var(&vars, "var", "Variable substituted into the command, as <name>=<value>. May be given several times")
+		testFlags.StringVar(&varFile, "var-file", "", "YAML, JSON, or .env file of variables, overridden by --var")
+		if testFlags.Parse(args[1:]) != nil {
+			return
+		}
+
+		if testFlags.NArg() != 2 {
 			printUsage()
 			return
 		}
 
-		actionId := args[1]
-		actions.ExecuteAction(actionId)
+		actionVars, err := resolveVars(varFile, vars)
+		if err != nil {
+			fmt.Println("ERROR: " + err.Error())
+			return
+		}
+
+		err = actions.TestAction(testFlags.Arg(0), testFlags.Arg(1), force, yes, actionVars)
+		if err != nil {
+			fmt.Println("ERROR: " + err.Error())
+		}
+	}
+
+	// Create a new configuration
+	if args[0] == "init" {
+		if len(args) != 1 {
+			printUsage()
+			return
+		}
+
+		err := actions.Init()
+		if err != nil {
+			fmt.Println("ERROR: " + err.Error())
+		}
+	}
+
+	// Lock orchid, preventing jobs and actions from being run
+	if args[0] == "lock" {
+		if len(args) < 2 {
+			printUsage()
+			return
+		}
+
+		err := actions.Lock(strings.Join(args[1:], " "))
+		if err != nil {
+			fmt.Println("ERROR: " + err.Error())
+		}
+	}
+
+	// Unlock orchid
+	if args[0] == "unlock" {
+		if len(args) != 1 {
+			printUsage()
+			return
+		}
+
+		err := actions.Unlock()
+		if err != nil {
+			fmt.Println("ERROR: " + err.Error())
+		}
 	}
 
 	// List
 	if args[0] == "list" {
-		if len(args) != 2 {
+		if len(args) < 2 {
 			printUsage()
 			return
 		}
 
+		// Actions can be listed by machine, and jobs, actions, machines,
+		// and logs formatted using a template
+		var machineId, format string
+		var byMachine bool
+		listFlags := flag.NewFlagSet("list "+args[1], flag.ContinueOnError)
+		if args[1] == "actions" {
+			listFlags.StringVar(&machineId, "machine", "", "Only list the actions targeting the machine")
+			listFlags.BoolVar(&byMachine, "by-machine", false, "Group the actions by the machines they target")
+		}
+		if args[1] != "scripts" && args[1] != "keys" {
+			listFlags.StringVar(&format, "format", "", "Go template printed for each item, e.g. '{{ .Id }}'")
+		}
+		if listFlags.Parse(args[2:]) != nil {
+			return
+		}
+
+		if listFlags.NArg() != 0 {
+			printUsage()
+			return
+		}
+
+		var err error
 		if args[1] == "jobs" {
 			// List jobs
-			actions.ListJobs()
+			err = actions.ListJobs(format)
 		} else if args[1] == "actions" {
-			// List actions
-			actions.ListActions()
+			// List actions, optionally only those of a machine
+			err = actions.ListActions(machineId, byMachine, format)
 		} else if args[1] == "machines" {
 			// List machines
-			actions.ListMachines()
+			err = actions.ListMachines(format)
 		} else if args[1] == "scripts" {
 			// List scripts
 			actions.ListScripts()
+		} else if args[1] == "keys" {
+			// List keys
+			actions.ListKeys()
 		} else if args[1] == "logs" {
 			// List logs
-			actions.ListLogs()
+			err = actions.ListLogs(format)
 		} else {
 			printUsage()
 		}
+		if err != nil {
+			fmt.Println("ERROR: " + err.Error())
+		}
+	}
+
+	// Print a shell completion script
+	if args[0] == "completion" {
+		if len(args) != 2 {
+			printUsage()
+			return
+		}
+
+		err := actions.Completion(args[1])
+		if err != nil {
+			fmt.Println("ERROR: " + err.Error())
+		}
+	}
+
+	// List ids for the completion scripts. Errors are printed to stderr, as
+	// the output is used as completion candidates
+	if args[0] == "__complete" {
+		err := actions.Complete(args[1:])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "ERROR: "+err.Error())
+		}
+		return
+	}
+
+	// Rename an entity, updating references to it
+	if args[0] == "rename" {
+		if len(args) != 4 {
+			printUsage()
+			return
+		}
+
+		err := actions.Rename(args[1], args[2], args[3])
+		if err != nil {
+			fmt.Println("ERROR: " + err.Error())
+		}
+	}
+
+	// Copy a job to a new job
+	if args[0] == "duplicate" {
+		if len(args) != 3 {
+			printUsage()
+			return
+		}
+
+		err := actions.DuplicateJob(args[1], args[2])
+		if err != nil {
+			fmt.Println("ERROR: " + err.Error())
+		}
+	}
+
+	// Copy a file to all machines of a group
+	if args[0] == "copy" {
+		var force bool
+		copyFlags := flag.NewFlagSet("copy", flag.ContinueOnError)
+		copyFlags.BoolVar(&force, "force", false, "Copy even if orchid is locked")
+		if copyFlags.Parse(args[1:]) != nil {
+			return
+		}
+
+		if copyFlags.NArg() != 3 {
+			printUsage()
+			return
+		}
+
+		err := actions.CopyToGroup(copyFlags.Arg(0), copyFlags.Arg(1), copyFlags.Arg(2), force)
+		if err != nil {
+			fmt.Println("ERROR: " + err.Error())
+		}
+	}
+
+	// Edit a configuration file, validating it before saving
+	if args[0] == "edit" {
+		if len(args) != 2 {
+			printUsage()
+			return
+		}
+
+		err := actions.Edit(args[1])
+		if err != nil {
+			fmt.Println("ERROR: " + err.Error())
+		}
+	}
+
+	// Export a job as a bundle
+	if args[0] == "export" {
+		if len(args) != 3 {
+			printUsage()
+			return
+		}
+
+		err := actions.Export(args[1], args[2])
+		if err != nil {
+			fmt.Println("ERROR: " + err.Error())
+		}
+	}
+
+	// Import a bundle
+	if args[0] == "import" {
+		if len(args) != 2 {
+			printUsage()
+			return
+		}
+
+		err := actions.Import(args[1])
+		if err != nil {
+			fmt.Println("ERROR: " + err.Error())
+		}
+	}
+
+	// Import the hosts of an ssh config as machines
+	if args[0] == "import-ssh-config" {
+		if len(args) > 2 {
+			printUsage()
+			return
+		}
+
+		configPath := ""
+		if len(args) == 2 {
+			configPath = args[1]
+		}
+		err := actions.ImportFromSSHConfig(configPath)
+		if err != nil {
+			fmt.Println("ERROR: " + err.Error())
+		}
+	}
+
+	// Describe a job
+	if args[0] == "describe" {
+		if len(args) != 2 {
+			printUsage()
+			return
+		}
+
+		err := actions.DescribeJob(args[1])
+		if err != nil {
+			fmt.Println("ERROR: " + err.Error())
+		}
+	}
+
+	// Describe a machine, checking whether it is reachable
+	if args[0] == "describe-machine" {
+		if len(args) != 2 {
+			printUsage()
+			return
+		}
+
+		err := actions.DescribeMachine(args[1])
+		if err != nil {
+			fmt.Println("ERROR: " + err.Error())
+		}
+	}
+
+	// Find where an entity is defined
+	if args[0] == "which" {
+		if len(args) != 2 {
+			printUsage()
+			return
+		}
+
+		err := actions.Which(args[1])
+		if err != nil {
+			fmt.Println("ERROR: " + err.Error())
+		}
+	}
+
+	// Open a log in the pager
+	if args[0] == "view" {
+		if len(args) != 2 {
+			printUsage()
+			return
+		}
+
+		err := actions.ViewLog(args[1])
+		if err != nil {
+			fmt.Println("ERROR: " + err.Error())
+		}
+	}
+
+	// Follow the latest run of a job
+	if args[0] == "follow" {
+		var latest bool
+		followFlags := flag.NewFlagSet("follow", flag.ContinueOnError)
+		followFlags.BoolVar(&latest, "latest", false, "Switch to each new run of the job as it starts")
+		if followFlags.Parse(args[1:]) != nil {
+			return
+		}
+
+		if followFlags.NArg() != 1 {
+			printUsage()
+			return
+		}
+
+		err := actions.FollowJob(followFlags.Arg(0), latest)
+		if err != nil {
+			fmt.Println("ERROR: " + err.Error())
+		}
 	}
 
 	// Get log output
 	if args[0] == "logs" {
+		var lines int
+		var follow, jsonLines bool
+		var output string
+		logsFlags := flag.NewFlagSet("logs", flag.ContinueOnError)
+		logsFlags.StringVar(&output, "output", "", "File to also write the output of the log to")
+		logsFlags.IntVar(&lines, "tail", -1, "Only show the last lines of the log")
+		logsFlags.BoolVar(&follow, "follow", false, "Follow the log after the last lines, if its job is running")
+		logsFlags.BoolVar(&jsonLines, "json-lines", false, "Write each line as a JSON object, followed by the status of the log")
+		if logsFlags.Parse(args[1:]) != nil {
+			return
+		}
+
+		if jsonLines {
+			if logsFlags.NArg() != 1 || lines >= 0 {
+				printUsage()
+				return
+			}
+			actions.GetLogOutput(logsFlags.Arg(0), output, true)
+			return
+		}
+
+		if lines >= 0 {
+			if logsFlags.NArg() != 1 {
+				printUsage()
+				return
+			}
+			err := actions.TailLog(logsFlags.Arg(0), lines, follow)
+			if err != nil {
+				fmt.Println("ERROR: " + err.Error())
+			}
+			return
+		}
+
+		args = append([]string{"logs"}, logsFlags.Args()...)
+		if len(args) < 2 {
+			printUsage()
+			return
+		}
+
+		if len(args) == 2 && actions.isGroupAction(args[1]) {
+			err := actions.FollowGroup(args[1])
+			if err != nil {
+				fmt.Println("ERROR: " + err.Error())
+			}
+			return
+		}
+
+		if len(args) == 2 && !actions.isJob(args[1]) {
+			logId := args[1]
+			actions.GetLogOutput(logId, output, false)
+			return
+		}
+
+		err := actions.FollowLogs(args[1:])
+		if err != nil {
+			fmt.Println("ERROR: " + err.Error())
+		}
+	}
+
+	// Show the audit log
+	if args[0] == "audit" {
+		if len(args) != 1 {
+			printUsage()
+			return
+		}
+
+		actions.ShowAudit()
+	}
+
+	// Clear the cache of steps
+	if args[0] == "clear-cache" {
+		if len(args) != 1 {
+			printUsage()
+			return
+		}
+
+		err := actions.ClearCache()
+		if err != nil {
+			fmt.Println("ERROR: " + err.Error())
+		}
+	}
+
+	// Show when the steps of a run ran
+	if args[0] == "trace" {
+		var chrome bool
+		traceFlags := flag.NewFlagSet("trace", flag.ContinueOnError)
+		traceFlags.BoolVar(&chrome, "chrome", false, "Print a trace in the Chrome trace event format instead of a timeline")
+		if traceFlags.Parse(args[1:]) != nil {
+			return
+		}
+
+		if traceFlags.NArg() != 1 {
+			printUsage()
+			return
+		}
+
+		err := actions.Trace(traceFlags.Arg(0), chrome)
+		if err != nil {
+			fmt.Println("ERROR: " + err.Error())
+		}
+	}
+
+	// Show the pipeline of a job as a diagram
+	if args[0] == "graph" {
+		var format string
+		graphFlags := flag.NewFlagSet("graph", flag.ContinueOnError)
+		graphFlags.StringVar(&format, "format", "dot", "Format of the diagram, either dot or mermaid")
+		if graphFlags.Parse(args[1:]) != nil {
+			return
+		}
+
+		if graphFlags.NArg() != 1 {
+			printUsage()
+			return
+		}
+
+		err := actions.Graph(graphFlags.Arg(0), format)
+		if err != nil {
+			fmt.Println("ERROR: " + err.Error())
+		}
+	}
+
+	// Summarize the runs of each job
+	if args[0] == "stats" {
+		var since string
+		statsFlags := flag.NewFlagSet("stats", flag.ContinueOnError)
+		statsFlags.StringVar(&since, "since", "", "Only include runs started within the duration, e.g. 7d, or since the date, e.g. 2024-01-31")
+		if statsFlags.Parse(args[1:]) != nil {
+			return
+		}
+
+		if statsFlags.NArg() != 0 {
+			printUsage()
+			return
+		}
+
+		err := actions.Stats(since)
+		if err != nil {
+			fmt.Println("ERROR: " + err.Error())
+		}
+	}
+
+	// Check whether the machines are reachable
+	if args[0] == "ping" {
+		var noCache bool
+		pingFlags := flag.NewFlagSet("ping", flag.ContinueOnError)
+		pingFlags.BoolVar(&noCache, "no-cache", false, "Check all machines, ignoring cached results")
+		if pingFlags.Parse(args[1:]) != nil {
+			return
+		}
+
+		if pingFlags.NArg() != 0 {
+			printUsage()
+			return
+		}
+
+		err := actions.PingAll(noCache)
+		if err != nil {
+			fmt.Println("ERROR: " + err.Error())
+		}
+	}
+
+	// Diagnose the environment
+	if args[0] == "doctor" {
+		if len(args) != 1 {
+			printUsage()
+			return
+		}
+
+		err := actions.Doctor()
+		if err != nil {
+			fmt.Println("ERROR: " + err.Error())
+		}
+	}
+
+	// Delete the keys not used by any machine
+	if args[0] == "prune-keys" {
+		var yes bool
+		pruneFlags := flag.NewFlagSet("prune-keys", flag.ContinueOnError)
+		pruneFlags.BoolVar(&yes, "yes", false, "Delete the keys without asking for confirmation")
+		if pruneFlags.Parse(args[1:]) != nil {
+			return
+		}
+
+		if pruneFlags.NArg() != 0 {
+			printUsage()
+			return
+		}
+
+		err := actions.PruneKeys(yes)
+		if err != nil {
+			fmt.Println("ERROR: " + err.Error())
+		}
+	}
+
+	// Show the public key of the key of a machine
+	if args[0] == "show-key" {
+		if len(args) != 2 {
+			printUsage()
+			return
+		}
+
+		err := actions.ShowKey(args[1])
+		if err != nil {
+			fmt.Println("ERROR: " + err.Error())
+		}
+	}
+
+	// Rotate the key of a machine
+	if args[0] == "swap-key" {
+		var removeOld bool
+		swapFlags := flag.NewFlagSet("swap-key", flag.ContinueOnError)
+		swapFlags.BoolVar(&removeOld, "remove-old", false, "Remove the old key from the authorized keys on the machine once swapped")
+		if swapFlags.Parse(args[1:]) != nil {
+			return
+		}
+
+		if swapFlags.NArg() != 2 {
+			printUsage()
+			return
+		}
+
+		err := actions.SwapKey(swapFlags.Arg(0), swapFlags.Arg(1), removeOld)
+		if err != nil {
+			fmt.Println("ERROR: " + err.Error())
+		}
+	}
+
+	// Gather the facts of machines
+	if args[0] == "facts" {
+		if len(args) > 2 {
+			printUsage()
+			return
+		}
+
+		machineId := ""
+		if len(args) == 2 {
+			machineId = args[1]
+		}
+		err := actions.GatherFacts(machineId)
+		if err != nil {
+			fmt.Println("ERROR: " + err.Error())
+		}
+	}
+
+	// Verify the host key of a machine
+	if args[0] == "verify" {
+		if len(args) != 2 {
+			printUsage()
+			return
+		}
+
+		err := actions.Verify(args[1])
+		if err != nil {
+			fmt.Println("ERROR: " + err.Error())
+		}
+	}
+
+	// Start the interactive shell
+	if args[0] == "shell" {
+		if len(args) != 1 {
+			printUsage()
+			return
+		}
+
+		err := actions.Shell()
+		if err != nil {
+			fmt.Println("ERROR: " + err.Error())
+		}
+	}
+
+	// Stop a running job
+	if args[0] == "stop" {
+		if len(args) != 2 {
+			printUsage()
+			return
+		}
+
+		err := actions.StopJob(args[1])
+		if err != nil {
+			fmt.Println("ERROR: " + err.Error())
+		}
+	}
+
+	// Cancel all running instances of a job
+	if args[0] == "cancel" {
 		if len(args) != 2 {
 			printUsage()
 			return
 		}
 
-		logId := args[1]
-		actions.GetLogOutput(logId)
+		err := actions.Cancel(args[1])
+		if err != nil {
+			fmt.Println("ERROR: " + err.Error())
+		}
+	}
+
+	// Stop all running jobs
+	if args[0] == "killall" {
+		if len(args) != 1 {
+			printUsage()
+			return
+		}
+
+		err := actions.KillAll()
+		if err != nil {
+			fmt.Println("ERROR: " + err.Error())
+		}
+	}
+
+	// Show or close the shared connections to machines
+	if args[0] == "connections" {
+		var closeAll bool
+		connectionsFlags := flag.NewFlagSet("connections", flag.ContinueOnError)
+		connectionsFlags.BoolVar(&closeAll, "close", false, "Close the connections")
+		if connectionsFlags.Parse(args[1:]) != nil {
+			return
+		}
+
+		if connectionsFlags.NArg() != 0 {
+			printUsage()
+			return
+		}
+
+		err := actions.Connections(closeAll)
+		if err != nil {
+			fmt.Println("ERROR: " + err.Error())
+		}
+	}
+
+	// Reconcile logs left running, e.g. after a crash
+	if args[0] == "kill-hung" {
+		var stale string
+		killHungFlags := flag.NewFlagSet("kill-hung", flag.ContinueOnError)
+		killHungFlags.StringVar(&stale, "stale", "", "Also stop jobs whose output has not been written to for the duration, e.g. 2h")
+		if killHungFlags.Parse(args[1:]) != nil {
+			return
+		}
+
+		if killHungFlags.NArg() != 0 {
+			printUsage()
+			return
+		}
+
+		duration, err := parseDuration(stale)
+		if err != nil {
+			fmt.Println("ERROR: " + err.Error())
+			return
+		}
+		err = actions.KillHung(duration)
+		if err != nil {
+			fmt.Println("ERROR: " + err.Error())
+		}
 	}
 
 	// SSH into a given machine
@@ -108,30 +990,60 @@ func main() {
 			return
 		}
 
-		machineId := args[1]
-		actions.SSH(machineId)
+		err := actions.SSH(args[1])
+		if err != nil {
+			fmt.Println("ERROR: " + err.Error())
+		}
 	}
 
 	// Copy files/directories from one machine to another
-	if args[0] == "scp" {
-		if len(args) != 3 {
+	if args[0] == "scp" || args[0] == "cp" {
+		var verify, force bool
+		scpFlags := flag.NewFlagSet(args[0], flag.ContinueOnError)
+		scpFlags.BoolVar(&verify, "verify", false, "Compare the SHA256 checksums of the source and the copy once copied")
+		scpFlags.BoolVar(&force, "force", false, "Copy to a machine even if orchid is locked")
+		if scpFlags.Parse(args[1:]) != nil {
+			return
+		}
+
+		if scpFlags.NArg() != 2 {
 			printUsage()
 			return
 		}
 
-		from := args[1]
-		to := args[2]
-		actions.SCP(from, to)
+		from := scpFlags.Arg(0)
+		to := scpFlags.Arg(1)
+		err := actions.Cp(from, to, verify, force)
+		if err != nil {
+			fmt.Println("ERROR: " + err.Error())
+		}
 	}
 
 	// Mount a remote directory locally
 	if args[0] == "mount" {
-		if len(args) != 4 {
+		var readOnly bool
+		var options string
+		mountFlags := flag.NewFlagSet("mount", flag.ContinueOnError)
+		mountFlags.BoolVar(&readOnly, "read-only", false, "Mount the directory read-only")
+		mountFlags.StringVar(&options, "options", "", "Comma separated options passed on to sshfs, e.g. reconnect,compression=yes")
+		if mountFlags.Parse(args[1:]) != nil {
+			return
+		}
+
+		if mountFlags.NArg() != 3 {
 			printUsage()
 			return
 		}
 
-                err := actions.Mount(args[1],args[2],args[3])
+		mountOptions := []string{}
+		if readOnly {
+			mountOptions = append(mountOptions, "ro")
+		}
+		if options != "" {
+			mountOptions = append(mountOptions, strings.Split(options, ",")...)
+		}
+
+                err := actions.Mount(mountFlags.Arg(0),mountFlags.Arg(1),mountFlags.Arg(2),mountOptions)
                 if err != nil {
                         fmt.Printf("Ouch, got error %#v, is the directory already mounted?",err)
                 }
@@ -148,22 +1060,92 @@ func main() {
                         fmt.Printf("Ouch, got error %#v, is the directory mounted?",err)
                 }
 	}
+
+	// Forward ports through a machine
+	if args[0] == "forward" {
+		var mode string
+		forwardFlags := flag.NewFlagSet("forward", flag.ContinueOnError)
+		forwardFlags.StringVar(&mode, "mode", "local", "The forward mode, local (ssh -L), remote (ssh -R), or dynamic (a SOCKS proxy, ssh -D)")
+		if forwardFlags.Parse(args[1:]) != nil {
+			return
+		}
+
+		if forwardFlags.NArg() < 2 {
+			printUsage()
+			return
+		}
+
+		err := actions.Forward(forwardFlags.Arg(0), mode, forwardFlags.Args()[1:])
+		if err != nil {
+			fmt.Println("ERROR: " + err.Error())
+		}
+	}
 }
 
 /*
 Prints a help message, explaining how to use the application
 */
 func printUsage() {
-	fmt.Println("Usage:")
-	fmt.Println("- list jobs\t// List all configured jobs")
-	fmt.Println("- list machines\t// List all configured machines")
+	fmt.Println("Usage: orchid [--timeout <duration>] [--no-tty] [--poll-logs] <command>")
+	fmt.Println("- list jobs [--format <template>]\t// List all configured jobs")
+	fmt.Println("- list actions [--machine <machine id>] [--by-machine] [--format <template>]\t// List all configured actions, or those targeting the machine, optionally grouped by machine")
+	fmt.Println("- list machines [--format <template>]\t// List all configured machines")
 	fmt.Println("- list scripts\t// List all configured scripts")
-	fmt.Println("- list logs\t// List all stored logs")
-	fmt.Println("- run <job id>\t// Run the job with the given id")
-	fmt.Println("- exec <action id>\t// Execute the action with the given id")
-	fmt.Println("- logs <log id>\t// Tail the log with the given id")
+	fmt.Println("- list keys\t// List all keys and the machines using them, flagging orphaned keys")
+	fmt.Println("- list logs [--format <template>]\t// List all stored logs")
+	fmt.Println("- completion <bash|zsh|fish>\t// Print the completion script of the shell")
+	fmt.Println("- copy [--force] <local path> <group id> <remote path>\t// Copy a file to all machines of the group concurrently")
+	fmt.Println("- edit <machines|jobs|actions|groups|scripts|settings>\t// Edit the configuration file in $EDITOR, saving it only if valid")
+	fmt.Println("- export <job id> <bundle file>\t// Export the job along with its machines and scripts, but not keys, as a bundle")
+	fmt.Println("- import <bundle file>\t// Import a bundle exported using export into the setup")
+	fmt.Println("- import-ssh-config [<ssh config file>]\t// Import the hosts of the ssh config, ~/.ssh/config by default, as machines")
+	fmt.Println("- init\t// Create a new configuration in the orchid directory, running steps in strict mode")
+	fmt.Println("- describe <job id>\t// Show the description and steps of the job with the given id")
+	fmt.Println("- describe-machine <machine id>\t// Show the configuration, groups, actions, and facts of the machine, and whether it is reachable")
+	fmt.Println("- rename <kind> <old id> <new id>\t// Rename the machine, job, action, group, script, or key, updating all references to it")
+	fmt.Println("- duplicate <job id> <new job id>\t// Copy the job to a new job with the new id")
+	fmt.Println("- which <id>\t// Show where the machine, job, action, group, script, or key with the given id is defined")
+	fmt.Println("- run [--only <steps>] [--from <step>] [--to <step>] [--force] [--quiet] [--check-only] [--no-cache] [--no-wait] [--machine <from>=<to>] [--only-machine <machines>] [--output <file>] [--watch-log] [--yes] [--marker <marker>] [--var <name>=<value>]... [--var-file <file>] [--step-timeout <duration>] [--job-timeout <duration>] <job id>\t// Run the job with the given id, optionally only the given steps (names or tags, comma separated) or range of steps")
+	fmt.Println("- exec [--force] [--abort-on-unreachable] [--yes] [--var <name>=<value>]... [--var-file <file>] [--batch <n | n%> [--health-check <action id>]] <action id>\t// Execute the action with the given id")
+	fmt.Println("- test [--force] [--yes] [--var <name>=<value>]... [--var-file <file>] <action id> <machine id>\t// Execute the action with the given id on the given machine instead of its own, e.g. a sandbox machine")
+	fmt.Println("- exec --all [--force] [--workers <n>] <command>\t// Execute the command on all machines in parallel")
+	fmt.Println("- watch [--debounce <duration>] <job id> <dir>\t// Run the job whenever files in the directory change, cancelling a run still going")
+	fmt.Println("- rerun [--force] [--quiet] [--yes] <log id>\t// Run the job of the log again with the same options")
+	fmt.Println("- retry [--force] [--quiet] [--yes] <log id>\t// Run the steps that failed in the run of the log again with the same options")
+	fmt.Println("- rollback [--force] [--quiet] [--yes] <job id>\t// Run the job again with the options of the last successful run of the marker deployed before the current one")
+	fmt.Println("- logs [--output <file>] <log id>\t// Tail the log with the given id")
+	fmt.Println("- logs --tail <n> [--follow] <log id>\t// Show the last n lines of the log, following it if running and --follow is given")
+	fmt.Println("- logs --json-lines [--output <file>] <log id>\t// Tail the log as JSON lines of {ts, step, stream, text}, followed by the status of the log")
+	fmt.Println("- logs <log id | job id>...\t// Tail several logs merged, a job id meaning its running or latest log")
+	fmt.Println("- logs <action id>\t// Tail the logs of the latest execution of the group action on each machine, prefixed with the machine id")
+	fmt.Println("- view <log id>\t// Open the log in $PAGER, at the first error of a failed run")
+	fmt.Println("- follow [--latest] <job id>\t// Tail the most recent run of the job, switching to new runs as they start with --latest")
+	fmt.Println("- lock <reason>\t// Lock orchid, refusing to run jobs and actions without --force until unlocked")
+	fmt.Println("- unlock\t// Unlock orchid")
+	fmt.Println("- clear-cache\t// Clear the cache of steps, making cached steps run the next time")
+	fmt.Println("- trace [--chrome] <log id>\t// Show when each step of the run ran as a timeline, or as a trace for chrome://tracing")
+	fmt.Println("- graph [--format dot|mermaid] <job id>\t// Show the pipeline of the job as a Graphviz or Mermaid diagram")
+	fmt.Println("- stats [--since <duration | date>]\t// Show the number of runs, success rate, average duration, and last run of each job")
+	fmt.Println("- ping [--no-cache]\t// Check whether the machines are reachable, reusing recent results")
+	fmt.Println("- shell\t// Start an interactive shell with completion of ids, loading the setup once")
+	fmt.Println("- audit\t// Show the audit log of who ran what")
+	fmt.Println("- stop <log id>\t// Stop the running job with the given log id")
+	fmt.Println("- cancel <job id>\t// Cancel all running instances of the job with the given id")
+	fmt.Println("- killall\t// Stop all running jobs")
+	fmt.Println("- connections [--close]\t// Show the machines with an open shared connection, or close the connections")
+	fmt.Println("- kill-hung [--stale <duration>]\t// Mark logs left running by a process which is gone failed, and stop jobs writing no output for the duration")
+	fmt.Println("- doctor\t// Check the environment and the setup, showing how to fix what is wrong")
+	fmt.Println("- prune-keys [--yes]\t// Delete the keys not used by any machine, after asking for confirmation")
+	fmt.Println("- show-key <machine id>\t// Show the public key of the private key of the machine")
+	fmt.Println("- swap-key [--remove-old] <machine id> <new key file>\t// Authorize the new key on the machine and switch the machine to it once verified")
+	fmt.Println("- facts [<machine id>]\t// Gather the facts of the machine, or all machines, for the steps run on them")
+	fmt.Println("- verify <machine id>\t// Show the host key fingerprints of the machine, and pin its host key if confirmed")
 	fmt.Println("- ssh <machine id>\t// SSH into the machine with the given id")
-	fmt.Println("- scp <machine id>:<path> <machine id>:<path>\t// Copy files/directories from one machine to another. Only one of the machines can be specified. The other must be a path to a local file / directory without ':'")
-        fmt.Println("- mount <machine id> <remote path> <local path>\t// Mount a remote directory (to which you have read access) locally")
+	fmt.Println("- scp [--verify] [--force] <machine id>:<path> <local path>\t// Copy files/directories from a machine to this machine. --verify compares the SHA256 checksums of the source and the copy")
+	fmt.Println("- scp [--verify] [--force] <local path> <machine id>:<path>\t// Copy files/directories from this machine to a machine. Local paths containing ':' must start with '/' or '.'")
+	fmt.Println("- scp [--verify] [--force] <machine id>:<path> <machine id>:<path>\t// Copy files/directories between two machines through this machine")
+	fmt.Println("- cp\t// Alias of scp")
+        fmt.Println("- mount [--read-only] [--options <options>] <machine id> <remote path> <local path>\t// Mount a remote directory (to which you have read access) locally, passing the comma separated options on to sshfs")
         fmt.Println("- unmount <local path>\t// Unmount a previously Mount'ed directory")
+	fmt.Println("- forward [--mode local|remote|dynamic] <machine id> <spec>...\t// Forward local ports through the machine (ssh -L), ports of the machine to this machine (ssh -R), or run a SOCKS proxy through the machine (ssh -D), until interrupted")
 }
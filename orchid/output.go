@@ -0,0 +1,147 @@
+/*
+Writers used for processing the output of commands before it is written to the
+log output file
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+/*
+Type implemented by writers buffering output, which must be flushed once the
+command writing to them has finished
+*/
+type flusher interface {
+	Flush() error
+}
+
+/*
+Writer normalizing output before writing it to the underlying writer. Lines
+overwritten using carriage returns, e.g. by progress bars, are collapsed to
+their final state, and only complete lines are written
+*/
+type normalizingWriter struct {
+	w    io.Writer
+	line []byte
+	cr   bool
+}
+
+/*
+Create a new normalizing writer writing to the given writer
+*/
+func newNormalizingWriter(w io.Writer) *normalizingWriter {
+	return &normalizingWriter{w: w}
+}
+
+/*
+Write output, buffering it until a line is complete
+*/
+func (n *normalizingWriter) Write(p []byte) (int, error) {
+	for _, b := range p {
+		if n.cr && b != '\n' {
+			// The line is being overwritten
+			n.line = n.line[:0]
+		}
+		n.cr = false
+
+		switch b {
+		case '\r':
+			n.cr = true
+		case '\n':
+			n.line = append(n.line, b)
+			_, err := n.w.Write(n.line)
+			n.line = n.line[:0]
+			if err != nil {
+				return 0, err
+			}
+		default:
+			n.line = append(n.line, b)
+		}
+	}
+	return len(p), nil
+}
+
+/*
+Write the incomplete line buffered, if any
+*/
+func (n *normalizingWriter) Flush() error {
+	n.cr = false
+	if len(n.line) == 0 {
+		return nil
+	}
+
+	_, err := n.w.Write(append(n.line, '\n'))
+	n.line = n.line[:0]
+	return err
+}
+
+/*
+Writer capping the output written to the underlying writer, both of the step
+writing to it and of its whole job. Once either limit is reached, a line
+telling the output was truncated is written, and the rest of the output is
+discarded while still accepted, so the command is not stopped by a broken pipe.
+A limit of 0 means no limit
+*/
+type limitedWriter struct {
+	w         io.Writer
+	limit     int64
+	written   int64
+	jobLimit  int64
+	jobOutput *int64
+	truncated bool
+}
+
+/*
+Create a new writer limiting the output of a step to the given limit, and that
+of its job, counted by jobOutput, to jobLimit
+*/
+func newLimitedWriter(w io.Writer, limit int64, jobLimit int64, jobOutput *int64) *limitedWriter {
+	return &limitedWriter{w: w, limit: limit, jobLimit: jobLimit, jobOutput: jobOutput}
+}
+
+/*
+Write output, up to the limits
+*/
+func (l *limitedWriter) Write(p []byte) (int, error) {
+	if l.truncated {
+		return len(p), nil
+	}
+
+	allowed := int64(len(p))
+	if l.limit > 0 && l.written+allowed > l.limit {
+		allowed = l.limit - l.written
+		l.truncated = true
+	}
+	if l.jobLimit > 0 && *l.jobOutput+allowed > l.jobLimit {
+		allowed = l.jobLimit - *l.jobOutput
+		l.truncated = true
+	}
+
+	n, err := l.w.Write(p[:allowed])
+	l.written += int64(n)
+	*l.jobOutput += int64(n)
+	if err != nil {
+		return n, err
+	}
+
+	if l.truncated {
+		_, err = fmt.Fprintf(l.w, "\n[output truncated after %d bytes]\n", l.written)
+		if err != nil {
+			return n, err
+		}
+	}
+	return len(p), nil
+}
+
+/*
+Flush the underlying writer, unless the output was truncated
+*/
+func (l *limitedWriter) Flush() error {
+	if f, ok := l.w.(flusher); ok && !l.truncated {
+		return f.Flush()
+	}
+	return nil
+}
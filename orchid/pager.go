@@ -0,0 +1,64 @@
+/*
+Viewing the output of logs in a pager, e.g. for reviewing a run once it is done
+*/
+
+package main
+
+import (
+	"bufio"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+/*
+Lines mentioning an error, e.g. "ERROR: Step step2 failed" or "error: not found"
+*/
+var errorLine = regexp.MustCompile(`(?i)\berror\b`)
+
+/*
+Get the number of the first line of the output of the log mentioning an error,
+or 0 if none do
+*/
+func firstErrorLine(path, logId string) (int, error) {
+	file, err := os.Open(path + "/logs/" + logId)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for number := 1; scanner.Scan(); number++ {
+		if errorLine.MatchString(scanner.Text()) {
+			return number, nil
+		}
+	}
+	return 0, scanner.Err()
+}
+
+/*
+Open the file in the pager given by $PAGER, falling back to less. less starts
+at the given line, unless it is 0
+*/
+func runPager(file string, line int) error {
+	pager := os.Getenv("PAGER")
+	if strings.TrimSpace(pager) == "" {
+		pager = "less"
+	}
+
+	args := []string{}
+	if line > 0 && filepath.Base(strings.Fields(pager)[0]) == "less" {
+		args = append(args, "+"+strconv.Itoa(line)+"g")
+	}
+
+	// The pager may include arguments, e.g. "less -R"
+	cmd := exec.Command("/bin/bash", append([]string{"-c", pager + ` "$@"`, "orchid"}, append(args, file)...)...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
@@ -6,84 +6,607 @@ logging
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
+	"syscall"
+	"time"
 )
 
 /*
 Type defining the pipeline
 */
 type Pipeline struct {
-	Cmds []*exec.Cmd
-	Log  Log
-	File *os.File
+	Steps    []Step
+	Log      Log
+	File     *os.File
+	Machines []Machine
+	Notify   *Notification
+	NoCache  bool
+
+	// Local command run when the job starts, before its first step
+	OnStart string
+
+	// How long steps wait for the locks of their machines, unless told
+	// not to wait, and the priority of the job when queued for them
+	LockTimeout time.Duration
+	NoWait      bool
+	Priority    int
+
+	// Machines to run on instead of those selected by steps
+	MachineMap map[string]string
+
+	// Timeout of each attempt of steps without a Timeout of their own, and
+	// of the whole job
+	StepTimeout time.Duration
+	JobTimeout  time.Duration
+
+	// Limits of the output of each step and of the whole job, and whether
+	// steps with truncated output fail. The output of the job so far is
+	// counted by jobOutput
+	MaxStepOutput       int64
+	MaxJobOutput        int64
+	FailTruncatedOutput bool
+	jobOutput           *int64
+}
+
+/*
+Type defining a single step of the pipeline
+*/
+type Step struct {
+	Name       string
+	Executable Executable
+	Cmd        *exec.Cmd
+	Skip       bool
+}
+
+/*
+Type defining the options for running a job. Only selects the steps with the
+given names or tags, while From and To select an inclusive range of steps.
+Steps selects the steps at the given indices, e.g. those retried by Retry.
+CheckOnly selects only the check steps, verifying the state without changing it.
+NoCache runs cached steps even if their inputs are unchanged. NoWait fails
+steps whose machine is locked by another job instead of waiting for it.
+MachineMap runs the steps of a machine on another machine instead, e.g. a
+canary, while OnlyMachines selects only the steps running on the given machines.
+Output is a file the output of the job is also written to while followed.
+Marker records what the run deploys, e.g. a version, given to the steps as
+ORCHID_MARKER and used for rolling back to it. Force runs the job even if
+orchid is locked, and Yes without confirming jobs marked Confirm. Quiet hides
+the progress shown while waiting for the job to produce output. RerunOf is the
+id of the log of the run repeated by this run, if any, RetryOf that of the run
+whose failed steps are retried, and RollbackOf that of the run rolled back
+from. Vars are the variables substituted into the commands
+and arguments of the steps. StepTimeout is the timeout of steps without a
+Timeout of their own, and JobTimeout that of the whole job, both given as
+durations such as "60s". The options are stored in the log, allowing the run
+to be repeated.
+*/
+type RunOptions struct {
+	Only         []string
+	Steps        []int
+	From         string
+	To           string
+	Force        bool
+	Quiet        bool
+	RerunOf      string
+	RetryOf      string
+	CheckOnly    bool
+	NoCache      bool
+	NoWait       bool
+	MachineMap   map[string]string
+	OnlyMachines []string
+	Output       string
+	Yes          bool
+	Marker       string
+	RollbackOf   string
+	Vars         map[string]string
+	StepTimeout  string
+	JobTimeout   string
+}
+
+/*
+Type defining the result of running a job, for programmatic use of orchid
+*/
+type JobResult struct {
+	LogId     string
+	JobId     string
+	Status    string
+	StartTime time.Time
+	EndTime   time.Time
+	Steps     []StepResult
+}
+
+/*
+Type defining the result of a single step of a job. The status is "Pending" for
+steps not reached, "Skipped" for steps not selected by the run options, and
+"Cached" for cached steps skipped as their inputs are unchanged.
+Artifacts are the paths of the artifacts collected, relative to the artifacts
+directory of the log
+*/
+type StepResult struct {
+	Name      string
+	Machine   string
+	Status    string
+	StartTime time.Time
+	EndTime   time.Time
+	Attempts  int
+	ExitCode  int
+	Error     string
+	Artifacts []string
+	Offset    int64
+	Length    int64
+	Output    string `json:",omitempty"`
 }
 
 /*
 Run/execute the pipeline, executing the commands it containes sequentially,
-aborting if an error is encountered. This includes updating the logs file.
+aborting if an error is encountered or the context is cancelled. This includes
+updating the logs file. The result of the job and each step is returned and
+stored in the log, and written to the result file of the log once the job is
+done
 */
-func (p Pipeline) Run(path string) {
+func (p Pipeline) Run(ctx context.Context, path string) (result JobResult) {
 	// Always close the file after use
 	defer p.File.Close()
 
+	defer func() {
+		err := writeResultFile(path, result)
+		if err != nil {
+			fmt.Println("WARNING: Could not write the result file of log " + result.LogId + ": " + err.Error())
+		}
+	}()
+
 	var err error
 
+	// The job fails once it runs out of time, unlike when it is cancelled
+	parent := ctx
+	if p.JobTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(parent, p.JobTimeout)
+		defer cancel()
+	}
+	timedOut := func() bool {
+		return ctx.Err() == context.DeadlineExceeded && parent.Err() == nil
+	}
+
+	p.Log.Steps = make([]StepResult, len(p.Steps))
+	for i, step := range p.Steps {
+		p.Log.Steps[i] = StepResult{Name: step.Name, Machine: step.Executable.Machine, Status: "Pending"}
+	}
+
 	// Write to the logs file that the job has started
 	p.Log, err = p.Log.start(path)
 	if err != nil {
-		p.File.Close()
-		p.Log.error(path, p.File)
-		return
+		p.notify(path, "Error", "", err.Error())
+		p.Log, _ = p.Log.error(path, p.File)
+		return p.Log.result()
 	}
 
-	// Run the commands
-	for i, cmd := range p.Cmds {
-		err = cmd.Start()
+	if p.OnStart != "" {
+		err = p.runOnStart(ctx, path)
 		if err != nil {
-			fmt.Fprintf(p.File, "ERROR: Failed to run script %d\n", i)
-			p.Log.error(path, p.File)
-			return
+			fmt.Fprintf(p.File, "ERROR: OnStart of job %s failed, aborting the job: %s\n", p.Log.JobId, err.Error())
+			p.notify(path, "Error", "", "OnStart failed: "+err.Error())
+			p.Log, _ = p.Log.error(path, p.File)
+			return p.Log.result()
+		}
+	}
+
+	// Steps exiting with a mapped exit code give the job their custom status,
+	// the last one winning
+	status := "Finished"
+
+	// Run the commands
+	for i, step := range p.Steps {
+		if ctx.Err() != nil {
+			break
+		}
+
+		if step.Skip {
+			fmt.Fprintf(p.File, "Skipping step %s\n", step.Name)
+			p.Log.Steps[i].Status = "Skipped"
+			continue
+		}
+
+		// Cached steps are skipped if their inputs are unchanged since they
+		// last succeeded
+		cacheKey := ""
+		if step.Executable.Cache && !p.NoCache {
+			key, keyErr := stepCacheKey(path, p.Log.JobId, step)
+			if keyErr != nil {
+				fmt.Fprintf(p.File, "WARNING: Could not check the cache of step %s: %s\n", step.Name, keyErr.Error())
+			} else if cached(path, key) {
+				fmt.Fprintf(p.File, "Step %s cache hit, skipping\n", step.Name)
+				p.Log.Steps[i].Status = "Cached"
+				continue
+			}
+			cacheKey = key
+		}
+
+		// Where the step starts in the output is recorded before writing its
+		// marker, telling the marker apart from output merely looking like one
+		result := &p.Log.Steps[i]
+		result.StartTime = time.Now()
+		if info, statErr := p.File.Stat(); statErr == nil {
+			result.Offset = info.Size()
+		}
+		if saveErr := p.Log.save(path); saveErr != nil {
+			fmt.Fprintf(p.File, "WARNING: Could not record the start of step %s: %s\n", step.Name, saveErr.Error())
+		}
+		fmt.Fprintln(p.File, stepMarker(step.Name))
+		err = p.runStep(ctx, path, step, result)
+		if info, statErr := p.File.Stat(); statErr == nil {
+			result.Length = info.Size() - result.Offset
+		}
+		if err == errStepSkipped {
+			result.EndTime = time.Now()
+			result.Status = "Skipped"
+			continue
+		}
+		if err == nil && len(step.Executable.Artifacts) > 0 {
+			result.Artifacts, err = collectArtifacts(ctx, path, step.Executable.Artifacts, result.Machine, p.Machines, p.Log.Id)
+			for _, artifact := range result.Artifacts {
+				fmt.Fprintf(p.File, "Step %s collected artifact %s\n", step.Name, artifact)
+			}
+		}
+		result.EndTime = time.Now()
+		if timedOut() {
+			result.Status = "Error"
+			result.Error = "Job timed out after " + p.JobTimeout.String()
+			break
+		}
+		if ctx.Err() != nil {
+			result.Status = "Cancelled"
+			fmt.Fprintf(p.File, "Cancelled during step %s\n", step.Name)
+			break
 		}
-		err = cmd.Wait()
 		if err != nil {
-			fmt.Println("Failed to wait for cmd")
-			fmt.Fprintf(p.File, "ERROR: Failed to wait for script %d to finish\n", i)
-			p.Log.error(path, p.File)
-			return
+			result.Status = "Error"
+			result.Error = err.Error()
+			if step.Executable.Check {
+				fmt.Fprintf(p.File, "ERROR: Check %s failed: %s\n", step.Name, err.Error())
+			} else {
+				fmt.Fprintf(p.File, "ERROR: Step %s failed: %s\n", step.Name, err.Error())
+			}
+			p.notify(path, "Error", step.Name, err.Error())
+			p.Log, _ = p.Log.error(path, p.File)
+			return p.Log.result()
+		}
+		if result.Status == "Pending" {
+			result.Status = "Finished"
+		} else {
+			status = result.Status
+		}
+
+		if cacheKey != "" {
+			entry := cacheEntry{JobId: p.Log.JobId, Step: step.Name, LogId: p.Log.Id, Time: result.EndTime}
+			if cacheErr := storeInCache(path, cacheKey, entry); cacheErr != nil {
+				fmt.Fprintf(p.File, "WARNING: Could not cache step %s: %s\n", step.Name, cacheErr.Error())
+			}
 		}
 	}
 
+	if timedOut() {
+		fmt.Fprintf(p.File, "ERROR: Job timed out after %s\n", p.JobTimeout)
+		p.notify(path, "Error", "", "Job timed out after "+p.JobTimeout.String())
+		p.Log, _ = p.Log.error(path, p.File)
+		return p.Log.result()
+	}
+	if ctx.Err() != nil {
+		p.notify(path, "Cancelled", "", "")
+		p.Log, _ = p.Log.cancel(path, p.File)
+		return p.Log.result()
+	}
+
 	// Write to the logs file that the job has finished, terminating
 	// any tails following the log, once the job has finished
-	p.Log, _ = p.Log.finish(path, p.File)
+	p.notify(path, status, "", "")
+	p.Log, _ = p.Log.finish(path, p.File, status)
 	//TODO find a way of handling the error that might be thrown
+	return p.Log.result()
 }
 
 /*
-Build a pipeline from a job
+Run the OnStart command of the job locally in the orchid directory, with the
+ids of the job and the log in the environment variables ORCHID_JOB_ID and
+ORCHID_LOG_ID. Its output is written to the log
+*/
+func (p Pipeline) runOnStart(ctx context.Context, path string) error {
+	cmd := exec.Command("/bin/bash", "-c", p.OnStart)
+	cmd.Dir = path
+	cmd.Env = append(os.Environ(), "ORCHID_JOB_ID="+p.Log.JobId, "ORCHID_LOG_ID="+p.Log.Id)
+	cmd.Stdout = p.File
+	cmd.Stderr = p.File
+	return runCmd(ctx, cmd)
+}
+
+/*
+Run a single step, retrying it according to its retry policy if it fails. The
+number of attempts and the exit code of the last attempt are recorded in the
+result
+*/
+func (p Pipeline) runStep(ctx context.Context, path string, step Step, result *StepResult) error {
+	backoff := stepBackoff(step.Executable)
+	timeout := p.stepTimeout(step.Executable)
+
+	// Select the machine to run on now, as it may change between runs
+	if step.Executable.MachineSelector != nil {
+		machineId, err := selectMachine(ctx, path, *step.Executable.MachineSelector, p.Machines)
+		if err != nil {
+			return err
+		}
+		if to, found := p.MachineMap[machineId]; found {
+			fmt.Fprintf(p.File, "Step %s selected machine %s, running on %s instead\n", step.Name, machineId, to)
+			machineId = to
+		}
+		fmt.Fprintf(p.File, "Step %s runs on selected machine %s\n", step.Name, machineId)
+		step.Executable.Machine = machineId
+		result.Machine = machineId
+
+		step.Cmd, err = buildExecutable(path, step.Executable, p.Machines, p.Log, p.File)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Steps only run on machines whose facts match their condition
+	if step.Executable.When != "" {
+		run, err := evaluateWhen(path, step.Executable.When, step.Executable.Machine)
+		if err != nil {
+			return err
+		}
+		if !run {
+			fmt.Fprintf(p.File, "Skipping step %s, as its When condition is false on machine %s\n", step.Name, step.Executable.Machine)
+			return errStepSkipped
+		}
+	}
+
+	// Only one job at a time runs steps on a machine. Steps on this machine
+	// are not locked, as jobs running locally do not interfere the same way
+	if step.Executable.Machine != "" && step.Executable.Machine != "local" {
+		waiter := lockWaiter{Id: p.Log.Id, Priority: p.Priority}
+		lock, err := lockMachine(ctx, path, step.Executable.Machine, p.LockTimeout, !p.NoWait, waiter, func(position int) {
+			fmt.Fprintf(p.File, "Step %s waiting for machine %s, locked by another job (priority %d, position %d in the queue)\n",
+				step.Name, step.Executable.Machine, p.Priority, position)
+		})
+		if err != nil {
+			return err
+		}
+		defer lock.release()
+	}
+
+	cmd := step.Cmd
+	retries := 0
+	connectRetries := 0
+	for attempt := 1; ; attempt++ {
+		limited := p.limitOutput(cmd, step.Executable)
+		err := runAttempt(ctx, cmd, timeout)
+		result.Attempts = attempt
+		result.ExitCode = exitCode(err)
+		if f, ok := cmd.Stdout.(flusher); ok {
+			f.Flush()
+		}
+		if limited != nil && limited.truncated && p.FailTruncatedOutput && err == nil {
+			err = fmt.Errorf("Output truncated after %d bytes", limited.written)
+		}
+		if code, ignored := ignoredExitCode(err, step.Executable.IgnoreExitCodes); ignored {
+			fmt.Fprintf(p.File, "Step %s exited with ignored exit code %d\n", step.Name, code)
+			err = nil
+		}
+		if code, status, mapped := mappedExitStatus(err, step.Executable.ExitStatuses); mapped {
+			fmt.Fprintf(p.File, "Step %s exited with exit code %d: %s\n", step.Name, code, status)
+			result.Status = status
+			err = nil
+		}
+		if err == nil || ctx.Err() != nil {
+			return err
+		}
+
+		// Failing to connect to the machine and the command itself failing
+		// are retried according to separate policies
+		failure, retry, allowed := "failed", retries, backoff.Attempts
+		if connectionFailed(step.Executable, err) {
+			failure, retry, allowed = "could not connect", connectRetries, step.Executable.ConnectRetries
+			connectRetries++
+		} else {
+			retries++
+		}
+		if retry >= allowed {
+			if step.Executable.Machine != "local" {
+				return remoteError(step.Executable.Machine, err)
+			}
+			return err
+		}
+
+		delay := backoff.Delay(retry)
+		fmt.Fprintf(p.File, "Step %s %s: %s. Retrying in %s (retry %d of %d)\n",
+			step.Name, failure, err.Error(), delay.Round(time.Millisecond), retry+1, allowed)
+		if !backoff.Wait(ctx, retry) {
+			return ctx.Err()
+		}
+
+		// A command can only be run once, so build it anew
+		cmd, err = buildExecutable(path, step.Executable, p.Machines, p.Log, p.File)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+/*
+Get the timeout of each attempt of the step. The step's own Timeout overrides
+the step timeout of the run
+*/
+func (p Pipeline) stepTimeout(executable Executable) time.Duration {
+	if timeout, err := parseDuration(executable.Timeout); err == nil && timeout > 0 {
+		return timeout
+	}
+	return p.StepTimeout
+}
+
+/*
+Run an attempt of the command of a step, killing it once it runs longer than
+the timeout, if any. An attempt running out of time fails like any other, so it
+is retried according to the retry policy of the step
+*/
+func runAttempt(ctx context.Context, cmd *exec.Cmd, timeout time.Duration) error {
+	if timeout <= 0 {
+		return runCmd(ctx, cmd)
+	}
+	attemptCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	err := runCmd(attemptCtx, cmd)
+	if attemptCtx.Err() == context.DeadlineExceeded && ctx.Err() == nil {
+		return errors.New("Timed out after " + timeout.String())
+	}
+	return err
+}
+
+/*
+Limit the output of the command of the step, if the step or the job has an
+output limit. The step's own MaxOutput overrides the limit of the settings
 */
-func buildPipeline(path, jobId string, log Log) (Pipeline, error) {
-	setup, err := loadSetup(path)
+func (p Pipeline) limitOutput(cmd *exec.Cmd, executable Executable) *limitedWriter {
+	limit := p.MaxStepOutput
+	if executable.MaxOutput > 0 {
+		limit = executable.MaxOutput
+	}
+	if limit <= 0 && p.MaxJobOutput <= 0 {
+		return nil
+	}
+
+	// Both outputs share the writer, ensuring they are counted together
+	limited := newLimitedWriter(cmd.Stdout, limit, p.MaxJobOutput, p.jobOutput)
+	cmd.Stdout = limited
+	cmd.Stderr = limited
+	return limited
+}
+
+/*
+Get the backoff policy for retrying the step
+*/
+func stepBackoff(executable Executable) Backoff {
+	backoff := Backoff{
+		Base:     time.Second,
+		Max:      time.Minute,
+		Jitter:   0.2,
+		Attempts: executable.Retries,
+	}
+	if delay, err := parseDuration(executable.RetryDelay); err == nil && delay > 0 {
+		backoff.Base = delay
+	}
+	if delay, err := parseDuration(executable.RetryMaxDelay); err == nil && delay > 0 {
+		backoff.Max = delay
+	}
+	return backoff
+}
+
+/*
+Run the command, killing it and any processes it started if the context is
+cancelled before it finishes
+*/
+func runCmd(ctx context.Context, cmd *exec.Cmd) error {
+	// Run the command in its own process group, allowing the group to be
+	// killed as a whole
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	err := cmd.Start()
 	if err != nil {
-		return Pipeline{}, err
+		return err
 	}
 
-	var job Job
-	jobFound := false
-	for _, j := range setup.Jobs {
-		if j.Id == jobId {
-			job = j
-			jobFound = true
-			break
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	select {
+	case err = <-done:
+		return err
+	case <-ctx.Done():
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		<-done
+		return ctx.Err()
+	}
+}
+
+/*
+Check whether the step failed because ssh could not connect to the machine,
+rather than because the command failed. ssh exits with 255 when the connection
+fails
+*/
+func connectionFailed(executable Executable, err error) bool {
+	return executable.Machine != "local" && exitCode(err) == 255
+}
+
+/*
+Get the exit code of the command given the error of running it. Errors other
+than the command exiting with a non-zero exit code give -1
+*/
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return exitErr.ExitCode()
+	}
+	return -1
+}
+
+/*
+Check whether the error is caused by the command exiting with one of the exit
+codes to be ignored, i.e. treated as success
+*/
+func ignoredExitCode(err error, codes []int) (int, bool) {
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok {
+		return 0, false
+	}
+
+	for _, code := range codes {
+		if exitErr.ExitCode() == code {
+			return code, true
 		}
 	}
+	return exitErr.ExitCode(), false
+}
+
+/*
+Get the custom status the error is mapped to, if it is caused by the command
+exiting with one of the mapped exit codes
+*/
+func mappedExitStatus(err error, statuses map[int]string) (int, string, bool) {
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok {
+		return 0, "", false
+	}
 
+	status, mapped := statuses[exitErr.ExitCode()]
+	return exitErr.ExitCode(), status, mapped
+}
+
+/*
+Build a pipeline from a job
+*/
+func buildPipeline(path string, setup Setup, jobId string, log Log, options RunOptions) (Pipeline, error) {
+	job, jobFound := setup.findJob(jobId)
 	if !jobFound {
-		return Pipeline{}, errors.New("Job not found")
+		return Pipeline{}, ErrJobNotFound
+	}
+
+	job, err := remapMachines(job, setup, options)
+	if err != nil {
+		return Pipeline{}, err
+	}
+
+	skip, err := selectSteps(job, options)
+	if err != nil {
+		return Pipeline{}, err
 	}
 
 	logPath := fmt.Sprintf("%s/logs/%s", path, log.Id)
@@ -95,51 +618,538 @@ func buildPipeline(path, jobId string, log Log) (Pipeline, error) {
 	var pipeline Pipeline
 	pipeline.File = outfile
 	pipeline.Log = log
-	for _, executable := range job.Pipeline {
-		cmd, execErr := buildExecutable(path, executable, setup.Machines, log, outfile)
-		if execErr != nil {
-			return Pipeline{}, execErr
+	pipeline.Notify = job.Notify
+	pipeline.OnStart = job.OnStart
+	pipeline.Priority = job.Priority
+	pipeline.NoCache = options.NoCache
+	pipeline.NoWait = options.NoWait
+	pipeline.MachineMap = options.MachineMap
+	pipeline.StepTimeout, err = parseDuration(options.StepTimeout)
+	if err != nil {
+		return Pipeline{}, errors.New("Invalid step timeout: " + err.Error())
+	}
+	pipeline.JobTimeout, err = parseDuration(options.JobTimeout)
+	if err != nil {
+		return Pipeline{}, errors.New("Invalid job timeout: " + err.Error())
+	}
+
+	settings, err := loadSettings(path)
+	if err != nil {
+		return Pipeline{}, err
+	}
+	pipeline.LockTimeout = settings.machineLockTimeout()
+	pipeline.Machines = withDefaultShell(setup.Machines, settings.Shell)
+	pipeline.MaxStepOutput = settings.MaxStepOutput
+	pipeline.MaxJobOutput = settings.MaxJobOutput
+	pipeline.FailTruncatedOutput = settings.FailTruncatedOutput
+	pipeline.jobOutput = new(int64)
+	for i, executable := range job.Pipeline {
+		// The environment of the step overrides that of the job, which
+		// overrides that of the settings
+		executable.Env = mergeEnv(settings.Env, job.Env, executable.Env)
+		if options.Marker != "" {
+			executable.Env["ORCHID_MARKER"] = options.Marker
+		}
+
+		// Inline scripts are piped to bash the same way as inline commands
+		if script, found := setup.findInlineScript(executable.Script); found && executable.Command == "" {
+			executable.Command = script.Body
+		}
+
+		// Skipped steps need not be given the variables they reference
+		if !skip[i] {
+			executable, err = expandExecutableVars(path, executable, options.Vars)
+			if err != nil {
+				return Pipeline{}, errors.New("Step " + stepName(executable, i) + ": " + err.Error())
+			}
+		}
+
+		// Strict mode is decided once, so retries run the same way
+		executable.Strict = strictMode(settings, executable.Strict, executable.Lenient)
+		if executable.Machine == "local" && executable.Shell == "" {
+			executable.Shell = settings.Shell
 		}
-		pipeline.Cmds = append(pipeline.Cmds, cmd)
+
+		// Steps with a machine selector are built once the machine is
+		// selected
+		var cmd *exec.Cmd
+		if executable.MachineSelector == nil {
+			var execErr error
+			cmd, execErr = buildExecutable(path, executable, pipeline.Machines, log, outfile)
+			if execErr != nil {
+				return Pipeline{}, execErr
+			}
+		}
+		pipeline.Steps = append(pipeline.Steps, Step{
+			Name:       stepName(executable, i),
+			Executable: executable,
+			Cmd:        cmd,
+			Skip:       skip[i],
+		})
 	}
 
 	return pipeline, nil
 }
 
+/*
+Build the command running the script of the executable locally with the given
+arguments
+*/
+func buildLocalExecutable(path string, executable Executable) (*exec.Cmd, error) {
+	shell := executable.Shell
+	if shell == "" || shell == "login" {
+		shell = os.Getenv("SHELL")
+		if shell == "" {
+			shell = "/bin/bash"
+		}
+	}
+
+	input, hasInput, err := stepInput(path, executable)
+	if err != nil {
+		return nil, err
+	}
+	if len(executable.SecretFiles) > 0 {
+		return nil, errors.New("SecretFiles can only be given to steps run on remote machines")
+	}
+	env := append(os.Environ(), envList(executable.Env)...)
+
+	if executable.Command != "" {
+		args := append(shellFlags(shell, executable.Strict), stdinArgs(shell)...)
+		cmd := exec.Command(shell, append(args, executable.Args...)...)
+		cmd.Env = env
+		cmd.Stdin = strings.NewReader(executable.Command)
+		if hasInput {
+			if !posixShell(shell) {
+				return nil, errors.New("Input can only be given to inline commands run using a POSIX shell, not " + shell)
+			}
+			cmd.Stdin = strings.NewReader(withInput(executable.Command, input))
+		}
+		return cmd, nil
+	}
+
+	script := path + "/scripts/" + executable.Script
+	scriptWithArgs := append(append(shellFlags(shell, executable.Strict), script), executable.Args...)
+	cmd := exec.Command(shell, scriptWithArgs...)
+	cmd.Env = env
+	if hasInput {
+		cmd.Stdin = strings.NewReader(input)
+	}
+	return cmd, nil
+}
+
+/*
+Build the command running the script of the executable on the remote machine
+with the given arguments, by piping the script to bash on the machine. An
+inline command is piped the same way, avoiding quoting it
+*/
+func buildRemoteExecutable(path string, executable Executable, machine Machine) (*exec.Cmd, error) {
+	shell := stepShell(executable, machine)
+	interpreter := append(append([]string{shell}, shellFlags(shell, executable.Strict)...), stdinArgs(shell)...)
+	if shell == "login" {
+		interpreter = loginInterpreter(executable.Strict)
+	}
+	// Steps can branch on the facts gathered about the machine, and get
+	// the environment of the step
+	env := append(factsEnv(path, machine.Id), remoteEnvArgs(executable.Env)...)
+	if executable.Container != "" {
+		interpreter = containerCommand(executable, env, interpreter)
+	} else if len(env) > 0 {
+		interpreter = append(append([]string{"env"}, env...), interpreter...)
+	}
+	// The arguments are quoted for the shell on the machine, and again for
+	// the local shell, like the environment
+	for _, arg := range executable.Args {
+		interpreter = append(interpreter, remoteArg(arg))
+	}
+	remoteCommand := strings.Join(interpreter, " ")
+	sshCommand := fmt.Sprintf(
+		"ssh -t %s %s '%s'",
+		sshOptions(path, machine, "-p"),
+		sshDestination(machine),
+		withMachineHooks(machine, remoteCommand),
+	)
+
+	input, hasInput, err := stepInput(path, executable)
+	if err != nil {
+		return nil, err
+	}
+
+	if executable.Command != "" || hasInput || len(executable.SecretFiles) > 0 {
+		script := executable.Command
+		if script == "" {
+			data, err := ioutil.ReadFile(path + "/scripts/" + executable.Script)
+			if err != nil {
+				return nil, err
+			}
+			script = string(data)
+		}
+		if hasInput {
+			// The script itself is read from stdin, so the input follows
+			// it in a here-document
+			if !posixShell(shell) {
+				return nil, errors.New("Input can only be given to steps run using a POSIX shell, not " + shell)
+			}
+			script = withInput(script, input)
+		}
+		if len(executable.SecretFiles) > 0 {
+			if !posixShell(shell) {
+				return nil, errors.New("SecretFiles can only be given to steps run using a POSIX shell, not " + shell)
+			}
+			script, err = withSecretFiles(path, script, executable.SecretFiles)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		cmd, err := machineCommand(machine, sshCommand)
+		if err != nil {
+			return nil, err
+		}
+		cmd.Stdin = strings.NewReader(script)
+		return cmd, nil
+	}
+
+	script := path + "/scripts/" + executable.Script
+	return machineCommand(machine, sshCommand+" < "+script)
+}
+
+/*
+Get the shell, or other interpreter, running the step on the machine: the Shell
+of the step, else the Shell of the machine, else the login shell of the user.
+The login shell of the machine is not that of containers, which use bash
+*/
+func stepShell(executable Executable, machine Machine) string {
+	if executable.Shell != "" {
+		return executable.Shell
+	}
+	if machine.Shell != "" {
+		return machine.Shell
+	}
+	if executable.Container != "" {
+		return "bash"
+	}
+	return "login"
+}
+
+/*
+Get the command running the login shell of the user on the machine, reading
+the script from stdin. The login shell is only known on the machine, so in
+strict mode, sh picks the flags of strict mode supported by the login shell
+there, like shellFlags
+*/
+func loginInterpreter(strict bool) []string {
+	if !strict {
+		// Expanded by the shell ssh runs the command with on the machine
+		return []string{`"$SHELL"`, "-s", "--"}
+	}
+	dispatch := `case "${SHELL##*/}" in ` +
+		`bash|zsh|ksh) exec "$SHELL" -euo pipefail -s -- "$@" ;; ` +
+		`sh|dash|ash) exec "$SHELL" -eu -s -- "$@" ;; ` +
+		`*) exec "$SHELL" -s -- "$@" ;; esac`
+	return []string{"sh", "-c", remoteArg(dispatch), "sh"}
+}
+
+/*
+Get the machines with the given shell as the Shell of those without one, e.g.
+the Shell of the settings
+*/
+func withDefaultShell(machines []Machine, shell string) []Machine {
+	if shell == "" {
+		return machines
+	}
+	withShell := make([]Machine, len(machines))
+	for i, machine := range machines {
+		if machine.Shell == "" {
+			machine.Shell = shell
+		}
+		withShell[i] = machine
+	}
+	return withShell
+}
+
+/*
+Check whether the shell is a POSIX shell, taking -s for reading the script from
+stdin, as opposed to another interpreter such as python3
+*/
+func posixShell(shell string) bool {
+	switch filepath.Base(shell) {
+	case "bash", "zsh", "sh", "dash", "ash", "ksh", "login":
+		return true
+	}
+	return false
+}
+
+/*
+Check whether a step or action runs in strict mode: if marked Strict, or if the
+Strict setting is given and it is not marked Lenient
+*/
+func strictMode(settings Settings, strict, lenient bool) bool {
+	return strict || (settings.Strict && !lenient)
+}
+
+/*
+Get the flags the shell runs a step or action with. In strict mode, they fail
+on the first failing command, on use of unset variables, and, in shells
+supporting it, on failures within pipes. Otherwise, and for interpreters other
+than POSIX shells, there are no flags. The flags of the login shell on a
+machine are picked on the machine, see loginInterpreter
+*/
+func shellFlags(shell string, strict bool) []string {
+	if !strict || !posixShell(shell) || shell == "login" {
+		return []string{}
+	}
+	switch filepath.Base(shell) {
+	case "bash", "zsh", "ksh":
+		return []string{"-euo", "pipefail"}
+	}
+	return []string{"-eu"}
+}
+
+/*
+Get the arguments making the shell read the script from stdin, followed by the
+arguments of the script
+*/
+func stdinArgs(shell string) []string {
+	if posixShell(shell) {
+		return []string{"-s", "--"}
+	}
+	return []string{"-"}
+}
+
+/*
+Get the machine of the step for listings, noting if it is selected when the job
+runs
+*/
+func stepMachine(executable Executable) string {
+	if executable.MachineSelector != nil {
+		return "(selected)"
+	}
+	return executable.Machine
+}
+
+/*
+Get what the step runs for listings: its script, or its inline command if it
+has one
+*/
+func stepCommand(executable Executable) string {
+	if executable.Command == "" {
+		return executable.Script
+	}
+	lines := strings.Split(strings.TrimSpace(executable.Command), "\n")
+	if len(lines) > 1 {
+		return lines[0] + " ..."
+	}
+	return lines[0]
+}
+
+/*
+Determine which steps of the job to skip given the run options. The returned
+slice holds a flag for each step in the order of the pipeline
+*/
+func selectSteps(job Job, options RunOptions) ([]bool, error) {
+	skip := make([]bool, len(job.Pipeline))
+
+	// Find the range of steps to run
+	from := 0
+	to := len(job.Pipeline) - 1
+	if options.From != "" {
+		from = findStep(job, options.From)
+		if from == -1 {
+			return nil, errors.New("Step '" + options.From + "' not found in job '" + job.Id + "'")
+		}
+	}
+	if options.To != "" {
+		to = findStep(job, options.To)
+		if to == -1 {
+			return nil, errors.New("Step '" + options.To + "' not found in job '" + job.Id + "'")
+		}
+	}
+	if from > to {
+		return nil, errors.New("Step '" + options.From + "' comes after step '" + options.To + "'")
+	}
+
+	for _, index := range options.Steps {
+		if index < 0 || index >= len(job.Pipeline) {
+			return nil, fmt.Errorf("Job '%s' has no step %d", job.Id, index+1)
+		}
+	}
+
+	for i, executable := range job.Pipeline {
+		skip[i] = i < from || i > to
+		if len(options.Only) > 0 && !matchesStep(executable, i, options.Only) {
+			skip[i] = true
+		}
+		if len(options.Steps) > 0 && !containsInt(options.Steps, i) {
+			skip[i] = true
+		}
+		if options.CheckOnly && !executable.Check {
+			skip[i] = true
+		}
+
+		// The machines of steps with a machine selector are unknown until
+		// they run, so they are skipped as well
+		if len(options.OnlyMachines) > 0 && !containsString(options.OnlyMachines, executable.Machine) {
+			skip[i] = true
+		}
+	}
+
+	if options.CheckOnly {
+		checks := false
+		for _, executable := range job.Pipeline {
+			checks = checks || executable.Check
+		}
+		if !checks {
+			return nil, errors.New("Job '" + job.Id + "' has no check steps")
+		}
+	}
+
+	// Make sure every name given to Only refers to an existing step
+	for _, name := range options.Only {
+		found := false
+		for i, executable := range job.Pipeline {
+			if matchesStep(executable, i, []string{name}) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, errors.New("No step named or tagged '" + name + "' found in job '" + job.Id + "'")
+		}
+	}
+
+	return skip, nil
+}
+
+/*
+Run the steps of the job on the machines given by the machine map of the
+options instead of their own. Steps with a machine selector run on the machine
+mapped from the one selected
+*/
+func remapMachines(job Job, setup Setup, options RunOptions) (Job, error) {
+	for from, to := range options.MachineMap {
+		if !machineExists(from, setup.Machines) {
+			return Job{}, fmt.Errorf("%w: '%s', to run on another machine", ErrMachineNotFound, from)
+		}
+		if !machineExists(to, setup.Machines) {
+			return Job{}, fmt.Errorf("%w: '%s', to run the steps of '%s' on", ErrMachineNotFound, to, from)
+		}
+	}
+	for _, machineId := range options.OnlyMachines {
+		if !machineExists(machineId, setup.Machines) {
+			return Job{}, fmt.Errorf("%w: '%s', given to run only the steps of", ErrMachineNotFound, machineId)
+		}
+	}
+
+	pipeline := make([]Executable, len(job.Pipeline))
+	for i, executable := range job.Pipeline {
+		if to, found := options.MachineMap[executable.Machine]; found {
+			executable.Machine = to
+		}
+		pipeline[i] = executable
+	}
+	job.Pipeline = pipeline
+	return job, nil
+}
+
+/*
+Check whether the list contains the number
+*/
+func containsInt(list []int, n int) bool {
+	for _, item := range list {
+		if item == n {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Check whether the list contains the string
+*/
+func containsString(list []string, s string) bool {
+	for _, element := range list {
+		if element == s {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Find the index of the step with the given name, returning -1 if not found
+*/
+func findStep(job Job, name string) int {
+	for i, executable := range job.Pipeline {
+		if stepName(executable, i) == name {
+			return i
+		}
+	}
+	return -1
+}
+
+/*
+Check whether the step matches any of the given names or tags
+*/
+func matchesStep(executable Executable, index int, names []string) bool {
+	for _, name := range names {
+		if stepName(executable, index) == name {
+			return true
+		}
+		for _, tag := range executable.Tags {
+			if tag == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+/*
+Get the name of a step. Steps without an id are named after their position in
+the pipeline, starting from step1
+*/
+func stepName(executable Executable, index int) string {
+	if executable.Id != "" {
+		return executable.Id
+	}
+	return fmt.Sprintf("step%d", index+1)
+}
+
 /*
 Build a command executable by the OS from an executable as defined in the job
-configuration
+configuration. Executables on the machine "local" run the script on this
+machine, while others run it on the remote machine through SSH. In both cases
+the output is written to the log output file
 */
 func buildExecutable(path string, executable Executable, machines []Machine, log Log, file *os.File) (*exec.Cmd, error) {
 	var cmd *exec.Cmd
-	script := path + "/scripts/" + executable.Script
-	scriptWithArgs := append([]string{script}, executable.Args...)
-	//script, executable.Args...
 	if executable.Machine == "local" {
-		cmd = exec.Command("/bin/bash", scriptWithArgs...)
+		var err error
+		cmd, err = buildLocalExecutable(path, executable)
+		if err != nil {
+			return nil, err
+		}
 	} else {
-		var machine Machine
-		for _, m := range machines {
-			if m.Id == executable.Machine {
-				machine = m
-				break
-			}
+		machine, found := Setup{Machines: machines}.findMachine(executable.Machine)
+		if !found {
+			return nil, ErrMachineNotFound
+		}
+		var err error
+		cmd, err = buildRemoteExecutable(path, executable, machine)
+		if err != nil {
+			return nil, err
 		}
-
-		sshCommand := fmt.Sprintf(
-			"ssh -t -o 'StrictHostKeyChecking no' %s@%s -p %s -i %s 'bash -s' -- < %s %s",
-			machine.User,
-			machine.Address,
-			machine.Port,
-			path+"/keys/"+machine.PrivateKey,
-			script,
-			strings.Join(executable.Args, " "),
-		)
-		cmd = exec.Command("/bin/bash", "-c", sshCommand)
 	}
 
-	cmd.Stdout = file
-	cmd.Stderr = file
+	if executable.Output == "normalized" {
+		// Both outputs share the writer, ensuring lines are not interleaved
+		writer := newNormalizingWriter(file)
+		cmd.Stdout = writer
+		cmd.Stderr = writer
+	} else {
+		cmd.Stdout = file
+		cmd.Stderr = file
+	}
 
 	return cmd, nil
 }
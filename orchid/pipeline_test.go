@@ -0,0 +1,313 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+/*
+Run the job in a new orchid directory, returning the result and the output of
+the job
+*/
+func runTestJob(t *testing.T, path string, job Job) (JobResult, string) {
+	t.Helper()
+	if err := os.MkdirAll(path+"/logs", 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	log := Log{Id: "test-" + job.Id, JobId: job.Id, Status: "New"}
+	pipeline, err := buildPipeline(path, Setup{Jobs: []Job{job}}, job.Id, log, RunOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := pipeline.Run(context.Background(), path)
+
+	output, err := ioutil.ReadFile(path + "/logs/" + log.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return result, string(output)
+}
+
+/*
+Test the flags steps run with in strict mode, enabled by the Strict setting or
+the step, and disabled by Lenient
+*/
+func TestShellFlags(t *testing.T) {
+	strict := Settings{Strict: true}
+	tests := []struct {
+		name       string
+		settings   Settings
+		executable Executable
+		machine    Machine
+		shell      string
+		flags      []string
+	}{
+		{"login by default", strict, Executable{}, Machine{}, "login", []string{}},
+		{"bash in containers", strict, Executable{Container: "node:20"}, Machine{}, "bash", []string{"-euo", "pipefail"}},
+		{"bash lenient by default", Settings{}, Executable{Shell: "bash"}, Machine{}, "bash", []string{}},
+		{"bash strict by setting", strict, Executable{Shell: "bash"}, Machine{}, "bash", []string{"-euo", "pipefail"}},
+		{"bash strict by step", Settings{}, Executable{Shell: "bash", Strict: true}, Machine{}, "bash", []string{"-euo", "pipefail"}},
+		{"bash lenient", strict, Executable{Shell: "bash", Lenient: true}, Machine{}, "bash", []string{}},
+		{"sh of the machine", strict, Executable{}, Machine{Shell: "sh"}, "sh", []string{"-eu"}},
+		{"sh of the step", strict, Executable{Shell: "/bin/sh"}, Machine{Shell: "zsh"}, "/bin/sh", []string{"-eu"}},
+		{"zsh", strict, Executable{Shell: "zsh"}, Machine{}, "zsh", []string{"-euo", "pipefail"}},
+		{"login", strict, Executable{Shell: "login"}, Machine{}, "login", []string{}},
+		{"python3", strict, Executable{Shell: "python3"}, Machine{}, "python3", []string{}},
+	}
+
+	for _, test := range tests {
+		shell := stepShell(test.executable, test.machine)
+		if shell != test.shell {
+			t.Errorf("%s: got shell %s, expected %s", test.name, shell, test.shell)
+		}
+		flags := shellFlags(shell, strictMode(test.settings, test.executable.Strict, test.executable.Lenient))
+		if !reflect.DeepEqual(flags, test.flags) {
+			t.Errorf("%s: got flags %v, expected %v", test.name, flags, test.flags)
+		}
+	}
+}
+
+/*
+Test the arguments making shells and other interpreters read the script from
+stdin
+*/
+func TestStdinArgs(t *testing.T) {
+	tests := map[string][]string{
+		"bash":    {"-s", "--"},
+		"/bin/sh": {"-s", "--"},
+		"python3": {"-"},
+	}
+	for shell, expected := range tests {
+		if args := stdinArgs(shell); !reflect.DeepEqual(args, expected) {
+			t.Errorf("%s: got %v, expected %v", shell, args, expected)
+		}
+	}
+}
+
+/*
+Test selecting steps by their position, as retried by Retry, regardless of
+steps named like the tags of other steps
+*/
+func TestSelectStepsByIndex(t *testing.T) {
+	job := Job{Id: "deploy", Pipeline: []Executable{
+		{Id: "build", Tags: []string{"web"}},
+		{Id: "web"},
+		{Id: "smoke", Tags: []string{"web"}},
+	}}
+
+	skip, err := selectSteps(job, RunOptions{Steps: []int{1, 2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(skip, []bool{true, false, false}) {
+		t.Errorf("got %v, expected only the last two steps to run", skip)
+	}
+
+	if _, err := selectSteps(job, RunOptions{Steps: []int{3}}); err == nil {
+		t.Error("expected an error for a step beyond the job")
+	}
+}
+
+/*
+Test that in a new configuration, a step fails on the first failing command
+even if not followed by &&, unless marked Lenient
+*/
+func TestStrictByDefault(t *testing.T) {
+	path := t.TempDir() + "/orchid"
+	if err := (&Actions{path: path}).Init(); err != nil {
+		t.Fatal(err)
+	}
+	job := Job{Id: "strict", Pipeline: []Executable{
+		{Id: "two-lines", Machine: "local", Command: "false\necho reached"},
+	}}
+
+	result, output := runTestJob(t, path, job)
+	if result.Status != "Error" {
+		t.Errorf("got status %s, expected the failing first line to fail the step", result.Status)
+	}
+	if strings.Contains(output, "reached") {
+		t.Errorf("the line after the failing command ran:\n%s", output)
+	}
+
+	job.Pipeline[0].Lenient = true
+	result, output = runTestJob(t, path, job)
+	if result.Status != "Finished" || !strings.Contains(output, "reached") {
+		t.Errorf("got status %s, expected the lenient step to carry on:\n%s", result.Status, output)
+	}
+
+	if err := (&Actions{path: path}).Init(); err == nil {
+		t.Error("expected init to refuse an existing configuration")
+	}
+}
+
+/*
+Test that exit codes are only ignored if listed
+*/
+func TestIgnoredExitCode(t *testing.T) {
+	tests := []struct {
+		command string
+		codes   []int
+		ignored bool
+	}{
+		{"exit 1", []int{1}, true},
+		{"exit 2", []int{1, 2}, true},
+		{"exit 2", []int{1}, false},
+		{"exit 1", nil, false},
+	}
+	for _, test := range tests {
+		err := exec.Command("/bin/sh", "-c", test.command).Run()
+		if _, ignored := ignoredExitCode(err, test.codes); ignored != test.ignored {
+			t.Errorf("%s with %v: got ignored %v, expected %v", test.command, test.codes, ignored, test.ignored)
+		}
+	}
+}
+
+/*
+Test that a step exiting with an ignored exit code succeeds, and the job goes on
+*/
+func TestStepIgnoringExitCode(t *testing.T) {
+	job := Job{Id: "grep", Pipeline: []Executable{
+		{Id: "no-match", Machine: "local", Command: "exit 1", IgnoreExitCodes: []int{1}},
+		{Id: "after", Machine: "local", Command: "echo reached"},
+	}}
+
+	result, output := runTestJob(t, t.TempDir(), job)
+	if result.Status != "Finished" {
+		t.Fatalf("got status %s, expected Finished:\n%s", result.Status, output)
+	}
+	if result.Steps[0].ExitCode != 1 || result.Steps[0].Status != "Finished" {
+		t.Errorf("got step %+v, expected it finished with exit code 1", result.Steps[0])
+	}
+	if !strings.Contains(output, "reached") {
+		t.Errorf("the step after the ignored exit code did not run:\n%s", output)
+	}
+
+	job.Pipeline[0].Command = "exit 2"
+	result, _ = runTestJob(t, t.TempDir(), job)
+	if result.Status != "Error" {
+		t.Errorf("got status %s for an exit code not ignored, expected Error", result.Status)
+	}
+}
+
+/*
+Test running a script on this machine, given its arguments, with its output in
+the log of the job
+*/
+func TestLocalScriptStep(t *testing.T) {
+	path := t.TempDir()
+	if err := os.MkdirAll(path+"/scripts", 0755); err != nil {
+		t.Fatal(err)
+	}
+	err := ioutil.WriteFile(path+"/scripts/greet.sh", []byte("echo \"hello $1 from $(pwd)\"\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	job := Job{Id: "greet", Pipeline: []Executable{
+		{Machine: "local", Script: "greet.sh", Args: []string{"local world"}},
+	}}
+	scripts, _ := loadDir(path + "/scripts")
+	if err := validateJobs([]Job{job}, []Machine{}, scripts, []Script{}, path); err != nil {
+		t.Fatalf("expected the local script step to be valid without machines: %v", err)
+	}
+
+	result, output := runTestJob(t, path, job)
+	if result.Status != "Finished" {
+		t.Fatalf("got status %s, expected Finished:\n%s", result.Status, output)
+	}
+	if !strings.Contains(output, "hello local world from ") {
+		t.Errorf("the output of the script is not in the log:\n%s", output)
+	}
+}
+
+/*
+Test that the Shell setting is the default of machines without a Shell
+*/
+func TestWithDefaultShell(t *testing.T) {
+	machines := []Machine{{Id: "web1"}, {Id: "web2", Shell: "sh"}}
+
+	withShell := withDefaultShell(machines, "zsh")
+	if withShell[0].Shell != "zsh" || withShell[1].Shell != "sh" {
+		t.Errorf("got shells %s and %s, expected zsh and sh", withShell[0].Shell, withShell[1].Shell)
+	}
+	if machines[0].Shell != "" {
+		t.Error("the machines of the setup were changed")
+	}
+	if shell := stepShell(Executable{}, withDefaultShell(machines, "")[0]); shell != "login" {
+		t.Errorf("got shell %s without the Shell setting, expected login", shell)
+	}
+}
+
+/*
+Put a stand-in for ssh first on the PATH, running the command ssh would run on
+the machine locally using sh, with the given login shell
+*/
+func fakeSSH(t *testing.T, loginShell string) {
+	t.Helper()
+	bin := t.TempDir()
+	// The remote command is the last argument of ssh
+	script := "#!/bin/sh\nfor arg; do last=\"$arg\"; done\nexec /bin/sh -c \"$last\"\n"
+	if err := ioutil.WriteFile(bin+"/ssh", []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+":"+os.Getenv("PATH"))
+	t.Setenv("SHELL", loginShell)
+}
+
+/*
+Test that the arguments of a step on a remote machine reach it as given, by
+running the command ssh would run on the machine using a stand-in for ssh
+*/
+func TestRemoteArgs(t *testing.T) {
+	fakeSSH(t, "/bin/sh")
+
+	args := []string{"a b", "it's", "$HOME", "`id`", "; exit 1"}
+	executable := Executable{Machine: "web1", Command: `printf '%s\n' "$@"`, Args: args}
+	machine := Machine{Id: "web1", Address: "192.0.2.10", Port: "22", User: "deploy"}
+	cmd, err := buildRemoteExecutable(t.TempDir(), executable, machine)
+	if err != nil {
+		t.Fatal(err)
+	}
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("%v: %s", err, output)
+	}
+	if got := strings.Split(strings.TrimSuffix(string(output), "\n"), "\n"); !reflect.DeepEqual(got, args) {
+		t.Errorf("got arguments %q, expected %q", got, args)
+	}
+}
+
+/*
+Test that steps on remote machines run using the login shell of the user by
+default, in strict mode if enabled, using a stand-in for ssh
+*/
+func TestRemoteLoginShell(t *testing.T) {
+	machine := Machine{Id: "web1", Address: "192.0.2.10", Port: "22", User: "deploy"}
+	tests := []struct {
+		loginShell string
+		strict     bool
+		reached    bool
+	}{
+		{"/bin/sh", false, true},
+		{"/bin/sh", true, false},
+		{"/bin/bash", true, false},
+	}
+	for _, test := range tests {
+		fakeSSH(t, test.loginShell)
+		executable := Executable{Machine: "web1", Command: "false\necho reached", Strict: test.strict}
+		cmd, err := buildRemoteExecutable(t.TempDir(), executable, machine)
+		if err != nil {
+			t.Fatal(err)
+		}
+		output, err := cmd.CombinedOutput()
+		if reached := strings.Contains(string(output), "reached"); reached != test.reached || (err == nil) != test.reached {
+			t.Errorf("%s strict %v: got %v and %q, expected reaching the second line %v", test.loginShell, test.strict, err, output, test.reached)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+/*
+Showing progress while waiting for a job to start producing output
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+/*
+How often the spinner is redrawn
+*/
+const spinnerInterval = 100 * time.Millisecond
+
+/*
+Type defining a spinner showing a status message on the terminal until stopped
+*/
+type spinner struct {
+	stop    chan bool
+	stopped chan bool
+	once    sync.Once
+}
+
+/*
+Start showing the spinner along with the message
+*/
+func startSpinner(message string) *spinner {
+	s := &spinner{stop: make(chan bool), stopped: make(chan bool)}
+
+	go func() {
+		defer close(s.stopped)
+		frames := []string{"|", "/", "-", "\\"}
+		ticker := time.NewTicker(spinnerInterval)
+		defer ticker.Stop()
+
+		for i := 0; ; i++ {
+			fmt.Fprintf(os.Stdout, "\r%s %s", frames[i%len(frames)], message)
+			select {
+			case <-s.stop:
+				// Clear the line, leaving room for the output
+				fmt.Fprint(os.Stdout, "\r\033[K")
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	return s
+}
+
+/*
+Stop the spinner, clearing its line. Safe to call several times, and on a nil
+spinner
+*/
+func (s *spinner) Stop() {
+	if s == nil {
+		return
+	}
+	s.once.Do(func() {
+		close(s.stop)
+		<-s.stopped
+	})
+}
+
+/*
+Get the message shown while waiting for the first step of the pipeline to start
+producing output
+*/
+func startMessage(pipeline Pipeline) string {
+	for _, step := range pipeline.Steps {
+		if step.Skip {
+			continue
+		}
+		machine := stepMachine(step.Executable)
+		if machine == "" || machine == "local" {
+			return "Starting step " + step.Name + "..."
+		}
+		if step.Executable.MachineSelector != nil {
+			return "Selecting the machine of step " + step.Name + "..."
+		}
+		return "Connecting to " + machine + "..."
+	}
+	return "Starting..."
+}
@@ -0,0 +1,109 @@
+/*
+Locating where the entities of the setup are defined
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+)
+
+/*
+Type defining where an entity of the setup is defined
+*/
+type Location struct {
+	Kind string
+	File string
+	Line int
+}
+
+/*
+Find the line on which each element of the JSON list in the file is defined,
+by the id of the element
+*/
+func locateIds(file string) (map[string]int, error) {
+	lines := map[string]int{}
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return lines, nil
+	}
+	if err != nil {
+		return lines, err
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	if _, err = decoder.Token(); err != nil {
+		return lines, err
+	}
+
+	for decoder.More() {
+		// The offset is right after the previous token, so skip ahead to
+		// the start of the element
+		offset := int(decoder.InputOffset())
+		for offset < len(data) && bytes.IndexByte([]byte(" \t\r\n,"), data[offset]) != -1 {
+			offset++
+		}
+
+		element := struct{ Id string }{}
+		if err = decoder.Decode(&element); err != nil {
+			return lines, err
+		}
+		if _, found := lines[element.Id]; !found {
+			lines[element.Id] = 1 + bytes.Count(data[:offset], []byte("\n"))
+		}
+	}
+
+	return lines, nil
+}
+
+/*
+Find where the entities with the given id are defined. Several entities of
+different kinds may share an id
+*/
+func locateEntity(path string, setup Setup, id string) ([]Location, error) {
+	locations := []Location{}
+
+	files := []struct {
+		kind string
+		file string
+	}{
+		{"machine", "machines.json"},
+		{"job", "jobs.json"},
+		{"action", "actions.json"},
+		{"group", "groups.json"},
+		{"script", "scripts.json"},
+	}
+	for _, f := range files {
+		lines, err := locateIds(path + "/" + f.file)
+		if err != nil {
+			return locations, err
+		}
+		if line, found := lines[id]; found {
+			locations = append(locations, Location{Kind: f.kind, File: path + "/" + f.file, Line: line})
+		}
+	}
+
+	// Machines not in machines.json come from the dynamic inventory
+	if _, found := setup.findMachine(id); found {
+		inFile := false
+		for _, location := range locations {
+			inFile = inFile || location.Kind == "machine"
+		}
+		if !inFile {
+			locations = append(locations, Location{Kind: "machine", File: "dynamic inventory"})
+		}
+	}
+
+	dirs := map[string]string{"script": path + "/scripts", "key": setup.KeyDir}
+	for _, kind := range []string{"script", "key"} {
+		file := dirs[kind] + "/" + id
+		if info, err := os.Stat(file); err == nil && !info.IsDir() {
+			locations = append(locations, Location{Kind: kind, File: file})
+		}
+	}
+
+	return locations, nil
+}
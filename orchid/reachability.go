@@ -0,0 +1,120 @@
+/*
+Definition of and methods for checking whether machines are reachable, caching
+the results for a short while
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+/*
+Type defining the result of checking whether a machine is reachable
+*/
+type Reachability struct {
+	Reachable bool
+	Error     string
+	Checked   time.Time
+	Cached    bool `json:"-"`
+}
+
+/*
+Check whether the machines are reachable. Results cached within the TTL are
+reused unless noCache is given, and new results are added to the cache
+*/
+func checkReachability(path string, machines []Machine, ttl time.Duration, noCache bool) (map[string]Reachability, error) {
+	cache, err := loadReachabilityCache(path)
+	if err != nil {
+		return nil, err
+	}
+
+	results := map[string]Reachability{}
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	limit := make(chan bool, 10)
+
+	for _, machine := range machines {
+		cached, found := cache[machine.Id]
+		if found && !noCache && time.Since(cached.Checked) < ttl {
+			cached.Cached = true
+			results[machine.Id] = cached
+			continue
+		}
+
+		wg.Add(1)
+		go func(machine Machine) {
+			defer wg.Done()
+			limit <- true
+			reachability := probeMachine(path, machine)
+			<-limit
+
+			mutex.Lock()
+			results[machine.Id] = reachability
+			cache[machine.Id] = reachability
+			mutex.Unlock()
+		}(machine)
+	}
+	wg.Wait()
+
+	return results, saveReachabilityCache(path, cache)
+}
+
+/*
+Check whether the machine is reachable by connecting to it using ssh
+*/
+func probeMachine(path string, machine Machine) Reachability {
+	sshCommand := fmt.Sprintf(
+		"ssh -o 'ConnectTimeout 5' %s %s true",
+		sshOptions(path, machine, "-p"),
+		sshDestination(machine),
+	)
+	cmd, err := machineCommand(machine, sshCommand)
+	if err != nil {
+		return Reachability{Reachable: false, Error: err.Error(), Checked: time.Now()}
+	}
+	output, err := cmd.CombinedOutput()
+
+	reachability := Reachability{Reachable: err == nil, Checked: time.Now()}
+	if err != nil {
+		reachability.Error = err.Error()
+		if len(output) > 0 {
+			reachability.Error = string(output)
+		}
+	}
+	return reachability
+}
+
+/*
+Load the cached reachability results
+*/
+func loadReachabilityCache(path string) (map[string]Reachability, error) {
+	cache := map[string]Reachability{}
+	data, err := ioutil.ReadFile(path + "/reachability.json")
+	if os.IsNotExist(err) {
+		return cache, nil
+	}
+	if err != nil {
+		return cache, err
+	}
+
+	err = json.Unmarshal(data, &cache)
+	return cache, err
+}
+
+/*
+Save the cached reachability results
+*/
+func saveReachabilityCache(path string, cache map[string]Reachability) error {
+	data, err := json.Marshal(cache)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path+"/reachability.json", data, 0644)
+}
@@ -0,0 +1,398 @@
+/*
+Renaming the entities of the setup, updating all references to them
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+/*
+Type defining a field of an element of a setup file
+*/
+type setupField struct {
+	Key   string
+	Value json.RawMessage
+}
+
+/*
+Type defining an element of a JSON list in a setup file. The fields keep their
+order, and fields unknown to orchid are kept, when written back
+*/
+type setupElement []setupField
+
+/*
+Decode the element, keeping the order of its fields
+*/
+func (e *setupElement) UnmarshalJSON(data []byte) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	if _, err := decoder.Token(); err != nil {
+		return err
+	}
+
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return err
+		}
+		key, _ := token.(string)
+
+		var value json.RawMessage
+		err = decoder.Decode(&value)
+		if err != nil {
+			return err
+		}
+		*e = append(*e, setupField{Key: key, Value: value})
+	}
+	return nil
+}
+
+/*
+Encode the element with its fields in their original order
+*/
+func (e setupElement) MarshalJSON() ([]byte, error) {
+	buffer := bytes.Buffer{}
+	buffer.WriteString("{")
+	for i, field := range e {
+		if i > 0 {
+			buffer.WriteString(",")
+		}
+		key, err := json.Marshal(field.Key)
+		if err != nil {
+			return nil, err
+		}
+		buffer.Write(key)
+		buffer.WriteString(":")
+		buffer.Write(field.Value)
+	}
+	buffer.WriteString("}")
+	return buffer.Bytes(), nil
+}
+
+/*
+Get the value of the string field, or "" if not a string
+*/
+func (e setupElement) getString(key string) string {
+	for _, field := range e {
+		if field.Key == key {
+			var value string
+			json.Unmarshal(field.Value, &value)
+			return value
+		}
+	}
+	return ""
+}
+
+/*
+Replace the value of the string field if it is oldValue. Returns whether it was
+replaced
+*/
+func (e setupElement) replaceString(key, oldValue, newValue string) bool {
+	for i, field := range e {
+		var value string
+		if field.Key == key && json.Unmarshal(field.Value, &value) == nil && value == oldValue {
+			e[i].Value, _ = encodeSetup(newValue, "")
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Replace oldValue in the list of strings of the field. Returns the number of
+values replaced
+*/
+func (e setupElement) replaceInList(key, oldValue, newValue string) int {
+	replaced := 0
+	for i, field := range e {
+		var values []string
+		if field.Key != key || json.Unmarshal(field.Value, &values) != nil {
+			continue
+		}
+		for j := range values {
+			if values[j] == oldValue {
+				values[j] = newValue
+				replaced++
+			}
+		}
+		if replaced > 0 {
+			e[i].Value, _ = encodeSetup(values, "")
+		}
+	}
+	return replaced
+}
+
+/*
+Apply the function to each element of the list of elements of the field, e.g.
+the steps of a job's pipeline
+*/
+func (e setupElement) updateElements(key string, update func(setupElement)) error {
+	for i, field := range e {
+		if field.Key != key {
+			continue
+		}
+		elements := []setupElement{}
+		err := json.Unmarshal(field.Value, &elements)
+		if err != nil {
+			return err
+		}
+		for _, element := range elements {
+			update(element)
+		}
+		e[i].Value, err = encodeSetup(elements, "")
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+Apply the function to the element of the field, e.g. the machine selector of a
+step
+*/
+func (e setupElement) updateElement(key string, update func(setupElement)) error {
+	for i, field := range e {
+		if field.Key != key || string(field.Value) == "null" {
+			continue
+		}
+		element := setupElement{}
+		err := json.Unmarshal(field.Value, &element)
+		if err != nil {
+			return err
+		}
+		update(element)
+		e[i].Value, err = encodeSetup(element, "")
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+Encode the value as JSON without escaping HTML characters, which would make
+commands such as "a && b" unreadable, optionally indenting it
+*/
+func encodeSetup(value interface{}, indent string) ([]byte, error) {
+	buffer := bytes.Buffer{}
+	encoder := json.NewEncoder(&buffer)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", indent)
+	err := encoder.Encode(value)
+	return bytes.TrimRight(buffer.Bytes(), "\n"), err
+}
+
+/*
+Load the elements of the setup file. A missing file has no elements
+*/
+func loadSetupFile(path, name string) ([]setupElement, error) {
+	elements := []setupElement{}
+	data, err := ioutil.ReadFile(path + "/" + name)
+	if os.IsNotExist(err) {
+		return elements, nil
+	}
+	if err != nil {
+		return elements, err
+	}
+
+	err = json.Unmarshal(data, &elements)
+	if err != nil {
+		return elements, errors.New("Could not read " + name + ": " + err.Error())
+	}
+	return elements, nil
+}
+
+/*
+Write the elements to the setup file, indented
+*/
+func writeSetupFile(path, name string, elements []setupElement) error {
+	data, err := encodeSetup(elements, "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path+"/"+name, append(data, '\n'), 0644)
+}
+
+/*
+Rename the machine, job, action, group, script, or key with the given id, and
+update all references to it. Fails if the new id is already in use. Returns the
+number of references updated
+*/
+func renameEntity(path, kind, oldId, newId string) (int, error) {
+	if newId == "" {
+		return 0, errors.New("The new id must be non-empty")
+	}
+	if oldId == newId {
+		return 0, errors.New("The new id is the same as the old id")
+	}
+
+	keyDirectory, err := keyDir(path)
+	if err != nil {
+		return 0, err
+	}
+
+	files := map[string][]setupElement{}
+	for _, name := range []string{"machines.json", "jobs.json", "actions.json", "groups.json", "scripts.json"} {
+		elements, err := loadSetupFile(path, name)
+		if err != nil {
+			return 0, err
+		}
+		files[name] = elements
+	}
+
+	// Inline scripts are renamed like the entities of the other files
+	inlineScript := false
+	if kind == "script" {
+		inlineScript = len(filterElements(files["scripts.json"], map[string]bool{oldId: true})) > 0
+	}
+
+	// Rename the entity itself
+	changed := map[string]bool{}
+	switch {
+	case kind == "machine" || kind == "job" || kind == "action" || kind == "group" || inlineScript:
+		name := kind + "s.json"
+		if kind == "machine" && newId == "local" {
+			return 0, errors.New("The id 'local' is reserved for the machine running orchid")
+		}
+		if inlineScript {
+			if _, err := os.Stat(path + "/scripts/" + newId); err == nil {
+				return 0, errors.New("A script named '" + newId + "' already exists")
+			}
+		}
+
+		found := false
+		for _, element := range files[name] {
+			if element.getString("Id") == newId {
+				return 0, errors.New("A " + kind + " with the id '" + newId + "' already exists")
+			}
+			found = element.getString("Id") == oldId || found
+		}
+		if !found {
+			return 0, errors.New("No " + kind + " with the id '" + oldId + "' was found in " + name)
+		}
+
+		for _, element := range files[name] {
+			element.replaceString("Id", oldId, newId)
+		}
+		changed[name] = true
+	case kind == "script" || kind == "key":
+		dir := path + "/" + kind + "s/"
+		if kind == "key" {
+			dir = keyDirectory + "/"
+		}
+		if _, err := os.Stat(dir + oldId); err != nil {
+			return 0, errors.New("No " + kind + " named '" + oldId + "' was found")
+		}
+		if _, err := os.Stat(dir + newId); err == nil {
+			return 0, errors.New("A " + kind + " named '" + newId + "' already exists")
+		}
+		if kind == "script" && len(filterElements(files["scripts.json"], map[string]bool{newId: true})) > 0 {
+			return 0, errors.New("A script named '" + newId + "' already exists")
+		}
+	default:
+		return 0, errors.New("Unknown kind '" + kind + "'. Must be machine, job, action, group, script, or key")
+	}
+
+	// Update the references to the entity
+	references := 0
+	replaceString := func(name string, element setupElement, key string) {
+		if element.replaceString(key, oldId, newId) {
+			changed[name] = true
+			references++
+		}
+	}
+
+	var selectorErr error
+	for _, job := range files["jobs.json"] {
+		if kind == "machine" {
+			replaceString("jobs.json", job, "DefaultMachine")
+		}
+		err := job.updateElements("Pipeline", func(step setupElement) {
+			switch kind {
+			case "machine":
+				replaceString("jobs.json", step, "Machine")
+				err := step.updateElement("MachineSelector", func(selector setupElement) {
+					if replaced := selector.replaceInList("Candidates", oldId, newId); replaced > 0 {
+						changed["jobs.json"] = true
+						references += replaced
+					}
+				})
+				if err != nil {
+					selectorErr = err
+				}
+			case "script":
+				replaceString("jobs.json", step, "Script")
+			}
+		})
+		if err == nil {
+			err = selectorErr
+		}
+		if err != nil {
+			return 0, errors.New("Could not read jobs.json: " + err.Error())
+		}
+	}
+
+	for _, action := range files["actions.json"] {
+		switch kind {
+		case "machine":
+			replaceString("actions.json", action, "Machine")
+		case "group":
+			replaceString("actions.json", action, "Group")
+		}
+	}
+
+	if kind == "machine" {
+		for _, group := range files["groups.json"] {
+			if replaced := group.replaceInList("Machines", oldId, newId); replaced > 0 {
+				changed["groups.json"] = true
+				references += replaced
+			}
+		}
+	}
+
+	if kind == "key" {
+		for _, machine := range files["machines.json"] {
+			replaceString("machines.json", machine, "PrivateKey")
+		}
+	}
+
+	// Write the changes once all of them are known to succeed
+	if (kind == "script" && !inlineScript) || kind == "key" {
+		dir := path + "/" + kind + "s/"
+		if kind == "key" {
+			dir = keyDirectory + "/"
+		}
+		err := os.MkdirAll(filepath.Dir(dir+newId), 0755)
+		if err != nil {
+			return 0, err
+		}
+		err = os.Rename(dir+oldId, dir+newId)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	for name := range changed {
+		err := writeSetupFile(path, name, files[name])
+		if err != nil {
+			return references, err
+		}
+	}
+
+	// Host keys are pinned by machine id
+	if kind == "machine" {
+		err := renamePinnedHostKeys(path, oldId, newId)
+		if err != nil {
+			return references, err
+		}
+	}
+
+	return references, nil
+}
@@ -0,0 +1,134 @@
+/*
+Executing group actions in waves of machines, e.g. for rolling restarts keeping
+most of a group serving while the rest restarts
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+/*
+Type defining the waves of machines a group action is executed in. Each wave
+has Size machines, or Percent percent of the machines of the group. The
+HealthCheck action, if any, is executed on each machine of a wave once the
+action succeeded on all of them, before the next wave starts
+*/
+type Batch struct {
+	Size        int
+	Percent     int
+	HealthCheck string
+}
+
+/*
+Parse the size of the waves, either a number of machines, e.g. "2", or a
+percentage of the group, e.g. "25%"
+*/
+func parseBatch(batch string) (*Batch, error) {
+	if strings.HasSuffix(batch, "%") {
+		percent, err := strconv.Atoi(strings.TrimSuffix(batch, "%"))
+		if err != nil || percent < 1 || percent > 100 {
+			return nil, errors.New("Invalid batch '" + batch + "', expected a percentage between 1% and 100%")
+		}
+		return &Batch{Percent: percent}, nil
+	}
+
+	size, err := strconv.Atoi(batch)
+	if err != nil || size < 1 {
+		return nil, errors.New("Invalid batch '" + batch + "', expected a number of machines or a percentage, e.g. 2 or 25%")
+	}
+	return &Batch{Size: size}, nil
+}
+
+/*
+Split the machines into waves. Percentages are rounded up, so every wave has at
+least one machine
+*/
+func (b Batch) waves(machines []Machine) [][]Machine {
+	size := b.Size
+	if b.Percent > 0 {
+		size = (len(machines)*b.Percent + 99) / 100
+	}
+	if size < 1 {
+		size = 1
+	}
+
+	waves := [][]Machine{}
+	for len(machines) > size {
+		waves = append(waves, machines[:size])
+		machines = machines[size:]
+	}
+	if len(machines) > 0 {
+		waves = append(waves, machines)
+	}
+	return waves
+}
+
+/*
+Execute the group action in waves of machines. The machines of a wave are
+executed on one at a time, as for other group actions. The next wave only
+starts once the action and the health check succeeded on every machine of the
+wave, leaving the remaining machines untouched if any failed. The output of the
+action on each machine is written to its log. The variables are substituted
+into the command of the health check
+*/
+func (a *Actions) runGroupActionInWaves(setup Setup, action Action, machines []Machine, batch Batch, logs *groupLogs, vars map[string]string) error {
+	var healthCheck Action
+	if batch.HealthCheck != "" {
+		var found bool
+		healthCheck, found = setup.findAction(batch.HealthCheck)
+		if !found {
+			return ErrActionNotFound
+		}
+		var err error
+		healthCheck.Command, err = expandVars(healthCheck.Command, vars)
+		if err != nil {
+			return errors.New("Health check " + healthCheck.Id + ": " + err.Error())
+		}
+	}
+
+	waves := batch.waves(machines)
+	done := 0
+	for i, wave := range waves {
+		ids := []string{}
+		for _, machine := range wave {
+			ids = append(ids, machine.Id)
+		}
+		fmt.Printf("===== Wave %d of %d: %s =====\n", i+1, len(waves), strings.Join(ids, ", "))
+
+		failed := []string{}
+		for _, machine := range wave {
+			fmt.Printf("----- %s -----\n", machine.Id)
+			action.Machine = machine.Id
+			err := logs.run(a, setup, action)
+			if err != nil {
+				fmt.Println("ERROR: " + err.Error())
+				failed = append(failed, machine.Id)
+			}
+		}
+
+		if len(failed) == 0 && batch.HealthCheck != "" {
+			for _, machine := range wave {
+				fmt.Printf("----- %s: health check %s -----\n", machine.Id, healthCheck.Id)
+				healthCheck.Machine = machine.Id
+				err := a.runAction(setup, healthCheck)
+				if err != nil {
+					fmt.Println("ERROR: " + err.Error())
+					failed = append(failed, machine.Id)
+				}
+			}
+		}
+
+		done += len(wave)
+		if len(failed) > 0 {
+			fmt.Printf("Wave %d of %d failed, %d of %d machines done\n", i+1, len(waves), done, len(machines))
+			return errors.New("The action failed on " + strings.Join(failed, ", ") + ". The remaining waves were not executed")
+		}
+		fmt.Printf("Wave %d of %d ok, %d of %d machines done\n", i+1, len(waves), done, len(machines))
+	}
+	return nil
+}
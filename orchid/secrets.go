@@ -0,0 +1,127 @@
+/*
+Materializing secrets as files on the machines running steps, for tools only
+reading secrets from files, e.g. credentials files
+*/
+
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"github.com/dchest/uniuri"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+/*
+Type defining a secret written to a temporary file on the machine while the
+step runs. The secret is read locally from the environment variable Env, or the
+file File relative to the orchid directory unless absolute
+*/
+type SecretFile struct {
+	Name string
+	Env  string
+	File string
+}
+
+/*
+Characters allowed in the names of secrets, which are part of the names of
+environment variables
+*/
+var secretName = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+
+/*
+Get the environment variable holding the path of the file of the secret on the
+machine, e.g. ORCHID_SECRET_DB for the secret named db. The command or script
+of the step references the path as {{ .secrets.db }}, see expandTemplate
+*/
+func secretVariable(secret SecretFile) string {
+	return "ORCHID_SECRET_" + strings.ToUpper(secret.Name)
+}
+
+/*
+Validate the secret files of a step
+*/
+func validateSecretFiles(secrets []SecretFile) error {
+	names := map[string]bool{}
+	for _, secret := range secrets {
+		if !secretName.MatchString(secret.Name) {
+			return errors.New("Invalid secret name '" + secret.Name + "'. Names may only contain letters, digits, and underscores")
+		}
+		if names[secretVariable(secret)] {
+			return errors.New("More than one secret named '" + secret.Name + "'")
+		}
+		names[secretVariable(secret)] = true
+		if (secret.Env == "") == (secret.File == "") {
+			return errors.New("The secret '" + secret.Name + "' must have either an Env or a File")
+		}
+	}
+	return nil
+}
+
+/*
+Read the value of the secret locally
+*/
+func readSecret(path string, secret SecretFile) ([]byte, error) {
+	if secret.Env != "" {
+		value := os.Getenv(secret.Env)
+		if value == "" {
+			return nil, errors.New("The environment variable " + secret.Env + " holding the secret '" + secret.Name + "' is empty")
+		}
+		return []byte(value), nil
+	}
+
+	file := secret.File
+	if !filepath.IsAbs(file) {
+		file = path + "/" + file
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.New("Could not read the secret '" + secret.Name + "': " + err.Error())
+	}
+	return data, nil
+}
+
+/*
+Wrap the script read by the shell from stdin so the secrets are written to
+temporary files only readable by the user before it runs, with their paths in
+environment variables, and removed once the shell exits, also when killed. The
+secrets are part of the script, base64 encoded to keep them exact, so they
+never appear on a command line. The script runs in a subshell, so its own traps
+and exits leave the removal in place
+*/
+func withSecretFiles(path, script string, secrets []SecretFile) (string, error) {
+	// Only the files created so far are removed if creating one fails
+	wrapped := strings.Builder{}
+	files := []string{}
+	for _, secret := range secrets {
+		variable := secretVariable(secret)
+		wrapped.WriteString(variable + "=\n")
+		files = append(files, "${"+variable+`:+"$`+variable+`"}`)
+	}
+	wrapped.WriteString("trap 'rm -f -- " + strings.Join(files, " ") + "' EXIT\n")
+	wrapped.WriteString("trap 'exit 129' HUP\ntrap 'exit 130' INT\ntrap 'exit 143' TERM\n")
+	for _, secret := range secrets {
+		value, err := readSecret(path, secret)
+		if err != nil {
+			return "", err
+		}
+
+		variable := secretVariable(secret)
+		delimiter := "ORCHID_SECRET_" + uniuri.New()
+		wrapped.WriteString(variable + "=$(umask 077 && mktemp) || exit 1\n")
+		wrapped.WriteString("export " + variable + "\n")
+		wrapped.WriteString(`base64 -d > "$` + variable + `" <<'` + delimiter + "'\n")
+		encoded := base64.StdEncoding.EncodeToString(value)
+		for len(encoded) > 76 {
+			wrapped.WriteString(encoded[:76] + "\n")
+			encoded = encoded[76:]
+		}
+		wrapped.WriteString(encoded + "\n" + delimiter + "\n")
+	}
+	wrapped.WriteString("(\n" + script + "\n)\n")
+	return wrapped.String(), nil
+}
@@ -0,0 +1,74 @@
+/*
+Selecting the machine of a step when the job runs, e.g. the current leader of a
+cluster
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+/*
+Type defining how the machine of a step is selected. Without candidates, the
+command runs locally and prints the id of the machine to run on. With
+candidates, the command runs on each candidate in turn, and the first candidate
+on which it succeeds is selected
+*/
+type MachineSelector struct {
+	Command    string
+	Candidates []string
+}
+
+/*
+Select the machine using the selector, returning its id
+*/
+func selectMachine(ctx context.Context, path string, selector MachineSelector, machines []Machine) (string, error) {
+	if len(selector.Candidates) == 0 {
+		output := bytes.Buffer{}
+		cmd := exec.Command("/bin/bash", "-c", selector.Command)
+		cmd.Stdout = &output
+		err := runCmd(ctx, cmd)
+		if err != nil {
+			return "", errors.New("The MachineSelector command failed: " + err.Error())
+		}
+
+		machineId := strings.TrimSpace(output.String())
+		if !machineExists(machineId, machines) {
+			return "", errors.New("The MachineSelector command selected unknown machine '" + machineId + "'")
+		}
+		return machineId, nil
+	}
+
+	for _, candidate := range selector.Candidates {
+		machine, found := Setup{Machines: machines}.findMachine(candidate)
+		if !found {
+			return "", ErrMachineNotFound
+		}
+
+		sshCommand := fmt.Sprintf(
+			"ssh %s %s '%s'",
+			sshOptions(path, machine, "-p"),
+			sshDestination(machine),
+			selector.Command,
+		)
+		cmd, err := machineCommand(machine, sshCommand)
+		if err != nil {
+			return "", err
+		}
+		err = runCmd(ctx, cmd)
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		if err == nil {
+			return machine.Id, nil
+		}
+	}
+
+	return "", errors.New("The MachineSelector command did not succeed on any of the candidates")
+}
@@ -0,0 +1,189 @@
+/*
+Definition of and methods for loading the optional settings configuration file
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+/*
+Type defining the settings. All settings are optional
+*/
+type Settings struct {
+	AllowedBinaries        []string
+	ReachabilityTTL        string
+	Inventory              *Inventory
+	MaxTransfers           int
+	MaxTransfersPerMachine int
+	TransferInterval       string
+	KeyDir                 string
+	MachineLockTimeout     string
+	PollLogs               bool
+	Env                    map[string]string
+	ConnectionPersist      string
+	MaxStepOutput          int64
+	MaxJobOutput           int64
+	FailTruncatedOutput    bool
+	ExpandEnv              bool
+	StrictEnv              bool
+	Strict                 bool
+	Shell                  string
+}
+
+/*
+Load the settings, using the defaults if there is no settings file
+*/
+func loadSettings(path string) (Settings, error) {
+	settings := &Settings{}
+	data, err := ioutil.ReadFile(path + "/settings.json")
+	if os.IsNotExist(err) {
+		return Settings{}, nil
+	}
+	if err != nil {
+		return Settings{}, err
+	}
+
+	err = json.Unmarshal(data, &settings)
+	if err != nil {
+		return Settings{}, err
+	}
+
+	err = validateSettings(*settings)
+	if err != nil {
+		return Settings{}, err
+	}
+
+	return *settings, nil
+}
+
+/*
+Validate the settings
+*/
+func validateSettings(settings Settings) error {
+	if _, err := parseDuration(settings.ReachabilityTTL); err != nil {
+		return errors.New("Settings invalid: Invalid ReachabilityTTL: " + err.Error())
+	}
+	if _, err := parseDuration(settings.TransferInterval); err != nil {
+		return errors.New("Settings invalid: Invalid TransferInterval: " + err.Error())
+	}
+	if _, err := parseDuration(settings.MachineLockTimeout); err != nil {
+		return errors.New("Settings invalid: Invalid MachineLockTimeout: " + err.Error())
+	}
+	if _, err := parseDuration(settings.ConnectionPersist); err != nil {
+		return errors.New("Settings invalid: Invalid ConnectionPersist: " + err.Error())
+	}
+	if settings.MaxStepOutput < 0 || settings.MaxJobOutput < 0 {
+		return errors.New("Settings invalid: Output limits can not be negative")
+	}
+	if err := validateEnv(settings.Env); err != nil {
+		return errors.New("Settings invalid: Invalid Env: " + err.Error())
+	}
+	if strings.ContainsAny(settings.Shell, "'\"") {
+		return errors.New("Settings invalid: Invalid Shell '" + settings.Shell + "'")
+	}
+
+	return nil
+}
+
+/*
+Get the directory holding the keys of the setup, given by the KeyDir setting
+relative to the setup, e.g. "keys-prod", or the keys directory by default
+*/
+func (s Settings) keyDir(path string) string {
+	if s.KeyDir == "" {
+		return filepath.Clean(path + "/keys")
+	}
+	if filepath.IsAbs(s.KeyDir) {
+		return filepath.Clean(s.KeyDir)
+	}
+	return filepath.Clean(path + "/" + s.KeyDir)
+}
+
+/*
+Get the directory holding the keys of the setup, for uses not loading the
+setup. Invalid settings are an error, rather than falling back to the keys
+directory, which would use keys of another setup
+*/
+func keyDir(path string) (string, error) {
+	settings, err := loadSettings(path)
+	if err != nil {
+		return "", err
+	}
+	return settings.keyDir(path), nil
+}
+
+/*
+Get how long the result of checking whether a machine is reachable is cached
+*/
+func (s Settings) reachabilityTTL() time.Duration {
+	ttl, err := parseDuration(s.ReachabilityTTL)
+	if err != nil || ttl == 0 {
+		return time.Minute
+	}
+	return ttl
+}
+
+/*
+Get how long a step waits for the lock of its machine held by another job
+*/
+func (s Settings) machineLockTimeout() time.Duration {
+	timeout, err := parseDuration(s.MachineLockTimeout)
+	if err != nil || timeout == 0 {
+		return 10 * time.Minute
+	}
+	return timeout
+}
+
+/*
+Check that the binary is allowed to be executed locally. If no allowlist is
+configured, every binary is allowed
+*/
+func (s Settings) checkBinaryAllowed(binary string) error {
+	if s.AllowedBinaries == nil {
+		return nil
+	}
+
+	resolved, err := resolveBinary(binary)
+	if err != nil {
+		return err
+	}
+
+	for _, allowed := range s.AllowedBinaries {
+		allowedResolved, err := resolveBinary(allowed)
+		if err != nil {
+			// Binaries on the allowlist need not exist on every machine
+			continue
+		}
+		if resolved == allowedResolved {
+			return nil
+		}
+	}
+
+	return errors.New("The binary '" + resolved + "' is not on the list of allowed binaries")
+}
+
+/*
+Resolve a binary name or path to the absolute path of the file executed
+*/
+func resolveBinary(binary string) (string, error) {
+	resolved, err := exec.LookPath(binary)
+	if err != nil {
+		return "", err
+	}
+
+	resolved, err = filepath.Abs(resolved)
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.EvalSymlinks(resolved)
+}
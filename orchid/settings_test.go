@@ -0,0 +1,35 @@
+package main
+
+import (
+	"io/ioutil"
+	"testing"
+)
+
+/*
+Test the key directory given by the KeyDir setting, and that invalid settings
+are an error rather than falling back to the keys directory
+*/
+func TestKeyDir(t *testing.T) {
+	tests := []struct {
+		keyDir   string
+		expected string
+	}{
+		{"", "/srv/orchid/keys"},
+		{"keys-prod", "/srv/orchid/keys-prod"},
+		{"keys-prod/", "/srv/orchid/keys-prod"},
+		{"/etc/orchid/keys", "/etc/orchid/keys"},
+	}
+	for _, test := range tests {
+		if dir := (Settings{KeyDir: test.keyDir}).keyDir("/srv/orchid"); dir != test.expected {
+			t.Errorf("%s: got %s, expected %s", test.keyDir, dir, test.expected)
+		}
+	}
+
+	path := t.TempDir()
+	if err := ioutil.WriteFile(path+"/settings.json", []byte(`{"KeyDir": `), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if dir, err := keyDir(path); err == nil {
+		t.Errorf("got %s for invalid settings, expected an error", dir)
+	}
+}
@@ -11,53 +11,202 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 )
 
 /*
 Type defining the complete setup of jobs, machines, and scripts
 */
 type Setup struct {
-	Machines []Machine
-	Jobs     []Job
-	Actions  []Action
-	Scripts  []string
+	Machines      []Machine
+	Jobs          []Job
+	Actions       []Action
+	Groups        []Group
+	Scripts       []string
+	InlineScripts []Script
+	KeyDir        string
 }
 
 /*
-Type defining a machine configuration
+Type defining a machine configuration. KeyFile and NoTTY are not configured,
+but set once the setup is loaded: the path of the key file, and whether orchid
+runs without a terminal
 */
 type Machine struct {
-	Id         string
-	Address    string
-	Port       string
-	User       string
-	PrivateKey string
+	Id          string
+	Description string
+	Address     string
+	Port        string
+	User        string
+	PrivateKey  string
+	KeyProvider string
+	Host        string
+	SSHConfig   string
+	PasswordEnv string
+	PreCommand  string
+	PostCommand string
+	Shell       string
+	KeyFile     string `json:"-"`
+	NoTTY       bool   `json:"-"`
 }
 
 /*
 Type defining a job configuration
 */
 type Job struct {
-	Id       string
-	Pipeline []Executable
+	Id             string
+	Description    string
+	DefaultMachine string
+	Env            map[string]string
+	Pipeline       []Executable
+	Notify         *Notification
+	Confirm        bool
+	OnStart        string
+	Priority       int
 }
 
 /*
 Type defining an executable (part of a job)
 */
 type Executable struct {
-	Machine string
-	Script  string
-	Args    []string
+	Id               string
+	Machine          string
+	MachineSelector  *MachineSelector
+	Script           string
+	Command          string
+	Args             []string
+	Env              map[string]string
+	Tags             []string
+	IgnoreExitCodes  []int
+	ExitStatuses     map[int]string
+	Output           string
+	MaxOutput        int64
+	Timeout          string
+	Retries          int
+	ConnectRetries   int
+	RetryDelay       string
+	RetryMaxDelay    string
+	Lenient          bool
+	Strict           bool
+	Artifacts        []string
+	Shell            string
+	Check            bool
+	Input            string
+	InputFile        string
+	SecretFiles      []SecretFile
+	Cache            bool
+	Container        string
+	ContainerEnv     []string
+	ContainerVolumes []string
+	When             string
 }
 
 /*
-Type defining an action
+Type defining an action. An action targets either a machine or a group of
+machines
 */
 type Action struct {
-	Id      string
-	Machine string
-	Command string
+	Id              string
+	Description     string
+	Machine         string
+	Group           string
+	Command         string
+	IgnoreExitCodes []int
+	Confirm         bool
+	Strict          bool
+	Lenient         bool
+}
+
+/*
+Type defining a script stored inline in the setup rather than in a file of the
+scripts directory
+*/
+type Script struct {
+	Id   string
+	Body string
+}
+
+/*
+Type defining a named group of machines
+*/
+type Group struct {
+	Id       string
+	Machines []string
+}
+
+/*
+Find the machine with the given id
+*/
+func (s Setup) findMachine(machineId string) (Machine, bool) {
+	for _, machine := range s.Machines {
+		if machine.Id == machineId {
+			return machine, true
+		}
+	}
+	return Machine{}, false
+}
+
+/*
+Find the job with the given id
+*/
+func (s Setup) findJob(jobId string) (Job, bool) {
+	for _, job := range s.Jobs {
+		if job.Id == jobId {
+			return job, true
+		}
+	}
+	return Job{}, false
+}
+
+/*
+Find the inline script with the given name
+*/
+func (s Setup) findInlineScript(name string) (Script, bool) {
+	for _, script := range s.InlineScripts {
+		if script.Id == name {
+			return script, true
+		}
+	}
+	return Script{}, false
+}
+
+/*
+Find the action with the given id
+*/
+func (s Setup) findAction(actionId string) (Action, bool) {
+	for _, action := range s.Actions {
+		if action.Id == actionId {
+			return action, true
+		}
+	}
+	return Action{}, false
+}
+
+/*
+Find the group with the given id
+*/
+func (s Setup) findGroup(groupId string) (Group, bool) {
+	for _, group := range s.Groups {
+		if group.Id == groupId {
+			return group, true
+		}
+	}
+	return Group{}, false
+}
+
+/*
+Get the machines of the group, in the order they are listed in
+*/
+func (s Setup) groupMachines(group Group) []Machine {
+	machines := []Machine{}
+	for _, machineId := range group.Machines {
+		if machine, found := s.findMachine(machineId); found {
+			machines = append(machines, machine)
+		}
+	}
+	return machines
 }
 
 /*
@@ -69,6 +218,23 @@ func loadSetup(path string) (Setup, error) {
 		return Setup{}, machineErr
 	}
 
+	settings, settingsErr := loadSettings(path)
+	if settingsErr != nil {
+		return Setup{}, settingsErr
+	}
+
+	if settings.Inventory != nil {
+		inventory, inventoryErr := loadInventory(path, *settings.Inventory)
+		if inventoryErr != nil {
+			return Setup{}, inventoryErr
+		}
+
+		machines, machineErr = mergeInventory(machines, inventory)
+		if machineErr != nil {
+			return Setup{}, machineErr
+		}
+	}
+
 	jobs, jobErr := loadJobs(path)
 	if jobErr != nil {
 		return Setup{}, jobErr
@@ -79,40 +245,84 @@ func loadSetup(path string) (Setup, error) {
 		return Setup{}, actionErr
 	}
 
+	groups, groupErr := loadGroups(path)
+	if groupErr != nil {
+		return Setup{}, groupErr
+	}
+
 	scripts, scriptErr := loadDir(path + "/scripts")
 	if scriptErr != nil {
 		return Setup{}, scriptErr
 	}
 
-	keys, keyErr := loadDir(path + "/keys")
+	inlineScripts, inlineScriptErr := loadInlineScripts(path)
+	if inlineScriptErr != nil {
+		return Setup{}, inlineScriptErr
+	}
+
+	keyDirectory := settings.keyDir(path)
+	keys, keyErr := loadDir(keyDirectory)
 	if keyErr != nil {
 		return Setup{}, keyErr
 	}
 
-	machineValidationErr := validateMachines(machines, keys, path)
+	if settings.ExpandEnv {
+		expandErr := expandSetupEnv(machines, jobs, actions, settings.StrictEnv)
+		if expandErr != nil {
+			return Setup{}, expandErr
+		}
+	}
+
+	setKeyFiles(machines, keyDirectory)
+	machineValidationErr := validateMachines(machines, keys, keyDirectory, path)
 	if machineValidationErr != nil {
 		return Setup{}, machineValidationErr
 	}
 
-	jobValidationErr := validateJobs(jobs, machines, scripts, path)
+	inlineScriptValidationErr := validateInlineScripts(inlineScripts, scripts, path)
+	if inlineScriptValidationErr != nil {
+		return Setup{}, inlineScriptValidationErr
+	}
+
+	jobValidationErr := validateJobs(jobs, machines, scripts, inlineScripts, path)
 	if jobValidationErr != nil {
 		return Setup{}, jobValidationErr
 	}
 
-	actionValidationErr := validateActions(actions, machines)
+	groupValidationErr := validateGroups(groups, machines)
+	if groupValidationErr != nil {
+		return Setup{}, groupValidationErr
+	}
+
+	actionValidationErr := validateActions(actions, machines, groups)
 	if actionValidationErr != nil {
 		return Setup{}, actionValidationErr
 	}
 
 	setup := Setup{
-		Machines: machines,
-		Jobs:     jobs,
-		Actions:  actions,
-		Scripts:  scripts,
+		Machines:      machines,
+		Jobs:          jobs,
+		Actions:       actions,
+		Groups:        groups,
+		Scripts:       scripts,
+		InlineScripts: inlineScripts,
+		KeyDir:        keyDirectory,
 	}
 	return setup, nil
 }
 
+/*
+Set the paths of the private key files of the machines, given the directory
+holding the keys
+*/
+func setKeyFiles(machines []Machine, keyDirectory string) {
+	for i := range machines {
+		if machines[i].PrivateKey != "" {
+			machines[i].KeyFile = keyDirectory + "/" + machines[i].PrivateKey
+		}
+	}
+}
+
 /*
 Load the configuration files concerned with machines
 */
@@ -146,6 +356,15 @@ func loadJobs(path string) ([]Job, error) {
 		return []Job{}, err
 	}
 
+	// Steps without a machine run on the default machine of their job
+	for _, job := range *jobs {
+		for i, executable := range job.Pipeline {
+			if executable.Machine == "" && executable.MachineSelector == nil {
+				job.Pipeline[i].Machine = job.DefaultMachine
+			}
+		}
+	}
+
 	return *jobs, nil
 }
 
@@ -167,6 +386,49 @@ func loadActions(path string) ([]Action, error) {
 	return *actions, nil
 }
 
+/*
+Load the configuration file concerned with groups. Groups are optional, so a
+missing file means no groups
+*/
+func loadGroups(path string) ([]Group, error) {
+	groups := &[]Group{}
+	data, err := ioutil.ReadFile(path + "/groups.json")
+	if os.IsNotExist(err) {
+		return []Group{}, nil
+	}
+	if err != nil {
+		return []Group{}, err
+	}
+
+	err = json.Unmarshal(data, &groups)
+	if err != nil {
+		return []Group{}, err
+	}
+
+	return *groups, nil
+}
+
+/*
+Load the optional configuration file concerned with inline scripts
+*/
+func loadInlineScripts(path string) ([]Script, error) {
+	scripts := &[]Script{}
+	data, err := ioutil.ReadFile(path + "/scripts.json")
+	if os.IsNotExist(err) {
+		return []Script{}, nil
+	}
+	if err != nil {
+		return []Script{}, err
+	}
+
+	err = json.Unmarshal(data, &scripts)
+	if err != nil {
+		return []Script{}, err
+	}
+
+	return *scripts, nil
+}
+
 /*
 Helper method for loading the names of all files in a single directory.
 Used for loading scripts and keys
@@ -191,12 +453,31 @@ func loadDir(path string) ([]string, error) {
 /*
 Validate the machine configuration
 */
-func validateMachines(machines []Machine, keys []string, path string) error {
+func validateMachines(machines []Machine, keys []string, keyDirectory string, path string) error {
 
 	for _, machine := range machines {
 		if machine.Id == "" {
 			return errors.New("Machine config invalid: Each machine must have a non-empty id")
 		}
+		if strings.ContainsAny(machine.Shell, "'\"") {
+			return errors.New("Machine config invalid: Machine '" + machine.Id + "' has an invalid Shell '" + machine.Shell + "'")
+		}
+		if strings.Contains(machine.PreCommand, "'") || strings.Contains(machine.PostCommand, "'") {
+			// The hooks are run within single quoted remote commands
+			return errors.New("Machine config invalid: Machine '" + machine.Id + "' has a PreCommand or PostCommand containing a single quote")
+		}
+		if machine.Host != "" {
+			// The connection details are left to the ssh config
+			if machine.SSHConfig != "" {
+				if _, err := os.Stat(sshConfigFile(path, machine)); err != nil {
+					return errors.New("Machine config invalid: Machine '" + machine.Id + "' contains reference to unknown SSHConfig")
+				}
+			}
+			continue
+		}
+		if machine.SSHConfig != "" {
+			return errors.New("Machine config invalid: Machine '" + machine.Id + "' must have a non-empty Host when using an SSHConfig")
+		}
 		if machine.Address == "" {
 			return errors.New("Machine config invalid: Machine '" + machine.Id + "' must have a non-empty Address")
 		}
@@ -206,11 +487,25 @@ func validateMachines(machines []Machine, keys []string, path string) error {
 		if machine.User == "" {
 			return errors.New("Machine config invalid: Machine '" + machine.Id + "' must have a non-empty User")
 		}
+		if machine.KeyProvider != "" {
+			// The key is not a file, but held by the provider
+			if machine.PrivateKey != "" {
+				return errors.New("Machine config invalid: Machine '" + machine.Id + "' can not have both a PrivateKey and a KeyProvider")
+			}
+			if err := validateKeyProvider(machine.KeyProvider); err != nil {
+				return errors.New("Machine config invalid: Machine '" + machine.Id + "': " + err.Error())
+			}
+			continue
+		}
+		if machine.PasswordEnv != "" && machine.PrivateKey == "" {
+			// The machine uses password authentication
+			continue
+		}
 		if machine.PrivateKey == "" {
-			return errors.New("Machine config invalid: Machine '" + machine.Id + "' must have a non-empty PrivateKey")
+			return errors.New("Machine config invalid: Machine '" + machine.Id + "' must have a non-empty PrivateKey, KeyProvider, or PasswordEnv")
 		}
 
-		pathLength := len(path + "/keys")
+		pathLength := len(keyDirectory)
 		found := false
 		for _, key := range keys {
 			if machine.PrivateKey == key[pathLength+1:] {
@@ -229,7 +524,7 @@ func validateMachines(machines []Machine, keys []string, path string) error {
 /*
 Validate the job configuration
 */
-func validateJobs(jobs []Job, machines []Machine, scripts []string, path string) error {
+func validateJobs(jobs []Job, machines []Machine, scripts []string, inlineScripts []Script, path string) error {
 	for _, job := range jobs {
 		if job.Id == "" {
 			return errors.New("Job config invalid: Each job must have a non-empty id")
@@ -238,18 +533,121 @@ func validateJobs(jobs []Job, machines []Machine, scripts []string, path string)
 			return errors.New("Job config invalid: Job '" + job.Id + "' must have a non-empty Pipeline")
 		}
 
-		for _, executable := range job.Pipeline {
-			machineFound := false
-			for _, machine := range machines {
-				if executable.Machine == machine.Id || executable.Machine == "local" {
-					machineFound = true
-					break
-				}
+		if job.Notify != nil {
+			if err := validateNotification(*job.Notify); err != nil {
+				return errors.New("Job config invalid: Job '" + job.Id + "' has an invalid notification: " + err.Error())
 			}
-			if !machineFound {
+		}
+
+		if err := validateEnv(job.Env); err != nil {
+			return errors.New("Job config invalid: Job '" + job.Id + "' has an invalid Env: " + err.Error())
+		}
+
+		if job.DefaultMachine != "" && !machineExists(job.DefaultMachine, machines) {
+			return errors.New("Job config invalid: Job '" + job.Id + "' has an unknown DefaultMachine '" + job.DefaultMachine + "'")
+		}
+
+		stepNames := map[string]bool{}
+		for i, executable := range job.Pipeline {
+			name := stepName(executable, i)
+			if stepNames[name] {
+				return errors.New("Job config invalid: Job '" + job.Id + "' contains more than one step named '" + name + "'")
+			}
+			stepNames[name] = true
+
+			if executable.MachineSelector != nil {
+				err := validateMachineSelector(*executable.MachineSelector, executable, machines)
+				if err != nil {
+					return errors.New("Job config invalid: Job '" + job.Id + "' contains a step with an invalid MachineSelector: " + err.Error())
+				}
+			} else if !machineExists(executable.Machine, machines) {
 				return errors.New("Job config invalid: Job '" + job.Id + "' contains a reference to one or more unknown machines")
 			}
 
+			if executable.Output != "" && executable.Output != "raw" && executable.Output != "normalized" {
+				return errors.New("Job config invalid: Job '" + job.Id + "' contains a step with an unknown Output mode '" + executable.Output + "'")
+			}
+
+			if executable.Retries < 0 {
+				return errors.New("Job config invalid: Job '" + job.Id + "' contains a step with a negative number of Retries")
+			}
+			if executable.ConnectRetries < 0 {
+				return errors.New("Job config invalid: Job '" + job.Id + "' contains a step with a negative number of ConnectRetries")
+			}
+			if executable.MaxOutput < 0 {
+				return errors.New("Job config invalid: Job '" + job.Id + "' contains a step with a negative MaxOutput")
+			}
+			if _, err := parseDuration(executable.Timeout); err != nil {
+				return errors.New("Job config invalid: Job '" + job.Id + "' contains a step with an invalid Timeout: " + err.Error())
+			}
+			if _, err := parseDuration(executable.RetryDelay); err != nil {
+				return errors.New("Job config invalid: Job '" + job.Id + "' contains a step with an invalid RetryDelay: " + err.Error())
+			}
+			if _, err := parseDuration(executable.RetryMaxDelay); err != nil {
+				return errors.New("Job config invalid: Job '" + job.Id + "' contains a step with an invalid RetryMaxDelay: " + err.Error())
+			}
+
+			if executable.Strict && executable.Lenient {
+				return errors.New("Job config invalid: Job '" + job.Id + "' contains a step that is both Strict and Lenient")
+			}
+
+			if executable.Input != "" && executable.InputFile != "" {
+				return errors.New("Job config invalid: Job '" + job.Id + "' contains a step with both an Input and an InputFile")
+			}
+			if executable.InputFile != "" {
+				if _, err := os.Stat(inputFile(path, executable)); err != nil {
+					return errors.New("Job config invalid: Job '" + job.Id + "' contains a step with an unknown InputFile '" + executable.InputFile + "'")
+				}
+			}
+
+			if err := validateEnv(executable.Env); err != nil {
+				return errors.New("Job config invalid: Job '" + job.Id + "' contains a step with an invalid Env: " + err.Error())
+			}
+
+			if err := validateSecretFiles(executable.SecretFiles); err != nil {
+				return errors.New("Job config invalid: Job '" + job.Id + "' contains a step with invalid SecretFiles: " + err.Error())
+			}
+
+			if executable.When != "" {
+				if _, err := parseWhen(executable.When); err != nil {
+					return errors.New("Job config invalid: Job '" + job.Id + "' contains a step with an invalid When: " + err.Error())
+				}
+			}
+
+			if err := validateContainer(executable); err != nil {
+				return errors.New("Job config invalid: Job '" + job.Id + "' contains a step with an invalid Container: " + err.Error())
+			}
+
+			if executable.Check && len(executable.IgnoreExitCodes) > 0 {
+				return errors.New("Job config invalid: Job '" + job.Id + "' contains a check step with IgnoreExitCodes. Checks fail on any non-zero exit code")
+			}
+
+			for code, status := range executable.ExitStatuses {
+				if code == 0 || reservedStatus(status) {
+					return errors.New("Job config invalid: Job '" + job.Id + "' contains a step mapping exit code " + strconv.Itoa(code) + " to an invalid status '" + status + "'")
+				}
+			}
+			if executable.Check && len(executable.ExitStatuses) > 0 {
+				return errors.New("Job config invalid: Job '" + job.Id + "' contains a check step with ExitStatuses. Checks fail on any non-zero exit code")
+			}
+
+			if strings.ContainsAny(executable.Shell, "'\"") {
+				return errors.New("Job config invalid: Job '" + job.Id + "' contains a step with an invalid Shell '" + executable.Shell + "'")
+			}
+
+			for _, artifact := range executable.Artifacts {
+				if artifact == "" || strings.Contains(artifact, "'") {
+					return errors.New("Job config invalid: Job '" + job.Id + "' contains a step with an invalid artifact path '" + artifact + "'")
+				}
+			}
+
+			if (executable.Script == "") == (executable.Command == "") {
+				return errors.New("Job config invalid: Job '" + job.Id + "' contains a step which must have either a Script or a Command")
+			}
+			if executable.Command != "" {
+				continue
+			}
+
 			pathLength := len(path + "/scripts")
 			scriptFound := false
 			for _, script := range scripts {
@@ -258,6 +656,9 @@ func validateJobs(jobs []Job, machines []Machine, scripts []string, path string)
 					break
 				}
 			}
+			if _, found := (Setup{InlineScripts: inlineScripts}).findInlineScript(executable.Script); found {
+				scriptFound = true
+			}
 			if !scriptFound {
 				return errors.New("Job config invalid: Job '" + job.Id + "' contains a reference to one or more unknown scripts")
 			}
@@ -267,26 +668,128 @@ func validateJobs(jobs []Job, machines []Machine, scripts []string, path string)
 	return nil
 }
 
+/*
+Validate the machine selector of the step
+*/
+func validateMachineSelector(selector MachineSelector, executable Executable, machines []Machine) error {
+	if executable.Machine != "" {
+		return errors.New("A step must have either a Machine or a MachineSelector, not both")
+	}
+	if selector.Command == "" {
+		return errors.New("The Command must be non-empty")
+	}
+	for _, candidate := range selector.Candidates {
+		if _, found := (Setup{Machines: machines}).findMachine(candidate); !found {
+			return errors.New("Unknown candidate machine '" + candidate + "'")
+		}
+	}
+	return nil
+}
+
 /*
 Validate the action configuration
 */
-func validateActions(actions []Action, machines []Machine) error {
+func validateActions(actions []Action, machines []Machine, groups []Group) error {
 	for _, action := range actions {
 		if action.Id == "" {
 			return errors.New("Action config invalid: Each action must have a non-empty id")
 		}
+		if action.Strict && action.Lenient {
+			return errors.New("Action config invalid: Action '" + action.Id + "' can not be both Strict and Lenient")
+		}
 
-		machineFound := false
-		for _, machine := range machines {
-			if action.Machine == machine.Id || action.Machine == "local" {
-				machineFound = true
-				break
+		if action.Group != "" {
+			if action.Machine != "" {
+				return errors.New("Action config invalid: Action '" + action.Id + "' must have either a Machine or a Group, not both")
 			}
+			if _, found := (Setup{Groups: groups}).findGroup(action.Group); !found {
+				return errors.New("Action config invalid: Action '" + action.Id + "' contains a reference to an unknown group")
+			}
+			continue
 		}
-		if !machineFound {
+
+		if !machineExists(action.Machine, machines) {
 			return errors.New("Action config invalid: Action '" + action.Id + "' contains a reference to one or more unknown machines")
 		}
 	}
 
 	return nil
 }
+
+/*
+Validate the groups, making sure they have unique ids and only contain known
+machines
+*/
+func validateGroups(groups []Group, machines []Machine) error {
+	ids := map[string]bool{}
+	for _, group := range groups {
+		if group.Id == "" {
+			return errors.New("Group config invalid: Each group must have a non-empty id")
+		}
+		if ids[group.Id] {
+			return errors.New("Group config invalid: Group id '" + group.Id + "' is used more than once")
+		}
+		ids[group.Id] = true
+
+		for _, machineId := range group.Machines {
+			if _, found := (Setup{Machines: machines}).findMachine(machineId); !found {
+				return errors.New("Group config invalid: Group '" + group.Id + "' contains a reference to unknown machine '" + machineId + "'")
+			}
+		}
+	}
+
+	return nil
+}
+
+/*
+Validate the inline scripts, making sure they have unique names, which are not
+also the names of script files, and a body
+*/
+func validateInlineScripts(inlineScripts []Script, scripts []string, path string) error {
+	files := map[string]bool{}
+	for _, script := range scripts {
+		files[script[len(path+"/scripts")+1:]] = true
+	}
+
+	ids := map[string]bool{}
+	for _, script := range inlineScripts {
+		if script.Id == "" {
+			return errors.New("Script config invalid: Each inline script must have a non-empty id")
+		}
+		if ids[script.Id] {
+			return errors.New("Script config invalid: Script id '" + script.Id + "' is used more than once")
+		}
+		ids[script.Id] = true
+
+		if files[script.Id] {
+			return errors.New("Script config invalid: Script '" + script.Id + "' is both inline and a file in the scripts directory")
+		}
+		if script.Body == "" {
+			return errors.New("Script config invalid: Script '" + script.Id + "' must have a non-empty Body")
+		}
+	}
+
+	return nil
+}
+
+/*
+Check whether the machine id refers to one of the machines or is "local",
+referring to the machine running orchid
+*/
+func machineExists(machineId string, machines []Machine) bool {
+	if machineId == "local" {
+		return true
+	}
+	_, found := Setup{Machines: machines}.findMachine(machineId)
+	return found
+}
+
+/*
+Parse an optional duration such as "1m30s", returning 0 if not given
+*/
+func parseDuration(duration string) (time.Duration, error) {
+	if duration == "" {
+		return 0, nil
+	}
+	return time.ParseDuration(duration)
+}
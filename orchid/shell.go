@@ -0,0 +1,359 @@
+/*
+Interactive shell for running orchid commands, loading the setup once rather
+than for every command
+*/
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"unicode/utf8"
+)
+
+/*
+Get the commands of the interactive shell: those of the command line, except
+for starting a shell and completion, and the commands of the shell itself
+*/
+func shellCommands() []string {
+	names := []string{}
+	for _, name := range commandNames() {
+		if name != "shell" && name != "completion" {
+			names = append(names, name)
+		}
+	}
+	return append(names, "reload", "help", "exit")
+}
+
+/*
+Run the interactive shell until exited. Identifiers of jobs, actions, machines,
+and logs are completed using tab. The setup is reloaded when its files change,
+while running jobs keep using the setup they were started with
+*/
+func (a *Actions) Shell() error {
+	err := a.reloadSetup()
+	if err != nil {
+		return err
+	}
+
+	// Reload the setup when it changes
+	stopWatching, err := a.watchSetup()
+	if err != nil {
+		fmt.Println("ERROR: The setup will not be reloaded on changes: " + err.Error())
+	} else {
+		defer stopWatching()
+	}
+
+	// Keep the shell running when interrupted, e.g. when stopping a job
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt)
+	defer signal.Stop(interrupts)
+	go func() {
+		for range interrupts {
+		}
+	}()
+
+	reader := bufio.NewReader(os.Stdin)
+	terminal := isTerminal(os.Stdin)
+	for {
+		var line string
+		if terminal {
+			line, err = readLine(reader, "orchid> ", a.complete)
+		} else {
+			line, err = reader.ReadString('\n')
+		}
+		if err == io.EOF {
+			fmt.Println()
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		args := splitArgs(line)
+		if len(args) == 0 {
+			continue
+		}
+
+		switch args[0] {
+		case "exit", "quit":
+			return nil
+		case "reload":
+			err = a.reloadSetup()
+			if err != nil {
+				fmt.Println("ERROR: " + err.Error())
+			} else {
+				fmt.Println("Setup reloaded")
+			}
+		case "help":
+			printUsage()
+			fmt.Println("- reload\t// Reload the setup")
+			fmt.Println("- exit\t// Exit the shell")
+		case "shell":
+			fmt.Println("ERROR: Already in the shell")
+		default:
+			runCommand(a, args)
+		}
+	}
+}
+
+/*
+Get the completion candidates for the word following the given words
+*/
+func (a *Actions) complete(words []string) []string {
+	if len(words) == 0 {
+		return shellCommands()
+	}
+
+	setup, _ := a.loadSetup()
+
+	candidates := []string{}
+	switch words[0] {
+	case "run", "describe":
+		for _, job := range setup.Jobs {
+			candidates = append(candidates, job.Id)
+		}
+	case "exec", "test":
+		if words[0] == "test" && len(words) > 1 {
+			return machineIds(setup)
+		}
+		for _, action := range setup.Actions {
+			candidates = append(candidates, action.Id)
+		}
+	case "ssh", "mount", "forward":
+		if len(words) == 1 {
+			return machineIds(setup)
+		}
+	case "logs", "stop":
+		logs, _ := loadLogs(a.path)
+		for _, log := range logs {
+			candidates = append(candidates, log.Id)
+		}
+	case "list":
+		candidates = []string{"jobs", "actions", "machines", "scripts", "keys", "logs"}
+	}
+	return candidates
+}
+
+/*
+Get the ids of all machines of the setup
+*/
+func machineIds(setup Setup) []string {
+	ids := []string{}
+	for _, machine := range setup.Machines {
+		ids = append(ids, machine.Id)
+	}
+	return ids
+}
+
+/*
+Read a line from the terminal, completing the last word using tab. Completes as
+much as is common to all candidates, listing the candidates if that is nothing
+*/
+func readLine(reader *bufio.Reader, prompt string, complete func([]string) []string) (string, error) {
+	restore, err := rawMode()
+	if err != nil {
+		// Read the line without completion
+		fmt.Print(prompt)
+		return reader.ReadString('\n')
+	}
+	defer restore()
+
+	fmt.Print(prompt)
+	line := []byte{}
+	for {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return "", err
+		}
+
+		switch b {
+		case '\n', '\r':
+			fmt.Println()
+			return string(line), nil
+		case 4: // Ctrl-D
+			if len(line) == 0 {
+				return "", io.EOF
+			}
+		case 127, 8: // Backspace
+			if len(line) > 0 {
+				line = deleteLastRune(line)
+				fmt.Print("\b \b")
+			}
+		case 27: // Escape sequences, e.g. arrow keys, are ignored
+			err = skipEscapeSequence(reader)
+			if err != nil {
+				return "", err
+			}
+		case '\t':
+			completion, candidates := completeLine(string(line), complete)
+			if completion != "" {
+				line = append(line, completion...)
+				fmt.Print(completion)
+			} else if len(candidates) > 1 {
+				fmt.Print("\n" + strings.Join(candidates, "  ") + "\n" + prompt + string(line))
+			}
+		default:
+			if b >= 32 {
+				line = append(line, b)
+				os.Stdout.Write([]byte{b})
+			}
+		}
+	}
+}
+
+/*
+Remove the last character of the line, which may span several bytes
+*/
+func deleteLastRune(line []byte) []byte {
+	_, size := utf8.DecodeLastRune(line)
+	return line[:len(line)-size]
+}
+
+/*
+Skip the rest of an escape sequence following ESC, e.g. of arrow keys ("[A"),
+Home and End ("[1~" or "OH"), or keys pressed along with Alt. Control sequences
+("[" followed by parameters) end with a byte in the range @ to ~
+*/
+func skipEscapeSequence(reader *bufio.Reader) error {
+	b, err := reader.ReadByte()
+	if err != nil {
+		return err
+	}
+	switch b {
+	case '[':
+		for {
+			b, err = reader.ReadByte()
+			if err != nil {
+				return err
+			}
+			if b >= '@' && b <= '~' {
+				return nil
+			}
+		}
+	case 'O':
+		_, err = reader.ReadByte()
+		return err
+	}
+	return nil
+}
+
+/*
+Complete the last word of the line, returning the text to append to the line
+and the candidates matching the word
+*/
+func completeLine(line string, complete func([]string) []string) (string, []string) {
+	words := splitArgs(line)
+	prefix := ""
+	if len(words) > 0 && !strings.HasSuffix(line, " ") {
+		prefix = words[len(words)-1]
+		words = words[:len(words)-1]
+	}
+
+	candidates := []string{}
+	for _, candidate := range complete(words) {
+		if strings.HasPrefix(candidate, prefix) {
+			candidates = append(candidates, candidate)
+		}
+	}
+	if len(candidates) == 0 {
+		return "", candidates
+	}
+
+	// Find the prefix common to all candidates
+	common := candidates[0]
+	for _, candidate := range candidates[1:] {
+		for !strings.HasPrefix(candidate, common) {
+			common = string(deleteLastRune([]byte(common)))
+		}
+	}
+
+	completion := common[len(prefix):]
+	if len(candidates) == 1 {
+		completion += " "
+	}
+	return completion, candidates
+}
+
+/*
+Split a line into arguments separated by whitespace. Arguments can be quoted
+using single or double quotes to include whitespace
+*/
+func splitArgs(line string) []string {
+	args := []string{}
+	current := []rune{}
+	inArg := false
+	var quote rune
+
+	for _, r := range line {
+		switch {
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote != 0:
+			current = append(current, r)
+		case r == '\'' || r == '"':
+			quote = r
+			inArg = true
+		case r == ' ' || r == '\t' || r == '\n' || r == '\r':
+			if inArg {
+				args = append(args, string(current))
+				current = current[:0]
+				inArg = false
+			}
+		default:
+			current = append(current, r)
+			inArg = true
+		}
+	}
+	if inArg {
+		args = append(args, string(current))
+	}
+
+	return args
+}
+
+/*
+Put the terminal in raw mode, reading input a byte at a time without echoing
+it. Returns a function restoring the previous mode
+*/
+func rawMode() (func(), error) {
+	state, err := stty("-g")
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = stty("-icanon", "-echo", "min", "1")
+	if err != nil {
+		return nil, err
+	}
+
+	return func() {
+		stty(strings.TrimSpace(state))
+	}, nil
+}
+
+/*
+Run stty on the terminal given as standard input
+*/
+func stty(args ...string) (string, error) {
+	cmd := exec.Command("stty", args...)
+	cmd.Stdin = os.Stdin
+	output, err := cmd.Output()
+	return string(output), err
+}
+
+/*
+Check whether the file is a terminal
+*/
+func isTerminal(file *os.File) bool {
+	info, err := file.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+)
+
+/*
+Test that whole escape sequences are skipped, leaving the input following them
+*/
+func TestSkipEscapeSequence(t *testing.T) {
+	tests := map[string]string{
+		"[Arest":    "rest",
+		"[1;5Crest": "rest",
+		"[3~rest":   "rest",
+		"[200~rest": "rest",
+		"OHrest":    "rest",
+		"brest":     "rest",
+	}
+	for input, expected := range tests {
+		reader := bufio.NewReader(strings.NewReader(input))
+		if err := skipEscapeSequence(reader); err != nil {
+			t.Fatal(err)
+		}
+		rest, _ := reader.ReadString('\n')
+		if rest != expected {
+			t.Errorf("ESC %q: got %q left, expected %q", input, rest, expected)
+		}
+	}
+}
+
+/*
+Test that deleting removes whole characters, not single bytes of them
+*/
+func TestDeleteLastRune(t *testing.T) {
+	tests := map[string]string{
+		"abc":    "ab",
+		"blåbær": "blåbæ",
+		"café":   "caf",
+		"日本":     "日",
+		"":       "",
+	}
+	for line, expected := range tests {
+		if got := string(deleteLastRune([]byte(line))); got != expected {
+			t.Errorf("%q: got %q, expected %q", line, got, expected)
+		}
+	}
+}
+
+/*
+Test completing up to the prefix common to the candidates, which may end in
+the middle of a multi-byte character
+*/
+func TestCompleteLine(t *testing.T) {
+	complete := func(words []string) []string {
+		return []string{"deploy-café", "deploy-cafè"}
+	}
+	completion, candidates := completeLine("run dep", complete)
+	if completion != "loy-caf" || len(candidates) != 2 {
+		t.Errorf("got completion %q of %v, expected \"loy-caf\"", completion, candidates)
+	}
+}
@@ -0,0 +1,167 @@
+/*
+Helpers for building the ssh, scp, and sshfs commands used for accessing
+machines
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+/*
+Get the options for connecting to the machine using ssh or scp. The flag for
+the port is "-p" for ssh and "-P" for scp
+*/
+func sshOptions(path string, machine Machine, portFlag string) string {
+	options := hostKeyOptions(path, machine) + connectionOptions(path, machine)
+	if machine.PasswordEnv == "" && !promptsForPin(machine) {
+		// Never prompt, as the key is all there is to authenticate with
+		options += " -o 'BatchMode yes'"
+	}
+
+	if machine.Host != "" {
+		// Leave the connection details to the ssh config
+		if machine.SSHConfig != "" {
+			options += " -F " + sshConfigFile(path, machine)
+		}
+		return options
+	}
+
+	if machine.KeyProvider != "" {
+		return strings.TrimRight(fmt.Sprintf("%s %s %s %s", options, portFlag, machine.Port, keyProviderOptions(machine)), " ")
+	}
+	if machine.PasswordEnv != "" && machine.PrivateKey == "" {
+		return fmt.Sprintf("%s %s %s -o 'PubkeyAuthentication no'", options, portFlag, machine.Port)
+	}
+	return fmt.Sprintf("%s %s %s -i %s", options, portFlag, machine.Port, keyFile(machine))
+}
+
+/*
+Get the options for mounting a directory of the machine using sshfs
+*/
+func sshfsOptions(path string, machine Machine) string {
+	options := sshfsOptionsWithoutHostKey(path, machine)
+	if !hostKeyPinned(path, machine.Id) {
+		return options
+	}
+	return strings.TrimSpace(fmt.Sprintf(
+		"%s -o StrictHostKeyChecking=yes -o UserKnownHostsFile=%s -o HostKeyAlias=%s",
+		options,
+		knownHostsFile(path),
+		machine.Id,
+	))
+}
+
+/*
+Get the options for mounting a directory of the machine using sshfs, except
+those checking the host key
+*/
+func sshfsOptionsWithoutHostKey(path string, machine Machine) string {
+	if machine.Host != "" {
+		if machine.SSHConfig != "" {
+			return "-F " + sshConfigFile(path, machine)
+		}
+		return ""
+	}
+
+	if machine.KeyProvider != "" {
+		return strings.TrimSpace("-p " + machine.Port + " " + keyProviderOptions(machine))
+	}
+	if machine.PasswordEnv != "" && machine.PrivateKey == "" {
+		return "-p " + machine.Port
+	}
+	return fmt.Sprintf("-p %s -o IdentityFile=%s", machine.Port, keyFile(machine))
+}
+
+/*
+Build the command running the ssh, scp, or sshfs command line for accessing the
+machine, failing if the key provider of the machine is not available. For
+machines using password authentication, the command line is run
+through sshpass, which is handed the password through the environment so it
+never appears on a command line
+*/
+func machineCommand(machine Machine, commandLine string) (*exec.Cmd, error) {
+	if err := checkKeyProvider(machine); err != nil {
+		return nil, err
+	}
+	if machine.PasswordEnv == "" {
+		return exec.Command("/bin/bash", "-c", commandLine), nil
+	}
+
+	password := os.Getenv(machine.PasswordEnv)
+	if password == "" {
+		return nil, errors.New("The environment variable " + machine.PasswordEnv + " holding the password of machine '" + machine.Id + "' is empty")
+	}
+
+	cmd := exec.Command("/bin/bash", "-c", "sshpass -e "+commandLine)
+	cmd.Env = append(os.Environ(), "SSHPASS="+password)
+	return cmd, nil
+}
+
+/*
+Get the destination to connect to for accessing the machine, i.e. either the
+host alias from the ssh config or the user and address of the machine
+*/
+func sshDestination(machine Machine) string {
+	if machine.Host != "" {
+		return machine.Host
+	}
+	return machine.User + "@" + strings.Trim(machine.Address, "[]")
+}
+
+/*
+Get the destination of the machine for the "destination:path" arguments of scp
+and sshfs. IPv6 addresses are bracketed, keeping their colons apart from the one
+preceding the path
+*/
+func remoteDestination(machine Machine) string {
+	if machine.Host == "" && strings.Contains(machine.Address, ":") {
+		return machine.User + "@[" + strings.Trim(machine.Address, "[]") + "]"
+	}
+	return sshDestination(machine)
+}
+
+/*
+Wrap a command run on the machine with the pre and post commands of the
+machine, if any. The command only runs if the pre command succeeds, and the post
+command only runs if the command succeeds
+*/
+func withMachineHooks(machine Machine, command string) string {
+	if machine.PreCommand != "" {
+		command = fmt.Sprintf(
+			"{ %s ; } </dev/null || { echo \"PreCommand of machine %s failed\" >&2 ; exit 1 ; } && %s",
+			machine.PreCommand,
+			machine.Id,
+			command,
+		)
+	}
+	if machine.PostCommand != "" {
+		command = fmt.Sprintf("%s && { %s ; } </dev/null", command, machine.PostCommand)
+	}
+	return command
+}
+
+/*
+Get the path of the private key file used for accessing the machine, as set
+when loading the setup
+*/
+func keyFile(machine Machine) string {
+	return machine.KeyFile
+}
+
+/*
+Get the path of the ssh config file of the machine. Relative paths are relative
+to the orchid directory
+*/
+func sshConfigFile(path string, machine Machine) string {
+	if filepath.IsAbs(machine.SSHConfig) {
+		return machine.SSHConfig
+	}
+	return path + "/" + machine.SSHConfig
+}
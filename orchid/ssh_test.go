@@ -0,0 +1,107 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+/*
+Test the destinations of machines given by addresses, including bracketed and
+unbracketed IPv6 addresses, and by Host aliases of the ssh config
+*/
+func TestDestinations(t *testing.T) {
+	tests := []struct {
+		machine Machine
+		ssh     string
+		remote  string
+	}{
+		{Machine{User: "deploy", Address: "192.0.2.10"}, "deploy@192.0.2.10", "deploy@192.0.2.10"},
+		{Machine{User: "deploy", Address: "web.example.com"}, "deploy@web.example.com", "deploy@web.example.com"},
+		{Machine{User: "deploy", Address: "2001:db8::10"}, "deploy@2001:db8::10", "deploy@[2001:db8::10]"},
+		{Machine{User: "deploy", Address: "[2001:db8::10]"}, "deploy@2001:db8::10", "deploy@[2001:db8::10]"},
+		{Machine{User: "deploy", Address: "::1"}, "deploy@::1", "deploy@[::1]"},
+		{Machine{Host: "bastion", Address: "2001:db8::10"}, "bastion", "bastion"},
+	}
+
+	for _, test := range tests {
+		if destination := sshDestination(test.machine); destination != test.ssh {
+			t.Errorf("%s: got ssh destination %s, expected %s", test.machine.Address, destination, test.ssh)
+		}
+		if destination := remoteDestination(test.machine); destination != test.remote {
+			t.Errorf("%s: got remote destination %s, expected %s", test.machine.Address, destination, test.remote)
+		}
+	}
+}
+
+/*
+Test that machines with pre or post commands containing single quotes are
+rejected, as they would end the quoting of the remote commands
+*/
+func TestMachineHooksQuotes(t *testing.T) {
+	machine := Machine{Id: "web1", Address: "192.0.2.10", Port: "22", User: "deploy", PasswordEnv: "WEB1_PASSWORD"}
+	machine.PreCommand = `. "$HOME/.profile"`
+	if err := validateMachines([]Machine{machine}, nil, "", ""); err != nil {
+		t.Errorf("got %v for a PreCommand with double quotes", err)
+	}
+
+	for _, hooks := range [][2]string{{"echo 'starting'", ""}, {"", "echo 'done'"}} {
+		machine.PreCommand, machine.PostCommand = hooks[0], hooks[1]
+		if err := validateMachines([]Machine{machine}, nil, "", ""); err == nil {
+			t.Errorf("%q: expected the single quote to be rejected", hooks)
+		}
+	}
+}
+
+/*
+Test the arguments ssh, scp, and sshfs are run with for a machine with an IPv6
+address, using stand-ins recording them
+*/
+func TestIPv6Commands(t *testing.T) {
+	bin := t.TempDir()
+	script := "#!/bin/sh\nprintf '%s\\n' \"$@\" > \"$0.args\"\n"
+	for _, name := range []string{"ssh", "scp", "sshfs"} {
+		if err := ioutil.WriteFile(bin+"/"+name, []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("PATH", bin+":"+os.Getenv("PATH"))
+
+	path := t.TempDir()
+	machine := Machine{Id: "web6", Address: "2001:db8::10", Port: "22", User: "deploy", PrivateKey: "web6", KeyFile: path + "/keys/web6"}
+	a := &Actions{path: path, setup: &Setup{Machines: []Machine{machine}}}
+	tests := []struct {
+		name     string
+		run      func() error
+		expected []string
+	}{
+		{"ssh", func() error { return a.SSH("web6") }, []string{
+			"-tt", "-o", "StrictHostKeyChecking no", "-o", "BatchMode yes", "-p", "22", "-i", path + "/keys/web6", "deploy@2001:db8::10",
+		}},
+		{"scp", func() error { return a.SCP("/tmp/app.tar", "web6:/srv/app.tar", false, false) }, []string{
+			"-o", "StrictHostKeyChecking no", "-o", "BatchMode yes", "-P", "22", "-i", path + "/keys/web6", "-r", "/tmp/app.tar", "deploy@[2001:db8::10]:/srv/app.tar",
+		}},
+		{"scp", func() error { return a.SCP("web6:/srv/app.log", "/tmp", false, false) }, []string{
+			"-o", "StrictHostKeyChecking no", "-o", "BatchMode yes", "-P", "22", "-i", path + "/keys/web6", "-r", "deploy@[2001:db8::10]:/srv/app.log", "/tmp",
+		}},
+		{"sshfs", func() error { return a.Mount("web6", "/srv", "/mnt/web6", nil) }, []string{
+			"deploy@[2001:db8::10]:/srv", "/mnt/web6", "-p", "22", "-o", "IdentityFile=" + path + "/keys/web6", "-o", "sshfs_sync",
+		}},
+	}
+
+	for _, test := range tests {
+		os.Remove(bin + "/" + test.name + ".args")
+		if err := test.run(); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		data, err := ioutil.ReadFile(bin + "/" + test.name + ".args")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if args := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n"); !reflect.DeepEqual(args, test.expected) {
+			t.Errorf("%s: got arguments %q, expected %q", test.name, args, test.expected)
+		}
+	}
+}
@@ -0,0 +1,232 @@
+/*
+Importing machines from an ssh config, e.g. ~/.ssh/config, bootstrapping the
+machines of a setup from the hosts already defined there
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+)
+
+/*
+Type defining a Host block of an ssh config, with the options of the block
+orchid uses, keyed by their lowercase keywords
+*/
+type sshConfigBlock struct {
+	Patterns []string
+	Options  map[string]string
+}
+
+/*
+Type defining a host of an ssh config, resolved from every block matching it
+*/
+type sshConfigHost struct {
+	Alias        string
+	HostName     string
+	User         string
+	Port         string
+	IdentityFile string
+}
+
+/*
+Parse the Host blocks of the ssh config. Only the first value of each option
+is kept, as ssh uses the first value given. Match blocks are skipped
+*/
+func parseSSHConfig(in io.Reader) ([]sshConfigBlock, error) {
+	blocks := []sshConfigBlock{}
+	var block *sshConfigBlock
+
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		// Keywords are separated from their values by whitespace or an
+		// equals sign
+		line = strings.Replace(line, "=", " ", 1)
+		keyword, value := line, ""
+		if i := strings.IndexAny(line, " \t"); i >= 0 {
+			keyword, value = line[:i], strings.Trim(strings.TrimSpace(line[i+1:]), "\"")
+		}
+		keyword = strings.ToLower(keyword)
+
+		switch keyword {
+		case "host":
+			blocks = append(blocks, sshConfigBlock{Patterns: strings.Fields(value), Options: map[string]string{}})
+			block = &blocks[len(blocks)-1]
+		case "match":
+			block = nil
+		case "hostname", "user", "port", "identityfile":
+			if block != nil && block.Options[keyword] == "" {
+				block.Options[keyword] = value
+			}
+		}
+	}
+	return blocks, scanner.Err()
+}
+
+/*
+Check whether the pattern of a Host block is a wildcard or negated pattern,
+rather than the alias of a single host
+*/
+func wildcardHost(pattern string) bool {
+	return strings.ContainsAny(pattern, "*?!")
+}
+
+/*
+Check whether the Host block applies to the alias. The block applies if any of
+its patterns matches, unless a negated pattern matches
+*/
+func (b sshConfigBlock) matches(alias string) bool {
+	matched := false
+	for _, pattern := range b.Patterns {
+		negated := strings.HasPrefix(pattern, "!")
+		ok, _ := filepath.Match(strings.TrimPrefix(pattern, "!"), alias)
+		if ok && negated {
+			return false
+		}
+		matched = matched || ok
+	}
+	return matched
+}
+
+/*
+Resolve the hosts of the ssh config, i.e. every alias of a Host block which is
+not a wildcard, with the options of all blocks matching it, e.g. defaults given
+by "Host *". Options missing from the config get the defaults of ssh
+*/
+func resolveSSHConfigHosts(blocks []sshConfigBlock) []sshConfigHost {
+	defaultUser := ""
+	if u, err := user.Current(); err == nil {
+		defaultUser = u.Username
+	}
+
+	hosts := []sshConfigHost{}
+	seen := map[string]bool{}
+	for _, block := range blocks {
+		for _, alias := range block.Patterns {
+			if wildcardHost(alias) || seen[alias] {
+				continue
+			}
+			seen[alias] = true
+
+			options := map[string]string{}
+			for _, other := range blocks {
+				if !other.matches(alias) {
+					continue
+				}
+				for keyword, value := range other.Options {
+					if options[keyword] == "" {
+						options[keyword] = value
+					}
+				}
+			}
+
+			host := sshConfigHost{
+				Alias:        alias,
+				HostName:     options["hostname"],
+				User:         options["user"],
+				Port:         options["port"],
+				IdentityFile: options["identityfile"],
+			}
+			if host.HostName == "" {
+				host.HostName = alias
+			}
+			if host.User == "" {
+				host.User = defaultUser
+			}
+			if host.Port == "" {
+				host.Port = "22"
+			}
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts
+}
+
+/*
+Expand a leading ~ of the path of the ssh config to the home directory
+*/
+func expandHome(path string) string {
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return path
+	}
+	return home + strings.TrimPrefix(path, "~")
+}
+
+/*
+Copy the identity file of the host into the key directory under its file name,
+returning the name of the key. A key with the same name and content is reused
+*/
+func importIdentityFile(path, identityFile string) (string, error) {
+	data, err := ioutil.ReadFile(expandHome(identityFile))
+	if err != nil {
+		return "", errors.New("Could not read the IdentityFile: " + err.Error())
+	}
+
+	keyDirectory, err := keyDir(path)
+	if err != nil {
+		return "", err
+	}
+	name := filepath.Base(identityFile)
+	current, err := ioutil.ReadFile(keyDirectory + "/" + name)
+	if err == nil {
+		if !bytes.Equal(current, data) {
+			return "", errors.New("A different key named '" + name + "' already exists")
+		}
+		return name, nil
+	}
+
+	err = os.MkdirAll(keyDirectory, 0700)
+	if err != nil {
+		return "", err
+	}
+	return name, ioutil.WriteFile(keyDirectory+"/"+name, data, 0600)
+}
+
+/*
+Build the machine element of the host. Hosts without an IdentityFile that
+orchid can copy, e.g. hosts relying on ssh-agent, are left to the ssh config
+using Host, referring to the config unless it is the default one of ssh
+*/
+func sshConfigMachine(path, configPath string, host sshConfigHost) (setupElement, error) {
+	field := func(key, value string) setupField {
+		encoded, _ := encodeSetup(value, "")
+		return setupField{Key: key, Value: encoded}
+	}
+
+	if host.IdentityFile == "" || strings.Contains(host.IdentityFile, "%") {
+		machine := setupElement{field("Id", host.Alias), field("Host", host.Alias)}
+		if configPath != expandHome("~/.ssh/config") {
+			machine = append(machine, field("SSHConfig", configPath))
+		}
+		return machine, nil
+	}
+
+	key, err := importIdentityFile(path, host.IdentityFile)
+	if err != nil {
+		return nil, err
+	}
+	return setupElement{
+		field("Id", host.Alias),
+		field("Address", host.HostName),
+		field("Port", host.Port),
+		field("User", host.User),
+		field("PrivateKey", key),
+	}, nil
+}
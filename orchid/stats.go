@@ -0,0 +1,108 @@
+/*
+Summarizing the runs of jobs from their logs
+*/
+
+package main
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+Type defining the summary of the runs of a job
+*/
+type JobStats struct {
+	JobId           string
+	Runs            int
+	Succeeded       int
+	Running         int
+	AverageDuration time.Duration
+	LastRun         time.Time
+}
+
+/*
+Get the share of the finished runs that succeeded, in percent
+*/
+func (s JobStats) successRate() float64 {
+	finished := s.Runs - s.Running
+	if finished == 0 {
+		return 0
+	}
+	return 100 * float64(s.Succeeded) / float64(finished)
+}
+
+/*
+Summarize the runs of each job started since the given time, sorted by job id
+*/
+func computeStats(logs []Log, since time.Time) []JobStats {
+	stats := map[string]*JobStats{}
+	durations := map[string]time.Duration{}
+
+	for _, log := range logs {
+		if log.StartTime.Before(since) || log.ActionId != "" {
+			continue
+		}
+
+		jobStats, found := stats[log.JobId]
+		if !found {
+			jobStats = &JobStats{JobId: log.JobId}
+			stats[log.JobId] = jobStats
+		}
+
+		jobStats.Runs++
+		if log.StartTime.After(jobStats.LastRun) {
+			jobStats.LastRun = log.StartTime
+		}
+		if log.running() {
+			jobStats.Running++
+			continue
+		}
+		if log.Status == "Finished" {
+			jobStats.Succeeded++
+		}
+		durations[log.JobId] += log.EndTime.Sub(log.StartTime)
+	}
+
+	summary := []JobStats{}
+	for jobId, jobStats := range stats {
+		if finished := jobStats.Runs - jobStats.Running; finished > 0 {
+			jobStats.AverageDuration = durations[jobId] / time.Duration(finished)
+		}
+		summary = append(summary, *jobStats)
+	}
+	sort.Slice(summary, func(i, j int) bool {
+		return summary[i].JobId < summary[j].JobId
+	})
+	return summary
+}
+
+/*
+Parse the start of a window of time, given either as a duration back from now,
+e.g. "12h" or "7d", or as a date, e.g. "2024-01-31"
+*/
+func parseSince(since string) (time.Time, error) {
+	if since == "" {
+		return time.Time{}, nil
+	}
+
+	if date, err := time.ParseInLocation("2006-01-02", since, time.Local); err == nil {
+		return date, nil
+	}
+
+	if strings.HasSuffix(since, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(since, "d"))
+		if err == nil && days >= 0 {
+			return time.Now().AddDate(0, 0, -days), nil
+		}
+	}
+
+	duration, err := time.ParseDuration(since)
+	if err != nil || duration < 0 {
+		return time.Time{}, errors.New("Invalid since '" + since + "'. Must be a duration, e.g. 12h or 7d, or a date, e.g. 2024-01-31")
+	}
+	return time.Now().Add(-duration), nil
+}
@@ -0,0 +1,102 @@
+/*
+Capping how long a single invocation of orchid runs, e.g. for invocations from
+cron, so a hung command can not pile up invocations
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+/*
+Exit code of invocations running out of time, the same as timeout(1)
+*/
+const timeoutExitCode = 124
+
+/*
+How long a job gets to record its cancellation once the invocation runs out of
+time, before its processes are killed
+*/
+const timeoutGracePeriod = 5 * time.Second
+
+/*
+Get the ids of the descendants of the process, i.e. its children and their
+children, found by their parent ids in /proc
+*/
+func descendants(pid int) []int {
+	entries, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return []int{}
+	}
+
+	children := map[int][]int{}
+	for _, entry := range entries {
+		child, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		stat, err := ioutil.ReadFile("/proc/" + entry.Name() + "/stat")
+		if err != nil {
+			continue
+		}
+
+		// The name of the process is in parentheses and may contain
+		// spaces, so the fields are read after the last parenthesis:
+		// the state followed by the parent id
+		fields := strings.Fields(string(stat[strings.LastIndex(string(stat), ")")+1:]))
+		if len(fields) < 2 {
+			continue
+		}
+		parent, err := strconv.Atoi(fields[1])
+		if err != nil {
+			continue
+		}
+		children[parent] = append(children[parent], child)
+	}
+
+	found := []int{}
+	queue := children[pid]
+	for len(queue) > 0 {
+		found = append(found, queue[0])
+		queue = append(queue[1:], children[queue[0]]...)
+	}
+	return found
+}
+
+/*
+Kill every process started by orchid, e.g. ssh, scp, and sshfs
+*/
+func killDescendants() {
+	for _, pid := range descendants(os.Getpid()) {
+		syscall.Kill(pid, syscall.SIGKILL)
+	}
+}
+
+/*
+Give the invocation a deadline, returning the context running out at the
+deadline. Jobs are cancelled through the context, and once the deadline has
+passed, the processes started by orchid are killed and orchid exits non-zero
+*/
+func withTimeout(timeout time.Duration) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	go func() {
+		<-ctx.Done()
+		cancel()
+		fmt.Println("ERROR: Timed out after " + timeout.String())
+
+		// Running jobs are cancelled by the context, so give them a
+		// moment to record it before killing whatever is left
+		time.Sleep(timeoutGracePeriod)
+		killDescendants()
+		os.Exit(timeoutExitCode)
+	}()
+	return ctx
+}
@@ -0,0 +1,145 @@
+/*
+Showing when the steps of a run ran, either as a timeline printed in the
+terminal or as a trace loaded in a trace viewer, e.g. chrome://tracing
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+/*
+Width of the bars of the timeline, in characters
+*/
+const timelineWidth = 60
+
+/*
+Type defining an event of a trace in the Chrome trace event format, with
+timestamps and durations in microseconds
+*/
+type traceEvent struct {
+	Name      string            `json:"name"`
+	Category  string            `json:"cat"`
+	Phase     string            `json:"ph"`
+	Timestamp int64             `json:"ts"`
+	Duration  int64             `json:"dur"`
+	Process   int               `json:"pid"`
+	Thread    int               `json:"tid"`
+	Args      map[string]string `json:"args"`
+}
+
+/*
+Get the end of the step, or now if it is still running
+*/
+func stepEnd(step StepResult) time.Time {
+	if step.EndTime.IsZero() {
+		return time.Now()
+	}
+	return step.EndTime
+}
+
+/*
+Get the steps of the log that ran, i.e. were not pending or skipped
+*/
+func tracedSteps(log Log) []StepResult {
+	steps := []StepResult{}
+	for _, step := range log.Steps {
+		if !step.StartTime.IsZero() {
+			steps = append(steps, step)
+		}
+	}
+	return steps
+}
+
+/*
+Format the timeline of the log, a bar per step positioned by its start and end
+relative to the run of the job
+*/
+func formatTimeline(log Log) string {
+	steps := tracedSteps(log)
+	if len(steps) == 0 {
+		return "No steps have run\n"
+	}
+
+	start := log.StartTime
+	end := log.EndTime
+	if end.IsZero() {
+		end = time.Now()
+	}
+	nameWidth := 0
+	for _, step := range steps {
+		if step.StartTime.Before(start) {
+			start = step.StartTime
+		}
+		if stepEnd(step).After(end) {
+			end = stepEnd(step)
+		}
+		if len(step.Name) > nameWidth {
+			nameWidth = len(step.Name)
+		}
+	}
+	total := end.Sub(start)
+	if total <= 0 {
+		total = time.Millisecond
+	}
+
+	// Position each bar by the offset of the step into the run, showing
+	// at least one character for steps too short to show otherwise
+	position := func(t time.Time) int {
+		return int(int64(t.Sub(start)) * timelineWidth / int64(total))
+	}
+	timeline := strings.Builder{}
+	for _, step := range steps {
+		from, to := position(step.StartTime), position(stepEnd(step))
+		if to <= from {
+			to = from + 1
+		}
+		if to > timelineWidth {
+			from, to = timelineWidth-(to-from), timelineWidth
+		}
+		bar := strings.Repeat(" ", from) + strings.Repeat("#", to-from) + strings.Repeat(" ", timelineWidth-to)
+		fmt.Fprintf(&timeline, "%-*s |%s| %s %s\n", nameWidth, step.Name, bar,
+			stepEnd(step).Sub(step.StartTime).Round(time.Millisecond), step.Status)
+	}
+	fmt.Fprintf(&timeline, "%-*s  %s\n", nameWidth, "", "0"+strings.Repeat(" ", timelineWidth-1)+total.Round(time.Millisecond).String())
+	return timeline.String()
+}
+
+/*
+Build the trace of the log in the Chrome trace event format. Each machine is a
+thread of the trace, so steps overlapping on different machines are shown side
+by side
+*/
+func chromeTrace(log Log) ([]byte, error) {
+	threads := map[string]int{}
+	events := []traceEvent{}
+	for _, step := range tracedSteps(log) {
+		thread, found := threads[step.Machine]
+		if !found {
+			thread = len(threads) + 1
+			threads[step.Machine] = thread
+		}
+		events = append(events, traceEvent{
+			Name:      step.Name,
+			Category:  log.JobId,
+			Phase:     "X",
+			Timestamp: step.StartTime.UnixNano() / int64(time.Microsecond),
+			Duration:  int64(stepEnd(step).Sub(step.StartTime) / time.Microsecond),
+			Process:   1,
+			Thread:    thread,
+			Args: map[string]string{
+				"machine":  step.Machine,
+				"status":   step.Status,
+				"attempts": fmt.Sprint(step.Attempts),
+			},
+		})
+	}
+
+	return json.MarshalIndent(struct {
+		TraceEvents []traceEvent `json:"traceEvents"`
+	}{events}, "", "  ")
+}
@@ -0,0 +1,223 @@
+/*
+Limiting of concurrent file transfers, preventing transfers from saturating the
+machines involved or being refused by them
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+/*
+How often the slots of transfers held by other transfers are tried again while
+waiting for one
+*/
+const transferLockInterval = 200 * time.Millisecond
+
+/*
+Type limiting the number of concurrent transfers, both in total and to each
+machine, as well as how often connections to the same machine are made. The
+limits hold across processes, e.g. for jobs running at the same time, as each
+transfer locks a slot file in the locks directory
+*/
+type transferLimiter struct {
+	path       string
+	global     int
+	perMachine int
+	interval   time.Duration
+}
+
+/*
+Create a new transfer limiter of the orchid directory using the limits of the
+settings
+*/
+func newTransferLimiter(path string, settings Settings) *transferLimiter {
+	global := settings.MaxTransfers
+	if global <= 0 {
+		global = 10
+	}
+	perMachine := settings.MaxTransfersPerMachine
+	if perMachine <= 0 {
+		perMachine = 2
+	}
+	interval, _ := parseDuration(settings.TransferInterval)
+
+	return &transferLimiter{
+		path:       path,
+		global:     global,
+		perMachine: perMachine,
+		interval:   interval,
+	}
+}
+
+/*
+Get the directory holding the slot files of transfers
+*/
+func transferLockDir(path string) string {
+	return path + "/locks/transfers"
+}
+
+/*
+Try to lock one of the given number of slot files with the given prefix without
+waiting. Returns nil if all of them are locked. The locks are released by the
+OS if orchid dies holding them
+*/
+func tryLockSlot(prefix string, slots int) (*os.File, error) {
+	for slot := 0; slot < slots; slot++ {
+		file, err := os.OpenFile(prefix+"."+strconv.Itoa(slot)+".lock", os.O_CREATE|os.O_RDWR, 0644)
+		if err != nil {
+			return nil, err
+		}
+		err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			return file, nil
+		}
+		file.Close()
+		if err != syscall.EWOULDBLOCK {
+			return nil, err
+		}
+	}
+	return nil, nil
+}
+
+/*
+Wait until a transfer involving the machine is allowed. Returns a function to
+call once the transfer is done
+*/
+func (l *transferLimiter) acquire(machineId string) (func(), error) {
+	dir := transferLockDir(l.path)
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	var machine, global *os.File
+	for {
+		machine, err = tryLockSlot(dir+"/"+machineId, l.perMachine)
+		if err != nil {
+			return nil, err
+		}
+		if machine != nil {
+			global, err = tryLockSlot(dir+"/global", l.global)
+			if err != nil {
+				machine.Close()
+				return nil, err
+			}
+			if global != nil {
+				break
+			}
+			// Let other transfers to the machine go ahead meanwhile
+			machine.Close()
+		}
+		time.Sleep(transferLockInterval)
+	}
+
+	if l.interval > 0 {
+		err = l.spaceConnect(machineId)
+		if err != nil {
+			global.Close()
+			machine.Close()
+			return nil, err
+		}
+	}
+
+	return func() {
+		global.Close()
+		machine.Close()
+	}, nil
+}
+
+/*
+Wait until the interval since the last connection to the machine has passed,
+reserving the next slot. The time of the last connection is kept in a file, so
+the interval is kept across processes
+*/
+func (l *transferLimiter) spaceConnect(machineId string) error {
+	file, err := os.OpenFile(transferLockDir(l.path)+"/"+machineId+".connect", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX)
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	connect := time.Now()
+	data, _ := ioutil.ReadAll(file)
+	if last, err := time.Parse(time.RFC3339Nano, strings.TrimSpace(string(data))); err == nil {
+		if next := last.Add(l.interval); next.After(connect) {
+			connect = next
+		}
+	}
+	err = file.Truncate(0)
+	if err == nil {
+		_, err = file.WriteAt([]byte(connect.Format(time.RFC3339Nano)), 0)
+	}
+	// Closing the file releases the lock
+	file.Close()
+	if err != nil {
+		return err
+	}
+
+	time.Sleep(time.Until(connect))
+	return nil
+}
+
+/*
+Get the transfer limiter, creating it on first use
+*/
+func (a *Actions) transferLimiter() (*transferLimiter, error) {
+	a.transferMutex.Lock()
+	defer a.transferMutex.Unlock()
+
+	if a.transfers == nil {
+		settings, err := loadSettings(a.path)
+		if err != nil {
+			return nil, err
+		}
+		a.transfers = newTransferLimiter(a.path, settings)
+	}
+	return a.transfers, nil
+}
+
+/*
+Copy files/directories between this machine and the given machine using scp,
+within the limits of concurrent transfers. The from and to arguments are passed
+to scp as is
+*/
+func (a *Actions) scp(machine Machine, from, to string, stdout, stderr io.Writer) error {
+	limiter, err := a.transferLimiter()
+	if err != nil {
+		return err
+	}
+	release, err := limiter.acquire(machine.Id)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	scpCommand := fmt.Sprintf(
+		"scp %s -r %s %s",
+		sshOptions(a.path, machine, "-P"),
+		from,
+		to,
+	)
+	cmd, err := machineCommand(machine, scpCommand)
+	if err != nil {
+		return err
+	}
+
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	return cmd.Run()
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+/*
+Test that limiters of the same orchid directory, e.g. of different processes,
+share the limit of transfers to a machine
+*/
+func TestTransferLimit(t *testing.T) {
+	path := t.TempDir()
+	settings := Settings{MaxTransfersPerMachine: 1}
+	first := newTransferLimiter(path, settings)
+	second := newTransferLimiter(path, settings)
+
+	release, err := first.acquire("web1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	acquired := make(chan func())
+	go func() {
+		release, err := second.acquire("web1")
+		if err != nil {
+			t.Error(err)
+		}
+		acquired <- release
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("a second transfer to the machine was allowed while the first one ran")
+	case <-time.After(3 * transferLockInterval):
+	}
+
+	// Transfers to other machines are not held up
+	other, err := second.acquire("web2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other()
+
+	release()
+	select {
+	case release := <-acquired:
+		release()
+	case <-time.After(time.Second):
+		t.Fatal("the second transfer to the machine was not allowed once the first one was done")
+	}
+}
+
+/*
+Test that connections to a machine are spaced out by the TransferInterval,
+also by different limiters
+*/
+func TestTransferInterval(t *testing.T) {
+	path := t.TempDir()
+	settings := Settings{TransferInterval: "300ms"}
+
+	start := time.Now()
+	for i := 0; i < 2; i++ {
+		release, err := newTransferLimiter(path, settings).acquire("web1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		release()
+	}
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond {
+		t.Errorf("two connections were made within %s, expected at least 300ms apart", elapsed)
+	}
+}
@@ -0,0 +1,38 @@
+/*
+Running unattended, e.g. in CI, where features interacting with the user fail
+fast rather than wait for input that never comes
+*/
+
+package main
+
+import (
+	"errors"
+)
+
+/*
+Check that orchid may interact with the user, returning an error naming the
+feature and how to do without it if orchid runs without a terminal, i.e. with
+--no-tty or with stdin not being a terminal
+*/
+func (a *Actions) requireTerminal(feature, hint string) error {
+	if !a.noTTY {
+		return nil
+	}
+	message := feature + " requires a terminal, but orchid runs without one"
+	if hint != "" {
+		message += ". " + hint
+	}
+	return errors.New(message)
+}
+
+/*
+Ask the user to confirm running the action or job marked Confirm by typing its
+id. Without a terminal, the confirmation fails as nothing could be typed
+*/
+func (a *Actions) confirmId(kind, id string) error {
+	err := a.requireTerminal("Confirming the "+kind+" "+id, "Pass --yes to run it without confirming")
+	if err != nil {
+		return err
+	}
+	return confirmId(kind, id)
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+/*
+Test that interactive features fail right away with an error saying why
+without a terminal, rather than waiting for input
+*/
+func TestNoTTY(t *testing.T) {
+	a := &Actions{path: t.TempDir(), setup: &Setup{}, noTTY: true}
+
+	if err := a.SSH("web1"); err == nil || !strings.Contains(err.Error(), "requires a terminal") {
+		t.Errorf("got %v from ssh, expected an error requiring a terminal", err)
+	}
+	if err := a.confirmId("job", "deploy"); err == nil || !strings.Contains(err.Error(), "--yes") {
+		t.Errorf("got %v from confirming, expected an error suggesting --yes", err)
+	}
+
+	a.noTTY = false
+	if err := a.requireTerminal("An interactive ssh session", ""); err != nil {
+		t.Errorf("got %v with a terminal", err)
+	}
+}
+
+/*
+Test that ssh is never left waiting for the PIN of a token given --no-tty, even
+from a terminal
+*/
+func TestNoTTYKeyProvider(t *testing.T) {
+	machine := Machine{Id: "hsm1", Address: "192.0.2.10", Port: "22", KeyProvider: "pkcs11:/usr/lib/opensc-pkcs11.so"}
+	a := &Actions{path: t.TempDir(), setup: &Setup{Machines: []Machine{machine}}, noTTY: true}
+
+	setup, err := a.loadSetup()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if promptsForPin(setup.Machines[0]) {
+		t.Error("expected ssh not to prompt for the PIN given --no-tty")
+	}
+	if options := sshOptions(a.path, setup.Machines[0], "-p"); !strings.Contains(options, "BatchMode yes") {
+		t.Errorf("got options %s, expected BatchMode given --no-tty", options)
+	}
+	if a.setup.Machines[0].NoTTY {
+		t.Error("the loaded setup was changed")
+	}
+}
@@ -0,0 +1,227 @@
+/*
+Variables given to a run, substituted into the commands, scripts, and arguments
+of its steps, e.g. the version to deploy
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+/*
+References to variables in commands, scripts, and arguments, e.g.
+{{ .vars.version }}
+*/
+var varReference = regexp.MustCompile(`\.vars\.([A-Za-z0-9_]+)`)
+
+/*
+References to the paths of the secret files of a step in its command or script,
+e.g. {{ .secrets.aws }}
+*/
+var secretReference = regexp.MustCompile(`\.secrets\.([A-Za-z0-9_]+)`)
+
+/*
+Valid names of variables
+*/
+var varName = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+
+/*
+Type defining the variables given using repeated --var flags
+*/
+type varFlags []string
+
+/*
+Get the variables given so far, as required by flag.Value
+*/
+func (v *varFlags) String() string {
+	return strings.Join(*v, ",")
+}
+
+/*
+Add a variable given as name=value
+*/
+func (v *varFlags) Set(value string) error {
+	*v = append(*v, value)
+	return nil
+}
+
+/*
+Parse variables given as name=value pairs
+*/
+func parseVars(pairs []string) (map[string]string, error) {
+	vars := map[string]string{}
+	for _, pair := range pairs {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || !varName.MatchString(parts[0]) {
+			return nil, errors.New("Invalid variable '" + pair + "', expected <name>=<value>")
+		}
+		vars[parts[0]] = parts[1]
+	}
+	return vars, nil
+}
+
+/*
+Load the variables of the file. Files ending with .env hold a name=value pair
+per line, while other files hold a YAML or JSON object of names and values
+*/
+func loadVarFile(file string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.New("Could not read the variable file: " + err.Error())
+	}
+
+	if filepath.Ext(file) != ".env" {
+		vars := map[string]string{}
+		err = yaml.Unmarshal(data, &vars)
+		if err != nil {
+			return nil, errors.New("Could not parse the variable file: " + err.Error())
+		}
+		for name := range vars {
+			if !varName.MatchString(name) {
+				return nil, errors.New("Invalid variable name '" + name + "' in the variable file")
+			}
+		}
+		return vars, nil
+	}
+
+	pairs := []string{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) == 2 && len(parts[1]) >= 2 && (parts[1][0] == '"' || parts[1][0] == '\'') && parts[1][len(parts[1])-1] == parts[1][0] {
+			line = parts[0] + "=" + parts[1][1:len(parts[1])-1]
+		}
+		pairs = append(pairs, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return parseVars(pairs)
+}
+
+/*
+Resolve the variables of a run from the variable file, if any, and the
+variables given on the command line, which override those of the file
+*/
+func resolveVars(varFile string, pairs []string) (map[string]string, error) {
+	vars := map[string]string{}
+	if varFile != "" {
+		fileVars, err := loadVarFile(varFile)
+		if err != nil {
+			return nil, err
+		}
+		vars = fileVars
+	}
+
+	given, err := parseVars(pairs)
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range given {
+		vars[name] = value
+	}
+	return vars, nil
+}
+
+/*
+Substitute the variables referenced in the string, a Go template given the
+variables as .vars like the When conditions of steps are given facts. Strings
+not referencing any variable are left as they are, so commands using {{ for
+other purposes, e.g. docker --format, need not escape it. Referencing a
+variable not given is an error, rather than silently leaving it empty
+*/
+func expandVars(s string, vars map[string]string) (string, error) {
+	return expandTemplate(s, vars, nil)
+}
+
+/*
+Substitute the variables and the paths of the secret files referenced in the
+string like expandVars, given the secrets as .secrets. The paths are those
+given by the secrets, e.g. {{ .secrets.aws }} is replaced by
+"$ORCHID_SECRET_AWS", expanded by the shell running the step
+*/
+func expandTemplate(s string, vars, secrets map[string]string) (string, error) {
+	references := varReference.FindAllStringSubmatch(s, -1)
+	secretReferences := secretReference.FindAllStringSubmatch(s, -1)
+	if references == nil && secretReferences == nil {
+		return s, nil
+	}
+	for _, reference := range references {
+		if _, found := vars[reference[1]]; !found {
+			return s, errors.New("The variable '" + reference[1] + "' is not given. Give it using --var " + reference[1] + "=<value>")
+		}
+	}
+	for _, reference := range secretReferences {
+		if _, found := secrets[reference[1]]; !found {
+			return s, errors.New("The secret '" + reference[1] + "' is not in the SecretFiles of the step. Secrets are only referenced in commands and scripts")
+		}
+	}
+
+	tmpl, err := template.New("vars").Option("missingkey=error").Parse(s)
+	if err != nil {
+		return s, errors.New("Invalid reference to a variable: " + err.Error())
+	}
+	output := bytes.Buffer{}
+	err = tmpl.Execute(&output, map[string]interface{}{"vars": vars, "secrets": secrets})
+	if err != nil {
+		return s, errors.New("Could not substitute the variables: " + err.Error())
+	}
+	return output.String(), nil
+}
+
+/*
+Substitute the variables referenced in the command, script, and arguments of
+the step, and the paths of its secret files referenced in its command or
+script. A script file referencing either is read and run as the command of the
+step, with them substituted
+*/
+func expandExecutableVars(path string, executable Executable, vars map[string]string) (Executable, error) {
+	secrets := map[string]string{}
+	for _, secret := range executable.SecretFiles {
+		secrets[secret.Name] = `"$` + secretVariable(secret) + `"`
+	}
+
+	command, err := expandTemplate(executable.Command, vars, secrets)
+	if err != nil {
+		return executable, err
+	}
+	executable.Command = command
+
+	if executable.Command == "" && executable.Script != "" {
+		data, err := ioutil.ReadFile(path + "/scripts/" + executable.Script)
+		if err != nil {
+			return executable, err
+		}
+		if varReference.Match(data) || secretReference.Match(data) {
+			executable.Command, err = expandTemplate(string(data), vars, secrets)
+			if err != nil {
+				return executable, errors.New("Script " + executable.Script + ": " + err.Error())
+			}
+		}
+	}
+
+	args := []string{}
+	for _, arg := range executable.Args {
+		arg, err = expandVars(arg, vars)
+		if err != nil {
+			return executable, err
+		}
+		args = append(args, arg)
+	}
+	executable.Args = args
+	return executable, nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+/*
+Test substituting variables, leaving strings not referencing any as they are
+*/
+func TestExpandVars(t *testing.T) {
+	vars := map[string]string{"version": "1.5.0", "stage": "production"}
+	tests := map[string]string{
+		"deploy --version {{ .vars.version }}":   "deploy --version 1.5.0",
+		"{{.vars.stage}}-{{ .vars.version }}":    "production-1.5.0",
+		"docker ps --format '{{ .Names }}'":      "docker ps --format '{{ .Names }}'",
+		`{{ "{{" }} .Names }} {{ .vars.stage }}`: "{{ .Names }} production",
+	}
+	for s, expected := range tests {
+		expanded, err := expandVars(s, vars)
+		if err != nil {
+			t.Errorf("%s: %v", s, err)
+		} else if expanded != expected {
+			t.Errorf("%s: got %q, expected %q", s, expanded, expected)
+		}
+	}
+
+	if _, err := expandVars("deploy {{ .vars.missing }}", vars); err == nil || !strings.Contains(err.Error(), "--var missing=") {
+		t.Errorf("got %v, expected an error naming the missing variable", err)
+	}
+}
+
+/*
+Test that variables are substituted into the script files of steps referencing
+them, while other scripts are run as files
+*/
+func TestExpandScriptVars(t *testing.T) {
+	path := t.TempDir()
+	if err := os.MkdirAll(path+"/scripts", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path+"/scripts/deploy.sh", []byte("deploy {{ .vars.version }}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path+"/scripts/plain.sh", []byte("uptime\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	vars := map[string]string{"version": "1.5.0"}
+
+	executable, err := expandExecutableVars(path, Executable{Script: "deploy.sh"}, vars)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if executable.Command != "deploy 1.5.0\n" {
+		t.Errorf("got command %q, expected the script with the variable substituted", executable.Command)
+	}
+
+	executable, err = expandExecutableVars(path, Executable{Script: "plain.sh"}, vars)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if executable.Command != "" {
+		t.Errorf("got command %q for a script not referencing variables", executable.Command)
+	}
+
+	if _, err := expandExecutableVars(path, Executable{Script: "deploy.sh"}, nil); err == nil {
+		t.Error("expected an error for a script referencing a variable not given")
+	}
+}
+
+/*
+Test that the paths of the secret files of a step are substituted into its
+command, but not into its arguments
+*/
+func TestExpandSecretPaths(t *testing.T) {
+	executable := Executable{
+		Command:     "deploy --credentials {{ .secrets.aws }} --version {{ .vars.version }}",
+		SecretFiles: []SecretFile{{Name: "aws", File: "secrets/aws"}},
+	}
+	expanded, err := expandExecutableVars(t.TempDir(), executable, map[string]string{"version": "1.5.0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := `deploy --credentials "$ORCHID_SECRET_AWS" --version 1.5.0`; expanded.Command != expected {
+		t.Errorf("got command %q, expected %q", expanded.Command, expected)
+	}
+
+	executable.Command = "deploy --credentials {{ .secrets.gcp }}"
+	if _, err := expandExecutableVars(t.TempDir(), executable, nil); err == nil {
+		t.Error("expected an error for a secret not in the SecretFiles of the step")
+	}
+
+	executable.Command = "deploy"
+	executable.Args = []string{"{{ .secrets.aws }}"}
+	if _, err := expandExecutableVars(t.TempDir(), executable, nil); err == nil {
+		t.Error("expected an error for a secret referenced in the arguments")
+	}
+}
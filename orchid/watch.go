@@ -0,0 +1,237 @@
+/*
+Watching files for changes: the configuration files of the setup, reloading the
+setup when they change, and directories of the user, running a job when they
+change
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gopkg.in/fsnotify.v1"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+/*
+How long to wait after a change before reloading the setup, allowing editors
+writing a file in several steps to finish
+*/
+const reloadDelay = 200 * time.Millisecond
+
+/*
+Watch the configuration files of the setup, reloading the setup when they
+change. If the changed setup is invalid, the error is reported and the previous
+setup is kept. Returns a function stopping the watch
+*/
+func (a *Actions) watchSetup() (func(), error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	err = watcher.Add(a.path)
+	if err != nil {
+		watcher.Close()
+		return nil, err
+	}
+
+	// The scripts and keys directories are optional
+	keyDirectory, err := keyDir(a.path)
+	if err != nil {
+		watcher.Close()
+		return nil, err
+	}
+	watcher.Add(a.path + "/scripts")
+	watcher.Add(keyDirectory)
+
+	go func() {
+		var reload <-chan time.Time
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if isSetupFile(a.path, keyDirectory, event.Name) {
+					reload = time.After(reloadDelay)
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				fmt.Println("\nERROR: Watching the setup failed: " + err.Error())
+			case <-reload:
+				reload = nil
+				err := a.reloadSetup()
+				if err != nil {
+					fmt.Println("\nERROR: Setup changed but is invalid, keeping the previous setup: " + err.Error())
+				} else {
+					fmt.Println("\nSetup changed and was reloaded")
+				}
+			}
+		}
+	}()
+
+	return func() {
+		watcher.Close()
+	}, nil
+}
+
+/*
+Check whether the file is one of the files making up the setup
+*/
+func isSetupFile(path, keyDirectory, name string) bool {
+	dir := filepath.Dir(name)
+	if dir == filepath.Clean(path+"/scripts") || dir == keyDirectory {
+		return true
+	}
+
+	switch filepath.Base(name) {
+	case "machines.json", "jobs.json", "actions.json", "groups.json", "scripts.json", "settings.json":
+		return dir == filepath.Clean(path)
+	}
+	return false
+}
+
+/*
+Watch the directory, including its subdirectories, running the job with the
+given id whenever files in it change. Changes are collected until none happen
+for the debounce interval. A run still going when files change again is
+cancelled before the job runs again. Watches until interrupted. A job marked
+Confirm is confirmed once, before watching starts
+*/
+func (a *Actions) Watch(jobId, dir string, debounce time.Duration) error {
+	setup, err := a.loadSetup()
+	if err != nil {
+		return err
+	}
+	job, found := setup.findJob(jobId)
+	if !found {
+		return ErrJobNotFound
+	}
+	// Confirmed once rather than on every change
+	if job.Confirm {
+		err = a.confirmId("job", jobId)
+		if err != nil {
+			return err
+		}
+	}
+	if debounce <= 0 {
+		return errors.New("The debounce interval must be positive")
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	err = watchTree(watcher, dir)
+	if err != nil {
+		return err
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	defer signal.Stop(signals)
+
+	var cancel context.CancelFunc
+	var done chan bool
+	stop := func() {
+		if cancel != nil {
+			cancel()
+			<-done
+			cancel = nil
+		}
+	}
+	defer stop()
+
+	fmt.Printf("Watching %s, running job %s when files change. Press Ctrl-C to stop\n", dir, jobId)
+
+	var changed <-chan time.Time
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			if ignoredPath(dir, event.Name) {
+				continue
+			}
+			// New directories are watched too
+			if event.Op&fsnotify.Create != 0 {
+				if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+					watchTree(watcher, event.Name)
+				}
+			}
+			changed = time.After(debounce)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			fmt.Println("ERROR: Watching " + dir + " failed: " + err.Error())
+		case <-changed:
+			changed = nil
+			if cancel != nil {
+				fmt.Println("Files changed, cancelling the running job")
+			}
+			stop()
+
+			fmt.Println("Files changed, running job " + jobId)
+			ctx, cancelRun := context.WithCancel(a.context())
+			cancel = cancelRun
+			done = make(chan bool)
+			go func(ctx context.Context, done chan bool) {
+				defer close(done)
+				_, err := a.runJob(ctx, jobId, RunOptions{Quiet: true, Yes: true})
+				if err != nil {
+					fmt.Println("ERROR: " + err.Error())
+				}
+			}(ctx, done)
+		case <-signals:
+			return nil
+		}
+	}
+}
+
+/*
+Watch the directory and all its subdirectories, except hidden ones such as .git
+*/
+func watchTree(watcher *fsnotify.Watcher, dir string) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		if path != dir && strings.HasPrefix(info.Name(), ".") {
+			return filepath.SkipDir
+		}
+		return watcher.Add(path)
+	})
+}
+
+/*
+Check whether the changed file is in a hidden directory, or is hidden itself,
+e.g. the swap files of editors
+*/
+func ignoredPath(dir, name string) bool {
+	relative, err := filepath.Rel(dir, name)
+	if err != nil {
+		return false
+	}
+	for _, part := range strings.Split(relative, string(filepath.Separator)) {
+		if strings.HasPrefix(part, ".") && part != "." && part != ".." {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,164 @@
+/*
+Running steps only on machines whose facts match a condition, e.g. installing
+packages using apt only on Ubuntu machines
+*/
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"text/template"
+	"text/template/parse"
+)
+
+/*
+Returned by runStep for steps whose When condition is false on their machine
+*/
+var errStepSkipped = errors.New("Step skipped")
+
+/*
+Parse the When condition of a step, a Go template evaluating to true or false.
+Conditions comparing the kernel name in .facts.os with what can only be a
+distribution, e.g. ubuntu, are rejected, as they would skip the step on every
+machine
+*/
+func parseWhen(when string) (*template.Template, error) {
+	tmpl, err := template.New("when").Option("missingkey=error").Parse(when)
+	if err != nil {
+		return nil, errors.New("Invalid When: " + err.Error())
+	}
+	if value, found := osComparedWithDistribution(tmpl.Tree.Root); found {
+		return nil, errors.New("When compares .facts.os, the kernel name e.g. Linux, with '" + value + "', which never matches. Compare .facts.distribution instead")
+	}
+	return tmpl, nil
+}
+
+/*
+Find a comparison of .facts.os with a string starting with a lowercase letter
+in the parsed condition. Kernel names as printed by uname -s, e.g. Linux or
+FreeBSD, never start with one, while the IDs of distributions always do
+*/
+func osComparedWithDistribution(node parse.Node) (string, bool) {
+	switch node := node.(type) {
+	case *parse.ListNode:
+		if node == nil {
+			return "", false
+		}
+		for _, child := range node.Nodes {
+			if value, found := osComparedWithDistribution(child); found {
+				return value, true
+			}
+		}
+	case *parse.ActionNode:
+		return osComparedWithDistribution(node.Pipe)
+	case *parse.IfNode:
+		return osComparedWithDistribution(&node.BranchNode)
+	case *parse.WithNode:
+		return osComparedWithDistribution(&node.BranchNode)
+	case *parse.RangeNode:
+		return osComparedWithDistribution(&node.BranchNode)
+	case *parse.BranchNode:
+		for _, child := range []parse.Node{node.Pipe, node.List, node.ElseList} {
+			if value, found := osComparedWithDistribution(child); found {
+				return value, true
+			}
+		}
+	case *parse.PipeNode:
+		if node == nil {
+			return "", false
+		}
+		for _, cmd := range node.Cmds {
+			if value, found := osComparedWithDistribution(cmd); found {
+				return value, true
+			}
+		}
+	case *parse.CommandNode:
+		comparesOS := false
+		values := []string{}
+		if len(node.Args) > 0 && isIdentifier(node.Args[0], "eq", "ne") {
+			for _, arg := range node.Args[1:] {
+				if field, ok := arg.(*parse.FieldNode); ok && strings.Join(field.Ident, ".") == "facts.os" {
+					comparesOS = true
+				}
+				if text, ok := arg.(*parse.StringNode); ok {
+					values = append(values, text.Text)
+				}
+			}
+		}
+		for _, value := range values {
+			if comparesOS && value != "" && value[0] >= 'a' && value[0] <= 'z' {
+				return value, true
+			}
+		}
+		for _, arg := range node.Args {
+			if value, found := osComparedWithDistribution(arg); found {
+				return value, true
+			}
+		}
+	}
+	return "", false
+}
+
+/*
+Check whether the node is the identifier of one of the given functions
+*/
+func isIdentifier(node parse.Node, names ...string) bool {
+	identifier, ok := node.(*parse.IdentifierNode)
+	if !ok {
+		return false
+	}
+	for _, name := range names {
+		if identifier.Ident == name {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Evaluate the When condition of the step against the facts of the machine it
+runs on. The condition is given the facts by the names of the fact script, e.g.
+.facts.distribution, and the id of the machine as .machine. A machine without
+gathered facts fails the step, rather than silently skipping it
+*/
+func evaluateWhen(path, when, machineId string) (bool, error) {
+	tmpl, err := parseWhen(when)
+	if err != nil {
+		return false, err
+	}
+
+	facts, found, err := loadFacts(path, machineId)
+	if err != nil {
+		return false, err
+	}
+	if !found {
+		return false, errors.New("The step has a When condition, but no facts are gathered for machine " + machineId + ". Gather them using orchid facts " + machineId)
+	}
+
+	data := map[string]interface{}{
+		"machine": machineId,
+		"facts": map[string]interface{}{
+			"os":           facts.OS,
+			"arch":         facts.Arch,
+			"kernel":       facts.Kernel,
+			"hostname":     facts.Hostname,
+			"distribution": facts.Distribution,
+			"free_disk_kb": facts.FreeDiskKB,
+		},
+	}
+	output := bytes.Buffer{}
+	err = tmpl.Execute(&output, data)
+	if err != nil {
+		return false, errors.New("Could not evaluate When: " + err.Error())
+	}
+
+	switch strings.TrimSpace(output.String()) {
+	case "true":
+		return true, nil
+	case "false", "":
+		return false, nil
+	}
+	return false, errors.New("When must evaluate to true or false, not '" + strings.TrimSpace(output.String()) + "'")
+}
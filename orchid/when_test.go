@@ -0,0 +1,32 @@
+package main
+
+import (
+	"testing"
+)
+
+/*
+Test that conditions comparing the kernel name with a distribution are
+rejected, while other conditions are valid
+*/
+func TestParseWhen(t *testing.T) {
+	tests := map[string]bool{
+		`{{ eq .facts.distribution "ubuntu" }}`:                           true,
+		`{{ eq .facts.os "Linux" }}`:                                      true,
+		`{{ ne .facts.os "FreeBSD" }}`:                                    true,
+		`{{ eq .facts.arch "x86_64" }}`:                                   true,
+		`{{ eq .facts.os "ubuntu" }}`:                                     false,
+		`{{ eq "debian" .facts.os }}`:                                     false,
+		`{{ and (eq .facts.arch "x86_64") (eq .facts.os "centos") }}`:     false,
+		`{{ if ne .facts.os "linux" }}true{{ else }}false{{ end }}`:       false,
+		`{{ or (eq .machine "web1") (eq .facts.distribution "debian") }}`: true,
+	}
+	for when, valid := range tests {
+		_, err := parseWhen(when)
+		if valid && err != nil {
+			t.Errorf("%s: %v", when, err)
+		}
+		if !valid && err == nil {
+			t.Errorf("%s: expected it to be rejected", when)
+		}
+	}
+}